@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const rawTraceEventDDL = `
+	CREATE TABLE IF NOT EXISTS {{.Prefix}}raw_trace_event (
+	    id               BIGINT      GENERATED ALWAYS AS IDENTITY,
+		archived         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		timestamp        TIMESTAMPTZ,
+		peer_id          TEXT        NOT NULL DEFAULT '',
+		source           TEXT        NOT NULL DEFAULT '',
+		index_name       TEXT        NOT NULL DEFAULT '',
+		event_type       TEXT        NOT NULL,
+		event            JSONB       NOT NULL,
+	    PRIMARY KEY (id)
+	);
+
+	ALTER TABLE {{.Prefix}}raw_trace_event ADD COLUMN IF NOT EXISTS index_name TEXT NOT NULL DEFAULT '';
+
+	CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}raw_trace_event_timestamp    ON {{.Prefix}}raw_trace_event (timestamp);
+	CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}raw_trace_event_event_type   ON {{.Prefix}}raw_trace_event (event_type);
+	CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}raw_trace_event_source       ON {{.Prefix}}raw_trace_event (source);
+	CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}raw_trace_event_index_name   ON {{.Prefix}}raw_trace_event (index_name);
+`
+
+// rawExportDef selects archived events from the raw_trace_event table.
+var rawExportDef = ExportDef{
+	// the event is selected as text since decoding it generically would lose the precision of timestamps
+	Query: `SELECT e.id, e.timestamp, e.source, e.event_type, e.event::TEXT AS event FROM {{.Prefix}}raw_trace_event e`,
+	TraceEvent: func(r exportRow) (*TraceEvent, error) {
+		raw := json.RawMessage(r.str("event"))
+		ev := new(TraceEvent)
+		if err := json.Unmarshal(raw, ev); err != nil {
+			return nil, fmt.Errorf("event: %w", err)
+		}
+		ev.Source = r.str("source")
+		ev.Raw = raw
+		return ev, nil
+	},
+}
+
+// archive writes events to the raw_trace_event table of a namespace.
+func (b *Batcher) archive(ctx context.Context, ns Namespace, traces map[EventType][]*TraceEvent) error {
+	// assumes mutex is held by caller
+	var evs []*TraceEvent
+	for _, tevs := range traces {
+		evs = append(evs, tevs...)
+	}
+
+	batch, err := rawTraceBatch(ns, evs)
+	if err != nil {
+		return fmt.Errorf("archive batch: %w", err)
+	}
+	rows, err := b.execBatch(ctx, ns, "raw_trace_event", batch)
+	if err != nil {
+		batcherLog.Error("failed to archive events", err, "count", len(evs), "schema", ns.Schema, "prefix", ns.Prefix)
+		return fmt.Errorf("archive: %w", err)
+	}
+	b.rowsInserted.Add(tableContext(ctx, "raw_trace_event"), rows)
+	return nil
+}
+
+// rawTraceBatch builds a batch that inserts events into the raw_trace_event table of a namespace.
+func rawTraceBatch(ns Namespace, evs []*TraceEvent) (*pgx.Batch, error) {
+	b := new(pgx.Batch)
+	if len(evs) == 0 {
+		return b, nil
+	}
+
+	cols := []string{"timestamp", "peer_id", "source", "index_name", "event_type", "event"}
+	values := make([]any, 0, len(evs)*len(cols))
+	for _, ev := range evs {
+		raw, err := rawEvent(ev)
+		if err != nil {
+			return nil, err
+		}
+
+		var ts *time.Time
+		if ev.Timestamp != nil {
+			t := time.Unix(0, *ev.Timestamp)
+			ts = &t
+		}
+
+		// the peer id is recorded so archived events can be filtered in the same way as stored events
+		var peerID string
+		if id, err := peer.IDFromBytes(ev.PeerID); err == nil {
+			peerID = id.String()
+		}
+
+		values = append(values,
+			ts,
+			peerID,
+			textValue(ev.Source),
+			ns.Index,
+			ev.Type.Key(),
+			raw,
+		)
+	}
+
+	b.Queue(buildBulkInsert(ns.Table("raw_trace_event"), cols, len(evs)), values...)
+	return b, nil
+}
+
+// rawEvent returns the form of an event to be archived, which is the event as received if it is known.
+// Source credentials are removed so they are not stored.
+func rawEvent(ev *TraceEvent) (json.RawMessage, error) {
+	if ev.Raw == nil {
+		e := *ev
+		e.SourceAuth = nil
+		return json.Marshal(&e)
+	}
+	if ev.SourceAuth == nil {
+		return ev.Raw, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(ev.Raw, &fields); err != nil {
+		return nil, fmt.Errorf("remove source auth: %w", err)
+	}
+	delete(fields, "sourceAuth")
+	return json.Marshal(fields)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AuthToken is a credential that a client may present to be allowed to send traces.
+type AuthToken struct {
+	// Token is the secret value presented by the client.
+	Token string
+
+	// Label is recorded as the source of traces authenticated with this token. It may be empty, in which
+	// case the source is derived from the request.
+	Label string
+}
+
+// ParseAuthToken parses a token specification of the form TOKEN or LABEL:TOKEN.
+func ParseAuthToken(spec string) (AuthToken, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return AuthToken{}, fmt.Errorf("empty token")
+	}
+	label, token, found := strings.Cut(spec, ":")
+	if !found {
+		return AuthToken{Token: spec}, nil
+	}
+	if token == "" {
+		return AuthToken{}, fmt.Errorf("empty token for label %q", label)
+	}
+	return AuthToken{Token: token, Label: label}, nil
+}
+
+// ReadAuthTokensFile reads token specifications from a file, one per line. Blank lines and lines
+// starting with # are ignored.
+func ReadAuthTokensFile(name string) ([]AuthToken, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []AuthToken
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tok, err := ParseAuthToken(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, lineNo, err)
+		}
+		tokens = append(tokens, tok)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Reasons an authentication attempt can be rejected, used to tag the auth_rejected metric.
+const (
+	authRejectMissingCredentials = "missing_credentials"
+	authRejectInvalidToken       = "invalid_token"
+	authRejectInvalidSourceAuth  = "invalid_source_auth"
+)
+
+// Authenticator verifies that requests to ingest traces come from a permitted client.
+type Authenticator struct {
+	tokens []AuthToken
+
+	// allowClientCert permits clients that present a TLS certificate verified against the
+	// configured client certificate authority.
+	allowClientCert bool
+
+	// allowSourceAuth permits requests without credentials of their own when each trace event
+	// they carry has a valid token in its SourceAuth field.
+	allowSourceAuth bool
+}
+
+func NewAuthenticator(tokens []AuthToken, allowClientCert bool, allowSourceAuth bool) *Authenticator {
+	return &Authenticator{
+		tokens:          tokens,
+		allowClientCert: allowClientCert,
+		allowSourceAuth: allowSourceAuth,
+	}
+}
+
+// Enabled reports whether any authentication method has been configured. When no method is
+// configured all requests are accepted.
+func (a *Authenticator) Enabled() bool {
+	return len(a.tokens) > 0 || a.allowClientCert
+}
+
+// RequestAuth is the outcome of authenticating a request.
+type RequestAuth struct {
+	// Label is recorded as the source of the request's traces. It may be empty, in which case the
+	// source is derived from the request.
+	Label string
+
+	// PerEvent is true when the request carried no credentials of its own but source auth is
+	// permitted, so each trace event must be authenticated by AuthenticateEvent.
+	PerEvent bool
+}
+
+// Authenticate checks the credentials presented with a request before its body is read. It returns
+// the outcome and a non-empty rejection reason if the request is not permitted.
+//
+// Credentials are checked in order: a bearer token or basic auth password in the Authorization
+// header and then a verified TLS client certificate. Credentials presented in the Authorization
+// header must be valid even if a client certificate would be accepted.
+func (a *Authenticator) Authenticate(r *http.Request) (RequestAuth, string) {
+	if !a.Enabled() {
+		return RequestAuth{}, ""
+	}
+
+	if token, ok := requestToken(r); ok {
+		tok, ok := a.lookup(token)
+		if !ok {
+			return RequestAuth{}, authRejectInvalidToken
+		}
+		return RequestAuth{Label: tok.Label}, ""
+	}
+
+	if a.allowClientCert && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		return RequestAuth{Label: r.TLS.VerifiedChains[0][0].Subject.CommonName}, ""
+	}
+
+	if a.allowSourceAuth && len(a.tokens) > 0 {
+		return RequestAuth{PerEvent: true}, ""
+	}
+
+	return RequestAuth{}, authRejectMissingCredentials
+}
+
+// AuthenticateEvent checks the SourceAuth field of a trace event sent in a request that carried no
+// credentials of its own. It returns the source label associated with the token, which may be empty,
+// and a non-empty rejection reason if the event is not permitted.
+func (a *Authenticator) AuthenticateEvent(ev *TraceEvent) (string, string) {
+	if ev == nil || ev.SourceAuth == nil || *ev.SourceAuth == "" {
+		return "", authRejectMissingCredentials
+	}
+	tok, ok := a.lookup(*ev.SourceAuth)
+	if !ok {
+		return "", authRejectInvalidSourceAuth
+	}
+	return tok.Label, ""
+}
+
+func (a *Authenticator) lookup(token string) (AuthToken, bool) {
+	var found AuthToken
+	ok := false
+	// compare against every token to avoid leaking which tokens exist through timing
+	for _, tok := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(tok.Token), []byte(token)) == 1 {
+			found = tok
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+// requestToken returns the token presented in the Authorization header of a request, either as a
+// bearer token or as the password of basic auth credentials.
+func requestToken(r *http.Request) (string, bool) {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password, true
+	}
+
+	authz := r.Header.Get("Authorization")
+	if authz == "" {
+		return "", false
+	}
+	scheme, token, found := strings.Cut(authz, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", true
+	}
+	return strings.TrimSpace(token), true
+}
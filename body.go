@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	errBodyTooLarge        = errors.New("request body too large")
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+)
+
+// countingReader counts the number of bytes read from an underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// requestBody is the decoded body of a request.
+type requestBody struct {
+	Data     []byte
+	Encoding string // the content encoding of the request, "identity" if uncompressed
+	WireSize int64  // number of bytes read from the connection
+}
+
+// readRequestBody reads the body of a request, decompressing it according to its Content-Encoding
+// header. An error wrapping errBodyTooLarge is returned if the decompressed body exceeds maxSize bytes
+// or the request body has been limited using http.MaxBytesReader and exceeds that limit. An error
+// wrapping errUnsupportedEncoding is returned if the encoding is not gzip, deflate or identity.
+func readRequestBody(r *http.Request, maxSize int64) (*requestBody, error) {
+	body, err := decodeRequestBody(r, maxSize)
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			return nil, fmt.Errorf("%w: exceeds %d bytes before decompression", errBodyTooLarge, mbe.Limit)
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+func decodeRequestBody(r *http.Request, maxSize int64) (*requestBody, error) {
+	cr := &countingReader{r: r.Body}
+	body := &requestBody{
+		Encoding: strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))),
+	}
+
+	var dr io.Reader
+	switch body.Encoding {
+	case "", "identity":
+		body.Encoding = "identity"
+		dr = cr
+	case "gzip", "x-gzip":
+		body.Encoding = "gzip"
+		gr, err := gzip.NewReader(cr)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		defer gr.Close()
+		dr = gr
+	case "deflate":
+		fr, err := newDeflateReader(cr)
+		if err != nil {
+			return nil, fmt.Errorf("deflate: %w", err)
+		}
+		defer fr.Close()
+		dr = fr
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnsupportedEncoding, body.Encoding)
+	}
+
+	buf := new(bytes.Buffer)
+	// read one byte beyond the limit so an oversized body can be detected
+	if _, err := buf.ReadFrom(io.LimitReader(dr, maxSize+1)); err != nil {
+		return nil, err
+	}
+	body.WireSize = cr.n
+	if int64(buf.Len()) > maxSize {
+		return nil, fmt.Errorf("%w: exceeds %d bytes", errBodyTooLarge, maxSize)
+	}
+	body.Data = buf.Bytes()
+
+	return body, nil
+}
+
+// newDeflateReader returns a reader for a deflate encoded stream. HTTP specifies that deflate bodies
+// use the zlib format but some clients send raw deflate data, so the zlib header is detected.
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := &peekReader{r: r}
+	hdr, err := br.peek(2)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hdr) == 2 && hdr[0]&0x0f == 8 && (uint16(hdr[0])<<8|uint16(hdr[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// peekReader allows the first bytes of a stream to be inspected before it is read.
+type peekReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (p *peekReader) peek(n int) ([]byte, error) {
+	for len(p.buf) < n {
+		b := make([]byte, n-len(p.buf))
+		m, err := p.r.Read(b)
+		p.buf = append(p.buf, b[:m]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p.buf, nil
+}
+
+func (p *peekReader) Read(b []byte) (int, error) {
+	if len(p.buf) > 0 {
+		n := copy(b, p.buf)
+		p.buf = p.buf[n:]
+		return n, nil
+	}
+	return p.r.Read(b)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func compressBody(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(buf)
+	case "zlib":
+		w = zlib.NewWriter(buf)
+	case "flate":
+		fw, err := flate.NewWriter(buf, flate.DefaultCompression)
+		if err != nil {
+			t.Fatalf("flate writer: %v", err)
+		}
+		w = fw
+	default:
+		t.Fatalf("unknown encoding %q", encoding)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadRequestBody(t *testing.T) {
+	data := []byte(strings.Repeat(`{"type":9,"timestamp":1680000000000000000,"join":{"topic":"/fil/msgs/mainnet"}}`+"\n", 10))
+
+	testCases := []struct {
+		name         string
+		encoding     string
+		body         []byte
+		maxSize      int64
+		maxBytes     int64 // limit applied with http.MaxBytesReader, if positive
+		wantEncoding string
+		wantErr      error
+	}{
+		{
+			name:         "no encoding",
+			body:         data,
+			wantEncoding: "identity",
+		},
+		{
+			name:         "identity",
+			encoding:     "identity",
+			body:         data,
+			wantEncoding: "identity",
+		},
+		{
+			name:         "gzip",
+			encoding:     "gzip",
+			body:         compressBody(t, "gzip", data),
+			wantEncoding: "gzip",
+		},
+		{
+			name:         "x-gzip",
+			encoding:     "x-gzip",
+			body:         compressBody(t, "gzip", data),
+			wantEncoding: "gzip",
+		},
+		{
+			name:         "encoding case and space",
+			encoding:     " GZip ",
+			body:         compressBody(t, "gzip", data),
+			wantEncoding: "gzip",
+		},
+		{
+			name:         "deflate zlib",
+			encoding:     "deflate",
+			body:         compressBody(t, "zlib", data),
+			wantEncoding: "deflate",
+		},
+		{
+			name:         "deflate raw",
+			encoding:     "deflate",
+			body:         compressBody(t, "flate", data),
+			wantEncoding: "deflate",
+		},
+		{
+			name:     "unsupported encoding",
+			encoding: "br",
+			body:     data,
+			wantErr:  errUnsupportedEncoding,
+		},
+		{
+			name:     "invalid gzip",
+			encoding: "gzip",
+			body:     data,
+			wantErr:  gzip.ErrHeader,
+		},
+		{
+			name:    "identity too large",
+			body:    data,
+			maxSize: int64(len(data)) - 1,
+			wantErr: errBodyTooLarge,
+		},
+		{
+			name:         "identity at limit",
+			body:         data,
+			maxSize:      int64(len(data)),
+			wantEncoding: "identity",
+		},
+		{
+			name:     "decompressed too large",
+			encoding: "gzip",
+			body:     compressBody(t, "gzip", data),
+			maxSize:  int64(len(data)) - 1,
+			wantErr:  errBodyTooLarge,
+		},
+		{
+			name:     "deflate decompressed too large",
+			encoding: "deflate",
+			body:     compressBody(t, "zlib", data),
+			maxSize:  int64(len(data)) - 1,
+			wantErr:  errBodyTooLarge,
+		},
+		{
+			name:     "compressed too large",
+			encoding: "gzip",
+			body:     compressBody(t, "gzip", data),
+			maxBytes: 10,
+			wantErr:  errBodyTooLarge,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/traces/_doc", bytes.NewReader(tc.body))
+			if tc.encoding != "" {
+				r.Header.Set("Content-Encoding", tc.encoding)
+			}
+			if tc.maxBytes > 0 {
+				r.Body = http.MaxBytesReader(httptest.NewRecorder(), r.Body, tc.maxBytes)
+			}
+			maxSize := tc.maxSize
+			if maxSize == 0 {
+				maxSize = 1 << 20
+			}
+
+			body, err := readRequestBody(r, maxSize)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("got error %v, wanted %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readRequestBody: %v", err)
+			}
+			if !bytes.Equal(body.Data, data) {
+				t.Errorf("got data %q, wanted %q", body.Data, data)
+			}
+			if body.Encoding != tc.wantEncoding {
+				t.Errorf("got encoding %q, wanted %q", body.Encoding, tc.wantEncoding)
+			}
+			if body.WireSize != int64(len(tc.body)) {
+				t.Errorf("got wire size %d, wanted %d", body.WireSize, len(tc.body))
+			}
+		})
+	}
+}
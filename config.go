@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the contents of a config file. Each setting tagged with a flag has the same meaning as
+// the flag. Settings that are not given are nil and leave the flag unchanged.
+type Config struct {
+	Listen       configListen       `yaml:"listen"`
+	TLS          configTLS          `yaml:"tls"`
+	Auth         configAuth         `yaml:"auth"`
+	Database     configDatabase     `yaml:"database"`
+	Index        configIndex        `yaml:"index"`
+	Filters      configFilters      `yaml:"filters"`
+	Pseudonymise configPseudonymise `yaml:"pseudonymise"`
+	Log          configLog          `yaml:"log"`
+	Tracing      configTracing      `yaml:"tracing"`
+	Shutdown     configShutdown     `yaml:"shutdown"`
+
+	file  string
+	lines map[string]int // line on which each setting appears, keyed by path
+}
+
+type configListen struct {
+	Addr                    *string         `yaml:"addr" flag:"addr"`
+	DiagnosticsAddr         *string         `yaml:"diagnostics_addr" flag:"diag-addr"`
+	DiagnosticsDebug        *bool           `yaml:"diagnostics_debug" flag:"diag-debug"`
+	NetworkMetrics          *bool           `yaml:"network_metrics" flag:"network-metrics"`
+	ReadyMaxQueue           *int            `yaml:"ready_max_queue" flag:"ready-max-queue"`
+	ReadyFlushAge           *string         `yaml:"ready_flush_age" flag:"ready-flush-age"`
+	MetricReportInterval    *int            `yaml:"metric_report_interval" flag:"metric-report-interval"`
+	OTLPMetricsEndpoint     *string         `yaml:"otlp_metrics_endpoint" flag:"otlp-metrics-endpoint"`
+	SourceHeader            *string         `yaml:"source_header" flag:"source-header"`
+	MetricSources           []string        `yaml:"metric_sources" flag:"metric-source"`
+	MetricTopics            []string        `yaml:"metric_topics" flag:"metric-topic"`
+	MaxBodySize             *int64          `yaml:"max_body_size" flag:"max-body-size"`
+	MaxDecompressedBodySize *int64          `yaml:"max_decompressed_body_size" flag:"max-decompressed-body-size"`
+	RateLimit               configRateLimit `yaml:"rate_limit"`
+}
+
+type configRateLimit struct {
+	Events *float64 `yaml:"events" flag:"rate-limit-events"`
+	Bytes  *float64 `yaml:"bytes" flag:"rate-limit-bytes"`
+}
+
+type configTLS struct {
+	Cert     *string `yaml:"cert" flag:"tls-cert"`
+	Key      *string `yaml:"key" flag:"tls-key"`
+	ClientCA *string `yaml:"client_ca" flag:"tls-client-ca"`
+}
+
+type configAuth struct {
+	Tokens     []string `yaml:"tokens" flag:"auth-token"`
+	TokensFile *string  `yaml:"tokens_file" flag:"auth-tokens-file"`
+	ClientCert *bool    `yaml:"client_cert" flag:"auth-client-cert"`
+	SourceAuth *bool    `yaml:"source_auth" flag:"auth-source-auth"`
+}
+
+type configDatabase struct {
+	Host          *string        `yaml:"host" flag:"db-host"`
+	Port          *int           `yaml:"port" flag:"db-port"`
+	Name          *string        `yaml:"name" flag:"db-name"`
+	User          *string        `yaml:"user" flag:"db-user"`
+	Password      *string        `yaml:"password" flag:"db-password"`
+	SSLMode       *string        `yaml:"sslmode" flag:"db-sslmode"`
+	BatchSize     *int           `yaml:"batch_size" flag:"batch-size"`
+	FlushInterval *string        `yaml:"flush_interval" flag:"flush-interval"`
+	Retention     *string        `yaml:"retention" flag:"retention"`
+	RawArchive    *bool          `yaml:"raw_archive" flag:"raw-archive"`
+	DedupWindow   *string        `yaml:"dedup_window" flag:"dedup-window"`
+	Rejected      configRejected `yaml:"rejected"`
+}
+
+type configRejected struct {
+	Sample *float64 `yaml:"sample" flag:"rejected-sample"`
+	Rate   *float64 `yaml:"rate" flag:"rejected-rate"`
+}
+
+type configIndex struct {
+	Mapping *string  `yaml:"mapping" flag:"index-mapping"`
+	Default *string  `yaml:"default" flag:"default-index"`
+	Allowed []string `yaml:"allowed" flag:"allowed-index"`
+	Max     *int     `yaml:"max" flag:"max-indexes"`
+}
+
+// configFilters holds filter rules, either in a separate file or given inline.
+type configFilters struct {
+	RulesFile    *string `yaml:"rules_file" flag:"filter-rules"`
+	FilterConfig `yaml:",inline"`
+}
+
+type configPseudonymise struct {
+	Mode    *string `yaml:"mode" flag:"pseudonymise"`
+	KeyFile *string `yaml:"key_file" flag:"pseudonym-key-file"`
+}
+
+type configLog struct {
+	Level      *string         `yaml:"level" flag:"log-level"`
+	Levels     configLogLevels `yaml:"levels"`
+	Format     *string         `yaml:"format" flag:"log-format"`
+	File       *string         `yaml:"file" flag:"log-file"`
+	MaxSize    *int64          `yaml:"max_size" flag:"log-file-max-size"`
+	MaxBackups *int            `yaml:"max_backups" flag:"log-file-max-backups"`
+	EventRate  *float64        `yaml:"event_rate" flag:"log-event-rate"`
+}
+
+// configLogLevels holds the log levels of components that log at a different level to the rest.
+type configLogLevels struct {
+	Server  *string `yaml:"server" flag:"log-level-server"`
+	Batcher *string `yaml:"batcher" flag:"log-level-batcher"`
+	DB      *string `yaml:"db" flag:"log-level-db"`
+}
+
+type configTracing struct {
+	Exporter     *string  `yaml:"exporter" flag:"trace-exporter"`
+	OTLPEndpoint *string  `yaml:"otlp_endpoint" flag:"otlp-traces-endpoint"`
+	SampleRatio  *float64 `yaml:"sample_ratio" flag:"trace-sample-ratio"`
+	File         *string  `yaml:"file" flag:"trace-file"`
+}
+
+type configShutdown struct {
+	Timeout  *string `yaml:"timeout" flag:"shutdown-timeout"`
+	SpoolDir *string `yaml:"spool_dir" flag:"shutdown-spool-dir"`
+}
+
+// configSetting is a setting in a config file that sets a flag.
+type configSetting struct {
+	path   string   // path of the setting in the file, such as database.host
+	flag   string   // name of the flag it sets
+	values []string // values to pass to the flag, more than one for a repeated flag
+}
+
+// configValidators check settings whose values cannot be checked when the flag is set.
+var configValidators = map[string]func(string) error{
+	"log-level": func(v string) error {
+		_, err := logLevelFromOptions(v)
+		return err
+	},
+	"log-level-server":  validateLogLevel,
+	"log-level-batcher": validateLogLevel,
+	"log-level-db":      validateLogLevel,
+	"log-format": func(v string) error {
+		switch v {
+		case LogFormatText, LogFormatJSON:
+			return nil
+		}
+		return fmt.Errorf("unsupported log format %q, must be %q or %q", v, LogFormatText, LogFormatJSON)
+	},
+	"index-mapping": func(v string) error {
+		_, err := NewIndexRouter(IndexMapping(v), defaultIndex, IndexLimits{})
+		return err
+	},
+	"dedup-window": func(v string) error {
+		_, err := time.ParseDuration(v)
+		return err
+	},
+	"flush-interval": func(v string) error {
+		_, err := time.ParseDuration(v)
+		return err
+	},
+	"retention": func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		return validateRetention(d)
+	},
+	"ready-flush-age": func(v string) error {
+		_, err := time.ParseDuration(v)
+		return err
+	},
+	"shutdown-timeout": func(v string) error {
+		_, err := time.ParseDuration(v)
+		return err
+	},
+	"trace-exporter": func(v string) error {
+		switch v {
+		case TraceExporterNone, TraceExporterOTLP, TraceExporterStdout:
+			return nil
+		}
+		return fmt.Errorf("unsupported trace exporter %q, must be %q, %q or %q", v, TraceExporterNone, TraceExporterOTLP, TraceExporterStdout)
+	},
+	"pseudonymise": func(v string) error {
+		switch v {
+		case PseudonymiseOff, PseudonymiseStore, PseudonymiseExport:
+			return nil
+		}
+		return fmt.Errorf("unsupported pseudonymise mode %q, must be %q, %q or %q", v, PseudonymiseOff, PseudonymiseStore, PseudonymiseExport)
+	},
+}
+
+func validateLogLevel(v string) error {
+	_, err := parseLogLevel(v)
+	return err
+}
+
+// ReadConfig reads and validates a yaml config file. Errors report the line on which the problem was found.
+func ReadConfig(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	cfg := &Config{file: file, lines: make(map[string]int)}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	recordConfigLines(&root, "", cfg.lines)
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		var te *yaml.TypeError
+		if errors.As(err, &te) {
+			return nil, fmt.Errorf("%s: %s", file, strings.Join(cfg.describeErrors(te.Errors), "; "))
+		}
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	for _, s := range cfg.settings() {
+		if validate, ok := configValidators[s.flag]; ok {
+			for _, v := range s.values {
+				if err := validate(v); err != nil {
+					return nil, cfg.errorf(s.path, "%w", err)
+				}
+			}
+		}
+	}
+	if cfg.Filters.RulesFile != nil && cfg.hasFilterRules() {
+		return nil, cfg.errorf("filters", "rules may be given inline or in rules_file but not both")
+	}
+	if _, _, err := cfg.Filters.compile(); err != nil {
+		return nil, cfg.errorf("filters", "%w", err)
+	}
+
+	return cfg, nil
+}
+
+// recordConfigLines records the line of each mapping key below node, keyed by its path.
+func recordConfigLines(node *yaml.Node, path string, lines map[string]int) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			recordConfigLines(n, path, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if path != "" {
+				key = path + "." + key
+			}
+			lines[key] = node.Content[i].Line
+			recordConfigLines(node.Content[i+1], key, lines)
+		}
+	}
+}
+
+var (
+	// yamlLineError matches an error reported by the yaml decoder for a line of the file.
+	yamlLineError = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+	// unknownFieldError matches the error reported by the yaml decoder for a setting that is not known.
+	unknownFieldError = regexp.MustCompile(`^field (\S+) not found in type`)
+)
+
+// describeErrors rewrites the errors reported by the yaml decoder to name the setting on the line
+// by its full path.
+func (cfg *Config) describeErrors(errs []string) []string {
+	described := make([]string, len(errs))
+	for i, msg := range errs {
+		described[i] = msg
+		m := yamlLineError.FindStringSubmatch(msg)
+		if m == nil {
+			continue
+		}
+		line, _ := strconv.Atoi(m[1])
+
+		if f := unknownFieldError.FindStringSubmatch(m[2]); f != nil {
+			described[i] = fmt.Sprintf("line %d: unknown setting %s", line, cfg.pathOnLine(line, f[1]))
+			continue
+		}
+		if path := cfg.pathOnLine(line, ""); path != "" {
+			described[i] = fmt.Sprintf("line %d: %s: %s", line, path, m[2])
+		}
+	}
+	return described
+}
+
+// pathOnLine returns the path of the setting on a line whose name ends with key, or of any setting
+// on the line if key is empty. If none is found key is returned.
+func (cfg *Config) pathOnLine(line int, key string) string {
+	found := key
+	for path, l := range cfg.lines {
+		if l != line {
+			continue
+		}
+		if key == "" || path == key || strings.HasSuffix(path, "."+key) {
+			// the longest path is the innermost setting
+			if len(path) > len(found) {
+				found = path
+			}
+		}
+	}
+	return found
+}
+
+// errorf returns an error for the setting at path, reporting the line it was found on.
+func (cfg *Config) errorf(path string, format string, args ...any) error {
+	msg := fmt.Errorf(format, args...)
+	if line, ok := cfg.lines[path]; ok {
+		return fmt.Errorf("%s: line %d: %s: %w", cfg.file, line, path, msg)
+	}
+	return fmt.Errorf("%s: %s: %w", cfg.file, path, msg)
+}
+
+// settings returns the settings given in the file that set flags.
+func (cfg *Config) settings() []configSetting {
+	var settings []configSetting
+	var walk func(v reflect.Value, path string)
+	walk = func(v reflect.Value, path string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			p := name
+			if path != "" && name != "" {
+				p = path + "." + name
+			} else if name == "" {
+				p = path
+			}
+
+			fv := v.Field(i)
+			flag := f.Tag.Get("flag")
+			switch {
+			case flag == "" && fv.Kind() == reflect.Struct:
+				walk(fv, p)
+			case flag == "":
+			case fv.Kind() == reflect.Pointer && !fv.IsNil():
+				settings = append(settings, configSetting{path: p, flag: flag, values: []string{fmt.Sprint(fv.Elem().Interface())}})
+			case fv.Kind() == reflect.Slice && fv.Len() > 0:
+				s := configSetting{path: p, flag: flag}
+				for j := 0; j < fv.Len(); j++ {
+					s.values = append(s.values, fmt.Sprint(fv.Index(j).Interface()))
+				}
+				settings = append(settings, s)
+			}
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "")
+	return settings
+}
+
+// hasFilterRules reports whether filter rules are given inline.
+func (cfg *Config) hasFilterRules() bool {
+	return cfg.Filters.Default != "" || len(cfg.Filters.Rules) > 0
+}
+
+// Apply sets the flags of a command from the settings in the file, except for flags that were set on
+// the command line or by environment variables, which take precedence.
+func (cfg *Config) Apply(cc *cli.Context) error {
+	for _, s := range cfg.settings() {
+		if cc.IsSet(s.flag) {
+			slog.Debug("config setting overridden by flag", "setting", s.path, "flag", s.flag)
+			continue
+		}
+		for _, v := range s.values {
+			if err := cc.Set(s.flag, v); err != nil {
+				return cfg.errorf(s.path, "%w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// ConfigReloader rereads a config file when the process receives a SIGHUP signal and applies the
+// settings that can be changed while running: the log level, rate limits and inline filter rules.
+// Other settings are only applied on restart.
+type ConfigReloader struct {
+	file    string
+	set     map[string]bool // flags set on the command line, which are not changed by reloading
+	limiter *SourceLimiter  // nil if rate limits are not reloaded
+	filter  *EventFilter    // nil if filter rules are not taken from the config file
+}
+
+// NewConfigReloader creates a ConfigReloader for a config file that has been applied to the flags
+// of cc. It must be created before the config is applied so that flags set on the command line can
+// be distinguished.
+func NewConfigReloader(cc *cli.Context, file string) *ConfigReloader {
+	set := make(map[string]bool)
+	for _, flag := range []string{"log-level", "log-level-server", "log-level-batcher", "log-level-db", "rate-limit-events", "rate-limit-bytes"} {
+		set[flag] = cc.IsSet(flag)
+	}
+	return &ConfigReloader{file: file, set: set}
+}
+
+func (r *ConfigReloader) Reload() error {
+	cfg, err := ReadConfig(r.file)
+	if err != nil {
+		return err
+	}
+
+	if !r.set["log-level"] {
+		// without a level in the file the level is chosen by the verbosity flags
+		var level string
+		if cfg.Log.Level != nil {
+			level = *cfg.Log.Level
+		}
+		lvl, err := logLevelFromOptions(level)
+		if err != nil {
+			return cfg.errorf("log.level", "%w", err)
+		}
+		logLevel.Set(lvl)
+	}
+
+	for _, c := range []struct {
+		flag      string
+		path      string
+		component string
+		level     *string
+	}{
+		{"log-level-server", "log.levels.server", LogComponentServer, cfg.Log.Levels.Server},
+		{"log-level-batcher", "log.levels.batcher", LogComponentBatcher, cfg.Log.Levels.Batcher},
+		{"log-level-db", "log.levels.db", LogComponentDB, cfg.Log.Levels.DB},
+	} {
+		if r.set[c.flag] {
+			continue
+		}
+		// without a level in the file the component logs at the level of the default logger
+		var level string
+		if c.level != nil {
+			level = *c.level
+		}
+		if err := setComponentLevel(c.component, level); err != nil {
+			return cfg.errorf(c.path, "%w", err)
+		}
+	}
+
+	if r.limiter != nil {
+		events, bytes := options.rateLimitEvents, options.rateLimitBytes
+		if !r.set["rate-limit-events"] {
+			events = derefFloat64(cfg.Listen.RateLimit.Events)
+		}
+		if !r.set["rate-limit-bytes"] {
+			bytes = derefFloat64(cfg.Listen.RateLimit.Bytes)
+		}
+		r.limiter.SetLimits(events, bytes)
+	}
+
+	if r.filter != nil {
+		if err := r.filter.Set(&cfg.Filters.FilterConfig); err != nil {
+			return cfg.errorf("filters", "%w", err)
+		}
+	}
+
+	slog.Info("reloaded config", "file", r.file)
+	return nil
+}
+
+func derefFloat64(f *float64) float64 {
+	if f == nil {
+		return 0
+	}
+	return *f
+}
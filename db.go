@@ -6,11 +6,11 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"golang.org/x/exp/slog"
 )
 
 func connect(ctx context.Context,
@@ -21,25 +21,27 @@ func connect(ctx context.Context,
 	dbUser string,
 	dbPassword string,
 ) (*pgx.Conn, error) {
-	slog.Info("connecting to database", "host", dbHost, "port", dbPort, "dbname", dbName)
+	dbLog.Info("connecting to database", "host", dbHost, "port", dbPort, "dbname", dbName)
 
-	dsn := fmt.Sprintf("host=%s port=%d dbname=%s sslmode=%s user=%s password=%s",
-		dbHost, dbPort, dbName, dbSSLMode, dbUser, dbPassword)
-
-	conn, err := pgx.Connect(ctx, dsn)
+	conn, err := pgx.Connect(ctx, databaseDSN(dbHost, dbPort, dbName, dbSSLMode, dbUser, dbPassword))
 	if err != nil {
 		return nil, fmt.Errorf("pgconn connect: %w", err)
 	}
 
-	if err := ensureDatabaseSchema(ctx, conn); err != nil {
+	if err := ensureDatabaseSchema(ctx, conn, Namespace{}); err != nil {
 		return nil, fmt.Errorf("ensure schema exists: %w", err)
 	}
 
 	return conn, nil
 }
 
-func ensureDatabaseSchema(ctx context.Context, conn *pgx.Conn) error {
-	slog.Info("ensuring database schema exists")
+func databaseDSN(dbHost string, dbPort int, dbName string, dbSSLMode string, dbUser string, dbPassword string) string {
+	return fmt.Sprintf("host=%s port=%d dbname=%s sslmode=%s user=%s password=%s",
+		dbHost, dbPort, dbName, dbSSLMode, dbUser, dbPassword)
+}
+
+func ensureDatabaseSchema(ctx context.Context, conn *pgx.Conn, ns Namespace) error {
+	dbLog.Info("ensuring database schema exists", "schema", ns.Schema, "prefix", ns.Prefix)
 
 	tx, err := conn.Begin(ctx)
 	if err != nil {
@@ -47,22 +49,46 @@ func ensureDatabaseSchema(ctx context.Context, conn *pgx.Conn) error {
 	}
 	defer tx.Rollback(ctx)
 
+	if ns.Schema != "" {
+		if _, err := tx.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+pgx.Identifier{ns.Schema}.Sanitize()); err != nil {
+			return fmt.Errorf("create schema: %w", err)
+		}
+	}
+	if err := ns.setSearchPath(ctx, tx); err != nil {
+		return err
+	}
+
 	for et, tbl := range eventDefs {
 		if tbl.DDL == "" {
-			slog.Debug("skipping event type, no ddl", "event_type", et.Key())
+			dbLog.Debug("skipping event type, no ddl", "event_type", et.Key())
 			continue
 		}
 		if tbl.BatchInsert == nil {
-			slog.Debug("skipping event type, no batch insert function defined", "event_type", et.Key())
+			dbLog.Debug("skipping event type, no batch insert function defined", "event_type", et.Key())
 			continue
 		}
-		slog.Debug("ensuring event type tables exists", "event_type", et.Key())
-		_, err = tx.Exec(ctx, tbl.DDL)
+		dbLog.Debug("ensuring event type tables exists", "event_type", et.Key())
+		ddl, err := ns.DDL(tbl.DDL)
+		if err != nil {
+			return fmt.Errorf("ddl template for %s: %w", et.Key(), err)
+		}
+		_, err = tx.Exec(ctx, ddl)
 		if err != nil {
 			return fmt.Errorf("exec ddl for %s: %w", et.Key(), err)
 		}
 	}
 
+	for name, tmpl := range tableDDL {
+		dbLog.Debug("ensuring table exists", "table", name)
+		ddl, err := ns.DDL(tmpl)
+		if err != nil {
+			return fmt.Errorf("ddl template for %s: %w", name, err)
+		}
+		if _, err := tx.Exec(ctx, ddl); err != nil {
+			return fmt.Errorf("exec ddl for %s: %w", name, err)
+		}
+	}
+
 	err = tx.Commit(context.Background())
 	if err != nil {
 		return fmt.Errorf("commit transaction: %w", err)
@@ -71,65 +97,133 @@ func ensureDatabaseSchema(ctx context.Context, conn *pgx.Conn) error {
 	return nil
 }
 
-type BatchInsertFunc func(context.Context, []*TraceEvent) (*pgx.Batch, error)
+// Namespace identifies the set of tables that events are written to.
+type Namespace struct {
+	Schema string // the postgresql schema containing the tables, empty for the connection's default schema
+	Prefix string // a prefix added to the name of each table
+	Index  string // the index recorded with each event, empty unless the source index mapping is used
+}
+
+// Table returns the name of a table within the namespace. The schema is not included since it is
+// selected using the search path.
+func (ns Namespace) Table(name string) string {
+	return ns.Prefix + name
+}
+
+// DDL executes a DDL template for the namespace.
+func (ns Namespace) DDL(tmpl string) (string, error) {
+	t, err := template.New("ddl").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, ns); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// setSearchPath sets the search path for the remainder of a transaction so unqualified table names
+// refer to tables in the namespace's schema.
+func (ns Namespace) setSearchPath(ctx context.Context, tx pgx.Tx) error {
+	if ns.Schema == "" {
+		return nil
+	}
+	if _, err := tx.Exec(ctx, "SET LOCAL search_path TO "+pgx.Identifier{ns.Schema}.Sanitize()); err != nil {
+		return fmt.Errorf("set search path: %w", err)
+	}
+	return nil
+}
+
+// BatchInsertFunc builds a batch of statements that insert events into the tables in a namespace.
+// Events that cannot be stored are passed to reject with the reason they were dropped.
+type BatchInsertFunc func(ctx context.Context, ns Namespace, evs []*TraceEvent, reject RejectFunc) (*pgx.Batch, error)
+
+// RejectFunc is called for an event that cannot be stored, with the reason it was dropped and optional
+// detail about the problem.
+type RejectFunc func(ev *TraceEvent, reason string, detail string)
 
 type EventDef struct {
-	Name        string
+	Name string
+
+	// DDL is a template for the statements that create the event type's tables. It is executed
+	// with the Namespace that the tables are to be created in.
 	DDL         string
 	BatchInsert BatchInsertFunc
 }
 
+// tableDDL holds templates for the statements that create tables that are not specific to an event type,
+// keyed by table name.
+var tableDDL = map[string]string{
+	"rejected_trace":  rejectedTraceDDL,
+	"raw_trace_event": rawTraceEventDDL,
+}
+
 var eventDefs = map[EventType]EventDef{
 	EventTypePublishMessage: {
 		Name: "publish_message_event",
 		DDL: `
-			CREATE TABLE IF NOT EXISTS publish_message_event (
+			CREATE TABLE IF NOT EXISTS {{.Prefix}}publish_message_event (
 			    id               INT         GENERATED ALWAYS AS IDENTITY,
 				peer_id          TEXT        NOT NULL,
 				timestamp        TIMESTAMPTZ NOT NULL,
+				source           TEXT        NOT NULL DEFAULT '',
+				index_name       TEXT        NOT NULL DEFAULT '',
+				dedup_key        BYTEA,
 				message_id       TEXT        NOT NULL,
 				topic            TEXT        NOT NULL,
 			    PRIMARY KEY (id)
 			);
 
-			CREATE INDEX IF NOT EXISTS idx_publish_message_event_timestamp ON publish_message_event (timestamp);
-			CREATE INDEX IF NOT EXISTS idx_publish_message_event_peer_id   ON publish_message_event (peer_id);
-			CREATE INDEX IF NOT EXISTS idx_publish_message_event_topic     ON publish_message_event USING hash (topic);
+			ALTER TABLE {{.Prefix}}publish_message_event ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}publish_message_event ADD COLUMN IF NOT EXISTS index_name TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}publish_message_event ADD COLUMN IF NOT EXISTS dedup_key BYTEA;
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_{{.Prefix}}publish_message_event_dedup_key ON {{.Prefix}}publish_message_event (dedup_key);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}publish_message_event_timestamp ON {{.Prefix}}publish_message_event (timestamp);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}publish_message_event_source    ON {{.Prefix}}publish_message_event (source);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}publish_message_event_index_name ON {{.Prefix}}publish_message_event (index_name);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}publish_message_event_peer_id   ON {{.Prefix}}publish_message_event (peer_id);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}publish_message_event_topic     ON {{.Prefix}}publish_message_event USING hash (topic);
 		`,
-		BatchInsert: func(ctx context.Context, evs []*TraceEvent) (*pgx.Batch, error) {
-			logger := slog.With("event_type", "publish_message")
+		BatchInsert: func(ctx context.Context, ns Namespace, evs []*TraceEvent, reject RejectFunc) (*pgx.Batch, error) {
 			b := new(pgx.Batch)
 
-			cols := []string{"peer_id", "timestamp", "message_id", "topic"}
+			cols := []string{"peer_id", "timestamp", "source", "index_name", "dedup_key", "message_id", "topic"}
 
 			values := make([]any, 0, len(evs)*len(cols))
 			rowCount := 0
 			for _, ev := range evs {
 				if ev.Timestamp == nil {
-					logger.Debug("skipping event, no timestamp")
+					reject(ev, DropReasonMissingTimestamp, "")
 					continue
 				}
 				sub := ev.PublishMessage
 				if sub == nil {
-					logger.Debug("skipping event, not a publish message event", "type", ev.Type)
+					reject(ev, DropReasonMissingSubEvent, "")
 					continue
 				}
 
 				peerID, err := peer.IDFromBytes([]byte(ev.PeerID))
 				if err != nil {
-					logger.Debug("skipping event, bad peer id", "peer_id", ev.PeerID)
+					reject(ev, DropReasonInvalidPeerID, "peer_id: "+err.Error())
 					continue
 				}
 
 				rowCount++
 				values = append(values, peerID.String())
 				values = append(values, time.Unix(0, *ev.Timestamp))
+				values = append(values, ev.Source)
+				values = append(values, ns.Index)
+				values = append(values, ev.DedupKey)
 				values = append(values, string(sub.MessageID))
 				values = append(values, derefString(sub.Topic, ""))
 			}
 
-			sql := buildBulkInsert("publish_message_event", cols, rowCount)
-			b.Queue(sql, values...)
+			if rowCount > 0 {
+				sql := buildBulkInsert(ns.Table("publish_message_event"), cols, rowCount) + onConflictDoNothing
+				b.Queue(sql, values...)
+			}
 			return b, nil
 		},
 	},
@@ -137,10 +231,13 @@ var eventDefs = map[EventType]EventDef{
 	EventTypeRejectMessage: {
 		Name: "reject_message_event",
 		DDL: `
-			CREATE TABLE IF NOT EXISTS reject_message_event (
+			CREATE TABLE IF NOT EXISTS {{.Prefix}}reject_message_event (
 			    id               INT         GENERATED ALWAYS AS IDENTITY,
 				peer_id          TEXT        NOT NULL,
 				timestamp        TIMESTAMPTZ NOT NULL,
+				source           TEXT        NOT NULL DEFAULT '',
+				index_name       TEXT        NOT NULL DEFAULT '',
+				dedup_key        BYTEA,
 				message_id       TEXT        NOT NULL,
 				topic            TEXT        NOT NULL,
 				received_from    TEXT        NOT NULL,
@@ -148,53 +245,64 @@ var eventDefs = map[EventType]EventDef{
 			    PRIMARY KEY (id)
 			);
 
-			CREATE INDEX IF NOT EXISTS idx_reject_message_event_timestamp       ON reject_message_event (timestamp);
-			CREATE INDEX IF NOT EXISTS idx_reject_message_event_peer_id         ON reject_message_event (peer_id);
-			CREATE INDEX IF NOT EXISTS idx_reject_message_event_topic           ON reject_message_event USING hash (topic);
-			CREATE INDEX IF NOT EXISTS idx_reject_message_event_received_from   ON reject_message_event (received_from);
+			ALTER TABLE {{.Prefix}}reject_message_event ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}reject_message_event ADD COLUMN IF NOT EXISTS index_name TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}reject_message_event ADD COLUMN IF NOT EXISTS dedup_key BYTEA;
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_{{.Prefix}}reject_message_event_dedup_key ON {{.Prefix}}reject_message_event (dedup_key);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}reject_message_event_timestamp       ON {{.Prefix}}reject_message_event (timestamp);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}reject_message_event_source          ON {{.Prefix}}reject_message_event (source);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}reject_message_event_index_name      ON {{.Prefix}}reject_message_event (index_name);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}reject_message_event_peer_id         ON {{.Prefix}}reject_message_event (peer_id);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}reject_message_event_topic           ON {{.Prefix}}reject_message_event USING hash (topic);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}reject_message_event_received_from   ON {{.Prefix}}reject_message_event (received_from);
 		`,
-		BatchInsert: func(ctx context.Context, evs []*TraceEvent) (*pgx.Batch, error) {
-			logger := slog.With("event_type", "reject_message")
+		BatchInsert: func(ctx context.Context, ns Namespace, evs []*TraceEvent, reject RejectFunc) (*pgx.Batch, error) {
 			b := new(pgx.Batch)
 
-			cols := []string{"peer_id", "timestamp", "message_id", "topic", "received_from", "reason"}
+			cols := []string{"peer_id", "timestamp", "source", "index_name", "dedup_key", "message_id", "topic", "received_from", "reason"}
 
 			values := make([]any, 0, len(evs)*len(cols))
 			rowCount := 0
 			for _, ev := range evs {
 				if ev.Timestamp == nil {
-					logger.Debug("skipping event, no timestamp")
+					reject(ev, DropReasonMissingTimestamp, "")
 					continue
 				}
 				sub := ev.RejectMessage
 				if sub == nil {
-					logger.Debug("skipping event, not a reject message event", "type", ev.Type)
+					reject(ev, DropReasonMissingSubEvent, "")
 					continue
 				}
 
 				peerID, err := peer.IDFromBytes([]byte(ev.PeerID))
 				if err != nil {
-					logger.Debug("skipping event, bad peer id", "peer_id", ev.PeerID)
+					reject(ev, DropReasonInvalidPeerID, "peer_id: "+err.Error())
 					continue
 				}
 
 				receivedFromPeerID, err := peer.IDFromBytes([]byte(sub.ReceivedFrom))
 				if err != nil {
-					logger.Debug("skipping event, bad received from peer id", "peer_id", sub.ReceivedFrom)
+					reject(ev, DropReasonInvalidPeerID, "received_from: "+err.Error())
 					continue
 				}
 
 				rowCount++
 				values = append(values, peerID.String())
 				values = append(values, time.Unix(0, *ev.Timestamp))
+				values = append(values, ev.Source)
+				values = append(values, ns.Index)
+				values = append(values, ev.DedupKey)
 				values = append(values, string(sub.MessageID))
 				values = append(values, derefString(sub.Topic, ""))
 				values = append(values, receivedFromPeerID.String())
 				values = append(values, derefString(sub.Reason, ""))
 			}
 
-			sql := buildBulkInsert("reject_message_event", cols, rowCount)
-			b.Queue(sql, values...)
+			if rowCount > 0 {
+				sql := buildBulkInsert(ns.Table("reject_message_event"), cols, rowCount) + onConflictDoNothing
+				b.Queue(sql, values...)
+			}
 			return b, nil
 		},
 	},
@@ -202,62 +310,76 @@ var eventDefs = map[EventType]EventDef{
 	EventTypeDuplicateMessage: {
 		Name: "duplicate_message_event",
 		DDL: `
-			CREATE TABLE IF NOT EXISTS duplicate_message_event (
+			CREATE TABLE IF NOT EXISTS {{.Prefix}}duplicate_message_event (
 			    id               INT         GENERATED ALWAYS AS IDENTITY,
 				peer_id          TEXT        NOT NULL,
 				timestamp        TIMESTAMPTZ NOT NULL,
+				source           TEXT        NOT NULL DEFAULT '',
+				index_name       TEXT        NOT NULL DEFAULT '',
+				dedup_key        BYTEA,
 				message_id       TEXT        NOT NULL,
 				topic            TEXT        NOT NULL,
 				received_from    TEXT        NOT NULL,
 			    PRIMARY KEY (id)
 			);
 
-			CREATE INDEX IF NOT EXISTS idx_duplicate_message_event_timestamp       ON duplicate_message_event (timestamp);
-			CREATE INDEX IF NOT EXISTS idx_duplicate_message_event_peer_id         ON duplicate_message_event (peer_id);
-			CREATE INDEX IF NOT EXISTS idx_duplicate_message_event_topic           ON duplicate_message_event USING hash (topic);
-			CREATE INDEX IF NOT EXISTS idx_duplicate_message_event_received_from   ON duplicate_message_event (received_from);
+			ALTER TABLE {{.Prefix}}duplicate_message_event ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}duplicate_message_event ADD COLUMN IF NOT EXISTS index_name TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}duplicate_message_event ADD COLUMN IF NOT EXISTS dedup_key BYTEA;
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_{{.Prefix}}duplicate_message_event_dedup_key ON {{.Prefix}}duplicate_message_event (dedup_key);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}duplicate_message_event_timestamp       ON {{.Prefix}}duplicate_message_event (timestamp);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}duplicate_message_event_source          ON {{.Prefix}}duplicate_message_event (source);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}duplicate_message_event_index_name      ON {{.Prefix}}duplicate_message_event (index_name);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}duplicate_message_event_peer_id         ON {{.Prefix}}duplicate_message_event (peer_id);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}duplicate_message_event_topic           ON {{.Prefix}}duplicate_message_event USING hash (topic);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}duplicate_message_event_received_from   ON {{.Prefix}}duplicate_message_event (received_from);
 		`,
-		BatchInsert: func(ctx context.Context, evs []*TraceEvent) (*pgx.Batch, error) {
-			logger := slog.With("event_type", "duplicate_message")
+		BatchInsert: func(ctx context.Context, ns Namespace, evs []*TraceEvent, reject RejectFunc) (*pgx.Batch, error) {
 			b := new(pgx.Batch)
 
-			cols := []string{"peer_id", "timestamp", "message_id", "topic", "received_from"}
+			cols := []string{"peer_id", "timestamp", "source", "index_name", "dedup_key", "message_id", "topic", "received_from"}
 
 			values := make([]any, 0, len(evs)*len(cols))
 			rowCount := 0
 			for _, ev := range evs {
 				if ev.Timestamp == nil {
-					logger.Debug("skipping event, no timestamp")
+					reject(ev, DropReasonMissingTimestamp, "")
 					continue
 				}
 				sub := ev.DuplicateMessage
 				if sub == nil {
-					logger.Debug("skipping event, not a duplicate message event", "type", ev.Type)
+					reject(ev, DropReasonMissingSubEvent, "")
 					continue
 				}
 
 				peerID, err := peer.IDFromBytes([]byte(ev.PeerID))
 				if err != nil {
-					logger.Debug("skipping event, bad peer id", "peer_id", ev.PeerID)
+					reject(ev, DropReasonInvalidPeerID, "peer_id: "+err.Error())
 					continue
 				}
 
 				receivedFromPeerID, err := peer.IDFromBytes([]byte(sub.ReceivedFrom))
 				if err != nil {
-					logger.Debug("skipping event, bad received from peer id", "peer_id", sub.ReceivedFrom)
+					reject(ev, DropReasonInvalidPeerID, "received_from: "+err.Error())
 					continue
 				}
 
 				rowCount++
 				values = append(values, peerID.String())
 				values = append(values, time.Unix(0, *ev.Timestamp))
+				values = append(values, ev.Source)
+				values = append(values, ns.Index)
+				values = append(values, ev.DedupKey)
 				values = append(values, string(sub.MessageID))
 				values = append(values, derefString(sub.Topic, ""))
 				values = append(values, receivedFromPeerID.String())
 			}
 
-			sql := buildBulkInsert("duplicate_message_event", cols, rowCount)
-			b.Queue(sql, values...)
+			if rowCount > 0 {
+				sql := buildBulkInsert(ns.Table("duplicate_message_event"), cols, rowCount) + onConflictDoNothing
+				b.Queue(sql, values...)
+			}
 			return b, nil
 		},
 	},
@@ -265,62 +387,76 @@ var eventDefs = map[EventType]EventDef{
 	EventTypeDeliverMessage: {
 		Name: "deliver_message_event",
 		DDL: `
-			CREATE TABLE IF NOT EXISTS deliver_message_event (
+			CREATE TABLE IF NOT EXISTS {{.Prefix}}deliver_message_event (
 			    id               INT         GENERATED ALWAYS AS IDENTITY,
 				peer_id          TEXT        NOT NULL,
 				timestamp        TIMESTAMPTZ NOT NULL,
+				source           TEXT        NOT NULL DEFAULT '',
+				index_name       TEXT        NOT NULL DEFAULT '',
+				dedup_key        BYTEA,
 				message_id       TEXT        NOT NULL,
 				topic            TEXT        NOT NULL,
 				received_from    TEXT        NOT NULL,
 			    PRIMARY KEY (id)
 			);
 
-			CREATE INDEX IF NOT EXISTS idx_deliver_message_event_timestamp       ON deliver_message_event (timestamp);
-			CREATE INDEX IF NOT EXISTS idx_deliver_message_event_peer_id         ON deliver_message_event (peer_id);
-			CREATE INDEX IF NOT EXISTS idx_deliver_message_event_topic           ON deliver_message_event USING hash (topic);
-			CREATE INDEX IF NOT EXISTS idx_deliver_message_event_received_from   ON deliver_message_event (received_from);
+			ALTER TABLE {{.Prefix}}deliver_message_event ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}deliver_message_event ADD COLUMN IF NOT EXISTS index_name TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}deliver_message_event ADD COLUMN IF NOT EXISTS dedup_key BYTEA;
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_{{.Prefix}}deliver_message_event_dedup_key ON {{.Prefix}}deliver_message_event (dedup_key);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}deliver_message_event_timestamp       ON {{.Prefix}}deliver_message_event (timestamp);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}deliver_message_event_source          ON {{.Prefix}}deliver_message_event (source);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}deliver_message_event_index_name      ON {{.Prefix}}deliver_message_event (index_name);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}deliver_message_event_peer_id         ON {{.Prefix}}deliver_message_event (peer_id);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}deliver_message_event_topic           ON {{.Prefix}}deliver_message_event USING hash (topic);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}deliver_message_event_received_from   ON {{.Prefix}}deliver_message_event (received_from);
 		`,
-		BatchInsert: func(ctx context.Context, evs []*TraceEvent) (*pgx.Batch, error) {
-			logger := slog.With("event_type", "deliver_message")
+		BatchInsert: func(ctx context.Context, ns Namespace, evs []*TraceEvent, reject RejectFunc) (*pgx.Batch, error) {
 			b := new(pgx.Batch)
 
-			cols := []string{"peer_id", "timestamp", "message_id", "topic", "received_from"}
+			cols := []string{"peer_id", "timestamp", "source", "index_name", "dedup_key", "message_id", "topic", "received_from"}
 
 			values := make([]any, 0, len(evs)*len(cols))
 			rowCount := 0
 			for _, ev := range evs {
 				if ev.Timestamp == nil {
-					logger.Debug("skipping event, no timestamp")
+					reject(ev, DropReasonMissingTimestamp, "")
 					continue
 				}
 				sub := ev.DeliverMessage
 				if sub == nil {
-					logger.Debug("skipping event, not a deliver message event", "type", ev.Type)
+					reject(ev, DropReasonMissingSubEvent, "")
 					continue
 				}
 
 				peerID, err := peer.IDFromBytes([]byte(ev.PeerID))
 				if err != nil {
-					logger.Debug("skipping event, bad peer id", "peer_id", ev.PeerID)
+					reject(ev, DropReasonInvalidPeerID, "peer_id: "+err.Error())
 					continue
 				}
 
 				receivedFromPeerID, err := peer.IDFromBytes([]byte(sub.ReceivedFrom))
 				if err != nil {
-					logger.Debug("skipping event, bad received from peer id", "peer_id", sub.ReceivedFrom)
+					reject(ev, DropReasonInvalidPeerID, "received_from: "+err.Error())
 					continue
 				}
 
 				rowCount++
 				values = append(values, peerID.String())
 				values = append(values, time.Unix(0, *ev.Timestamp))
+				values = append(values, ev.Source)
+				values = append(values, ns.Index)
+				values = append(values, ev.DedupKey)
 				values = append(values, string(sub.MessageID))
 				values = append(values, derefString(sub.Topic, ""))
 				values = append(values, receivedFromPeerID.String())
 			}
 
-			sql := buildBulkInsert("deliver_message_event", cols, rowCount)
-			b.Queue(sql, values...)
+			if rowCount > 0 {
+				sql := buildBulkInsert(ns.Table("deliver_message_event"), cols, rowCount) + onConflictDoNothing
+				b.Queue(sql, values...)
+			}
 			return b, nil
 		},
 	},
@@ -328,59 +464,73 @@ var eventDefs = map[EventType]EventDef{
 	EventTypeAddPeer: {
 		Name: "add_peer_event",
 		DDL: `
-			CREATE TABLE IF NOT EXISTS add_peer_event (
+			CREATE TABLE IF NOT EXISTS {{.Prefix}}add_peer_event (
 			    id               INT         GENERATED ALWAYS AS IDENTITY,
 				peer_id          TEXT        NOT NULL,
 				timestamp        TIMESTAMPTZ NOT NULL,
+				source           TEXT        NOT NULL DEFAULT '',
+				index_name       TEXT        NOT NULL DEFAULT '',
+				dedup_key        BYTEA,
 				other_peer_id    TEXT        NOT NULL,
 				proto            TEXT        NOT NULL,
 			    PRIMARY KEY (id)
 			);
 
-			CREATE INDEX IF NOT EXISTS idx_add_peer_event_timestamp       ON add_peer_event (timestamp);
-			CREATE INDEX IF NOT EXISTS idx_add_peer_event_peer_id         ON add_peer_event (peer_id);
-			CREATE INDEX IF NOT EXISTS idx_add_peer_event_other_peer_id   ON add_peer_event (other_peer_id);
+			ALTER TABLE {{.Prefix}}add_peer_event ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}add_peer_event ADD COLUMN IF NOT EXISTS index_name TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}add_peer_event ADD COLUMN IF NOT EXISTS dedup_key BYTEA;
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_{{.Prefix}}add_peer_event_dedup_key ON {{.Prefix}}add_peer_event (dedup_key);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}add_peer_event_timestamp       ON {{.Prefix}}add_peer_event (timestamp);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}add_peer_event_source          ON {{.Prefix}}add_peer_event (source);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}add_peer_event_index_name      ON {{.Prefix}}add_peer_event (index_name);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}add_peer_event_peer_id         ON {{.Prefix}}add_peer_event (peer_id);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}add_peer_event_other_peer_id   ON {{.Prefix}}add_peer_event (other_peer_id);
 		`,
-		BatchInsert: func(ctx context.Context, evs []*TraceEvent) (*pgx.Batch, error) {
-			logger := slog.With("event_type", "add_peer")
+		BatchInsert: func(ctx context.Context, ns Namespace, evs []*TraceEvent, reject RejectFunc) (*pgx.Batch, error) {
 			b := new(pgx.Batch)
 
-			cols := []string{"peer_id", "timestamp", "other_peer_id", "proto"}
+			cols := []string{"peer_id", "timestamp", "source", "index_name", "dedup_key", "other_peer_id", "proto"}
 
 			values := make([]any, 0, len(evs)*len(cols))
 			rowCount := 0
 			for _, ev := range evs {
 				if ev.Timestamp == nil {
-					logger.Debug("skipping event, no timestamp")
+					reject(ev, DropReasonMissingTimestamp, "")
 					continue
 				}
 				sub := ev.AddPeer
 				if sub == nil {
-					logger.Debug("skipping event, not an add peer event", "type", ev.Type)
+					reject(ev, DropReasonMissingSubEvent, "")
 					continue
 				}
 
 				peerID, err := peer.IDFromBytes(ev.PeerID)
 				if err != nil {
-					logger.Debug("skipping event, bad peer id", "peer_id", ev.PeerID)
+					reject(ev, DropReasonInvalidPeerID, "peer_id: "+err.Error())
 					continue
 				}
 
 				otherPeerID, err := peer.IDFromBytes(sub.PeerID)
 				if err != nil {
-					logger.Debug("skipping event, bad received from peer id", "peer_id", sub.PeerID)
+					reject(ev, DropReasonInvalidPeerID, "other_peer_id: "+err.Error())
 					continue
 				}
 
 				rowCount++
 				values = append(values, peerID.String())
 				values = append(values, time.Unix(0, *ev.Timestamp))
+				values = append(values, ev.Source)
+				values = append(values, ns.Index)
+				values = append(values, ev.DedupKey)
 				values = append(values, otherPeerID.String())
 				values = append(values, derefString(ev.AddPeer.Proto, ""))
 			}
 
-			sql := buildBulkInsert("add_peer_event", cols, rowCount)
-			b.Queue(sql, values...)
+			if rowCount > 0 {
+				sql := buildBulkInsert(ns.Table("add_peer_event"), cols, rowCount) + onConflictDoNothing
+				b.Queue(sql, values...)
+			}
 			return b, nil
 		},
 	},
@@ -388,57 +538,71 @@ var eventDefs = map[EventType]EventDef{
 	EventTypeRemovePeer: {
 		Name: "remove_peer_event",
 		DDL: `
-			CREATE TABLE IF NOT EXISTS remove_peer_event (
+			CREATE TABLE IF NOT EXISTS {{.Prefix}}remove_peer_event (
 			    id               INT         GENERATED ALWAYS AS IDENTITY,
 				peer_id          TEXT        NOT NULL,
 				timestamp        TIMESTAMPTZ NOT NULL,
+				source           TEXT        NOT NULL DEFAULT '',
+				index_name       TEXT        NOT NULL DEFAULT '',
+				dedup_key        BYTEA,
 				other_peer_id    TEXT        NOT NULL,
 			    PRIMARY KEY (id)
 			);
 
-			CREATE INDEX IF NOT EXISTS idx_remove_peer_event_timestamp       ON remove_peer_event (timestamp);
-			CREATE INDEX IF NOT EXISTS idx_remove_peer_event_peer_id         ON remove_peer_event (peer_id);
-			CREATE INDEX IF NOT EXISTS idx_remove_peer_event_other_peer_id   ON remove_peer_event (other_peer_id);
+			ALTER TABLE {{.Prefix}}remove_peer_event ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}remove_peer_event ADD COLUMN IF NOT EXISTS index_name TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}remove_peer_event ADD COLUMN IF NOT EXISTS dedup_key BYTEA;
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_{{.Prefix}}remove_peer_event_dedup_key ON {{.Prefix}}remove_peer_event (dedup_key);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}remove_peer_event_timestamp       ON {{.Prefix}}remove_peer_event (timestamp);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}remove_peer_event_source          ON {{.Prefix}}remove_peer_event (source);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}remove_peer_event_index_name      ON {{.Prefix}}remove_peer_event (index_name);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}remove_peer_event_peer_id         ON {{.Prefix}}remove_peer_event (peer_id);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}remove_peer_event_other_peer_id   ON {{.Prefix}}remove_peer_event (other_peer_id);
 		`,
-		BatchInsert: func(ctx context.Context, evs []*TraceEvent) (*pgx.Batch, error) {
-			logger := slog.With("event_type", "remove_peer")
+		BatchInsert: func(ctx context.Context, ns Namespace, evs []*TraceEvent, reject RejectFunc) (*pgx.Batch, error) {
 			b := new(pgx.Batch)
 
-			cols := []string{"peer_id", "timestamp", "other_peer_id"}
+			cols := []string{"peer_id", "timestamp", "source", "index_name", "dedup_key", "other_peer_id"}
 
 			values := make([]any, 0, len(evs)*len(cols))
 			rowCount := 0
 			for _, ev := range evs {
 				if ev.Timestamp == nil {
-					logger.Debug("skipping event, no timestamp")
+					reject(ev, DropReasonMissingTimestamp, "")
 					continue
 				}
 				sub := ev.RemovePeer
 				if sub == nil {
-					logger.Debug("skipping event, not a remove peer event", "type", ev.Type)
+					reject(ev, DropReasonMissingSubEvent, "")
 					continue
 				}
 
 				peerID, err := peer.IDFromBytes(ev.PeerID)
 				if err != nil {
-					logger.Debug("skipping event, bad peer id", "peer_id", ev.PeerID)
+					reject(ev, DropReasonInvalidPeerID, "peer_id: "+err.Error())
 					continue
 				}
 
 				otherPeerID, err := peer.IDFromBytes(sub.PeerID)
 				if err != nil {
-					logger.Debug("skipping event, bad received from peer id", "peer_id", sub.PeerID)
+					reject(ev, DropReasonInvalidPeerID, "other_peer_id: "+err.Error())
 					continue
 				}
 
 				rowCount++
 				values = append(values, peerID.String())
 				values = append(values, time.Unix(0, *ev.Timestamp))
+				values = append(values, ev.Source)
+				values = append(values, ns.Index)
+				values = append(values, ev.DedupKey)
 				values = append(values, otherPeerID.String())
 			}
 
-			sql := buildBulkInsert("remove_peer_event", cols, rowCount)
-			b.Queue(sql, values...)
+			if rowCount > 0 {
+				sql := buildBulkInsert(ns.Table("remove_peer_event"), cols, rowCount) + onConflictDoNothing
+				b.Queue(sql, values...)
+			}
 			return b, nil
 		},
 	},
@@ -446,52 +610,66 @@ var eventDefs = map[EventType]EventDef{
 	EventTypeJoin: {
 		Name: "join_event",
 		DDL: `
-			CREATE TABLE IF NOT EXISTS join_event (
+			CREATE TABLE IF NOT EXISTS {{.Prefix}}join_event (
 			    id               INT         GENERATED ALWAYS AS IDENTITY,
 				peer_id          TEXT        NOT NULL,
 				timestamp        TIMESTAMPTZ NOT NULL,
+				source           TEXT        NOT NULL DEFAULT '',
+				index_name       TEXT        NOT NULL DEFAULT '',
+				dedup_key        BYTEA,
 				topic            TEXT        NOT NULL,
 			    PRIMARY KEY (id)
 			);
 
-			CREATE INDEX IF NOT EXISTS idx_join_event_timestamp  ON join_event (timestamp);
-			CREATE INDEX IF NOT EXISTS idx_join_event_peer_id    ON join_event (peer_id);
-			CREATE INDEX IF NOT EXISTS idx_join_event_topic      ON join_event USING hash (topic);
+			ALTER TABLE {{.Prefix}}join_event ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}join_event ADD COLUMN IF NOT EXISTS index_name TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}join_event ADD COLUMN IF NOT EXISTS dedup_key BYTEA;
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_{{.Prefix}}join_event_dedup_key ON {{.Prefix}}join_event (dedup_key);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}join_event_timestamp  ON {{.Prefix}}join_event (timestamp);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}join_event_source     ON {{.Prefix}}join_event (source);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}join_event_index_name ON {{.Prefix}}join_event (index_name);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}join_event_peer_id    ON {{.Prefix}}join_event (peer_id);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}join_event_topic      ON {{.Prefix}}join_event USING hash (topic);
 		`,
 
-		BatchInsert: func(ctx context.Context, evs []*TraceEvent) (*pgx.Batch, error) {
-			logger := slog.With("event_type", "join")
+		BatchInsert: func(ctx context.Context, ns Namespace, evs []*TraceEvent, reject RejectFunc) (*pgx.Batch, error) {
 			b := new(pgx.Batch)
 
-			cols := []string{"peer_id", "timestamp", "topic"}
+			cols := []string{"peer_id", "timestamp", "source", "index_name", "dedup_key", "topic"}
 
 			values := make([]any, 0, len(evs)*len(cols))
 			rowCount := 0
 			for _, ev := range evs {
 				if ev.Timestamp == nil {
-					logger.Debug("skipping event, no timestamp")
+					reject(ev, DropReasonMissingTimestamp, "")
 					continue
 				}
 				sub := ev.Join
 				if sub == nil {
-					logger.Debug("skipping event, not a join event", "type", ev.Type)
+					reject(ev, DropReasonMissingSubEvent, "")
 					continue
 				}
 
 				peerID, err := peer.IDFromBytes([]byte(ev.PeerID))
 				if err != nil {
-					logger.Debug("skipping event, bad peer id", "peer_id", ev.PeerID)
+					reject(ev, DropReasonInvalidPeerID, "peer_id: "+err.Error())
 					continue
 				}
 
 				rowCount++
 				values = append(values, peerID.String())
 				values = append(values, time.Unix(0, *ev.Timestamp))
+				values = append(values, ev.Source)
+				values = append(values, ns.Index)
+				values = append(values, ev.DedupKey)
 				values = append(values, derefString(sub.Topic, ""))
 			}
 
-			sql := buildBulkInsert("join_event", cols, rowCount)
-			b.Queue(sql, values...)
+			if rowCount > 0 {
+				sql := buildBulkInsert(ns.Table("join_event"), cols, rowCount) + onConflictDoNothing
+				b.Queue(sql, values...)
+			}
 			return b, nil
 		},
 	},
@@ -499,51 +677,65 @@ var eventDefs = map[EventType]EventDef{
 	EventTypeLeave: {
 		Name: "leave_event",
 		DDL: `
-			CREATE TABLE IF NOT EXISTS leave_event (
+			CREATE TABLE IF NOT EXISTS {{.Prefix}}leave_event (
 			    id               INT         GENERATED ALWAYS AS IDENTITY,
 				peer_id          TEXT        NOT NULL,
 				timestamp        TIMESTAMPTZ NOT NULL,
+				source           TEXT        NOT NULL DEFAULT '',
+				index_name       TEXT        NOT NULL DEFAULT '',
+				dedup_key        BYTEA,
 				topic            TEXT        NOT NULL,
 			    PRIMARY KEY (id)
 			);
 
-			CREATE INDEX IF NOT EXISTS idx_leave_event_timestamp  ON leave_event (timestamp);
-			CREATE INDEX IF NOT EXISTS idx_leave_event_peer_id    ON leave_event (peer_id);
-			CREATE INDEX IF NOT EXISTS idx_leave_event_topic      ON leave_event USING hash (topic);
+			ALTER TABLE {{.Prefix}}leave_event ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}leave_event ADD COLUMN IF NOT EXISTS index_name TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}leave_event ADD COLUMN IF NOT EXISTS dedup_key BYTEA;
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_{{.Prefix}}leave_event_dedup_key ON {{.Prefix}}leave_event (dedup_key);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}leave_event_timestamp  ON {{.Prefix}}leave_event (timestamp);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}leave_event_source     ON {{.Prefix}}leave_event (source);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}leave_event_index_name ON {{.Prefix}}leave_event (index_name);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}leave_event_peer_id    ON {{.Prefix}}leave_event (peer_id);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}leave_event_topic      ON {{.Prefix}}leave_event USING hash (topic);
 		`,
-		BatchInsert: func(ctx context.Context, evs []*TraceEvent) (*pgx.Batch, error) {
-			logger := slog.With("event_type", "leave")
+		BatchInsert: func(ctx context.Context, ns Namespace, evs []*TraceEvent, reject RejectFunc) (*pgx.Batch, error) {
 			b := new(pgx.Batch)
 
-			cols := []string{"peer_id", "timestamp", "topic"}
+			cols := []string{"peer_id", "timestamp", "source", "index_name", "dedup_key", "topic"}
 
 			values := make([]any, 0, len(evs)*len(cols))
 			rowCount := 0
 			for _, ev := range evs {
 				if ev.Timestamp == nil {
-					logger.Debug("skipping event, no timestamp")
+					reject(ev, DropReasonMissingTimestamp, "")
 					continue
 				}
 				sub := ev.Leave
 				if sub == nil {
-					logger.Debug("skipping event, not a leave event", "type", ev.Type)
+					reject(ev, DropReasonMissingSubEvent, "")
 					continue
 				}
 
 				peerID, err := peer.IDFromBytes([]byte(ev.PeerID))
 				if err != nil {
-					logger.Debug("skipping event, bad peer id", "peer_id", ev.PeerID)
+					reject(ev, DropReasonInvalidPeerID, "peer_id: "+err.Error())
 					continue
 				}
 
 				rowCount++
 				values = append(values, peerID.String())
 				values = append(values, time.Unix(0, *ev.Timestamp))
+				values = append(values, ev.Source)
+				values = append(values, ns.Index)
+				values = append(values, ev.DedupKey)
 				values = append(values, derefString(sub.Topic, ""))
 			}
 
-			sql := buildBulkInsert("leave_event", cols, rowCount)
-			b.Queue(sql, values...)
+			if rowCount > 0 {
+				sql := buildBulkInsert(ns.Table("leave_event"), cols, rowCount) + onConflictDoNothing
+				b.Queue(sql, values...)
+			}
 			return b, nil
 		},
 	},
@@ -551,49 +743,58 @@ var eventDefs = map[EventType]EventDef{
 	EventTypeGraft: {
 		Name: "graft_event",
 		DDL: `
-			CREATE TABLE IF NOT EXISTS graft_event (
+			CREATE TABLE IF NOT EXISTS {{.Prefix}}graft_event (
 			    id               INT         GENERATED ALWAYS AS IDENTITY,
 				peer_id          TEXT        NOT NULL,
 				timestamp        TIMESTAMPTZ NOT NULL,
+				source           TEXT        NOT NULL DEFAULT '',
+				index_name       TEXT        NOT NULL DEFAULT '',
+				dedup_key        BYTEA,
 				topic            TEXT        NOT NULL,
 				other_peer_id    TEXT        NOT NULL,
 			    PRIMARY KEY (id)
 			);
 
-			CREATE INDEX IF NOT EXISTS idx_graft_event_timestamp       ON graft_event (timestamp);
-			CREATE INDEX IF NOT EXISTS idx_graft_event_peer_id         ON graft_event (peer_id);
-			CREATE INDEX IF NOT EXISTS idx_graft_event_topic           ON graft_event USING hash (topic);
-			CREATE INDEX IF NOT EXISTS idx_graft_event_other_peer_id   ON graft_event (other_peer_id);
+			ALTER TABLE {{.Prefix}}graft_event ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}graft_event ADD COLUMN IF NOT EXISTS index_name TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}graft_event ADD COLUMN IF NOT EXISTS dedup_key BYTEA;
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_{{.Prefix}}graft_event_dedup_key ON {{.Prefix}}graft_event (dedup_key);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}graft_event_timestamp       ON {{.Prefix}}graft_event (timestamp);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}graft_event_source          ON {{.Prefix}}graft_event (source);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}graft_event_index_name      ON {{.Prefix}}graft_event (index_name);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}graft_event_peer_id         ON {{.Prefix}}graft_event (peer_id);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}graft_event_topic           ON {{.Prefix}}graft_event USING hash (topic);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}graft_event_other_peer_id   ON {{.Prefix}}graft_event (other_peer_id);
 		`,
 
-		BatchInsert: func(ctx context.Context, evs []*TraceEvent) (*pgx.Batch, error) {
-			logger := slog.With("event_type", "graft")
+		BatchInsert: func(ctx context.Context, ns Namespace, evs []*TraceEvent, reject RejectFunc) (*pgx.Batch, error) {
 			b := new(pgx.Batch)
 
-			cols := []string{"peer_id", "timestamp", "topic", "other_peer_id"}
+			cols := []string{"peer_id", "timestamp", "source", "index_name", "dedup_key", "topic", "other_peer_id"}
 
 			values := make([]any, 0, len(evs)*len(cols))
 			rowCount := 0
 			for _, ev := range evs {
 				if ev.Timestamp == nil {
-					logger.Debug("skipping event, no timestamp")
+					reject(ev, DropReasonMissingTimestamp, "")
 					continue
 				}
 				sub := ev.Graft
 				if sub == nil {
-					logger.Debug("skipping event, not a graft event", "type", ev.Type)
+					reject(ev, DropReasonMissingSubEvent, "")
 					continue
 				}
 
 				peerID, err := peer.IDFromBytes([]byte(ev.PeerID))
 				if err != nil {
-					logger.Debug("skipping event, bad peer id", "peer_id", ev.PeerID)
+					reject(ev, DropReasonInvalidPeerID, "peer_id: "+err.Error())
 					continue
 				}
 
 				otherPeerID, err := peer.IDFromBytes(sub.PeerID)
 				if err != nil {
-					logger.Debug("skipping event, bad other peer id", "other_peer_id", sub.PeerID)
+					reject(ev, DropReasonInvalidPeerID, "other_peer_id: "+err.Error())
 					continue
 				}
 
@@ -601,13 +802,18 @@ var eventDefs = map[EventType]EventDef{
 				values = append(values,
 					peerID.String(),
 					time.Unix(0, *ev.Timestamp),
+					ev.Source,
+					ns.Index,
+					ev.DedupKey,
 					derefString(sub.Topic, ""),
 					otherPeerID.String(),
 				)
 			}
 
-			sql := buildBulkInsert("graft_event", cols, rowCount)
-			b.Queue(sql, values...)
+			if rowCount > 0 {
+				sql := buildBulkInsert(ns.Table("graft_event"), cols, rowCount) + onConflictDoNothing
+				b.Queue(sql, values...)
+			}
 			return b, nil
 		},
 	},
@@ -615,49 +821,58 @@ var eventDefs = map[EventType]EventDef{
 	EventTypePrune: {
 		Name: "prune_event",
 		DDL: `
-			CREATE TABLE IF NOT EXISTS prune_event (
+			CREATE TABLE IF NOT EXISTS {{.Prefix}}prune_event (
 			    id               INT         GENERATED ALWAYS AS IDENTITY,
 				peer_id          TEXT        NOT NULL,
 				timestamp        TIMESTAMPTZ NOT NULL,
+				source           TEXT        NOT NULL DEFAULT '',
+				index_name       TEXT        NOT NULL DEFAULT '',
+				dedup_key        BYTEA,
 				topic            TEXT        NOT NULL,
 				other_peer_id    TEXT        NOT NULL,
 			    PRIMARY KEY (id)
 			);
 
-			CREATE INDEX IF NOT EXISTS idx_prune_event_timestamp       ON prune_event (timestamp);
-			CREATE INDEX IF NOT EXISTS idx_prune_event_peer_id         ON prune_event (peer_id);
-			CREATE INDEX IF NOT EXISTS idx_prune_event_topic           ON prune_event USING hash (topic);
-			CREATE INDEX IF NOT EXISTS idx_prune_event_other_peer_id   ON prune_event (other_peer_id);
+			ALTER TABLE {{.Prefix}}prune_event ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}prune_event ADD COLUMN IF NOT EXISTS index_name TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}prune_event ADD COLUMN IF NOT EXISTS dedup_key BYTEA;
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_{{.Prefix}}prune_event_dedup_key ON {{.Prefix}}prune_event (dedup_key);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}prune_event_timestamp       ON {{.Prefix}}prune_event (timestamp);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}prune_event_source          ON {{.Prefix}}prune_event (source);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}prune_event_index_name      ON {{.Prefix}}prune_event (index_name);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}prune_event_peer_id         ON {{.Prefix}}prune_event (peer_id);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}prune_event_topic           ON {{.Prefix}}prune_event USING hash (topic);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}prune_event_other_peer_id   ON {{.Prefix}}prune_event (other_peer_id);
 		`,
 
-		BatchInsert: func(ctx context.Context, evs []*TraceEvent) (*pgx.Batch, error) {
-			logger := slog.With("event_type", "prune")
+		BatchInsert: func(ctx context.Context, ns Namespace, evs []*TraceEvent, reject RejectFunc) (*pgx.Batch, error) {
 			b := new(pgx.Batch)
 
-			cols := []string{"peer_id", "timestamp", "topic", "other_peer_id"}
+			cols := []string{"peer_id", "timestamp", "source", "index_name", "dedup_key", "topic", "other_peer_id"}
 
 			values := make([]any, 0, len(evs)*len(cols))
 			rowCount := 0
 			for _, ev := range evs {
 				if ev.Timestamp == nil {
-					logger.Debug("skipping event, no timestamp")
+					reject(ev, DropReasonMissingTimestamp, "")
 					continue
 				}
 				sub := ev.Prune
 				if sub == nil {
-					logger.Debug("skipping event, not a prune event", "type", ev.Type)
+					reject(ev, DropReasonMissingSubEvent, "")
 					continue
 				}
 
 				peerID, err := peer.IDFromBytes(ev.PeerID)
 				if err != nil {
-					logger.Debug("skipping event, bad peer id", "peer_id", ev.PeerID)
+					reject(ev, DropReasonInvalidPeerID, "peer_id: "+err.Error())
 					continue
 				}
 
 				otherPeerID, err := peer.IDFromBytes(sub.PeerID)
 				if err != nil {
-					logger.Debug("skipping event, bad other peer id", "other_peer_id", sub.PeerID)
+					reject(ev, DropReasonInvalidPeerID, "other_peer_id: "+err.Error())
 					continue
 				}
 
@@ -665,13 +880,18 @@ var eventDefs = map[EventType]EventDef{
 				values = append(values,
 					peerID.String(),
 					time.Unix(0, *ev.Timestamp),
+					ev.Source,
+					ns.Index,
+					ev.DedupKey,
 					derefString(sub.Topic, ""),
 					otherPeerID.String(),
 				)
 			}
 
-			sql := buildBulkInsert("prune_event", cols, rowCount)
-			b.Queue(sql, values...)
+			if rowCount > 0 {
+				sql := buildBulkInsert(ns.Table("prune_event"), cols, rowCount) + onConflictDoNothing
+				b.Queue(sql, values...)
+			}
 			return b, nil
 		},
 	},
@@ -679,10 +899,13 @@ var eventDefs = map[EventType]EventDef{
 	EventTypePeerScore: {
 		Name: "peer_score_event",
 		DDL: `
-			CREATE TABLE IF NOT EXISTS peer_score_event (
+			CREATE TABLE IF NOT EXISTS {{.Prefix}}peer_score_event (
 			    id                    INT         GENERATED ALWAYS AS IDENTITY,
 				peer_id               TEXT        NOT NULL,
 				timestamp             TIMESTAMPTZ NOT NULL,
+				source                TEXT        NOT NULL DEFAULT '',
+				index_name            TEXT        NOT NULL DEFAULT '',
+				dedup_key             BYTEA,
 				other_peer_id         TEXT        NOT NULL,
 				app_specific_score    FLOAT8      NOT NULL,
 				ip_colocation_factor  FLOAT8      NOT NULL,
@@ -690,11 +913,18 @@ var eventDefs = map[EventType]EventDef{
 			    PRIMARY KEY (id)
 			);
 
-			CREATE INDEX IF NOT EXISTS idx_peer_score_event_timestamp       ON peer_score_event (timestamp);
-			CREATE INDEX IF NOT EXISTS idx_peer_score_event_peer_id         ON peer_score_event (peer_id);
-			CREATE INDEX IF NOT EXISTS idx_peer_score_event_other_peer_id   ON peer_score_event (other_peer_id);
+			ALTER TABLE {{.Prefix}}peer_score_event ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}peer_score_event ADD COLUMN IF NOT EXISTS index_name TEXT NOT NULL DEFAULT '';
+			ALTER TABLE {{.Prefix}}peer_score_event ADD COLUMN IF NOT EXISTS dedup_key BYTEA;
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_{{.Prefix}}peer_score_event_dedup_key ON {{.Prefix}}peer_score_event (dedup_key);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}peer_score_event_timestamp       ON {{.Prefix}}peer_score_event (timestamp);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}peer_score_event_source          ON {{.Prefix}}peer_score_event (source);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}peer_score_event_index_name      ON {{.Prefix}}peer_score_event (index_name);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}peer_score_event_peer_id         ON {{.Prefix}}peer_score_event (peer_id);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}peer_score_event_other_peer_id   ON {{.Prefix}}peer_score_event (other_peer_id);
 
-			CREATE TABLE IF NOT EXISTS peer_score_topic (
+			CREATE TABLE IF NOT EXISTS {{.Prefix}}peer_score_topic (
 			    id                          INT         GENERATED ALWAYS AS IDENTITY,
 			    peer_score_event_id         INT         NOT NULL,
 				topic                       TEXT        NOT NULL,
@@ -705,58 +935,38 @@ var eventDefs = map[EventType]EventDef{
 			    PRIMARY KEY (id)
 			);
 
-			CREATE INDEX IF NOT EXISTS idx_peer_score_topic_peer_score_event_id   ON peer_score_topic (peer_score_event_id);
-			CREATE INDEX IF NOT EXISTS idx_peer_score_topic_topic                 ON peer_score_topic USING hash (topic);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}peer_score_topic_peer_score_event_id   ON {{.Prefix}}peer_score_topic (peer_score_event_id);
+			CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}peer_score_topic_topic                 ON {{.Prefix}}peer_score_topic USING hash (topic);
 		`,
-		BatchInsert: func(ctx context.Context, evs []*TraceEvent) (*pgx.Batch, error) {
-			logger := slog.With("event_type", "peer_score")
+		BatchInsert: func(ctx context.Context, ns Namespace, evs []*TraceEvent, reject RejectFunc) (*pgx.Batch, error) {
 			b := new(pgx.Batch)
 
-			parentCols := []string{"peer_id", "timestamp", "other_peer_id", "app_specific_score", "ip_colocation_factor", "behaviour_penalty"}
+			parentCols := []string{"peer_id", "timestamp", "source", "index_name", "dedup_key", "other_peer_id", "app_specific_score", "ip_colocation_factor", "behaviour_penalty"}
 			childCols := []string{"peer_score_event_id", "topic", "time_in_mesh", "first_message_deliveries", "mesh_message_deliveries", "invalid_message_deliveries"}
+			childTypes := []string{"TEXT", "INTERVAL", "FLOAT8", "FLOAT8", "FLOAT8"}
 
 			eventCount := 0
 			for _, ev := range evs {
 				if ev.Timestamp == nil {
-					logger.Debug("skipping event, no timestamp")
+					reject(ev, DropReasonMissingTimestamp, "")
 					continue
 				}
 				sub := ev.PeerScore
 				if sub == nil {
-					logger.Debug("skipping event, not a peer score event", "type", ev.Type)
+					reject(ev, DropReasonMissingSubEvent, "")
 					continue
 				}
 
-				// TODO: remove this terrible hack caused by Lotus putting pretty peer ids into a byte slice and encoding to json
-				// See https://github.com/filecoin-project/lotus/pull/10271
-				peerID, err := peer.IDFromBytes(ev.PeerID)
+				peerID, err := decodePeerID(ev.PeerID)
 				if err != nil {
-					decoded, err := base64.StdEncoding.DecodeString(string(ev.PeerID))
-					if err != nil {
-						logger.Debug("skipping event, guessing peer id encoding", "error", err, "peer_id", ev.PeerID)
-						continue
-					}
-
-					peerID, err = peer.IDFromBytes(decoded)
-					if err != nil {
-						logger.Debug("skipping event, bad peer id", "error", err, "peer_id", ev.PeerID)
-						continue
-					}
+					reject(ev, DropReasonInvalidPeerID, "peer_id: "+err.Error())
+					continue
 				}
 
-				otherPeerID, err := peer.IDFromBytes(sub.PeerID)
+				otherPeerID, err := decodePeerID(sub.PeerID)
 				if err != nil {
-					decoded, err := base64.StdEncoding.DecodeString(string(sub.PeerID))
-					if err != nil {
-						logger.Debug("skipping event, guessing peer id encoding", "error", err, "peer_id", ev.PeerID)
-						continue
-					}
-
-					peerID, err = peer.IDFromBytes(decoded)
-					if err != nil {
-						logger.Debug("skipping event, bad peer id", "error", err, "peer_id", ev.PeerID)
-						continue
-					}
+					reject(ev, DropReasonInvalidPeerID, "other_peer_id: "+err.Error())
+					continue
 				}
 
 				values := make([]any, 0, len(parentCols)+len(sub.Topics)*len(childCols))
@@ -765,6 +975,9 @@ var eventDefs = map[EventType]EventDef{
 				values = append(values,
 					peerID.String(),
 					time.Unix(0, *ev.Timestamp),
+					ev.Source,
+					ns.Index,
+					ev.DedupKey,
 					otherPeerID.String(),
 					sub.AppSpecificScore,
 					sub.IPColocationFactor,
@@ -784,7 +997,7 @@ var eventDefs = map[EventType]EventDef{
 					)
 				}
 
-				sql := buildBulkInsertParentChild("peer_score_event", parentCols, "peer_score_topic", childCols, childRowCount)
+				sql := buildBulkInsertParentChild(ns.Table("peer_score_event"), parentCols, ns.Table("peer_score_topic"), childCols, childTypes, childRowCount)
 				b.Queue(sql, values...)
 				eventCount++
 			}
@@ -793,6 +1006,21 @@ var eventDefs = map[EventType]EventDef{
 	},
 }
 
+// decodePeerID decodes a peer id from its binary form, falling back to decoding it as base64 text.
+// TODO: remove this terrible hack caused by Lotus putting pretty peer ids into a byte slice and encoding to json
+// See https://github.com/filecoin-project/lotus/pull/10271
+func decodePeerID(b []byte) (peer.ID, error) {
+	id, err := peer.IDFromBytes(b)
+	if err == nil {
+		return id, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(b))
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromBytes(decoded)
+}
+
 func derefString(s *string, def string) string {
 	if s == nil {
 		return def
@@ -822,27 +1050,42 @@ func buildBulkInsert(table string, columns []string, rowCount int) string {
 	return b.String()
 }
 
-func buildBulkInsertParentChild(parentTable string, parentColumns []string, childTable string, childColumns []string, childRowCount int) string {
+// onConflictDoNothing is appended to statements that insert events so that events that have already
+// been stored, identified by their dedup_key, are skipped.
+const onConflictDoNothing = " ON CONFLICT (dedup_key) DO NOTHING"
+
+func buildBulkInsertParentChild(parentTable string, parentColumns []string, childTable string, childColumns []string, childTypes []string, childRowCount int) string {
 	// WITH new_peer_score_event AS (
 	//     INSERT INTO peer_score_event(
 	//     	peer_id,
 	//     	timestamp,
+	//     	source,
+	//     	dedup_key,
 	//     	other_peer_id,
 	//     	app_specific_score,
 	//     	ip_colocation_factor,
 	//     	behaviour_penalty
-	//     ) VALUES ($1, $2, $3, $4, $5, $6)
+	//     ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	//     ON CONFLICT (dedup_key) DO NOTHING
 	//     RETURNING id
 	// )
 
-	// INSERT INTO peer_score_topic (peer_score_event_id, topic, time_in_mesh, first_message_deliveries, mesh_message_deliveries, invalid_message_deliveries)
-	// VALUES (
-	//	(select id from new_peer_score_event), $7, $8, $9, $10, $11),
-	//	(select id from new_peer_score_event), $12, $13, $14, $15, $16)
+	// , new_peer_score_topic AS (
+	//     INSERT INTO peer_score_topic (peer_score_event_id, topic, time_in_mesh, first_message_deliveries, mesh_message_deliveries, invalid_message_deliveries)
+	//     SELECT p.id, v.* FROM new_peer_score_event p CROSS JOIN (VALUES
+	//	    ($9::TEXT, $10::INTERVAL, $11::FLOAT8, $12::FLOAT8, $13::FLOAT8),
+	//	    ($14::TEXT, $15::INTERVAL, $16::FLOAT8, $17::FLOAT8, $18::FLOAT8)
+	//     ) v
 	// )
+	// SELECT id FROM new_peer_score_event
+
+	// When the parent is a duplicate no id is returned and so no children are inserted. The child values
+	// are cast since their types cannot be inferred from the columns they are selected into. The final
+	// select makes the statement's command tag count the parent rows inserted, as it does when there
+	// are no children, rather than the child rows.
 
 	if childRowCount == 0 {
-		return buildBulkInsert(parentTable, parentColumns, 1)
+		return buildBulkInsert(parentTable, parentColumns, 1) + onConflictDoNothing
 	}
 
 	var b strings.Builder
@@ -863,25 +1106,30 @@ func buildBulkInsertParentChild(parentTable string, parentColumns []string, chil
 		b.WriteString("$")
 		b.WriteString(strconv.Itoa(idx))
 	}
-	b.WriteString(") RETURNING id) ")
-	b.WriteString("INSERT INTO " + childTable + "(" + strings.Join(childColumns, ", ") + ") VALUES ")
+	b.WriteString(")" + onConflictDoNothing + " RETURNING id), ")
+	b.WriteString("new_" + childTable + " AS (")
+	b.WriteString("INSERT INTO " + childTable + "(" + strings.Join(childColumns, ", ") + ") ")
+	b.WriteString("SELECT p.id, v.* FROM new_" + parentTable + " p CROSS JOIN (VALUES ")
 
-	// Write placeholders for child values
+	// Write placeholders for child values, the first child column being the parent id
 	for r := 0; r < childRowCount; r++ {
 		if r > 0 {
 			b.WriteString(",")
 		}
 		b.WriteString("(")
-		b.WriteString("(select id from new_")
-		b.WriteString(parentTable)
-		b.WriteString(")")
 		for c := 1; c < len(childColumns); c++ {
+			if c > 1 {
+				b.WriteString(",")
+			}
 			idx++
-			b.WriteString(",")
 			b.WriteString("$")
 			b.WriteString(strconv.Itoa(idx))
+			b.WriteString("::")
+			b.WriteString(childTypes[c-1])
 		}
 		b.WriteString(")")
 	}
+	b.WriteString(") v) ")
+	b.WriteString("SELECT id FROM new_" + parentTable)
 	return b.String()
 }
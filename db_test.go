@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestBuildBulkInsertParentChild(t *testing.T) {
+	testCases := []struct {
+		name       string
+		childCount int
+		want       string
+	}{
+		{
+			name: "no children",
+			want: "INSERT INTO ps(a, b) VALUES ($1, $2) ON CONFLICT (dedup_key) DO NOTHING",
+		},
+		{
+			// the statement's command tag counts the parent rows inserted, not the child rows
+			name:       "children",
+			childCount: 2,
+			want: "WITH new_ps AS (INSERT INTO ps(a, b) VALUES ($1, $2) ON CONFLICT (dedup_key) DO NOTHING RETURNING id), " +
+				"new_pst AS (INSERT INTO pst(ps_id, c, d) SELECT p.id, v.* FROM new_ps p CROSS JOIN (VALUES ($3::TEXT,$4::FLOAT8),($5::TEXT,$6::FLOAT8)) v) " +
+				"SELECT id FROM new_ps",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := buildBulkInsertParentChild("ps", []string{"a", "b"}, "pst", []string{"ps_id", "c", "d"}, []string{"TEXT", "FLOAT8"}, tc.childCount)
+			if got != tc.want {
+				t.Errorf("got %s\nwanted %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/gorilla/mux"
+)
+
+// unsafeVars are the expvar variables that are not served since they may contain secrets, such as
+// a database password given as a flag.
+var unsafeVars = map[string]bool{
+	"cmdline": true,
+}
+
+// debugState is the internal state served by the debug vars page.
+type debugState struct {
+	BatchSize  int           `json:"batch_size"`
+	Goroutines int           `json:"goroutines"`
+	Batcher    BatcherStatus `json:"batcher"`
+}
+
+// mountDebugHandlers adds pprof profiles and a json dump of internal state to a router under /debug/.
+// The command line is not served by either since it may contain secrets.
+func mountDebugHandlers(mx *mux.Router, b *Batcher) {
+	mx.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mx.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mx.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mx.Path("/debug/pprof/cmdline").Handler(http.NotFoundHandler())
+	mx.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+
+	mx.Handle("/debug/vars", debugVarsHandler(b))
+}
+
+// debugVarsHandler serves the published expvar variables, such as memstats, in the same format as the
+// expvar package with the state of the Batcher added as tracecatcher.
+func debugVarsHandler(b *Batcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := expvar.Func(func() any {
+			return debugState{
+				BatchSize:  b.cfg.Size,
+				Goroutines: runtime.NumGoroutine(),
+				Batcher:    b.Status(),
+			}
+		})
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\n")
+		fmt.Fprintf(w, "%q: %s", "tracecatcher", state.String())
+		expvar.Do(func(kv expvar.KeyValue) {
+			if unsafeVars[kv.Key] {
+				return
+			}
+			fmt.Fprintf(w, ",\n%q: %s", kv.Key, kv.Value)
+		})
+		fmt.Fprintf(w, "\n}\n")
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDiagDebugHandlers(t *testing.T) {
+	testCases := []struct {
+		name       string
+		debug      bool
+		path       string
+		wantStatus int
+	}{
+		{name: "health without debug", path: "/healthz", wantStatus: http.StatusOK},
+		{name: "vars without debug", path: "/debug/vars", wantStatus: http.StatusNotFound},
+		{name: "pprof without debug", path: "/debug/pprof/", wantStatus: http.StatusNotFound},
+		{name: "heap without debug", path: "/debug/pprof/heap", wantStatus: http.StatusNotFound},
+		{name: "vars", debug: true, path: "/debug/vars", wantStatus: http.StatusOK},
+		{name: "pprof", debug: true, path: "/debug/pprof/", wantStatus: http.StatusOK},
+		{name: "heap", debug: true, path: "/debug/pprof/heap", wantStatus: http.StatusOK},
+		{name: "cmdline", debug: true, path: "/debug/pprof/cmdline", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dr := &DiagRunner{
+				metrics: http.NotFoundHandler(),
+				batcher: newTestBatcher(t),
+				debug:   tc.debug,
+			}
+			ts := httptest.NewServer(dr.handler())
+			defer ts.Close()
+
+			resp, err := ts.Client().Get(ts.URL + tc.path)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("got status %d, wanted %d", resp.StatusCode, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDebugVarsHandler(t *testing.T) {
+	ts := httptest.NewServer(debugVarsHandler(newTestBatcher(t)))
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if _, ok := vars["memstats"]; !ok {
+		t.Errorf("memstats missing from vars")
+	}
+	if _, ok := vars["cmdline"]; ok {
+		t.Errorf("got cmdline in vars, wanted it withheld")
+	}
+
+	var state debugState
+	if err := json.Unmarshal(vars["tracecatcher"], &state); err != nil {
+		t.Fatalf("decode tracecatcher state: %v", err)
+	}
+	if state.Goroutines == 0 {
+		t.Errorf("got no goroutines in state")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// dedupKeySize is the number of bytes of the content hash used to identify an event.
+const dedupKeySize = 16
+
+// eventDedupKey returns a key derived from the type, peer, timestamp and payload of an event. Events
+// sent more than once, by a retrying tracer or by redundant tracers, have the same key. The source of
+// the event is not included.
+func eventDedupKey(ev *TraceEvent) ([]byte, error) {
+	e := *ev
+	e.SourceAuth = nil
+	data, err := json.Marshal(&e)
+	if err != nil {
+		return nil, fmt.Errorf("marshal event: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return sum[:dedupKeySize], nil
+}
+
+// DedupWindow remembers the keys of events stored within a period so duplicates can be discarded
+// before they are written. The keys of events that are queued but not yet stored are remembered
+// separately so that a duplicate of an event that fails to be written is not discarded.
+type DedupWindow struct {
+	window time.Duration
+	seen   map[dedupEntry]struct{}
+	expiry []dedupExpiry // in the order the entries expire
+	queued map[dedupEntry]struct{}
+}
+
+type dedupEntry struct {
+	ns  Namespace
+	key [dedupKeySize]byte
+}
+
+type dedupExpiry struct {
+	entry dedupEntry
+	at    time.Time
+}
+
+// NewDedupWindow creates a DedupWindow that remembers events for the given period. It returns nil
+// if the period is not positive.
+func NewDedupWindow(window time.Duration) *DedupWindow {
+	if window <= 0 {
+		return nil
+	}
+	return &DedupWindow{
+		window: window,
+		seen:   make(map[dedupEntry]struct{}),
+		queued: make(map[dedupEntry]struct{}),
+	}
+}
+
+// Seen reports whether an event with the key has been stored in the namespace within the window or
+// is queued to be stored. If not, the key is recorded as queued.
+func (w *DedupWindow) Seen(ns Namespace, key []byte, now time.Time) bool {
+	w.expire(now)
+
+	e := newDedupEntry(ns, key)
+	if _, ok := w.seen[e]; ok {
+		return true
+	}
+	if _, ok := w.queued[e]; ok {
+		return true
+	}
+	w.queued[e] = struct{}{}
+	return false
+}
+
+// Stored records that an event with the key has been stored in the namespace.
+func (w *DedupWindow) Stored(ns Namespace, key []byte, now time.Time) {
+	e := newDedupEntry(ns, key)
+	delete(w.queued, e)
+	if _, ok := w.seen[e]; ok {
+		return
+	}
+	w.seen[e] = struct{}{}
+	w.expiry = append(w.expiry, dedupExpiry{entry: e, at: now.Add(w.window)})
+}
+
+// Flushed forgets the keys of queued events once every queued event has either been stored or could
+// not be written.
+func (w *DedupWindow) Flushed() {
+	w.queued = make(map[dedupEntry]struct{})
+}
+
+func (w *DedupWindow) expire(now time.Time) {
+	for len(w.expiry) > 0 && !w.expiry[0].at.After(now) {
+		delete(w.seen, w.expiry[0].entry)
+		w.expiry = w.expiry[1:]
+	}
+}
+
+func newDedupEntry(ns Namespace, key []byte) dedupEntry {
+	e := dedupEntry{ns: ns}
+	copy(e.key[:], key)
+	return e
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDedupWindow(t *testing.T) {
+	const (
+		seen    = "seen"
+		stored  = "stored"
+		flushed = "flushed"
+	)
+	type op struct {
+		kind   string
+		key    byte
+		ns     Namespace
+		after  time.Duration // since the start of the test
+		wantOK bool          // for seen, whether the key was reported as seen
+	}
+	other := Namespace{Prefix: "other_"}
+
+	testCases := []struct {
+		name string
+		ops  []op
+	}{
+		{
+			name: "queued duplicate",
+			ops: []op{
+				{kind: seen, key: 1},
+				{kind: seen, key: 1, wantOK: true},
+				{kind: seen, key: 2},
+			},
+		},
+		{
+			name: "stored duplicate",
+			ops: []op{
+				{kind: seen, key: 1},
+				{kind: stored, key: 1},
+				{kind: flushed},
+				{kind: seen, key: 1, after: time.Second, wantOK: true},
+			},
+		},
+		{
+			name: "not stored is forgotten",
+			ops: []op{
+				{kind: seen, key: 1},
+				{kind: flushed},
+				{kind: seen, key: 1},
+			},
+		},
+		{
+			name: "stored expires",
+			ops: []op{
+				{kind: seen, key: 1},
+				{kind: stored, key: 1},
+				{kind: flushed},
+				{kind: seen, key: 1, after: time.Minute},
+			},
+		},
+		{
+			name: "namespaces are separate",
+			ops: []op{
+				{kind: seen, key: 1},
+				{kind: stored, key: 1},
+				{kind: seen, key: 1, ns: other},
+				{kind: seen, key: 1, wantOK: true},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := NewDedupWindow(time.Minute)
+			start := time.Now()
+			for i, o := range tc.ops {
+				key := make([]byte, dedupKeySize)
+				key[0] = o.key
+				now := start.Add(o.after)
+				switch o.kind {
+				case seen:
+					if got := w.Seen(o.ns, key, now); got != o.wantOK {
+						t.Errorf("op %d: got seen %v, wanted %v", i, got, o.wantOK)
+					}
+				case stored:
+					w.Stored(o.ns, key, now)
+				case flushed:
+					w.Flushed()
+				}
+			}
+		})
+	}
+}
+
+func TestDedupAfterFailedWrite(t *testing.T) {
+	failBatchInsert(t, EventTypeJoin)
+
+	b, err := NewBatcher(nil, BatcherConfig{Size: 1000, DedupWindow: time.Minute})
+	if err != nil {
+		t.Fatalf("NewBatcher: %v", err)
+	}
+	ctx := context.Background()
+
+	b.Add(ctx, Namespace{}, testEvent(EventTypeJoin, true))
+	b.Add(ctx, Namespace{}, testEvent(EventTypeJoin, true))
+	if got := b.Status().EventTypes["join"].Dropped; got != 1 {
+		t.Fatalf("got %d dropped before flush, wanted 1 duplicate", got)
+	}
+
+	if err := b.Flush(ctx); err == nil {
+		t.Fatalf("got no flush error")
+	}
+
+	// the event was not written so a copy sent again is queued rather than discarded as a duplicate
+	b.Add(ctx, Namespace{}, testEvent(EventTypeJoin, true))
+	if got := len(b.traces[Namespace{}][EventTypeJoin]); got != 1 {
+		t.Errorf("got %d queued events, wanted 1", got)
+	}
+}
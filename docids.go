@@ -0,0 +1,69 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// maxDocumentIDs is the number of document ids remembered for detecting attempts to create a document
+// that already exists.
+const maxDocumentIDs = 100000
+
+// documentIDs remembers the ids of documents indexed with ids chosen by the client so that creating a
+// document with an id that is already in use can be rejected. Trace events are not stored by id, so only
+// the most recently used ids are remembered and older ones are forgotten.
+type documentIDs struct {
+	max int
+
+	mu    sync.Mutex
+	ids   map[documentID]*list.Element
+	order *list.List // of documentID, least recently used first
+}
+
+type documentID struct {
+	index string
+	id    string
+}
+
+func newDocumentIDs(max int) *documentIDs {
+	return &documentIDs{
+		max:   max,
+		ids:   make(map[documentID]*list.Element),
+		order: list.New(),
+	}
+}
+
+// Reserve records that a document with the id is being created in an index. It returns false if the id
+// is already in use.
+func (d *documentIDs) Reserve(index, id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := documentID{index: index, id: id}
+	if _, ok := d.ids[key]; ok {
+		return false
+	}
+	d.add(key)
+	return true
+}
+
+// Put records that a document with the id has been indexed, whether or not the id was in use.
+func (d *documentIDs) Put(index, id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := documentID{index: index, id: id}
+	if el, ok := d.ids[key]; ok {
+		d.order.MoveToBack(el)
+		return
+	}
+	d.add(key)
+}
+
+// add remembers an id, forgetting the least recently used ids beyond the maximum.
+func (d *documentIDs) add(key documentID) {
+	d.ids[key] = d.order.PushBack(key)
+	for len(d.ids) > d.max {
+		el := d.order.Front()
+		d.order.Remove(el)
+		delete(d.ids, el.Value.(documentID))
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file contains types and helpers for emulating the parts of the Elasticsearch API that are
+// used by Elasticsearch clients and log shippers.
+
+// defaultIndex is the name of the index that Lotus is conventionally configured to send traces to.
+const defaultIndex = "traces"
+
+// esError is an error that is reported to clients in the form used by Elasticsearch.
+type esError struct {
+	Status     int
+	Type       string
+	Reason     string
+	Index      string        // optional name of the index the error relates to
+	RetryAfter time.Duration // optional duration after which the client may retry
+}
+
+func (e *esError) Error() string {
+	return e.Type + ": " + e.Reason
+}
+
+func (e *esError) cause() map[string]any {
+	c := map[string]any{
+		"type":   e.Type,
+		"reason": e.Reason,
+	}
+	if e.Index != "" {
+		c["index"] = e.Index
+		c["index_uuid"] = "_na_"
+		c["resource.type"] = "index_or_alias"
+		c["resource.id"] = e.Index
+	}
+	return c
+}
+
+// MarshalJSON encodes the error in the form used for errors in the items of a bulk response.
+func (e *esError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.cause())
+}
+
+func newIndexNotFoundError(index string) *esError {
+	return &esError{
+		Status: http.StatusNotFound,
+		Type:   "index_not_found_exception",
+		Reason: "no such index [" + index + "]",
+		Index:  index,
+	}
+}
+
+func newInvalidIndexNameError(index string, reason string) *esError {
+	return &esError{
+		Status: http.StatusBadRequest,
+		Type:   "invalid_index_name_exception",
+		Reason: "Invalid index name [" + index + "], " + reason,
+		Index:  index,
+	}
+}
+
+// newIndexNotAllowedError reports an index that is not in the allowed list, in the form Elasticsearch
+// uses when an index does not exist and may not be created automatically.
+func newIndexNotAllowedError(index string) *esError {
+	eserr := newIndexNotFoundError(index)
+	eserr.Reason += " and [action.auto_create_index] does not allow it"
+	return eserr
+}
+
+// newTooManyIndexesError reports an index that could not be created because the maximum number of
+// indexes has been reached, in the form Elasticsearch uses when the shard limit is reached.
+func newTooManyIndexesError(index string, max int) *esError {
+	return &esError{
+		Status: http.StatusBadRequest,
+		Type:   "validation_exception",
+		Reason: fmt.Sprintf("Validation Failed: 1: this action would add an index but the cluster already has the maximum of [%d] indexes;", max),
+		Index:  index,
+	}
+}
+
+func newVersionConflictError(index string, id string) *esError {
+	return &esError{
+		Status: http.StatusConflict,
+		Type:   "version_conflict_engine_exception",
+		Reason: "[" + id + "]: version conflict, document already exists (current version [1])",
+		Index:  index,
+	}
+}
+
+func newParseError(err error) *esError {
+	return &esError{
+		Status: http.StatusBadRequest,
+		Type:   "mapper_parsing_exception",
+		Reason: "failed to parse: " + err.Error(),
+	}
+}
+
+func newAuthError(reason string) *esError {
+	return &esError{
+		Status: http.StatusUnauthorized,
+		Type:   "security_exception",
+		Reason: "unable to authenticate request: " + reason,
+	}
+}
+
+func newThrottledError(retryAfter time.Duration) *esError {
+	return &esError{
+		Status:     http.StatusTooManyRequests,
+		Type:       "es_rejected_execution_exception",
+		Reason:     "rejected execution: rate limit exceeded",
+		RetryAfter: retryAfter,
+	}
+}
+
+// writeESError writes an error response in the form used by Elasticsearch.
+func writeESError(w http.ResponseWriter, e *esError) {
+	switch e.Status {
+	case http.StatusUnauthorized:
+		w.Header().Set("WWW-Authenticate", `Basic realm="tracecatcher"`)
+	case http.StatusTooManyRequests:
+		w.Header().Set("Retry-After", retryAfterSeconds(e.RetryAfter))
+	}
+
+	writeESResponse(w, e.Status, map[string]any{
+		"error": map[string]any{
+			"root_cause": []any{e.cause()},
+			"type":       e.Type,
+			"reason":     e.Reason,
+		},
+		"status": e.Status,
+	})
+}
+
+// writeESResponse writes a JSON response with the headers expected from Elasticsearch.
+func writeESResponse(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// validateIndexName checks an index name against the rules used by Elasticsearch.
+func validateIndexName(index string) *esError {
+	switch {
+	case index == "":
+		return newInvalidIndexNameError(index, "must not be empty")
+	case index == "." || index == "..":
+		return newInvalidIndexNameError(index, "must not be '.' or '..'")
+	case strings.ToLower(index) != index:
+		return newInvalidIndexNameError(index, "must be lowercase")
+	case strings.HasPrefix(index, "_") || strings.HasPrefix(index, "-") || strings.HasPrefix(index, "+"):
+		return newInvalidIndexNameError(index, "must not start with '_', '-', or '+'")
+	case strings.ContainsAny(index, `\/*?"<>| ,#:`):
+		return newInvalidIndexNameError(index, `must not contain the following characters [ , \", *, \\, <, |, ,, >, /, ?, #, :]`)
+	case len(index) > 255:
+		return newInvalidIndexNameError(index, "index name is too long")
+	}
+	return nil
+}
+
+func retryAfterSeconds(d time.Duration) string {
+	secs := int(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.Itoa(secs)
+}
+
+// newDocumentID generates a random document identifier in the same form as those generated by Elasticsearch.
+func newDocumentID() string {
+	buf := make([]byte, 15)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// esDocResult is the result of indexing a single document.
+type esDocResult struct {
+	Index       string    `json:"_index"`
+	Type        string    `json:"_type"`
+	ID          string    `json:"_id"`
+	Version     int       `json:"_version,omitempty"`
+	Result      string    `json:"result,omitempty"`
+	Shards      *esShards `json:"_shards,omitempty"`
+	SeqNo       *int64    `json:"_seq_no,omitempty"`
+	PrimaryTerm int       `json:"_primary_term,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	Error       *esError  `json:"error,omitempty"`
+}
+
+type esShards struct {
+	Total      int `json:"total"`
+	Successful int `json:"successful"`
+	Failed     int `json:"failed"`
+}
+
+// esBulkResponse is the response to a bulk request.
+type esBulkResponse struct {
+	Took   int64                    `json:"took"`
+	Errors bool                     `json:"errors"`
+	Items  []map[string]esDocResult `json:"items"`
+}
+
+// esBulkAction is the metadata supplied with each action in a bulk request.
+type esBulkAction struct {
+	Index string `json:"_index"`
+	ID    string `json:"_id"`
+}
+
+var esRootDocument = map[string]any{
+	"cluster_name": "traces",
+	"cluster_uuid": "aaaabbbbccccddddaaaabbbbccccdddd",
+	"name":         "traces",
+	"tagline":      "You Know, for Search",
+	"version": map[string]any{
+		"build_date":                          "2023-01-01",
+		"build_flavor":                        "default",
+		"build_hash":                          "",
+		"build_snapshot":                      false,
+		"build_type":                          "",
+		"lucene_version":                      "",
+		"minimum_index_compatibility_version": "5.6.0",
+		"minimum_wire_compatibility_version":  "5.6.0",
+		"number":                              "7.0.0",
+	},
+}
+
+func esClusterHealth(activeShards int) map[string]any {
+	return map[string]any{
+		"cluster_name":                     "traces",
+		"status":                           "green",
+		"timed_out":                        false,
+		"number_of_nodes":                  1,
+		"number_of_data_nodes":             1,
+		"active_primary_shards":            activeShards,
+		"active_shards":                    activeShards,
+		"relocating_shards":                0,
+		"initializing_shards":              0,
+		"unassigned_shards":                0,
+		"delayed_unassigned_shards":        0,
+		"number_of_pending_tasks":          0,
+		"number_of_in_flight_fetch":        0,
+		"task_max_waiting_in_queue_millis": 0,
+		"active_shards_percent_as_number":  100.0,
+	}
+}
@@ -0,0 +1,973 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/parquet-go/parquet-go"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	ExportFormatNDJSON  = "ndjson"
+	ExportFormatCSV     = "csv"
+	ExportFormatParquet = "parquet"
+	ExportFormatTrace   = "trace" // newline delimited json in the format written by the go-libp2p-pubsub JSONTracer
+)
+
+// exportFetchSize is the number of rows fetched from the database cursor at a time.
+const exportFetchSize = 1000
+
+var exportOptions struct {
+	eventType string
+	format    string
+	output    string
+}
+
+// filterOptions are the options common to commands that read stored events.
+var filterOptions struct {
+	from   string
+	to     string
+	peer   string
+	topic  string
+	source string
+	index  string
+}
+
+// filterFlags are the flags that select stored events to be read.
+var filterFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:        "from",
+		Usage:       "Only read events at or after this time, as an RFC3339 timestamp or a date",
+		Destination: &filterOptions.from,
+	},
+	&cli.StringFlag{
+		Name:        "to",
+		Usage:       "Only read events before this time, as an RFC3339 timestamp or a date",
+		Destination: &filterOptions.to,
+	},
+	&cli.StringFlag{
+		Name:        "peer",
+		Usage:       "Only read events traced by this peer",
+		Destination: &filterOptions.peer,
+	},
+	&cli.StringFlag{
+		Name:        "topic",
+		Usage:       "Only read events for this topic",
+		Destination: &filterOptions.topic,
+	},
+	&cli.StringFlag{
+		Name:        "source",
+		Usage:       "Only read events received from this source",
+		Destination: &filterOptions.source,
+	},
+	&cli.StringFlag{
+		Name:        "index",
+		Usage:       "The index to read events from, which determines the tables they are read from according to --index-mapping",
+		Value:       defaultIndex,
+		Destination: &filterOptions.index,
+	},
+}
+
+var exportCommand = &cli.Command{
+	Name:  "export",
+	Usage: "Export stored events of a single type",
+	Flags: concatFlags(
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:        "type",
+				Usage:       "The type of event to export, such as 'deliver_message' or 'peer_score'",
+				Required:    true,
+				Destination: &exportOptions.eventType,
+			},
+			&cli.StringFlag{
+				Name:        "format",
+				Usage:       "The output format: 'ndjson', 'csv', 'parquet' or 'trace' for newline delimited json in the format written by the go-libp2p-pubsub JSONTracer",
+				Value:       ExportFormatNDJSON,
+				Destination: &exportOptions.format,
+			},
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "Write the export to `FILE` instead of stdout",
+				Value:       "-",
+				Destination: &exportOptions.output,
+			},
+		},
+		filterFlags,
+		loggingFlags,
+		databaseFlags,
+		indexFlags,
+		pseudonymFlags,
+	),
+	Action: runExport,
+}
+
+// ExportDef describes how stored events of a type are read back from the database.
+type ExportDef struct {
+	// Query is a template for the statement that selects the events, executed with the Namespace
+	// that the tables are in. The event table must be aliased as e so filters can be appended.
+	Query string
+
+	// TopicFilter is a condition that selects events for a topic, with %s standing for the topic
+	// parameter. It is empty for event types that have no topic.
+	TopicFilter string
+
+	// TraceEvent converts a row selected by Query back into a trace event.
+	TraceEvent func(exportRow) (*TraceEvent, error)
+}
+
+var exportDefs = map[EventType]ExportDef{
+	EventTypePublishMessage: {
+		Query:       `SELECT e.peer_id, e.timestamp, e.source, e.message_id, e.topic FROM {{.Prefix}}publish_message_event e`,
+		TopicFilter: "e.topic = %s",
+		TraceEvent: func(r exportRow) (*TraceEvent, error) {
+			ev, err := r.traceEvent(EventTypePublishMessage)
+			if err != nil {
+				return nil, err
+			}
+			ev.PublishMessage = &PublishMessageEvent{
+				MessageID: r.bytes("message_id"),
+				Topic:     r.stringPtr("topic"),
+			}
+			return ev, nil
+		},
+	},
+
+	EventTypeRejectMessage: {
+		Query:       `SELECT e.peer_id, e.timestamp, e.source, e.message_id, e.topic, e.received_from, e.reason FROM {{.Prefix}}reject_message_event e`,
+		TopicFilter: "e.topic = %s",
+		TraceEvent: func(r exportRow) (*TraceEvent, error) {
+			ev, err := r.traceEvent(EventTypeRejectMessage)
+			if err != nil {
+				return nil, err
+			}
+			receivedFrom, err := r.peerID("received_from")
+			if err != nil {
+				return nil, err
+			}
+			ev.RejectMessage = &RejectMessageEvent{
+				MessageID:    r.bytes("message_id"),
+				ReceivedFrom: receivedFrom,
+				Reason:       r.stringPtr("reason"),
+				Topic:        r.stringPtr("topic"),
+			}
+			return ev, nil
+		},
+	},
+
+	EventTypeDuplicateMessage: {
+		Query:       `SELECT e.peer_id, e.timestamp, e.source, e.message_id, e.topic, e.received_from FROM {{.Prefix}}duplicate_message_event e`,
+		TopicFilter: "e.topic = %s",
+		TraceEvent: func(r exportRow) (*TraceEvent, error) {
+			ev, err := r.traceEvent(EventTypeDuplicateMessage)
+			if err != nil {
+				return nil, err
+			}
+			receivedFrom, err := r.peerID("received_from")
+			if err != nil {
+				return nil, err
+			}
+			ev.DuplicateMessage = &DuplicateMessageEvent{
+				MessageID:    r.bytes("message_id"),
+				ReceivedFrom: receivedFrom,
+				Topic:        r.stringPtr("topic"),
+			}
+			return ev, nil
+		},
+	},
+
+	EventTypeDeliverMessage: {
+		Query:       `SELECT e.peer_id, e.timestamp, e.source, e.message_id, e.topic, e.received_from FROM {{.Prefix}}deliver_message_event e`,
+		TopicFilter: "e.topic = %s",
+		TraceEvent: func(r exportRow) (*TraceEvent, error) {
+			ev, err := r.traceEvent(EventTypeDeliverMessage)
+			if err != nil {
+				return nil, err
+			}
+			receivedFrom, err := r.peerID("received_from")
+			if err != nil {
+				return nil, err
+			}
+			ev.DeliverMessage = &DeliverMessageEvent{
+				MessageID:    r.bytes("message_id"),
+				Topic:        r.stringPtr("topic"),
+				ReceivedFrom: receivedFrom,
+			}
+			return ev, nil
+		},
+	},
+
+	EventTypeAddPeer: {
+		Query: `SELECT e.peer_id, e.timestamp, e.source, e.other_peer_id, e.proto FROM {{.Prefix}}add_peer_event e`,
+		TraceEvent: func(r exportRow) (*TraceEvent, error) {
+			ev, err := r.traceEvent(EventTypeAddPeer)
+			if err != nil {
+				return nil, err
+			}
+			other, err := r.peerID("other_peer_id")
+			if err != nil {
+				return nil, err
+			}
+			ev.AddPeer = &AddPeerEvent{
+				PeerID: other,
+				Proto:  r.stringPtr("proto"),
+			}
+			return ev, nil
+		},
+	},
+
+	EventTypeRemovePeer: {
+		Query: `SELECT e.peer_id, e.timestamp, e.source, e.other_peer_id FROM {{.Prefix}}remove_peer_event e`,
+		TraceEvent: func(r exportRow) (*TraceEvent, error) {
+			ev, err := r.traceEvent(EventTypeRemovePeer)
+			if err != nil {
+				return nil, err
+			}
+			other, err := r.peerID("other_peer_id")
+			if err != nil {
+				return nil, err
+			}
+			ev.RemovePeer = &RemovePeerEvent{
+				PeerID: other,
+			}
+			return ev, nil
+		},
+	},
+
+	EventTypeJoin: {
+		Query:       `SELECT e.peer_id, e.timestamp, e.source, e.topic FROM {{.Prefix}}join_event e`,
+		TopicFilter: "e.topic = %s",
+		TraceEvent: func(r exportRow) (*TraceEvent, error) {
+			ev, err := r.traceEvent(EventTypeJoin)
+			if err != nil {
+				return nil, err
+			}
+			ev.Join = &JoinEvent{
+				Topic: r.stringPtr("topic"),
+			}
+			return ev, nil
+		},
+	},
+
+	EventTypeLeave: {
+		Query:       `SELECT e.peer_id, e.timestamp, e.source, e.topic FROM {{.Prefix}}leave_event e`,
+		TopicFilter: "e.topic = %s",
+		TraceEvent: func(r exportRow) (*TraceEvent, error) {
+			ev, err := r.traceEvent(EventTypeLeave)
+			if err != nil {
+				return nil, err
+			}
+			ev.Leave = &LeaveEvent{
+				Topic: r.stringPtr("topic"),
+			}
+			return ev, nil
+		},
+	},
+
+	EventTypeGraft: {
+		Query:       `SELECT e.peer_id, e.timestamp, e.source, e.topic, e.other_peer_id FROM {{.Prefix}}graft_event e`,
+		TopicFilter: "e.topic = %s",
+		TraceEvent: func(r exportRow) (*TraceEvent, error) {
+			ev, err := r.traceEvent(EventTypeGraft)
+			if err != nil {
+				return nil, err
+			}
+			other, err := r.peerID("other_peer_id")
+			if err != nil {
+				return nil, err
+			}
+			ev.Graft = &GraftEvent{
+				PeerID: other,
+				Topic:  r.stringPtr("topic"),
+			}
+			return ev, nil
+		},
+	},
+
+	EventTypePrune: {
+		Query:       `SELECT e.peer_id, e.timestamp, e.source, e.topic, e.other_peer_id FROM {{.Prefix}}prune_event e`,
+		TopicFilter: "e.topic = %s",
+		TraceEvent: func(r exportRow) (*TraceEvent, error) {
+			ev, err := r.traceEvent(EventTypePrune)
+			if err != nil {
+				return nil, err
+			}
+			other, err := r.peerID("other_peer_id")
+			if err != nil {
+				return nil, err
+			}
+			ev.Prune = &PruneEvent{
+				PeerID: other,
+				Topic:  r.stringPtr("topic"),
+			}
+			return ev, nil
+		},
+	},
+
+	EventTypePeerScore: {
+		// topic scores are aggregated into a json array, with time in mesh converted to nanoseconds
+		Query: `
+			SELECT e.peer_id, e.timestamp, e.source, e.other_peer_id, e.app_specific_score, e.ip_colocation_factor, e.behaviour_penalty,
+				COALESCE((
+					SELECT json_agg(json_build_object(
+						'topic', t.topic,
+						'time_in_mesh', (EXTRACT(EPOCH FROM t.time_in_mesh) * 1e9)::BIGINT,
+						'first_message_deliveries', t.first_message_deliveries,
+						'mesh_message_deliveries', t.mesh_message_deliveries,
+						'invalid_message_deliveries', t.invalid_message_deliveries
+					) ORDER BY t.id)
+					FROM {{.Prefix}}peer_score_topic t
+					WHERE t.peer_score_event_id = e.id
+				), '[]'::json) AS topics
+			FROM {{.Prefix}}peer_score_event e`,
+		TopicFilter: "EXISTS (SELECT 1 FROM {{.Prefix}}peer_score_topic t WHERE t.peer_score_event_id = e.id AND t.topic = %s)",
+		TraceEvent: func(r exportRow) (*TraceEvent, error) {
+			ev, err := r.traceEvent(EventTypePeerScore)
+			if err != nil {
+				return nil, err
+			}
+			other, err := r.peerID("other_peer_id")
+			if err != nil {
+				return nil, err
+			}
+
+			var topics []struct {
+				Topic                    string  `json:"topic"`
+				TimeInMesh               int64   `json:"time_in_mesh"`
+				FirstMessageDeliveries   float64 `json:"first_message_deliveries"`
+				MeshMessageDeliveries    float64 `json:"mesh_message_deliveries"`
+				InvalidMessageDeliveries float64 `json:"invalid_message_deliveries"`
+			}
+			data, err := json.Marshal(r["topics"])
+			if err != nil {
+				return nil, fmt.Errorf("topics: %w", err)
+			}
+			if err := json.Unmarshal(data, &topics); err != nil {
+				return nil, fmt.Errorf("topics: %w", err)
+			}
+
+			ev.PeerScore = &PeerScoreEvent{
+				PeerID:             other,
+				AppSpecificScore:   r.float("app_specific_score"),
+				IPColocationFactor: r.float("ip_colocation_factor"),
+				BehaviourPenalty:   r.float("behaviour_penalty"),
+				Topics:             make([]TopicScoreEvent, 0, len(topics)),
+			}
+			for _, t := range topics {
+				ev.PeerScore.Topics = append(ev.PeerScore.Topics, TopicScoreEvent{
+					Topic:                    t.Topic,
+					TimeInMesh:               time.Duration(t.TimeInMesh),
+					FirstMessageDeliveries:   t.FirstMessageDeliveries,
+					MeshMessageDeliveries:    t.MeshMessageDeliveries,
+					InvalidMessageDeliveries: t.InvalidMessageDeliveries,
+				})
+			}
+			return ev, nil
+		},
+	},
+}
+
+// exportRow holds the values of a row selected for export, keyed by column name.
+type exportRow map[string]any
+
+func (r exportRow) str(col string) string {
+	s, _ := r[col].(string)
+	return s
+}
+
+func (r exportRow) stringPtr(col string) *string {
+	s, ok := r[col].(string)
+	if !ok {
+		return nil
+	}
+	return &s
+}
+
+func (r exportRow) bytes(col string) []byte {
+	s, ok := r[col].(string)
+	if !ok {
+		return nil
+	}
+	return []byte(s)
+}
+
+func (r exportRow) float(col string) float64 {
+	f, _ := r[col].(float64)
+	return f
+}
+
+// peerID decodes a peer id that was stored in its string form. A null value, which is also used for
+// ids withheld by the pseudonymiser, gives no peer id.
+func (r exportRow) peerID(col string) ([]byte, error) {
+	if r[col] == nil {
+		return nil, nil
+	}
+	id, err := peer.Decode(r.str(col))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", col, err)
+	}
+	return []byte(id), nil
+}
+
+// traceEvent returns a trace event of the given type with the fields common to all events filled in.
+func (r exportRow) traceEvent(et EventType) (*TraceEvent, error) {
+	peerID, err := r.peerID("peer_id")
+	if err != nil {
+		return nil, err
+	}
+	ts, ok := r["timestamp"].(time.Time)
+	if !ok {
+		return nil, fmt.Errorf("timestamp: unexpected type %T", r["timestamp"])
+	}
+	nanos := ts.UnixNano()
+	return &TraceEvent{
+		Type:      &et,
+		PeerID:    peerID,
+		Timestamp: &nanos,
+		Source:    r.str("source"),
+	}, nil
+}
+
+// parseExportTime parses a time given as an RFC3339 timestamp, or a date and optional time in UTC.
+func parseExportTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised time %q", s)
+}
+
+// exportEventType looks up an event type by its key.
+func exportEventType(key string) (EventType, ExportDef, error) {
+	var keys []string
+	for et, def := range exportDefs {
+		if et.Key() == key {
+			return et, def, nil
+		}
+		keys = append(keys, et.Key())
+	}
+	sort.Strings(keys)
+	return 0, ExportDef{}, fmt.Errorf("unsupported event type %q, must be one of %s", key, strings.Join(keys, ", "))
+}
+
+func runExport(cc *cli.Context) error {
+	// stdout may be used for the export so log to stderr
+	if err := setupLogging(os.Stderr); err != nil {
+		return err
+	}
+
+	_, def, err := exportEventType(exportOptions.eventType)
+	if err != nil {
+		return err
+	}
+
+	switch exportOptions.format {
+	case ExportFormatNDJSON, ExportFormatCSV, ExportFormatParquet, ExportFormatTrace:
+	default:
+		return fmt.Errorf("unsupported format %q, must be one of %s, %s, %s or %s", exportOptions.format, ExportFormatNDJSON, ExportFormatCSV, ExportFormatParquet, ExportFormatTrace)
+	}
+
+	pseudonyms, err := newPseudonymiserFromOptions(PseudonymiseExport)
+	if err != nil {
+		return err
+	}
+
+	ns, filter, err := filterFromOptions()
+	if err != nil {
+		return err
+	}
+	if filter.Topic != "" && def.TopicFilter == "" {
+		return fmt.Errorf("%s events cannot be filtered by topic", exportOptions.eventType)
+	}
+	query, args, err := def.query(ns, filter)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if exportOptions.output != "-" {
+		f, err := os.Create(exportOptions.output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	bw := bufio.NewWriter(out)
+
+	ctx, stop := signal.NotifyContext(cc.Context, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	conn, err := connect(ctx, options.dbHost, options.dbPort, options.dbName, options.dbSSLMode, options.dbUser, options.dbPassword)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := ns.setSearchPath(ctx, tx); err != nil {
+		return err
+	}
+
+	cur, err := declareExportCursor(ctx, tx, "export_cursor", query, args)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var w exportWriter
+	var count int64
+	for {
+		row, err := cur.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if w == nil {
+			// the writer is created once the columns of the result are known
+			w, err = newExportWriter(exportOptions.format, bw, cur.Fields(), def)
+			if err != nil {
+				return err
+			}
+		}
+		if row == nil {
+			break
+		}
+		if pseudonyms != nil {
+			pseudonyms.Row(row)
+		}
+		if err := w.Write(row); err != nil {
+			return fmt.Errorf("write row: %w", err)
+		}
+		count++
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d %s events in %s\n", count, exportOptions.eventType, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// exportFilter selects the stored events to be read.
+type exportFilter struct {
+	From   time.Time // events at or after this time, if not zero
+	To     time.Time // events before this time, if not zero
+	Peer   string    // events traced by this peer
+	Topic  string    // events for this topic
+	Source string    // events received from this source
+	Index  string    // events sent to this index, only recorded when using the source index mapping
+	Types  []string  // events with one of these type keys, only applicable to tables holding more than one type
+}
+
+// filterFromOptions returns the namespace and filter specified by the filter flags.
+func filterFromOptions() (Namespace, exportFilter, error) {
+	var f exportFilter
+
+	indexes, err := NewIndexRouter(IndexMapping(options.indexMapping), options.defaultIndex, IndexLimits{})
+	if err != nil {
+		return Namespace{}, f, fmt.Errorf("failed to configure index mapping: %w", err)
+	}
+	if eserr := validateIndexName(filterOptions.index); eserr != nil {
+		return Namespace{}, f, fmt.Errorf("invalid index: %s", eserr.Reason)
+	}
+	ns, eserr := indexes.Route(filterOptions.index)
+	if eserr != nil {
+		return Namespace{}, f, fmt.Errorf("invalid index: %s", eserr.Reason)
+	}
+
+	if filterOptions.from != "" {
+		if f.From, err = parseExportTime(filterOptions.from); err != nil {
+			return Namespace{}, f, fmt.Errorf("from: %w", err)
+		}
+	}
+	if filterOptions.to != "" {
+		if f.To, err = parseExportTime(filterOptions.to); err != nil {
+			return Namespace{}, f, fmt.Errorf("to: %w", err)
+		}
+	}
+	if filterOptions.peer != "" {
+		id, err := peer.Decode(filterOptions.peer)
+		if err != nil {
+			return Namespace{}, f, fmt.Errorf("peer: %w", err)
+		}
+		f.Peer = id.String()
+	}
+	f.Topic = filterOptions.topic
+	f.Source = filterOptions.source
+	f.Index = ns.Index
+
+	return ns, f, nil
+}
+
+// query returns the statement and arguments that select the events matching a filter from a namespace,
+// ordered by time.
+func (def ExportDef) query(ns Namespace, f exportFilter) (string, []any, error) {
+	where, args, err := f.where(def.TopicFilter)
+	if err != nil {
+		return "", nil, err
+	}
+	query, err := ns.DDL(def.Query + where + " ORDER BY e.timestamp, e.id")
+	if err != nil {
+		return "", nil, fmt.Errorf("query template: %w", err)
+	}
+	return query, args, nil
+}
+
+// where returns a WHERE clause and its arguments that select the events matching a filter from a table
+// aliased as e, or an empty clause if the filter matches every event. topicFilter is the condition used
+// to match a topic, which is empty if the table cannot be filtered by topic.
+func (f exportFilter) where(topicFilter string) (string, []any, error) {
+	var conds []string
+	var args []any
+	addCond := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, "$"+strconv.Itoa(len(args))))
+	}
+	if !f.From.IsZero() {
+		addCond("e.timestamp >= %s::TIMESTAMPTZ", f.From)
+	}
+	if !f.To.IsZero() {
+		addCond("e.timestamp < %s::TIMESTAMPTZ", f.To)
+	}
+	if f.Peer != "" {
+		addCond("e.peer_id = %s::TEXT", f.Peer)
+	}
+	if f.Topic != "" {
+		if topicFilter == "" {
+			return "", nil, fmt.Errorf("event type cannot be filtered by topic")
+		}
+		addCond(topicFilter, f.Topic)
+	}
+	if f.Source != "" {
+		addCond("e.source = %s::TEXT", f.Source)
+	}
+	if f.Index != "" {
+		addCond("e.index_name = %s::TEXT", f.Index)
+	}
+	if len(f.Types) > 0 {
+		addCond("e.event_type = ANY(%s::TEXT[])", f.Types)
+	}
+
+	if len(conds) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args, nil
+}
+
+// exportCursor streams the rows selected by a query through a database cursor so that the result set
+// is never held in memory. It must be used within a transaction.
+type exportCursor struct {
+	tx     pgx.Tx
+	fetch  string
+	fields []pgconn.FieldDescription
+	rows   []exportRow
+	done   bool
+}
+
+func declareExportCursor(ctx context.Context, tx pgx.Tx, name string, query string, args []any) (*exportCursor, error) {
+	if _, err := tx.Exec(ctx, "DECLARE "+name+" NO SCROLL CURSOR FOR "+query, args...); err != nil {
+		return nil, fmt.Errorf("declare cursor: %w", err)
+	}
+	return &exportCursor{
+		tx:    tx,
+		fetch: "FETCH FORWARD " + strconv.Itoa(exportFetchSize) + " FROM " + name,
+	}, nil
+}
+
+// Next returns the next row, or nil when all rows have been read.
+func (c *exportCursor) Next(ctx context.Context) (exportRow, error) {
+	if len(c.rows) == 0 && !c.done {
+		if err := c.fill(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.rows) == 0 {
+		return nil, nil
+	}
+	row := c.rows[0]
+	c.rows = c.rows[1:]
+	return row, nil
+}
+
+// Fields returns the columns of the result. It is only valid after the first call to Next.
+func (c *exportCursor) Fields() []pgconn.FieldDescription {
+	return c.fields
+}
+
+func (c *exportCursor) fill(ctx context.Context) error {
+	rows, err := c.tx.Query(ctx, c.fetch)
+	if err != nil {
+		return fmt.Errorf("fetch: %w", err)
+	}
+	defer rows.Close()
+
+	c.fields = rows.FieldDescriptions()
+	c.rows = make([]exportRow, 0, exportFetchSize)
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return fmt.Errorf("read row: %w", err)
+		}
+		row := make(exportRow, len(values))
+		for i, v := range values {
+			row[c.fields[i].Name] = v
+		}
+		c.rows = append(c.rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("fetch: %w", err)
+	}
+
+	if len(c.rows) < exportFetchSize {
+		c.done = true
+	}
+	return nil
+}
+
+// exportWriter writes exported rows in an output format.
+type exportWriter interface {
+	Write(exportRow) error
+	Close() error
+}
+
+func newExportWriter(format string, w io.Writer, fields []pgconn.FieldDescription, def ExportDef) (exportWriter, error) {
+	cols := make([]string, len(fields))
+	for i := range fields {
+		cols[i] = fields[i].Name
+	}
+
+	switch format {
+	case ExportFormatNDJSON:
+		return &ndjsonExportWriter{w: w, cols: cols}, nil
+	case ExportFormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(cols); err != nil {
+			return nil, err
+		}
+		return &csvExportWriter{w: cw, cols: cols}, nil
+	case ExportFormatParquet:
+		return newParquetExportWriter(w, fields), nil
+	case ExportFormatTrace:
+		return &traceExportWriter{enc: json.NewEncoder(w), def: def}, nil
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+// ndjsonExportWriter writes each row as a json object with keys in column order.
+type ndjsonExportWriter struct {
+	w    io.Writer
+	cols []string
+	buf  []byte
+}
+
+func (ew *ndjsonExportWriter) Write(row exportRow) error {
+	ew.buf = append(ew.buf[:0], '{')
+	for i, col := range ew.cols {
+		if i > 0 {
+			ew.buf = append(ew.buf, ',')
+		}
+		ew.buf = strconv.AppendQuote(ew.buf, col)
+		ew.buf = append(ew.buf, ':')
+		v := row[col]
+		if t, ok := v.(time.Time); ok {
+			v = t.UTC()
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", col, err)
+		}
+		ew.buf = append(ew.buf, data...)
+	}
+	ew.buf = append(ew.buf, '}', '\n')
+	_, err := ew.w.Write(ew.buf)
+	return err
+}
+
+func (ew *ndjsonExportWriter) Close() error { return nil }
+
+// csvExportWriter writes rows as csv with a header row. Nested values are written as json.
+type csvExportWriter struct {
+	w      *csv.Writer
+	cols   []string
+	record []string
+}
+
+func (ew *csvExportWriter) Write(row exportRow) error {
+	ew.record = ew.record[:0]
+	for _, col := range ew.cols {
+		var s string
+		switch v := row[col].(type) {
+		case nil:
+		case string:
+			s = v
+		case time.Time:
+			s = v.UTC().Format(time.RFC3339Nano)
+		case float64:
+			s = strconv.FormatFloat(v, 'g', -1, 64)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		case int32:
+			s = strconv.FormatInt(int64(v), 10)
+		default:
+			data, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", col, err)
+			}
+			s = string(data)
+		}
+		ew.record = append(ew.record, s)
+	}
+	return ew.w.Write(ew.record)
+}
+
+func (ew *csvExportWriter) Close() error {
+	ew.w.Flush()
+	return ew.w.Error()
+}
+
+// traceExportWriter converts each row back into a trace event and writes it as json.
+type traceExportWriter struct {
+	enc *json.Encoder
+	def ExportDef
+}
+
+func (ew *traceExportWriter) Write(row exportRow) error {
+	ev, err := ew.def.TraceEvent(row)
+	if err != nil {
+		return err
+	}
+	return ew.enc.Encode(ev)
+}
+
+func (ew *traceExportWriter) Close() error { return nil }
+
+// parquetExportWriter writes rows to a parquet file with a schema derived from the result columns.
+// Every column is optional. Nested values are written as json.
+type parquetExportWriter struct {
+	w       *parquet.Writer
+	cols    []string
+	oids    []uint32
+	indexes []int // the parquet column index of each result column
+	rows    []parquet.Row
+}
+
+func newParquetExportWriter(w io.Writer, fields []pgconn.FieldDescription) *parquetExportWriter {
+	ew := &parquetExportWriter{
+		cols:    make([]string, len(fields)),
+		oids:    make([]uint32, len(fields)),
+		indexes: make([]int, len(fields)),
+	}
+
+	group := parquet.Group{}
+	for i, f := range fields {
+		ew.cols[i] = f.Name
+		ew.oids[i] = f.DataTypeOID
+		var node parquet.Node
+		switch f.DataTypeOID {
+		case pgtype.TimestamptzOID, pgtype.TimestampOID:
+			node = parquet.Timestamp(parquet.Microsecond)
+		case pgtype.Float8OID, pgtype.Float4OID:
+			node = parquet.Leaf(parquet.DoubleType)
+		case pgtype.Int8OID, pgtype.Int4OID, pgtype.Int2OID:
+			node = parquet.Int(64)
+		case pgtype.JSONOID, pgtype.JSONBOID:
+			node = parquet.JSON()
+		default:
+			node = parquet.String()
+		}
+		group[f.Name] = parquet.Optional(node)
+	}
+
+	schema := parquet.NewSchema("trace_event", group)
+	for i, col := range ew.cols {
+		leaf, _ := schema.Lookup(col)
+		ew.indexes[i] = leaf.ColumnIndex
+	}
+	ew.w = parquet.NewWriter(w, schema)
+	return ew
+}
+
+func (ew *parquetExportWriter) Write(row exportRow) error {
+	prow := make(parquet.Row, len(ew.cols))
+	for i, col := range ew.cols {
+		var v parquet.Value
+		switch val := row[col].(type) {
+		case nil:
+			prow[ew.indexes[i]] = parquet.Value{}.Level(0, 0, ew.indexes[i])
+			continue
+		case string:
+			v = parquet.ByteArrayValue([]byte(val))
+		case time.Time:
+			v = parquet.Int64Value(val.UnixMicro())
+		case float64:
+			v = parquet.DoubleValue(val)
+		case float32:
+			v = parquet.DoubleValue(float64(val))
+		case int64:
+			v = parquet.Int64Value(val)
+		case int32:
+			v = parquet.Int64Value(int64(val))
+		case int16:
+			v = parquet.Int64Value(int64(val))
+		default:
+			data, err := json.Marshal(val)
+			if err != nil {
+				return fmt.Errorf("%s: %w", col, err)
+			}
+			v = parquet.ByteArrayValue(data)
+		}
+		prow[ew.indexes[i]] = v.Level(0, 1, ew.indexes[i])
+	}
+
+	// rows are buffered so they are written to the parquet writer in batches
+	ew.rows = append(ew.rows, prow)
+	if len(ew.rows) >= exportFetchSize {
+		return ew.flushRows()
+	}
+	return nil
+}
+
+func (ew *parquetExportWriter) flushRows() error {
+	if len(ew.rows) == 0 {
+		return nil
+	}
+	if _, err := ew.w.WriteRows(ew.rows); err != nil {
+		return err
+	}
+	ew.rows = ew.rows[:0]
+	return nil
+}
+
+func (ew *parquetExportWriter) Close() error {
+	if err := ew.flushRows(); err != nil {
+		return err
+	}
+	return ew.w.Close()
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestExportQuery(t *testing.T) {
+	from := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 4, 2, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		et       EventType
+		ns       Namespace
+		filter   exportFilter
+		want     string
+		wantArgs []any
+		wantErr  bool
+	}{
+		{
+			name: "no filter",
+			et:   EventTypeJoin,
+			want: `SELECT e.peer_id, e.timestamp, e.source, e.topic FROM join_event e ORDER BY e.timestamp, e.id`,
+		},
+		{
+			name:     "prefix and filters",
+			et:       EventTypeDeliverMessage,
+			ns:       Namespace{Prefix: "lotus_", Index: "lotus"},
+			filter:   exportFilter{From: from, To: to, Peer: "12D3KooW", Topic: "/fil/msgs/mainnet", Source: "node1", Index: "lotus"},
+			want:     `SELECT e.peer_id, e.timestamp, e.source, e.message_id, e.topic, e.received_from FROM lotus_deliver_message_event e WHERE e.timestamp >= $1::TIMESTAMPTZ AND e.timestamp < $2::TIMESTAMPTZ AND e.peer_id = $3::TEXT AND e.topic = $4 AND e.source = $5::TEXT AND e.index_name = $6::TEXT ORDER BY e.timestamp, e.id`,
+			wantArgs: []any{from, to, "12D3KooW", "/fil/msgs/mainnet", "node1", "lotus"},
+		},
+		{
+			name:     "peer score topic",
+			et:       EventTypePeerScore,
+			ns:       Namespace{Prefix: "lotus_"},
+			filter:   exportFilter{Topic: "/fil/msgs/mainnet"},
+			want:     `EXISTS (SELECT 1 FROM lotus_peer_score_topic t WHERE t.peer_score_event_id = e.id AND t.topic = $1) ORDER BY e.timestamp, e.id`,
+			wantArgs: []any{"/fil/msgs/mainnet"},
+		},
+		{
+			name:    "topic of type without topic",
+			et:      EventTypeAddPeer,
+			filter:  exportFilter{Topic: "/fil/msgs/mainnet"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query, args, err := exportDefs[tc.et].query(tc.ns, tc.filter)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got query %q, wanted error", query)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			if !strings.HasSuffix(query, tc.want) {
+				t.Errorf("got query %q\nwanted it to end with %q", query, tc.want)
+			}
+			if !reflect.DeepEqual(args, tc.wantArgs) {
+				t.Errorf("got args %v, wanted %v", args, tc.wantArgs)
+			}
+		})
+	}
+}
+
+func TestParseExportTime(t *testing.T) {
+	testCases := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{in: "2023-04-01T12:30:00Z", want: time.Date(2023, 4, 1, 12, 30, 0, 0, time.UTC)},
+		{in: "2023-04-01T12:30:00+02:00", want: time.Date(2023, 4, 1, 10, 30, 0, 0, time.UTC)},
+		{in: "2023-04-01T12:30:00", want: time.Date(2023, 4, 1, 12, 30, 0, 0, time.UTC)},
+		{in: "2023-04-01 12:30:00", want: time.Date(2023, 4, 1, 12, 30, 0, 0, time.UTC)},
+		{in: "2023-04-01", want: time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{in: "yesterday", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := parseExportTime(tc.in)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, wanted error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseExportTime: %v", err)
+			}
+			if !got.Equal(tc.want) {
+				t.Errorf("got %v, wanted %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// testExportRow returns a row as read from the database with the columns common to every event type.
+func testExportRow(t *testing.T, cols exportRow) exportRow {
+	t.Helper()
+	observerID, err := peer.IDFromBytes(mustDecodeBase64(t, testObserverID))
+	if err != nil {
+		t.Fatalf("observer peer id: %v", err)
+	}
+	row := exportRow{
+		"peer_id":   observerID.String(),
+		"timestamp": time.Unix(0, 1680000000000000000),
+		"source":    "node1",
+	}
+	for col, v := range cols {
+		row[col] = v
+	}
+	return row
+}
+
+func TestExportDefTraceEvent(t *testing.T) {
+	otherID, err := peer.IDFromBytes(mustDecodeBase64(t, testOtherID))
+	if err != nil {
+		t.Fatalf("other peer id: %v", err)
+	}
+	common := `"peerID":"` + testObserverID + `","timestamp":1680000000000000000`
+
+	testCases := []struct {
+		name    string
+		et      EventType
+		cols    exportRow
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "deliver message",
+			et:   EventTypeDeliverMessage,
+			cols: exportRow{"message_id": "msg1", "topic": "/fil/msgs/mainnet", "received_from": otherID.String()},
+			want: `{"type":3,` + common + `,"deliverMessage":{"messageID":"bXNnMQ==","topic":"/fil/msgs/mainnet","receivedFrom":"` + testOtherID + `"}}`,
+		},
+		{
+			name: "add peer",
+			et:   EventTypeAddPeer,
+			cols: exportRow{"other_peer_id": otherID.String(), "proto": "/meshsub/1.1.0"},
+			want: `{"type":4,` + common + `,"addPeer":{"peerID":"` + testOtherID + `","proto":"/meshsub/1.1.0"}}`,
+		},
+		{
+			name: "peer score",
+			et:   EventTypePeerScore,
+			cols: exportRow{
+				"other_peer_id":        otherID.String(),
+				"app_specific_score":   10.0,
+				"ip_colocation_factor": 0.5,
+				"behaviour_penalty":    1.0,
+				// json columns are decoded by pgx into generic values
+				"topics": []any{map[string]any{
+					"topic":                      "/fil/msgs/mainnet",
+					"time_in_mesh":               60000000000.0,
+					"first_message_deliveries":   1.0,
+					"mesh_message_deliveries":    2.0,
+					"invalid_message_deliveries": 0.0,
+				}},
+			},
+			want: `{"type":100,` + common + `,"peerScore":{"peerID":"` + testOtherID + `","score":0,"appSpecificScore":10,"ipColocationFactor":0.5,"behaviourPenalty":1,` +
+				`"topics":[{"topic":"/fil/msgs/mainnet","timeInMesh":60000000000,"firstMessageDeliveries":1,"meshMessageDeliveries":2,"invalidMessageDeliveries":0}]}}`,
+		},
+		{
+			name:    "invalid peer id",
+			et:      EventTypeRemovePeer,
+			cols:    exportRow{"other_peer_id": "not a peer id"},
+			wantErr: true,
+		},
+		{
+			name:    "missing timestamp",
+			et:      EventTypeJoin,
+			cols:    exportRow{"timestamp": nil},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ev, err := exportDefs[tc.et].TraceEvent(testExportRow(t, tc.cols))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got event %+v, wanted error", ev)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("TraceEvent: %v", err)
+			}
+
+			got, err := json.Marshal(ev)
+			if err != nil {
+				t.Fatalf("marshal event: %v", err)
+			}
+			want, err := json.Marshal(mustParseEvent(t, tc.want))
+			if err != nil {
+				t.Fatalf("marshal wanted event: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("got %s\nwanted %s", got, want)
+			}
+		})
+	}
+}
+
+func TestExportWriters(t *testing.T) {
+	fields := []pgconn.FieldDescription{
+		{Name: "peer_id", DataTypeOID: pgtype.TextOID},
+		{Name: "timestamp", DataTypeOID: pgtype.TimestamptzOID},
+		{Name: "source", DataTypeOID: pgtype.TextOID},
+		{Name: "topic", DataTypeOID: pgtype.TextOID},
+	}
+	rows := []exportRow{
+		testExportRow(t, exportRow{"topic": "/fil/msgs/mainnet"}),
+		testExportRow(t, exportRow{"topic": nil}),
+	}
+	peerID := rows[0].str("peer_id")
+
+	testCases := []struct {
+		format string
+		want   string // the output, if text
+	}{
+		{
+			format: ExportFormatNDJSON,
+			want: `{"peer_id":"` + peerID + `","timestamp":"2023-03-28T10:40:00Z","source":"node1","topic":"/fil/msgs/mainnet"}` + "\n" +
+				`{"peer_id":"` + peerID + `","timestamp":"2023-03-28T10:40:00Z","source":"node1","topic":null}` + "\n",
+		},
+		{
+			format: ExportFormatCSV,
+			want: "peer_id,timestamp,source,topic\n" +
+				peerID + ",2023-03-28T10:40:00Z,node1,/fil/msgs/mainnet\n" +
+				peerID + ",2023-03-28T10:40:00Z,node1,\n",
+		},
+		{
+			format: ExportFormatTrace,
+			want: `{"type":9,"peerID":"` + testObserverID + `","timestamp":1680000000000000000,"join":{"topic":"/fil/msgs/mainnet"}}` + "\n" +
+				`{"type":9,"peerID":"` + testObserverID + `","timestamp":1680000000000000000,"join":{}}` + "\n",
+		},
+		{
+			format: ExportFormatParquet,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := newExportWriter(tc.format, &buf, fields, exportDefs[EventTypeJoin])
+			if err != nil {
+				t.Fatalf("newExportWriter: %v", err)
+			}
+			for _, row := range rows {
+				if err := w.Write(row); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			if tc.format != ExportFormatParquet {
+				if got := buf.String(); got != tc.want {
+					t.Errorf("got\n%s\nwanted\n%s", got, tc.want)
+				}
+				return
+			}
+
+			f, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatalf("open parquet: %v", err)
+			}
+			if got := f.NumRows(); got != int64(len(rows)) {
+				t.Errorf("got %d rows, wanted %d", got, len(rows))
+			}
+			for _, field := range fields {
+				if _, ok := f.Schema().Lookup(field.Name); !ok {
+					t.Errorf("column %s missing from schema", field.Name)
+				}
+			}
+		})
+	}
+
+	if _, err := newExportWriter("xml", new(bytes.Buffer), fields, exportDefs[EventTypeJoin]); err == nil {
+		t.Errorf("got no error for unsupported format")
+	}
+}
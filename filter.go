@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+)
+
+// Actions taken by filter rules.
+const (
+	FilterActionInclude = "include"
+	FilterActionExclude = "exclude"
+)
+
+// Ways in which included events are sampled.
+const (
+	FilterSampleRandom    = "random"     // each event is sampled independently
+	FilterSampleMessageID = "message_id" // every event for a message is either kept or dropped
+)
+
+// FilterConfig is the contents of a filter rules file.
+type FilterConfig struct {
+	// Default is the action taken for events that match no rule, include if empty.
+	Default string `yaml:"default"`
+
+	// Rules are tried in order and the first rule that matches an event decides whether it is kept.
+	Rules []FilterRuleConfig `yaml:"rules"`
+}
+
+// FilterRuleConfig describes a rule that matches events. A rule with no conditions matches every
+// event and each condition that is given must match. Within a condition an event needs to match only
+// one of the values.
+type FilterRuleConfig struct {
+	Name          string   `yaml:"name"`
+	Types         []string `yaml:"types"`          // event type keys, such as duplicate_message
+	Topics        []string `yaml:"topics"`         // exact topic names
+	TopicPrefixes []string `yaml:"topic_prefixes"` // topic name prefixes
+	TopicRegex    string   `yaml:"topic_regex"`    // regular expression matching topic names
+	Peers         []string `yaml:"peers"`          // ids of the peer that traced the event
+	Sources       []string `yaml:"sources"`        // sources of the event
+	Action        string   `yaml:"action"`         // include or exclude, include if empty
+	Sample        *float64 `yaml:"sample"`         // fraction of included events that are kept, all if not given
+	SampleBy      string   `yaml:"sample_by"`      // random or message_id, random if empty
+}
+
+// filterRule is a compiled FilterRuleConfig.
+type filterRule struct {
+	name          string
+	types         map[string]bool
+	topics        map[string]bool
+	topicPrefixes []string
+	topicRegex    *regexp.Regexp
+	peers         map[string]bool
+	sources       map[string]bool
+	exclude       bool
+	sample        float64
+	byMessageID   bool
+}
+
+// ParseFilterConfig parses filter rules written in yaml or json.
+func ParseFilterConfig(data []byte) (*FilterConfig, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	fc := new(FilterConfig)
+	if err := dec.Decode(fc); err != nil {
+		if errors.Is(err, io.EOF) {
+			return fc, nil // an empty file has no rules
+		}
+		return nil, err
+	}
+	return fc, nil
+}
+
+// compile validates the configuration and returns the rules it describes and whether events matching
+// no rule are excluded.
+func (fc *FilterConfig) compile() ([]*filterRule, bool, error) {
+	var excludeDefault bool
+	switch fc.Default {
+	case "", FilterActionInclude:
+	case FilterActionExclude:
+		excludeDefault = true
+	default:
+		return nil, false, fmt.Errorf("default: unsupported action %q, must be %q or %q", fc.Default, FilterActionInclude, FilterActionExclude)
+	}
+
+	knownTypes := make(map[string]bool)
+	for et := range eventDefs {
+		knownTypes[et.Key()] = true
+	}
+
+	rules := make([]*filterRule, 0, len(fc.Rules))
+	for i, rc := range fc.Rules {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", i+1)
+		}
+
+		r := &filterRule{
+			name:          name,
+			topicPrefixes: rc.TopicPrefixes,
+			sample:        1,
+		}
+
+		if len(rc.Types) > 0 {
+			r.types = make(map[string]bool, len(rc.Types))
+			for _, t := range rc.Types {
+				if !knownTypes[t] {
+					return nil, false, fmt.Errorf("%s: unknown event type %q", name, t)
+				}
+				r.types[t] = true
+			}
+		}
+		if len(rc.Topics) > 0 {
+			r.topics = make(map[string]bool, len(rc.Topics))
+			for _, t := range rc.Topics {
+				r.topics[t] = true
+			}
+		}
+		if rc.TopicRegex != "" {
+			re, err := regexp.Compile(rc.TopicRegex)
+			if err != nil {
+				return nil, false, fmt.Errorf("%s: topic_regex: %w", name, err)
+			}
+			r.topicRegex = re
+		}
+		if len(rc.Peers) > 0 {
+			r.peers = make(map[string]bool, len(rc.Peers))
+			for _, p := range rc.Peers {
+				id, err := peer.Decode(p)
+				if err != nil {
+					return nil, false, fmt.Errorf("%s: peer %q: %w", name, p, err)
+				}
+				r.peers[id.String()] = true
+			}
+		}
+		if len(rc.Sources) > 0 {
+			r.sources = make(map[string]bool, len(rc.Sources))
+			for _, s := range rc.Sources {
+				r.sources[s] = true
+			}
+		}
+
+		switch rc.Action {
+		case "", FilterActionInclude:
+		case FilterActionExclude:
+			r.exclude = true
+		default:
+			return nil, false, fmt.Errorf("%s: unsupported action %q, must be %q or %q", name, rc.Action, FilterActionInclude, FilterActionExclude)
+		}
+
+		if rc.Sample != nil {
+			if *rc.Sample < 0 || *rc.Sample > 1 {
+				return nil, false, fmt.Errorf("%s: sample must be between 0 and 1", name)
+			}
+			if r.exclude {
+				return nil, false, fmt.Errorf("%s: sample cannot be used with the exclude action", name)
+			}
+			r.sample = *rc.Sample
+		}
+
+		switch rc.SampleBy {
+		case "", FilterSampleRandom:
+		case FilterSampleMessageID:
+			r.byMessageID = true
+		default:
+			return nil, false, fmt.Errorf("%s: unsupported sample_by %q, must be %q or %q", name, rc.SampleBy, FilterSampleRandom, FilterSampleMessageID)
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, excludeDefault, nil
+}
+
+// matches reports whether the rule matches an event.
+func (r *filterRule) matches(ev *TraceEvent) bool {
+	if r.types != nil && !r.types[ev.Type.Key()] {
+		return false
+	}
+	if r.sources != nil && !r.sources[ev.Source] {
+		return false
+	}
+	if r.peers != nil {
+		id, err := peer.IDFromBytes(ev.PeerID)
+		if err != nil || !r.peers[id.String()] {
+			return false
+		}
+	}
+	if r.topics != nil || r.topicPrefixes != nil || r.topicRegex != nil {
+		matched := false
+		for _, t := range eventTopics(ev) {
+			if r.matchesTopic(t) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *filterRule) matchesTopic(topic string) bool {
+	if r.topics != nil && !r.topics[topic] {
+		return false
+	}
+	if r.topicPrefixes != nil {
+		matched := false
+		for _, p := range r.topicPrefixes {
+			if strings.HasPrefix(topic, p) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.topicRegex != nil && !r.topicRegex.MatchString(topic) {
+		return false
+	}
+	return true
+}
+
+// sampled reports whether an event included by the rule is kept.
+func (r *filterRule) sampled(ev *TraceEvent) bool {
+	if r.sample >= 1 {
+		return true
+	}
+	if r.sample <= 0 {
+		return false
+	}
+	if r.byMessageID {
+		if id := eventMessageID(ev); id != nil {
+			// the rule name is included so rules with the same rate select different messages
+			h := sha256.New()
+			h.Write([]byte(r.name))
+			h.Write(id)
+			return float64(binary.BigEndian.Uint64(h.Sum(nil)))/math.MaxUint64 < r.sample
+		}
+		// events without a message id are sampled randomly
+	}
+	return rand.Float64() < r.sample
+}
+
+// eventTopics returns the topics that an event relates to.
+func eventTopics(ev *TraceEvent) []string {
+	var topic *string
+	switch {
+	case ev.PublishMessage != nil:
+		topic = ev.PublishMessage.Topic
+	case ev.RejectMessage != nil:
+		topic = ev.RejectMessage.Topic
+	case ev.DuplicateMessage != nil:
+		topic = ev.DuplicateMessage.Topic
+	case ev.DeliverMessage != nil:
+		topic = ev.DeliverMessage.Topic
+	case ev.Join != nil:
+		topic = ev.Join.Topic
+	case ev.Leave != nil:
+		topic = ev.Leave.Topic
+	case ev.Graft != nil:
+		topic = ev.Graft.Topic
+	case ev.Prune != nil:
+		topic = ev.Prune.Topic
+	case ev.PeerScore != nil:
+		topics := make([]string, 0, len(ev.PeerScore.Topics))
+		for _, t := range ev.PeerScore.Topics {
+			topics = append(topics, t.Topic)
+		}
+		return topics
+	}
+	if topic == nil {
+		return nil
+	}
+	return []string{*topic}
+}
+
+// eventMessageID returns the id of the message that an event relates to, or nil if it does not
+// relate to a single message.
+func eventMessageID(ev *TraceEvent) []byte {
+	switch {
+	case ev.PublishMessage != nil:
+		return ev.PublishMessage.MessageID
+	case ev.RejectMessage != nil:
+		return ev.RejectMessage.MessageID
+	case ev.DuplicateMessage != nil:
+		return ev.DuplicateMessage.MessageID
+	case ev.DeliverMessage != nil:
+		return ev.DeliverMessage.MessageID
+	}
+	return nil
+}
+
+// EventFilter decides which events are stored according to rules read from a file or given in a
+// config file. Rules read from a file are reloaded when Reload is called.
+type EventFilter struct {
+	file string // empty if the rules were not read from a file
+
+	mu             sync.RWMutex
+	rules          []*filterRule
+	excludeDefault bool
+}
+
+// NewEventFilter reads the rules in file, returning an error if they are not valid.
+func NewEventFilter(file string) (*EventFilter, error) {
+	f := &EventFilter{file: file}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// NewConfigEventFilter creates an EventFilter that applies the given rules, returning an error if they
+// are not valid. Its rules are replaced by calling Set.
+func NewConfigEventFilter(fc *FilterConfig) (*EventFilter, error) {
+	f := new(EventFilter)
+	if err := f.Set(fc); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the rules from disk if they were read from a file. The previous rules remain in use if
+// the file cannot be read or the rules are not valid.
+func (f *EventFilter) Reload() error {
+	if f.file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(f.file)
+	if err != nil {
+		return fmt.Errorf("read filter rules: %w", err)
+	}
+	fc, err := ParseFilterConfig(data)
+	if err != nil {
+		return fmt.Errorf("parse filter rules %s: %w", f.file, err)
+	}
+	if err := f.Set(fc); err != nil {
+		return fmt.Errorf("filter rules %s: %w", f.file, err)
+	}
+	slog.Info("loaded filter rules", "file", f.file, "rules", len(fc.Rules))
+	return nil
+}
+
+// Set replaces the rules. The previous rules remain in use if the new rules are not valid.
+func (f *EventFilter) Set(fc *FilterConfig) error {
+	rules, excludeDefault, err := fc.compile()
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.rules = rules
+	f.excludeDefault = excludeDefault
+	f.mu.Unlock()
+	return nil
+}
+
+// Filter reports whether an event should be stored. When it should not, the reason for dropping it
+// is returned. Filter may be called on a nil EventFilter, which keeps every event.
+func (f *EventFilter) Filter(ev *TraceEvent) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, r := range f.rules {
+		if !r.matches(ev) {
+			continue
+		}
+		if r.exclude {
+			return false, DropReasonFiltered
+		}
+		if !r.sampled(ev) {
+			return false, DropReasonSampled
+		}
+		return true, ""
+	}
+	if f.excludeDefault {
+		return false, DropReasonFiltered
+	}
+	return true, ""
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func newTestEventFilter(t *testing.T, rules string) *EventFilter {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "filter.yaml")
+	if err := os.WriteFile(file, []byte(rules), 0o600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	f, err := NewEventFilter(file)
+	if err != nil {
+		t.Fatalf("NewEventFilter: %v", err)
+	}
+	return f
+}
+
+func topicEvent(et EventType, topic string, source string) *TraceEvent {
+	ts := int64(1680000000000000000)
+	ev := &TraceEvent{Type: &et, PeerID: []byte("peer"), Timestamp: &ts, Source: source}
+	switch et {
+	case EventTypeJoin:
+		ev.Join = &JoinEvent{Topic: &topic}
+	case EventTypeLeave:
+		ev.Leave = &LeaveEvent{Topic: &topic}
+	}
+	return ev
+}
+
+func TestParseFilterConfig(t *testing.T) {
+	testCases := []struct {
+		name      string
+		data      string
+		wantRules int
+		wantErr   string // returned by ParseFilterConfig or compiling the rules
+	}{
+		{name: "empty", data: ""},
+		{
+			name: "yaml",
+			data: `
+default: exclude
+rules:
+  - name: mainnet messages
+    types: [publish_message, deliver_message]
+    topic_prefixes: [/fil/msgs/]
+    sample: 0.1
+    sample_by: message_id
+  - topics: [/fil/blocks/mainnet]
+    topic_regex: ^/fil/
+    sources: [node1]
+    action: include
+`,
+			wantRules: 2,
+		},
+		{name: "json", data: `{"default":"include","rules":[{"types":["join"],"action":"exclude"}]}`, wantRules: 1},
+		{name: "unknown setting", data: "rules:\n  - typs: [join]\n", wantErr: "field typs not found"},
+		{name: "unsupported default", data: "default: drop\n", wantErr: `default: unsupported action "drop"`},
+		{name: "unknown type", data: "rules:\n  - types: [joined]\n", wantErr: `rule 1: unknown event type "joined"`},
+		{name: "invalid regex", data: "rules:\n  - name: bad\n    topic_regex: '('\n", wantErr: "bad: topic_regex"},
+		{name: "invalid peer", data: "rules:\n  - peers: [notapeer]\n", wantErr: `rule 1: peer "notapeer"`},
+		{name: "unsupported action", data: "rules:\n  - action: keep\n", wantErr: `rule 1: unsupported action "keep"`},
+		{name: "sample out of range", data: "rules:\n  - sample: 1.5\n", wantErr: "rule 1: sample must be between 0 and 1"},
+		{name: "sample with exclude", data: "rules:\n  - action: exclude\n    sample: 0.5\n", wantErr: "rule 1: sample cannot be used with the exclude action"},
+		{name: "unsupported sample_by", data: "rules:\n  - sample: 0.5\n    sample_by: peer\n", wantErr: `rule 1: unsupported sample_by "peer"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fc, err := ParseFilterConfig([]byte(tc.data))
+			var rules []*filterRule
+			if err == nil {
+				rules, _, err = fc.compile()
+			}
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("got error %v, wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if len(rules) != tc.wantRules {
+				t.Errorf("got %d rules, wanted %d", len(rules), tc.wantRules)
+			}
+		})
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	observer, err := peer.IDFromBytes(mustDecodeBase64(t, testObserverID))
+	if err != nil {
+		t.Fatalf("peer id: %v", err)
+	}
+
+	fromObserver := topicEvent(EventTypeJoin, "/fil/msgs/mainnet", "")
+	fromObserver.PeerID = []byte(observer)
+
+	testCases := []struct {
+		name       string
+		rules      string
+		ev         *TraceEvent
+		want       bool
+		wantReason string
+	}{
+		{name: "no rules", rules: "", ev: topicEvent(EventTypeJoin, "/fil/msgs/mainnet", ""), want: true},
+		{name: "default exclude", rules: "default: exclude\n", ev: topicEvent(EventTypeJoin, "/fil/msgs/mainnet", ""), wantReason: DropReasonFiltered},
+		{
+			name:       "excluded by type",
+			rules:      "rules:\n  - types: [join]\n    action: exclude\n",
+			ev:         topicEvent(EventTypeJoin, "/fil/msgs/mainnet", ""),
+			wantReason: DropReasonFiltered,
+		},
+		{
+			name:  "other type not excluded",
+			rules: "rules:\n  - types: [join]\n    action: exclude\n",
+			ev:    topicEvent(EventTypeLeave, "/fil/msgs/mainnet", ""),
+			want:  true,
+		},
+		{
+			name:  "first matching rule decides",
+			rules: "default: exclude\nrules:\n  - topics: [/fil/msgs/mainnet]\n  - action: exclude\n",
+			ev:    topicEvent(EventTypeJoin, "/fil/msgs/mainnet", ""),
+			want:  true,
+		},
+		{
+			name:  "topic prefix",
+			rules: "default: exclude\nrules:\n  - topic_prefixes: [/fil/msgs/]\n",
+			ev:    topicEvent(EventTypeJoin, "/fil/msgs/calibnet", ""),
+			want:  true,
+		},
+		{
+			name:       "topic regex not matched",
+			rules:      "default: exclude\nrules:\n  - topic_regex: calibnet$\n",
+			ev:         topicEvent(EventTypeJoin, "/fil/msgs/mainnet", ""),
+			wantReason: DropReasonFiltered,
+		},
+		{
+			name:  "all conditions must match",
+			rules: "rules:\n  - types: [join]\n    sources: [node1]\n    action: exclude\n",
+			ev:    topicEvent(EventTypeJoin, "/fil/msgs/mainnet", "node2"),
+			want:  true,
+		},
+		{
+			name:       "source",
+			rules:      "rules:\n  - sources: [node1]\n    action: exclude\n",
+			ev:         topicEvent(EventTypeJoin, "/fil/msgs/mainnet", "node1"),
+			wantReason: DropReasonFiltered,
+		},
+		{
+			name:       "peer",
+			rules:      fmt.Sprintf("rules:\n  - peers: [%s]\n    action: exclude\n", observer),
+			ev:         fromObserver,
+			wantReason: DropReasonFiltered,
+		},
+		{
+			name:  "peer that cannot be decoded does not match",
+			rules: fmt.Sprintf("rules:\n  - peers: [%s]\n    action: exclude\n", observer),
+			ev:    topicEvent(EventTypeJoin, "/fil/msgs/mainnet", ""),
+			want:  true,
+		},
+		{
+			name:       "sampled out",
+			rules:      "rules:\n  - sample: 0\n",
+			ev:         topicEvent(EventTypeJoin, "/fil/msgs/mainnet", ""),
+			wantReason: DropReasonSampled,
+		},
+		{
+			name:  "sampled in",
+			rules: "rules:\n  - sample: 1\n",
+			ev:    topicEvent(EventTypeJoin, "/fil/msgs/mainnet", ""),
+			want:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keep, reason := newTestEventFilter(t, tc.rules).Filter(tc.ev)
+			if keep != tc.want || reason != tc.wantReason {
+				t.Errorf("got %v %q, wanted %v %q", keep, reason, tc.want, tc.wantReason)
+			}
+		})
+	}
+}
+
+func TestEventFilterSampleByMessageID(t *testing.T) {
+	f := newTestEventFilter(t, "rules:\n  - sample: 0.5\n    sample_by: message_id\n")
+
+	// every event relating to a message is kept or dropped together, and about half the messages are kept
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		id := []byte(fmt.Sprintf("message-%d", i))
+		publish, deliver := EventTypePublishMessage, EventTypeDeliverMessage
+		pub := &TraceEvent{Type: &publish, PublishMessage: &PublishMessageEvent{MessageID: id}}
+		del := &TraceEvent{Type: &deliver, DeliverMessage: &DeliverMessageEvent{MessageID: id}}
+
+		keepPub, _ := f.Filter(pub)
+		keepDel, _ := f.Filter(del)
+		if keepPub != keepDel {
+			t.Fatalf("message %d: got publish kept %v and deliver kept %v", i, keepPub, keepDel)
+		}
+		if keepPub {
+			kept++
+		}
+	}
+	if kept < 400 || kept > 600 {
+		t.Errorf("got %d of 1000 messages kept, wanted about 500", kept)
+	}
+}
+
+func TestEventFilterNil(t *testing.T) {
+	var f *EventFilter
+	if keep, reason := f.Filter(topicEvent(EventTypeJoin, "/fil/msgs/mainnet", "")); !keep || reason != "" {
+		t.Errorf("got %v %q, wanted event kept", keep, reason)
+	}
+}
+
+func TestEventFilterReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "filter.yaml")
+	write := func(rules string) {
+		if err := os.WriteFile(file, []byte(rules), 0o600); err != nil {
+			t.Fatalf("write rules: %v", err)
+		}
+	}
+	ev := topicEvent(EventTypeJoin, "/fil/msgs/mainnet", "")
+
+	write("rules:\n  - types: [join]\n    action: exclude\n")
+	f, err := NewEventFilter(file)
+	if err != nil {
+		t.Fatalf("NewEventFilter: %v", err)
+	}
+	if keep, _ := f.Filter(ev); keep {
+		t.Fatalf("event kept by initial rules")
+	}
+
+	// invalid rules leave the previous rules in use
+	write("rules:\n  - types: [joined]\n")
+	if err := f.Reload(); err == nil {
+		t.Errorf("got no error reloading invalid rules")
+	}
+	if keep, _ := f.Filter(ev); keep {
+		t.Errorf("event kept after reloading invalid rules")
+	}
+
+	write("rules:\n  - types: [leave]\n    action: exclude\n")
+	if err := f.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if keep, _ := f.Filter(ev); !keep {
+		t.Errorf("event not kept after reloading rules")
+	}
+}
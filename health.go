@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/exp/slog"
+)
+
+// pingTimeout is the time allowed for the database to respond to a readiness check.
+const pingTimeout = 2 * time.Second
+
+const (
+	// maxStatusSources is the number of sources whose last event time is reported by the status
+	// endpoint. When more are seen the source seen least recently is forgotten.
+	maxStatusSources = 1000
+
+	// statusSourceAge is how long a source is reported by the status endpoint after its last event.
+	statusSourceAge = 24 * time.Hour
+)
+
+// ReadinessConfig sets the limits beyond which tracecatcher reports that it is not ready to receive traces.
+type ReadinessConfig struct {
+	// MaxQueue is the number of events that may be queued or waiting to be queued.
+	MaxQueue int
+
+	// FlushAge is how long a failed flush makes tracecatcher unready, and how long a flush may take
+	// before it is considered stuck.
+	FlushAge time.Duration
+
+	// DB checks that the database can be reached. When nil the database is not checked.
+	DB *DBPinger
+}
+
+// EventTypeStatus counts the events of one type handled since tracecatcher started.
+type EventTypeStatus struct {
+	Received int64 `json:"received"`
+	Stored   int64 `json:"stored"`
+	Dropped  int64 `json:"dropped"`
+}
+
+// BatcherStatus is a snapshot of the state of a Batcher.
+type BatcherStatus struct {
+	Queued              int                        `json:"queued"`
+	Pending             map[string]int             `json:"pending,omitempty"` // queued events of each type
+	Waiting             int                        `json:"waiting"`           // events waiting for a flush to finish before being queued
+	Flushing            bool                       `json:"flushing"`
+	FlushStarted        *time.Time                 `json:"flush_started,omitempty"`
+	LastFlush           *time.Time                 `json:"last_flush,omitempty"`
+	LastFlushDuration   string                     `json:"last_flush_duration,omitempty"`
+	LastFlushEvents     int                        `json:"last_flush_events"`
+	LastFlushError      string                     `json:"last_flush_error,omitempty"`
+	LastSuccessfulFlush *time.Time                 `json:"last_successful_flush,omitempty"`
+	SchemaErrors        map[string]SchemaError     `json:"schema_errors,omitempty"` // keyed by the pattern of table names
+	EventTypes          map[string]EventTypeStatus `json:"event_types"`
+	Sources             map[string]time.Time       `json:"sources"` // time the last event was received from each recently seen source
+}
+
+// SchemaError records a failure to create the tables of a namespace.
+type SchemaError struct {
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// batcherStats records the state of a Batcher for the status and readiness checks. It has its own
+// mutex so the state can be read while the Batcher is flushing.
+type batcherStats struct {
+	mu           sync.Mutex
+	queued       int
+	pending      map[string]int // queued events of each type
+	waiting      int
+	flushStarted time.Time // zero when not flushing
+	lastFlush    time.Time
+	lastDuration time.Duration
+	lastEvents   int
+	lastErr      error
+	lastSuccess  time.Time
+	schemaErrs   map[Namespace]SchemaError // cleared when the tables are created
+	types        map[string]*EventTypeStatus
+	sources      map[string]time.Time
+}
+
+func newBatcherStats() *batcherStats {
+	return &batcherStats{
+		pending:    make(map[string]int),
+		schemaErrs: make(map[Namespace]SchemaError),
+		types:      make(map[string]*EventTypeStatus),
+		sources:    make(map[string]time.Time),
+	}
+}
+
+func (s *batcherStats) eventType(key string) *EventTypeStatus {
+	// assumes mutex is held by caller
+	st, ok := s.types[key]
+	if !ok {
+		st = new(EventTypeStatus)
+		s.types[key] = st
+	}
+	return st
+}
+
+func (s *batcherStats) wait(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waiting += n
+}
+
+func (s *batcherStats) received(eventType string, source string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eventType(eventType).Received++
+	if _, ok := s.sources[source]; !ok && len(s.sources) >= maxStatusSources {
+		s.forgetSources(now)
+	}
+	s.sources[source] = now
+}
+
+// forgetSources makes room for a new source by removing those not seen within statusSourceAge or, if
+// there are none, the source seen least recently.
+func (s *batcherStats) forgetSources(now time.Time) {
+	// assumes mutex is held by caller
+	var oldest string
+	var oldestSeen time.Time
+	for src, seen := range s.sources {
+		if now.Sub(seen) > statusSourceAge {
+			delete(s.sources, src)
+			continue
+		}
+		if oldestSeen.IsZero() || seen.Before(oldestSeen) {
+			oldest, oldestSeen = src, seen
+		}
+	}
+	if len(s.sources) >= maxStatusSources {
+		delete(s.sources, oldest)
+	}
+}
+
+func (s *batcherStats) stored(eventType string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eventType(eventType).Stored += int64(n)
+}
+
+func (s *batcherStats) dropped(eventType string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eventType(eventType).Dropped += int64(n)
+}
+
+func (s *batcherStats) queue(eventType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued++
+	s.pending[eventType]++
+}
+
+func (s *batcherStats) schema(ns Namespace, err error, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.schemaErrs[ns] = SchemaError{Error: err.Error(), Time: now}
+	} else {
+		delete(s.schemaErrs, ns)
+	}
+}
+
+func (s *batcherStats) flushStart(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushStarted = now
+}
+
+func (s *batcherStats) flushEnd(now time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastFlush = now
+	s.lastDuration = now.Sub(s.flushStarted)
+	s.lastEvents = s.queued
+	s.lastErr = err
+	if err == nil {
+		s.lastSuccess = now
+	}
+	s.flushStarted = time.Time{}
+	s.queued = 0
+	s.pending = make(map[string]int)
+}
+
+// Status returns a snapshot of the state of the Batcher.
+func (b *Batcher) Status() BatcherStatus {
+	s := b.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := BatcherStatus{
+		Queued:     s.queued,
+		Pending:    make(map[string]int, len(s.pending)),
+		Waiting:    s.waiting,
+		Flushing:   !s.flushStarted.IsZero(),
+		EventTypes: make(map[string]EventTypeStatus, len(s.types)),
+		Sources:    make(map[string]time.Time, len(s.sources)),
+	}
+	if !s.flushStarted.IsZero() {
+		t := s.flushStarted
+		st.FlushStarted = &t
+	}
+	if !s.lastFlush.IsZero() {
+		t := s.lastFlush
+		st.LastFlush = &t
+		st.LastFlushDuration = s.lastDuration.String()
+		st.LastFlushEvents = s.lastEvents
+	}
+	if s.lastErr != nil {
+		st.LastFlushError = s.lastErr.Error()
+	}
+	if !s.lastSuccess.IsZero() {
+		t := s.lastSuccess
+		st.LastSuccessfulFlush = &t
+	}
+	if len(s.schemaErrs) > 0 {
+		st.SchemaErrors = make(map[string]SchemaError, len(s.schemaErrs))
+		for ns, se := range s.schemaErrs {
+			name := ns.Table("*")
+			if ns.Schema != "" {
+				name = ns.Schema + "." + name
+			}
+			st.SchemaErrors[name] = se
+		}
+	}
+	for key, n := range s.pending {
+		st.Pending[key] = n
+	}
+	for key, ts := range s.types {
+		st.EventTypes[key] = *ts
+	}
+	now := time.Now()
+	for src, t := range s.sources {
+		if now.Sub(t) <= statusSourceAge {
+			st.Sources[src] = t
+		}
+	}
+	return st
+}
+
+// DBPinger checks that the database can be reached using a connection of its own, so readiness checks
+// neither wait for nor interfere with a flush using the Batcher's connection. The connection is made
+// when first needed and made again after a ping fails.
+type DBPinger struct {
+	connect func(context.Context) (*pgx.Conn, error)
+
+	mu   sync.Mutex
+	conn *pgx.Conn // nil when not connected
+}
+
+// NewDBPinger creates a DBPinger that uses connect to connect to the database.
+func NewDBPinger(connect func(context.Context) (*pgx.Conn, error)) *DBPinger {
+	return &DBPinger{connect: connect}
+}
+
+// Ping checks that the database responds within pingTimeout.
+func (p *DBPinger) Ping(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	if p.conn == nil {
+		conn, err := p.connect(ctx)
+		if err != nil {
+			return fmt.Errorf("connect: %w", err)
+		}
+		p.conn = conn
+	}
+
+	if err := p.conn.Ping(ctx); err != nil {
+		p.conn.Close(context.Background())
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the DBPinger's connection.
+func (p *DBPinger) Close(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close(ctx)
+	p.conn = nil
+	return err
+}
+
+// readinessCheck is the result of one of the checks made by the readiness endpoint.
+type readinessCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Ready checks whether the Batcher is able to store events.
+func (b *Batcher) Ready(ctx context.Context, cfg ReadinessConfig) []readinessCheck {
+	now := time.Now()
+	st := b.Status()
+
+	db := readinessCheck{Name: "database", OK: true}
+	if cfg.DB == nil {
+		db.Detail = "not checked"
+	} else if err := cfg.DB.Ping(ctx); err != nil {
+		db.OK = false
+		db.Detail = err.Error()
+	}
+
+	// the tables of a namespace are only created again when events are sent to it so failures expire
+	schema := readinessCheck{Name: "schema", OK: true}
+	var failed []string
+	for name, se := range st.SchemaErrors {
+		if now.Sub(se.Time) <= cfg.FlushAge {
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		schema.OK = false
+		schema.Detail = fmt.Sprintf("failed to create tables for %v", failed)
+	}
+
+	queue := readinessCheck{Name: "queue", OK: true}
+	if depth := st.Queued + st.Waiting; cfg.MaxQueue > 0 && depth >= cfg.MaxQueue {
+		queue.OK = false
+		queue.Detail = fmt.Sprintf("%d events queued, limit is %d", depth, cfg.MaxQueue)
+	}
+
+	flush := readinessCheck{Name: "flush", OK: true}
+	switch {
+	case st.FlushStarted != nil && now.Sub(*st.FlushStarted) > cfg.FlushAge:
+		flush.OK = false
+		flush.Detail = fmt.Sprintf("flush started %s ago has not finished", now.Sub(*st.FlushStarted).Round(time.Second))
+	case st.LastFlushError != "" && now.Sub(*st.LastFlush) <= cfg.FlushAge:
+		flush.OK = false
+		flush.Detail = "last flush failed: " + st.LastFlushError
+	}
+
+	return []readinessCheck{db, schema, queue, flush}
+}
+
+// healthzHandler reports that the process is alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports whether the Batcher is ready to store events, responding with 503 if not.
+func readyzHandler(b *Batcher, cfg ReadinessConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := b.Ready(r.Context(), cfg)
+		ready := true
+		for _, c := range checks {
+			if !c.OK {
+				ready = false
+				slog.Debug("readiness check failed", "check", c.Name, "detail", c.Detail)
+			}
+		}
+
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, struct {
+			Ready  bool             `json:"ready"`
+			Checks []readinessCheck `json:"checks"`
+		}{ready, checks})
+	}
+}
+
+// statusHandler reports the state of the Batcher.
+func statusHandler(b *Batcher, started time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, struct {
+			Started time.Time     `json:"started"`
+			Uptime  string        `json:"uptime"`
+			Batcher BatcherStatus `json:"batcher"`
+		}{started, time.Since(started).Round(time.Second).String(), b.Status()})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		slog.Debug("failed to write response", "error", err)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestBatcherStatsSources(t *testing.T) {
+	start := time.Now()
+
+	testCases := []struct {
+		name      string
+		seen      func(s *batcherStats) // records sources before the new one
+		wantCount int
+		wantGone  []string
+		wantKept  []string
+	}{
+		{
+			name: "below limit",
+			seen: func(s *batcherStats) {
+				s.received("join", "a", start)
+			},
+			wantCount: 2,
+			wantKept:  []string{"a"},
+		},
+		{
+			name: "full forgets least recent",
+			seen: func(s *batcherStats) {
+				for i := 0; i < maxStatusSources; i++ {
+					s.received("join", fmt.Sprintf("s%d", i), start.Add(time.Duration(i)*time.Second))
+				}
+			},
+			wantCount: maxStatusSources,
+			wantGone:  []string{"s0"},
+			wantKept:  []string{"s1", fmt.Sprintf("s%d", maxStatusSources-1)},
+		},
+		{
+			name: "full forgets aged",
+			seen: func(s *batcherStats) {
+				for i := 0; i < maxStatusSources; i++ {
+					at := start
+					if i%2 == 0 {
+						at = start.Add(-2 * statusSourceAge)
+					}
+					s.received("join", fmt.Sprintf("s%d", i), at)
+				}
+			},
+			wantCount: maxStatusSources/2 + 1,
+			wantGone:  []string{"s0", "s2"},
+			wantKept:  []string{"s1", "s3"},
+		},
+		{
+			name: "seen again while full",
+			seen: func(s *batcherStats) {
+				for i := 0; i < maxStatusSources-1; i++ {
+					s.received("join", fmt.Sprintf("s%d", i), start)
+				}
+				s.received("join", "new", start.Add(-time.Second))
+			},
+			wantCount: maxStatusSources,
+			wantKept:  []string{"s0"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newBatcherStats()
+			tc.seen(s)
+			s.received("join", "new", start.Add(time.Hour))
+
+			if len(s.sources) != tc.wantCount {
+				t.Errorf("got %d sources, wanted %d", len(s.sources), tc.wantCount)
+			}
+			if _, ok := s.sources["new"]; !ok {
+				t.Errorf("new source not recorded")
+			}
+			for _, src := range tc.wantGone {
+				if _, ok := s.sources[src]; ok {
+					t.Errorf("source %s still recorded", src)
+				}
+			}
+			for _, src := range tc.wantKept {
+				if _, ok := s.sources[src]; !ok {
+					t.Errorf("source %s not recorded", src)
+				}
+			}
+		})
+	}
+}
+
+func TestReady(t *testing.T) {
+	unreachable := NewDBPinger(func(ctx context.Context) (*pgx.Conn, error) {
+		return nil, errors.New("connection refused")
+	})
+	cfg := ReadinessConfig{MaxQueue: 2, FlushAge: time.Minute}
+
+	testCases := []struct {
+		name      string
+		db        *DBPinger
+		prepare   func(b *Batcher)
+		wantReady map[string]bool
+	}{
+		{
+			name:      "database not checked",
+			wantReady: map[string]bool{"database": true, "schema": true, "queue": true, "flush": true},
+		},
+		{
+			name:      "database unreachable",
+			db:        unreachable,
+			wantReady: map[string]bool{"database": false, "schema": true, "queue": true, "flush": true},
+		},
+		{
+			name: "queue full",
+			prepare: func(b *Batcher) {
+				b.stats.queue("join")
+				b.stats.queue("join")
+			},
+			wantReady: map[string]bool{"database": true, "schema": true, "queue": false, "flush": true},
+		},
+		{
+			name: "recent flush failed",
+			prepare: func(b *Batcher) {
+				b.stats.flushStart(time.Now())
+				b.stats.flushEnd(time.Now(), errors.New("broken"))
+			},
+			wantReady: map[string]bool{"database": true, "schema": true, "queue": true, "flush": false},
+		},
+		{
+			name: "old flush failed",
+			prepare: func(b *Batcher) {
+				b.stats.flushStart(time.Now().Add(-2 * time.Minute))
+				b.stats.flushEnd(time.Now().Add(-2*time.Minute), errors.New("broken"))
+			},
+			wantReady: map[string]bool{"database": true, "schema": true, "queue": true, "flush": true},
+		},
+		{
+			name: "flush stuck",
+			prepare: func(b *Batcher) {
+				b.stats.flushStart(time.Now().Add(-2 * time.Minute))
+			},
+			wantReady: map[string]bool{"database": true, "schema": true, "queue": true, "flush": false},
+		},
+		{
+			name: "schema failed",
+			prepare: func(b *Batcher) {
+				b.stats.schema(Namespace{Prefix: "test_"}, errors.New("broken"), time.Now())
+			},
+			wantReady: map[string]bool{"database": true, "schema": false, "queue": true, "flush": true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBatcher(t)
+			if tc.prepare != nil {
+				tc.prepare(b)
+			}
+			cfg := cfg
+			cfg.DB = tc.db
+			for _, c := range b.Ready(context.Background(), cfg) {
+				want, ok := tc.wantReady[c.Name]
+				if !ok {
+					t.Errorf("unexpected check %q", c.Name)
+					continue
+				}
+				if c.OK != want {
+					t.Errorf("check %s: got ok %v, wanted %v (%s)", c.Name, c.OK, want, c.Detail)
+				}
+			}
+		})
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	unreachable := NewDBPinger(func(ctx context.Context) (*pgx.Conn, error) {
+		return nil, errors.New("connection refused")
+	})
+
+	testCases := []struct {
+		name       string
+		db         *DBPinger
+		wantStatus int
+	}{
+		{name: "ready", wantStatus: http.StatusOK},
+		{name: "not ready", db: unreachable, wantStatus: http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBatcher(t)
+			ts := httptest.NewServer(readyzHandler(b, ReadinessConfig{FlushAge: time.Minute, DB: tc.db}))
+			defer ts.Close()
+
+			resp, err := ts.Client().Get(ts.URL)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("got status %d, wanted %d", resp.StatusCode, tc.wantStatus)
+			}
+			var body struct {
+				Ready bool `json:"ready"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if body.Ready != (tc.wantStatus == http.StatusOK) {
+				t.Errorf("got ready %v with status %d", body.Ready, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestBatcherRunFlushesPeriodically(t *testing.T) {
+	// the insert fails before reaching the database, which is enough to show a flush was attempted
+	failBatchInsert(t, EventTypeJoin)
+
+	b, err := NewBatcher(nil, BatcherConfig{Size: 1000, FlushInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewBatcher: %v", err)
+	}
+	b.Add(context.Background(), Namespace{}, testEvent(EventTypeJoin, true))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- b.Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Status().LastFlush == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("no flush within 5s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run: %v", err)
+	}
+
+	st := b.Status()
+	if st.Queued != 0 {
+		t.Errorf("got %d queued, wanted 0", st.Queued)
+	}
+	if st.LastFlushEvents != 1 {
+		t.Errorf("got %d events in last flush, wanted 1", st.LastFlushEvents)
+	}
+}
+
+func TestDiagRunnerShutdown(t *testing.T) {
+	dr := &DiagRunner{
+		addr:     "127.0.0.1:0",
+		metrics:  http.NotFoundHandler(),
+		batcher:  newTestBatcher(t),
+		shutdown: NewShutdownDeadline(time.Second),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- dr.Run(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("got error %v, wanted nil after an orderly shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("diagnostics server did not shut down")
+	}
+}
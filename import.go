@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/exp/slog"
+)
+
+var importOptions struct {
+	format           string
+	source           string
+	index            string
+	stateFile        string
+	progressInterval time.Duration
+}
+
+var importCommand = &cli.Command{
+	Name:      "import",
+	Usage:     "Import traces from files written by the go-libp2p-pubsub PBTracer or JSONTracer",
+	ArgsUsage: "FILE...",
+	Flags: concatFlags(
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:        "format",
+				Usage:       "The format of the trace files, either 'pb' for length delimited protobuf or 'json' for newline delimited json. Files may be gzip compressed.",
+				Required:    true,
+				Destination: &importOptions.format,
+			},
+			&cli.StringFlag{
+				Name:        "source",
+				Usage:       "The source to record for each imported event",
+				Destination: &importOptions.source,
+			},
+			&cli.StringFlag{
+				Name:        "index",
+				Usage:       "The index to import events into, which determines the tables they are written to according to --index-mapping",
+				Value:       defaultIndex,
+				Destination: &importOptions.index,
+			},
+			&cli.StringFlag{
+				Name:        "state",
+				Usage:       "Record progress in `FILE` so an interrupted import can be resumed by running the same command again",
+				Destination: &importOptions.stateFile,
+			},
+			&cli.DurationFlag{
+				Name:        "progress-interval",
+				Usage:       "The interval on which progress is reported",
+				Value:       10 * time.Second,
+				Destination: &importOptions.progressInterval,
+			},
+		},
+		loggingFlags,
+		databaseFlags,
+		indexFlags,
+		pseudonymFlags,
+	),
+	Action: runImport,
+}
+
+// importState records how far each file has been imported.
+type importState struct {
+	Files map[string]*importFileState `json:"files"`
+}
+
+type importFileState struct {
+	Offset   int64 `json:"offset"`   // offset in the uncompressed file of the end of the last imported event
+	Events   int64 `json:"events"`   // number of events stored
+	Dropped  int64 `json:"dropped"`  // number of events read but not stored, such as duplicates and filtered events
+	Complete bool  `json:"complete"` // whether the whole file has been imported
+}
+
+func readImportState(name string) (*importState, error) {
+	st := &importState{Files: map[string]*importFileState{}}
+	if name == "" {
+		return st, nil
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return st, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("parse state file: %w", err)
+	}
+	if st.Files == nil {
+		st.Files = map[string]*importFileState{}
+	}
+	return st, nil
+}
+
+// write atomically replaces the state file.
+func (st *importState) write(name string) error {
+	if name == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func runImport(cc *cli.Context) error {
+	if err := setupLogging(os.Stdout); err != nil {
+		return err
+	}
+
+	if cc.NArg() == 0 {
+		return fmt.Errorf("no files specified")
+	}
+	if importOptions.format != TraceFormatPB && importOptions.format != TraceFormatJSON {
+		return fmt.Errorf("unsupported format %q, must be %q or %q", importOptions.format, TraceFormatPB, TraceFormatJSON)
+	}
+
+	indexes, err := NewIndexRouter(IndexMapping(options.indexMapping), options.defaultIndex, IndexLimits{})
+	if err != nil {
+		return fmt.Errorf("failed to configure index mapping: %w", err)
+	}
+	if eserr := validateIndexName(importOptions.index); eserr != nil {
+		return fmt.Errorf("invalid index: %s", eserr.Reason)
+	}
+
+	state, err := readImportState(importOptions.stateFile)
+	if err != nil {
+		return fmt.Errorf("failed to read state: %w", err)
+	}
+
+	filter, err := newEventFilterFromOptions()
+	if err != nil {
+		return err
+	}
+	pseudonyms, err := newPseudonymiserFromOptions(PseudonymiseStore)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(cc.Context, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	conn, err := connect(ctx, options.dbHost, options.dbPort, options.dbName, options.dbSSLMode, options.dbUser, options.dbPassword)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	// The importer flushes explicitly so it knows which events have been committed.
+	bat, err := NewBatcher(conn, BatcherConfig{
+		Size:        math.MaxInt,
+		Rejects:     NewRejectSampler(options.rejectedSample, options.rejectedRate),
+		Archive:     options.rawArchive,
+		DedupWindow: options.dedupWindow,
+		Filter:      filter,
+		Pseudonyms:  pseudonyms,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create batcher: %w", err)
+	}
+
+	imp := &importer{
+		batcher: bat,
+		indexes: indexes,
+		state:   state,
+	}
+
+	for _, name := range cc.Args().Slice() {
+		if err := imp.importFile(ctx, name); err != nil {
+			return fmt.Errorf("import %s: %w", name, err)
+		}
+		if ctx.Err() != nil {
+			fmt.Fprintln(os.Stderr, "import interrupted")
+			return nil
+		}
+	}
+
+	return nil
+}
+
+type importer struct {
+	batcher *Batcher
+	indexes *IndexRouter
+	state   *importState
+}
+
+func (imp *importer) importFile(ctx context.Context, name string) error {
+	key, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+
+	fs, ok := imp.state.Files[key]
+	if !ok {
+		fs = new(importFileState)
+		imp.state.Files[key] = fs
+	}
+	if fs.Complete {
+		fmt.Fprintf(os.Stderr, "%s: already imported %d events, %d dropped, skipping\n", name, fs.Events, fs.Dropped)
+		return nil
+	}
+
+	tr, err := OpenTraceFile(name, importOptions.format, fs.Offset)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	var size int64
+	if info, err := os.Stat(name); err == nil && !tr.Compressed() {
+		size = info.Size()
+	}
+
+	if fs.Offset > 0 {
+		fmt.Fprintf(os.Stderr, "%s: resuming from offset %d after %d events, %d dropped\n", name, fs.Offset, fs.Events, fs.Dropped)
+	}
+
+	// pending counts the events queued since the last checkpoint and skipped those read but not queued
+	pending, skipped := int64(0), int64(0)
+
+	// checkpoint commits the events read so far and records the offset reached. Queued events that
+	// are rejected when written are counted as dropped.
+	checkpoint := func() error {
+		before := imp.batcher.storedTotal()
+		if err := imp.batcher.Flush(ctx); err != nil {
+			return fmt.Errorf("write events: %w", err)
+		}
+		stored := int64(imp.batcher.storedTotal() - before)
+		fs.Offset = tr.Offset()
+		fs.Events += stored
+		fs.Dropped += skipped + pending - stored
+		pending, skipped = 0, 0
+		return imp.state.write(importOptions.stateFile)
+	}
+
+	start := time.Now()
+	startEvents, startDropped := fs.Events, fs.Dropped
+	progress := time.NewTicker(importOptions.progressInterval)
+	defer progress.Stop()
+
+	report := func() {
+		events := fs.Events + pending
+		dropped := fs.Dropped + skipped
+		rate := float64(events+dropped-startEvents-startDropped) / time.Since(start).Seconds()
+		if size > 0 {
+			fmt.Fprintf(os.Stderr, "%s: %d events, %d dropped, %.1f%%, %.0f events/s\n", name, events, dropped, 100*float64(tr.Offset())/float64(size), rate)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %d events, %d dropped, %d bytes, %.0f events/s\n", name, events, dropped, tr.Offset(), rate)
+		}
+	}
+
+	for {
+		if ctx.Err() != nil {
+			// use a fresh context so the final checkpoint is written after an interrupt
+			ctx = context.Background()
+			if err := checkpoint(); err != nil {
+				return err
+			}
+			report()
+			return nil
+		}
+
+		ev, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			// commit what was read before the error so the import can be resumed after fixing the file
+			if cerr := checkpoint(); cerr != nil {
+				slog.Error("failed to write checkpoint", cerr)
+			}
+			return err
+		}
+
+		ev.Source = importOptions.source
+		ns, eserr := imp.indexes.Route(importOptions.index)
+		if eserr != nil {
+			return fmt.Errorf("invalid index: %s", eserr.Reason)
+		}
+		if imp.batcher.Add(ctx, ns, ev) {
+			pending++
+		} else {
+			skipped++
+		}
+
+		if pending+skipped >= int64(options.batchSize) {
+			if err := checkpoint(); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-progress.C:
+			report()
+		default:
+		}
+	}
+
+	if err := checkpoint(); err != nil {
+		return err
+	}
+	fs.Complete = true
+	if err := imp.state.write(importOptions.stateFile); err != nil {
+		return err
+	}
+	report()
+	fmt.Fprintf(os.Stderr, "%s: imported %d events, %d dropped, in %s\n", name, fs.Events-startEvents, fs.Dropped-startDropped, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestImportFileCountsDroppedEvents(t *testing.T) {
+	join := `{"type":9,"peerID":"ACQIARIgdW9lSDAUXbBP5cEuIUugYQrYpZjnmK3OvgbjWRTnWkw=","timestamp":TS,"join":{"topic":"/fil/msgs/mainnet"}}`
+	stored1 := strings.Replace(join, "TS", "1680000000000000001", 1)
+	stored2 := strings.Replace(join, "TS", "1680000000000000002", 1)
+	noTimestamp := `{"type":9,"peerID":"ACQIARIgdW9lSDAUXbBP5cEuIUugYQrYpZjnmK3OvgbjWRTnWkw=","join":{"topic":"/fil/msgs/mainnet"}}`
+	noType := `{"peerID":"ACQIARIgdW9lSDAUXbBP5cEuIUugYQrYpZjnmK3OvgbjWRTnWkw="}`
+
+	testCases := []struct {
+		name        string
+		batchSize   int
+		lines       []string
+		wantEvents  int64
+		wantDropped int64
+	}{
+		{
+			name:       "all stored",
+			batchSize:  100,
+			lines:      []string{stored1, stored2},
+			wantEvents: 2,
+		},
+		{
+			// a duplicate and an event without a type are not queued, an event without a timestamp is
+			// rejected when it is written
+			name:        "some dropped",
+			batchSize:   100,
+			lines:       []string{stored1, stored1, noType, noTimestamp, stored2},
+			wantEvents:  2,
+			wantDropped: 3,
+		},
+		{
+			name:        "dropped across checkpoints",
+			batchSize:   2,
+			lines:       []string{stored1, stored1, noType, noTimestamp, stored2},
+			wantEvents:  2,
+			wantDropped: 3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			name := filepath.Join(dir, "events.ndjson")
+			if err := os.WriteFile(name, []byte(strings.Join(tc.lines, "\n")+"\n"), 0o644); err != nil {
+				t.Fatalf("write events: %v", err)
+			}
+
+			setImportOptions(t, filepath.Join(dir, "state.json"), tc.batchSize)
+
+			bat, err := NewBatcher(nil, BatcherConfig{Size: 1 << 30, DedupWindow: time.Minute})
+			if err != nil {
+				t.Fatalf("NewBatcher: %v", err)
+			}
+			bat.send = func(ctx context.Context, ns Namespace, batch *pgx.Batch) (int64, error) {
+				return int64(batch.Len()), nil
+			}
+			indexes, err := NewIndexRouter(IndexMappingNone, defaultIndex, IndexLimits{})
+			if err != nil {
+				t.Fatalf("NewIndexRouter: %v", err)
+			}
+			state, err := readImportState(importOptions.stateFile)
+			if err != nil {
+				t.Fatalf("readImportState: %v", err)
+			}
+
+			imp := &importer{batcher: bat, indexes: indexes, state: state}
+			if err := imp.importFile(context.Background(), name); err != nil {
+				t.Fatalf("importFile: %v", err)
+			}
+
+			// the counts are recorded in the state file
+			written, err := readImportState(importOptions.stateFile)
+			if err != nil {
+				t.Fatalf("readImportState: %v", err)
+			}
+			key, _ := filepath.Abs(name)
+			fs, ok := written.Files[key]
+			if !ok {
+				t.Fatalf("no state recorded for file")
+			}
+			if !fs.Complete {
+				t.Errorf("file not recorded as complete")
+			}
+			if fs.Events != tc.wantEvents {
+				t.Errorf("got %d events, wanted %d", fs.Events, tc.wantEvents)
+			}
+			if fs.Dropped != tc.wantDropped {
+				t.Errorf("got %d dropped, wanted %d", fs.Dropped, tc.wantDropped)
+			}
+		})
+	}
+}
+
+// setImportOptions sets the options used by the importer until the test ends.
+func setImportOptions(t *testing.T, stateFile string, batchSize int) {
+	t.Helper()
+	prevImport, prevBatchSize := importOptions, options.batchSize
+	t.Cleanup(func() {
+		importOptions = prevImport
+		options.batchSize = prevBatchSize
+	})
+	importOptions.format = TraceFormatJSON
+	importOptions.index = defaultIndex
+	importOptions.stateFile = stateFile
+	importOptions.progressInterval = time.Hour
+	options.batchSize = batchSize
+}
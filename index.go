@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// IndexMapping determines how the Elasticsearch index that a trace is sent to is recorded in the database.
+type IndexMapping string
+
+const (
+	// IndexMappingNone writes traces for every index to the same tables.
+	IndexMappingNone IndexMapping = "none"
+
+	// IndexMappingSchema writes traces for each index to tables in a postgresql schema named after the index.
+	IndexMappingSchema IndexMapping = "schema"
+
+	// IndexMappingPrefix writes traces for each index to tables whose names are prefixed by the index name.
+	IndexMappingPrefix IndexMapping = "prefix"
+
+	// IndexMappingSource writes traces for every index to the same tables, recording the index name
+	// in the index_name column of each event.
+	IndexMappingSource IndexMapping = "source"
+)
+
+// IndexLimits restricts the indexes that traces may be sent to. The default index is always allowed.
+type IndexLimits struct {
+	// Allowed lists the indexes that may be created or written to. When empty any index is allowed.
+	Allowed []string
+
+	// Max is the maximum number of indexes, including the default index. Zero means no limit.
+	Max int
+}
+
+// IndexRouter maps the Elasticsearch index that a trace is sent to onto the namespace it is stored in.
+type IndexRouter struct {
+	mapping      IndexMapping
+	defaultIndex string
+	allowed      map[string]bool // nil when any index is allowed
+	max          int
+
+	mu         sync.Mutex
+	known      map[string]Namespace // indexes that have been created or written to
+	namespaces map[Namespace]string // index that each schema or prefix is used by
+}
+
+// NewIndexRouter creates an IndexRouter. In the schema and prefix mappings, traces sent to the default
+// index are written to the default tables.
+func NewIndexRouter(mapping IndexMapping, defaultIndex string, limits IndexLimits) (*IndexRouter, error) {
+	switch mapping {
+	case IndexMappingNone, IndexMappingSchema, IndexMappingPrefix, IndexMappingSource:
+	default:
+		return nil, fmt.Errorf("unknown index mapping %q", mapping)
+	}
+
+	if eserr := validateIndexName(defaultIndex); eserr != nil {
+		return nil, fmt.Errorf("default index: %s", eserr.Reason)
+	}
+
+	ir := &IndexRouter{
+		mapping:      mapping,
+		defaultIndex: defaultIndex,
+		known:        make(map[string]Namespace),
+		namespaces:   make(map[Namespace]string),
+		max:          limits.Max,
+	}
+	if len(limits.Allowed) > 0 {
+		ir.allowed = map[string]bool{defaultIndex: true}
+		for _, index := range limits.Allowed {
+			if eserr := validateIndexName(index); eserr != nil {
+				return nil, fmt.Errorf("allowed index: %s", eserr.Reason)
+			}
+			ir.allowed[index] = true
+		}
+	}
+	if _, eserr := ir.Create(defaultIndex); eserr != nil {
+		return nil, fmt.Errorf("default index: %s", eserr.Reason)
+	}
+	return ir, nil
+}
+
+// Exists reports whether an index has been created or written to.
+func (ir *IndexRouter) Exists(index string) bool {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	_, ok := ir.known[index]
+	return ok
+}
+
+// Create records that an index has been created. It returns false if the index already existed, or an
+// error if the index may not be created.
+func (ir *IndexRouter) Create(index string) (bool, *esError) {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	if _, ok := ir.known[index]; ok {
+		return false, nil
+	}
+	if _, eserr := ir.add(index); eserr != nil {
+		return false, eserr
+	}
+	return true, nil
+}
+
+// Route returns the namespace that an event sent to an index should be stored in. It returns an error
+// if events may not be sent to the index.
+func (ir *IndexRouter) Route(index string) (Namespace, *esError) {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	if ns, ok := ir.known[index]; ok {
+		return ns, nil
+	}
+	return ir.add(index)
+}
+
+// add records an index, checking that it is allowed and that its tables are not shared with another
+// index.
+func (ir *IndexRouter) add(index string) (Namespace, *esError) {
+	// assumes mutex is held by caller
+	if ir.allowed != nil && !ir.allowed[index] {
+		return Namespace{}, newIndexNotAllowedError(index)
+	}
+	if ir.max > 0 && len(ir.known) >= ir.max {
+		return Namespace{}, newTooManyIndexesError(index, ir.max)
+	}
+
+	ns := ir.namespace(index)
+	if ns.Schema != "" || ns.Prefix != "" {
+		if other, ok := ir.namespaces[ns]; ok && other != index {
+			return Namespace{}, newInvalidIndexNameError(index, "its tables would be shared with index ["+other+"]")
+		}
+		if ns.Schema != "" && reservedSchema(ns.Schema) {
+			return Namespace{}, newInvalidIndexNameError(index, "the schema name is reserved by postgresql")
+		}
+		ir.namespaces[ns] = index
+	}
+	ir.known[index] = ns
+	return ns, nil
+}
+
+// namespace returns the namespace that the mapping assigns to an index.
+func (ir *IndexRouter) namespace(index string) Namespace {
+	if ir.mapping == IndexMappingSource {
+		return Namespace{Index: index}
+	}
+	if index == ir.defaultIndex {
+		return Namespace{}
+	}
+	switch ir.mapping {
+	case IndexMappingSchema:
+		return Namespace{Schema: schemaName(index)}
+	case IndexMappingPrefix:
+		return Namespace{Prefix: tablePrefix(index)}
+	}
+	return Namespace{}
+}
+
+// maxIdentifierLen is the maximum length in bytes of a postgresql identifier. Longer identifiers are
+// silently truncated, so names that differ only after this length refer to the same object.
+const maxIdentifierLen = 63
+
+// indexHashLen is the number of hex characters of the hash of an index name added to schema names and
+// table prefixes that could not be made from the index name unchanged.
+const indexHashLen = 8
+
+// maxTablePrefixLen is the maximum length of a table prefix such that every table and index created
+// for a namespace has a name that fits in a postgresql identifier.
+var maxTablePrefixLen = maxIdentifierLen - longestPrefixedIdentifier()
+
+var prefixedIdentifierPattern = regexp.MustCompile(`\w*\{\{\.Prefix\}\}\w*`)
+
+// longestPrefixedIdentifier returns the length of the longest identifier, excluding the prefix, in the
+// statements that create the tables of a namespace.
+func longestPrefixedIdentifier() int {
+	ddls := make([]string, 0, len(eventDefs)+len(tableDDL))
+	for _, def := range eventDefs {
+		ddls = append(ddls, def.DDL)
+	}
+	for _, ddl := range tableDDL {
+		ddls = append(ddls, ddl)
+	}
+
+	longest := 0
+	for _, ddl := range ddls {
+		for _, id := range prefixedIdentifierPattern.FindAllString(ddl, -1) {
+			if n := len(id) - len("{{.Prefix}}"); n > longest {
+				longest = n
+			}
+		}
+	}
+	return longest
+}
+
+// tablePrefix converts an index name into a prefix that may be used in unquoted table names. Index
+// names that contain characters not allowed in unquoted identifiers, or that are too long, are
+// replaced by a shortened form followed by a hash of the name so that different indexes are given
+// different prefixes.
+func tablePrefix(index string) string {
+	var b strings.Builder
+	if index[0] >= '0' && index[0] <= '9' {
+		// unquoted identifiers may not start with a digit
+		b.WriteRune('_')
+	}
+	for _, r := range index {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	name := b.String()
+	if name == index && len(name)+1 <= maxTablePrefixLen {
+		return name + "_"
+	}
+
+	if keep := maxTablePrefixLen - indexHashLen - 2; len(name) > keep {
+		name = name[:keep]
+	}
+	return name + "_" + indexHash(index) + "_"
+}
+
+// schemaName converts an index name into the name of a schema. Schema names are quoted so only index
+// names that are too long are changed, by shortening them and adding a hash of the name.
+func schemaName(index string) string {
+	if len(index) <= maxIdentifierLen {
+		return index
+	}
+	name := index[:maxIdentifierLen-indexHashLen-1]
+	for !utf8.ValidString(name) {
+		// do not split a multibyte character
+		name = name[:len(name)-1]
+	}
+	return name + "_" + indexHash(index)
+}
+
+func indexHash(index string) string {
+	h := sha256.Sum256([]byte(index))
+	return hex.EncodeToString(h[:])[:indexHashLen]
+}
+
+// reservedSchema reports whether a schema name may not be used for an index since it is reserved by
+// postgresql or holds the default tables.
+func reservedSchema(name string) bool {
+	return name == "public" || name == "information_schema" || strings.HasPrefix(name, "pg_")
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestTablePrefix(t *testing.T) {
+	testCases := []struct {
+		index string
+		want  string
+	}{
+		{index: "calibnet", want: "calibnet_"},
+		{index: "net_2", want: "net_2_"},
+		{index: "abcdefghijklmnopqrstu", want: "abcdefghijklmnopqrstu_"},
+		{index: "abcdefghijklmnopqrstuv", want: "abcdefghijkl_" + indexHash("abcdefghijklmnopqrstuv") + "_"},
+		{index: "my-index", want: "my_index_" + indexHash("my-index") + "_"},
+		{index: "my.index", want: "my_index_" + indexHash("my.index") + "_"},
+		{index: "2023", want: "_2023_" + indexHash("2023") + "_"},
+		{index: "netzwerk-ü", want: "netzwerk___" + indexHash("netzwerk-ü") + "_"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.index, func(t *testing.T) {
+			got := tablePrefix(tc.index)
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+			if len(got) > maxTablePrefixLen {
+				t.Errorf("prefix %q is longer than %d bytes", got, maxTablePrefixLen)
+			}
+		})
+	}
+}
+
+func TestTablePrefixIdentifierLength(t *testing.T) {
+	indexes := []string{
+		"calibnet",
+		"abcdefghijklmnopqrstu",
+		strings.Repeat("a", 255),
+		strings.Repeat("ü", 127),
+		"9-" + strings.Repeat("x", 200),
+	}
+
+	identifier := regexp.MustCompile(`\w*\{\{\.Prefix\}\}\w*`)
+	for _, index := range indexes {
+		prefix := tablePrefix(index)
+		for _, def := range eventDefs {
+			for _, id := range identifier.FindAllString(def.DDL, -1) {
+				name := strings.Replace(id, "{{.Prefix}}", prefix, 1)
+				if len(name) > maxIdentifierLen {
+					t.Errorf("identifier %q for index %q is longer than %d bytes", name, index, maxIdentifierLen)
+				}
+			}
+		}
+	}
+}
+
+func TestSchemaName(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	multibyte := strings.Repeat("ü", 40)
+
+	testCases := []struct {
+		name  string
+		index string
+		want  string
+	}{
+		{name: "short", index: "calibnet", want: "calibnet"},
+		{name: "punctuation", index: "my-index.1", want: "my-index.1"},
+		{name: "max", index: strings.Repeat("a", 63), want: strings.Repeat("a", 63)},
+		{name: "long", index: long, want: long[:54] + "_" + indexHash(long)},
+		{name: "multibyte", index: multibyte, want: multibyte[:54] + "_" + indexHash(multibyte)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := schemaName(tc.index)
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+			if len(got) > maxIdentifierLen {
+				t.Errorf("schema name is %d bytes, longer than %d", len(got), maxIdentifierLen)
+			}
+		})
+	}
+}
+
+func TestIndexRouterRoute(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	// differs from long only after the 54 bytes kept in the schema name, so only the hash distinguishes them
+	longer := strings.Repeat("a", 71)
+
+	testCases := []struct {
+		name    string
+		mapping IndexMapping
+		indexes []string
+		want    Namespace
+		wantErr string
+	}{
+		{
+			name:    "default index",
+			mapping: IndexMappingSchema,
+			indexes: []string{defaultIndex},
+			want:    Namespace{},
+		},
+		{
+			name:    "schema",
+			mapping: IndexMappingSchema,
+			indexes: []string{"calibnet"},
+			want:    Namespace{Schema: "calibnet"},
+		},
+		{
+			name:    "prefix",
+			mapping: IndexMappingPrefix,
+			indexes: []string{"calibnet"},
+			want:    Namespace{Prefix: "calibnet_"},
+		},
+		{
+			name:    "none",
+			mapping: IndexMappingNone,
+			indexes: []string{"calibnet", "mainnet"},
+			want:    Namespace{},
+		},
+		{
+			name:    "long schemas",
+			mapping: IndexMappingSchema,
+			indexes: []string{long, longer},
+			want:    Namespace{Schema: schemaName(longer)},
+		},
+		{
+			name:    "sanitised prefixes",
+			mapping: IndexMappingPrefix,
+			indexes: []string{"my-index", "my.index"},
+			want:    Namespace{Prefix: tablePrefix("my.index")},
+		},
+		{
+			name:    "prefix collides with hashed name",
+			mapping: IndexMappingPrefix,
+			indexes: []string{"my-index", "my_index_" + indexHash("my-index")},
+			wantErr: "Invalid index name [my_index_" + indexHash("my-index") + "], its tables would be shared with index [my-index]",
+		},
+		{
+			name:    "reserved schema",
+			mapping: IndexMappingSchema,
+			indexes: []string{"public"},
+			wantErr: "Invalid index name [public], the schema name is reserved by postgresql",
+		},
+		{
+			name:    "pg schema",
+			mapping: IndexMappingSchema,
+			indexes: []string{"pg_catalog"},
+			wantErr: "Invalid index name [pg_catalog], the schema name is reserved by postgresql",
+		},
+		{
+			name:    "source",
+			mapping: IndexMappingSource,
+			indexes: []string{"calibnet"},
+			want:    Namespace{Index: "calibnet"},
+		},
+		{
+			name:    "source default index",
+			mapping: IndexMappingSource,
+			indexes: []string{defaultIndex},
+			want:    Namespace{Index: defaultIndex},
+		},
+		{
+			name:    "reserved name as prefix",
+			mapping: IndexMappingPrefix,
+			indexes: []string{"public"},
+			want:    Namespace{Prefix: "public_"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ir, err := NewIndexRouter(tc.mapping, defaultIndex, IndexLimits{})
+			if err != nil {
+				t.Fatalf("NewIndexRouter: %v", err)
+			}
+
+			var ns Namespace
+			var eserr *esError
+			for _, index := range tc.indexes {
+				ns, eserr = ir.Route(index)
+				if eserr != nil {
+					break
+				}
+			}
+
+			if tc.wantErr != "" {
+				if eserr == nil {
+					t.Fatalf("got no error, wanted %q", tc.wantErr)
+				}
+				if eserr.Status != http.StatusBadRequest || eserr.Type != "invalid_index_name_exception" {
+					t.Errorf("got error %d %s, wanted 400 invalid_index_name_exception", eserr.Status, eserr.Type)
+				}
+				if eserr.Reason != tc.wantErr {
+					t.Errorf("got reason %q, wanted %q", eserr.Reason, tc.wantErr)
+				}
+				return
+			}
+			if eserr != nil {
+				t.Fatalf("got error: %v", eserr)
+			}
+			if ns != tc.want {
+				t.Errorf("got namespace %+v, wanted %+v", ns, tc.want)
+			}
+		})
+	}
+}
+
+func TestIndexRouterCreate(t *testing.T) {
+	ir, err := NewIndexRouter(IndexMappingPrefix, defaultIndex, IndexLimits{})
+	if err != nil {
+		t.Fatalf("NewIndexRouter: %v", err)
+	}
+
+	testCases := []struct {
+		index   string
+		created bool
+		wantErr bool
+	}{
+		{index: defaultIndex, created: false},
+		{index: "calibnet", created: true},
+		{index: "calibnet", created: false},
+		{index: "my-index", created: true},
+		{index: "my_index_" + indexHash("my-index"), wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		created, eserr := ir.Create(tc.index)
+		if (eserr != nil) != tc.wantErr {
+			t.Errorf("Create(%q): got error %v, wanted error: %v", tc.index, eserr, tc.wantErr)
+			continue
+		}
+		if created != tc.created {
+			t.Errorf("Create(%q): got %v, wanted %v", tc.index, created, tc.created)
+		}
+	}
+	if ir.Exists("my_index_" + indexHash("my-index")) {
+		t.Errorf("index that could not be created exists")
+	}
+}
+
+func TestIndexRouterLimits(t *testing.T) {
+	testCases := []struct {
+		name       string
+		limits     IndexLimits
+		indexes    []string
+		wantStatus int
+		wantType   string
+		wantReason string
+	}{
+		{
+			name:    "no limits",
+			indexes: []string{"a", "b", "c"},
+		},
+		{
+			name:    "allowed",
+			limits:  IndexLimits{Allowed: []string{"a", "b"}},
+			indexes: []string{"a", "b", defaultIndex},
+		},
+		{
+			name:       "not allowed",
+			limits:     IndexLimits{Allowed: []string{"a"}},
+			indexes:    []string{"a", "b"},
+			wantStatus: http.StatusNotFound,
+			wantType:   "index_not_found_exception",
+			wantReason: "no such index [b] and [action.auto_create_index] does not allow it",
+		},
+		{
+			name:    "within max",
+			limits:  IndexLimits{Max: 3},
+			indexes: []string{"a", "b", "a", defaultIndex},
+		},
+		{
+			name:       "beyond max",
+			limits:     IndexLimits{Max: 3},
+			indexes:    []string{"a", "b", "c"},
+			wantStatus: http.StatusBadRequest,
+			wantType:   "validation_exception",
+			wantReason: "Validation Failed: 1: this action would add an index but the cluster already has the maximum of [3] indexes;",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ir, err := NewIndexRouter(IndexMappingPrefix, defaultIndex, tc.limits)
+			if err != nil {
+				t.Fatalf("NewIndexRouter: %v", err)
+			}
+
+			var eserr *esError
+			for _, index := range tc.indexes {
+				if _, eserr = ir.Route(index); eserr != nil {
+					break
+				}
+			}
+
+			if tc.wantType == "" {
+				if eserr != nil {
+					t.Fatalf("got error: %v", eserr)
+				}
+				return
+			}
+			if eserr == nil {
+				t.Fatalf("got no error, wanted %s", tc.wantType)
+			}
+			if eserr.Status != tc.wantStatus || eserr.Type != tc.wantType || eserr.Reason != tc.wantReason {
+				t.Errorf("got error %d %s %q, wanted %d %s %q", eserr.Status, eserr.Type, eserr.Reason, tc.wantStatus, tc.wantType, tc.wantReason)
+			}
+		})
+	}
+}
+
+func TestValidateIndexName(t *testing.T) {
+	testCases := []struct {
+		index   string
+		wantErr string
+	}{
+		{index: "traces"},
+		{index: "calibnet-2023.01"},
+		{index: strings.Repeat("a", 255)},
+		{index: "", wantErr: "must not be empty"},
+		{index: ".", wantErr: "must not be '.' or '..'"},
+		{index: "..", wantErr: "must not be '.' or '..'"},
+		{index: "Traces", wantErr: "must be lowercase"},
+		{index: "_traces", wantErr: "must not start with '_', '-', or '+'"},
+		{index: "-traces", wantErr: "must not start with '_', '-', or '+'"},
+		{index: "+traces", wantErr: "must not start with '_', '-', or '+'"},
+		{index: "tra ces", wantErr: "must not contain the following characters"},
+		{index: "tra*ces", wantErr: "must not contain the following characters"},
+		{index: "tra:ces", wantErr: "must not contain the following characters"},
+		{index: strings.Repeat("a", 256), wantErr: "index name is too long"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.index, func(t *testing.T) {
+			eserr := validateIndexName(tc.index)
+			if tc.wantErr == "" {
+				if eserr != nil {
+					t.Errorf("got error %q", eserr.Reason)
+				}
+				return
+			}
+			if eserr == nil {
+				t.Fatalf("got no error, wanted %q", tc.wantErr)
+			}
+			if eserr.Status != http.StatusBadRequest || eserr.Type != "invalid_index_name_exception" {
+				t.Errorf("got error %d %s, wanted 400 invalid_index_name_exception", eserr.Status, eserr.Type)
+			}
+			if !strings.Contains(eserr.Reason, tc.wantErr) {
+				t.Errorf("got reason %q, wanted it to contain %q", eserr.Reason, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+)
+
+var loadgenOptions struct {
+	target           string
+	peers            int
+	topics           int
+	rate             float64
+	duration         time.Duration
+	concurrency      int
+	bulkSize         int
+	headers          cli.StringSlice
+	seed             int64
+	timeout          time.Duration
+	progressInterval time.Duration
+}
+
+var loadgenCommand = &cli.Command{
+	Name:  "loadgen",
+	Usage: "Send synthetic gossipsub traces to a tracecatcher or Elasticsearch endpoint for load testing",
+	Flags: concatFlags(
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:        "target",
+				Usage:       "The `URL` to send events to. Events are sent one per request unless the path ends in /_bulk, such as http://localhost:5151/traces/_bulk",
+				Required:    true,
+				Destination: &loadgenOptions.target,
+			},
+			&cli.IntFlag{
+				Name:        "peers",
+				Usage:       "The number of peers to simulate",
+				Value:       50,
+				Destination: &loadgenOptions.peers,
+			},
+			&cli.IntFlag{
+				Name:        "topics",
+				Usage:       "The number of topics to simulate",
+				Value:       4,
+				Destination: &loadgenOptions.topics,
+			},
+			&cli.Float64Flag{
+				Name:        "rate",
+				Usage:       "The target number of events per second to send",
+				Value:       1000,
+				Destination: &loadgenOptions.rate,
+			},
+			&cli.DurationFlag{
+				Name:        "duration",
+				Usage:       "How long to send events for",
+				Value:       time.Minute,
+				Destination: &loadgenOptions.duration,
+			},
+			&cli.IntFlag{
+				Name:        "concurrency",
+				Usage:       "The number of requests to send concurrently",
+				Value:       4,
+				Destination: &loadgenOptions.concurrency,
+			},
+			&cli.IntFlag{
+				Name:        "bulk-size",
+				Usage:       "The maximum number of events to send in each bulk request",
+				Value:       500,
+				Destination: &loadgenOptions.bulkSize,
+			},
+			&cli.StringSliceFlag{
+				Name:        "header",
+				Usage:       "An HTTP header to send with each request, in the form 'Name: value', such as an Authorization header. May be repeated.",
+				Destination: &loadgenOptions.headers,
+			},
+			&cli.Int64Flag{
+				Name:        "seed",
+				Usage:       "Seed for generating peers and events. The same seed simulates the same peers.",
+				Value:       1,
+				Destination: &loadgenOptions.seed,
+			},
+			&cli.DurationFlag{
+				Name:        "timeout",
+				Usage:       "The timeout for each request",
+				Value:       30 * time.Second,
+				Destination: &loadgenOptions.timeout,
+			},
+			&cli.DurationFlag{
+				Name:        "progress-interval",
+				Usage:       "The interval on which progress is reported",
+				Value:       10 * time.Second,
+				Destination: &loadgenOptions.progressInterval,
+			},
+		},
+		loggingFlags,
+	),
+	Action: runLoadgen,
+}
+
+// loadgenMix is the relative frequency of each event type in generated traces, roughly following the
+// traces of a busy gossipsub node where duplicate deliveries and rpcs dominate.
+var loadgenMix = []struct {
+	Type   EventType
+	Weight int
+}{
+	{EventTypePublishMessage, 4},
+	{EventTypeRejectMessage, 1},
+	{EventTypeDuplicateMessage, 30},
+	{EventTypeDeliverMessage, 20},
+	{EventTypeAddPeer, 2},
+	{EventTypeRemovePeer, 2},
+	{EventTypeRecvRPC, 15},
+	{EventTypeSendRPC, 15},
+	{EventTypeDropRPC, 1},
+	{EventTypeJoin, 1},
+	{EventTypeLeave, 1},
+	{EventTypeGraft, 3},
+	{EventTypePrune, 3},
+	{EventTypePeerScore, 2},
+}
+
+const loadgenProto = "/meshsub/1.1.0"
+
+func runLoadgen(cc *cli.Context) error {
+	if err := setupLogging(os.Stdout); err != nil {
+		return err
+	}
+
+	if loadgenOptions.peers < 2 {
+		return fmt.Errorf("at least 2 peers must be simulated")
+	}
+	if loadgenOptions.topics < 1 {
+		return fmt.Errorf("at least 1 topic must be simulated")
+	}
+	if loadgenOptions.rate <= 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+	if loadgenOptions.concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+	if loadgenOptions.bulkSize < 1 {
+		return fmt.Errorf("bulk size must be at least 1")
+	}
+
+	headers := make(http.Header)
+	for _, h := range loadgenOptions.headers.Value() {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			return fmt.Errorf("invalid header %q, must be in the form 'Name: value'", h)
+		}
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	sim, err := newLoadSimulation(loadgenOptions.seed, loadgenOptions.peers, loadgenOptions.topics)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(cc.Context, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	// the limiter is shared so the workers together send at the target rate
+	limiter := rate.NewLimiter(rate.Limit(loadgenOptions.rate), int(loadgenOptions.rate/10)+1)
+	end := time.Now().Add(loadgenOptions.duration)
+	client := &http.Client{Timeout: loadgenOptions.timeout}
+
+	workers := make([]*replayer, loadgenOptions.concurrency)
+	for i := range workers {
+		workers[i] = &replayer{
+			client:   client,
+			target:   loadgenOptions.target,
+			bulk:     strings.HasSuffix(strings.TrimRight(loadgenOptions.target, "/"), "/_bulk"),
+			bulkSize: loadgenOptions.bulkSize,
+			headers:  headers,
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "simulating %d peers on %d topics at %.0f events/s for %s\n", loadgenOptions.peers, loadgenOptions.topics, loadgenOptions.rate, loadgenOptions.duration)
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		progress := time.NewTicker(loadgenOptions.progressInterval)
+		defer progress.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-progress.C:
+				reportLoadgen(workers, start)
+			}
+		}
+	}()
+
+	g, gctx := errgroup.WithContext(ctx)
+	for i, rp := range workers {
+		gen := &loadGenerator{
+			ctx:     gctx,
+			sim:     sim,
+			rnd:     rand.New(rand.NewSource(loadgenOptions.seed + int64(i) + 1)),
+			limiter: limiter,
+			end:     end,
+		}
+		rp := rp
+		g.Go(func() error {
+			// progress is reported for all workers together
+			return rp.replay(gctx, gen, 0, 0)
+		})
+	}
+	err = g.Wait()
+	close(done)
+
+	reportLoadgen(workers, start)
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// reportLoadgen reports the combined throughput and error rates of the workers.
+func reportLoadgen(workers []*replayer, start time.Time) {
+	var sent, failed, requests, errs int64
+	for _, rp := range workers {
+		sent += rp.sent.Load()
+		failed += rp.failed.Load()
+		requests += rp.requests.Load()
+		errs += rp.errors.Load()
+	}
+	elapsed := time.Since(start)
+
+	var eventErrRate, requestErrRate float64
+	if sent+failed > 0 {
+		eventErrRate = 100 * float64(failed) / float64(sent+failed)
+	}
+	if requests > 0 {
+		requestErrRate = 100 * float64(errs) / float64(requests)
+	}
+	fmt.Fprintf(os.Stderr, "sent %d events, %.0f events/s, %d failed (%.2f%%), %d requests, %d request errors (%.2f%%) in %s\n",
+		sent, float64(sent)/elapsed.Seconds(), failed, eventErrRate, requests, errs, requestErrRate, elapsed.Round(time.Millisecond))
+}
+
+// loadSimulation is the set of peers and topics that traces are generated for.
+type loadSimulation struct {
+	peers  []peer.ID
+	topics []string
+
+	mu     sync.Mutex
+	seqno  uint64
+	recent map[string][][]byte // ids of recently published messages by topic
+}
+
+func newLoadSimulation(seed int64, peerCount int, topicCount int) (*loadSimulation, error) {
+	sim := &loadSimulation{
+		recent: make(map[string][][]byte),
+	}
+
+	rnd := rand.New(rand.NewSource(seed))
+	for i := 0; i < peerCount; i++ {
+		_, pub, err := crypto.GenerateEd25519Key(rnd)
+		if err != nil {
+			return nil, fmt.Errorf("generate key: %w", err)
+		}
+		id, err := peer.IDFromPublicKey(pub)
+		if err != nil {
+			return nil, fmt.Errorf("peer id: %w", err)
+		}
+		sim.peers = append(sim.peers, id)
+	}
+
+	for i := 0; i < topicCount; i++ {
+		sim.topics = append(sim.topics, fmt.Sprintf("/loadgen/topic/%d", i))
+	}
+
+	return sim, nil
+}
+
+// publish returns the id of a newly published message.
+func (sim *loadSimulation) publish(from peer.ID, topic string) []byte {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	sim.seqno++
+
+	// message ids are hashes of the sender and sequence number, hex encoded so they can be stored as text
+	var seqno [8]byte
+	binary.BigEndian.PutUint64(seqno[:], sim.seqno)
+	h := sha256.Sum256(append([]byte(from), seqno[:]...))
+	id := []byte(hex.EncodeToString(h[:]))
+
+	const keep = 100
+	ids := append(sim.recent[topic], id)
+	if len(ids) > keep {
+		ids = ids[len(ids)-keep:]
+	}
+	sim.recent[topic] = ids
+	return id
+}
+
+// message returns the id of a recently published message, publishing one if there are none.
+func (sim *loadSimulation) message(rnd *rand.Rand, topic string) []byte {
+	sim.mu.Lock()
+	ids := sim.recent[topic]
+	sim.mu.Unlock()
+	if len(ids) == 0 {
+		return sim.publish(sim.peers[rnd.Intn(len(sim.peers))], topic)
+	}
+	return ids[rnd.Intn(len(ids))]
+}
+
+// loadGenerator generates a stream of trace events at a rate set by its limiter until its end time,
+// after which Next returns io.EOF.
+type loadGenerator struct {
+	ctx     context.Context
+	sim     *loadSimulation
+	rnd     *rand.Rand
+	limiter *rate.Limiter
+	end     time.Time
+}
+
+func (g *loadGenerator) Next() (*TraceEvent, error) {
+	if time.Now().After(g.end) {
+		return nil, io.EOF
+	}
+	if err := g.limiter.Wait(g.ctx); err != nil {
+		return nil, err
+	}
+
+	total := 0
+	for _, m := range loadgenMix {
+		total += m.Weight
+	}
+	n := g.rnd.Intn(total)
+	et := loadgenMix[0].Type
+	for _, m := range loadgenMix {
+		if n < m.Weight {
+			et = m.Type
+			break
+		}
+		n -= m.Weight
+	}
+
+	return g.event(et), nil
+}
+
+// event generates an event of a type, traced by a random peer.
+func (g *loadGenerator) event(et EventType) *TraceEvent {
+	sim := g.sim
+	self := sim.peers[g.rnd.Intn(len(sim.peers))]
+	other := g.otherPeer(self)
+	topic := sim.topics[g.rnd.Intn(len(sim.topics))]
+	ts := time.Now().UnixNano()
+
+	ev := &TraceEvent{
+		Type:      &et,
+		PeerID:    []byte(self),
+		Timestamp: &ts,
+	}
+
+	switch et {
+	case EventTypePublishMessage:
+		ev.PublishMessage = &PublishMessageEvent{
+			MessageID: sim.publish(self, topic),
+			Topic:     &topic,
+		}
+	case EventTypeRejectMessage:
+		reason := rejectReasons[g.rnd.Intn(len(rejectReasons))]
+		ev.RejectMessage = &RejectMessageEvent{
+			MessageID:    sim.message(g.rnd, topic),
+			ReceivedFrom: []byte(other),
+			Reason:       &reason,
+			Topic:        &topic,
+		}
+	case EventTypeDuplicateMessage:
+		ev.DuplicateMessage = &DuplicateMessageEvent{
+			MessageID:    sim.message(g.rnd, topic),
+			ReceivedFrom: []byte(other),
+			Topic:        &topic,
+		}
+	case EventTypeDeliverMessage:
+		ev.DeliverMessage = &DeliverMessageEvent{
+			MessageID:    sim.message(g.rnd, topic),
+			Topic:        &topic,
+			ReceivedFrom: []byte(other),
+		}
+	case EventTypeAddPeer:
+		proto := loadgenProto
+		ev.AddPeer = &AddPeerEvent{
+			PeerID: []byte(other),
+			Proto:  &proto,
+		}
+	case EventTypeRemovePeer:
+		ev.RemovePeer = &RemovePeerEvent{
+			PeerID: []byte(other),
+		}
+	case EventTypeRecvRPC:
+		ev.RecvRPC = &RecvRPCEvent{
+			ReceivedFrom: []byte(other),
+			Meta:         g.rpcMeta(topic),
+		}
+	case EventTypeSendRPC:
+		ev.SendRPC = &SendRPCEvent{
+			SendTo: []byte(other),
+			Meta:   g.rpcMeta(topic),
+		}
+	case EventTypeDropRPC:
+		ev.DropRPC = &DropRPCEvent{
+			SendTo: []byte(other),
+			Meta:   g.rpcMeta(topic),
+		}
+	case EventTypeJoin:
+		ev.Join = &JoinEvent{Topic: &topic}
+	case EventTypeLeave:
+		ev.Leave = &LeaveEvent{Topic: &topic}
+	case EventTypeGraft:
+		ev.Graft = &GraftEvent{
+			PeerID: []byte(other),
+			Topic:  &topic,
+		}
+	case EventTypePrune:
+		ev.Prune = &PruneEvent{
+			PeerID: []byte(other),
+			Topic:  &topic,
+		}
+	case EventTypePeerScore:
+		ev.PeerScore = g.peerScore(other)
+	}
+	return ev
+}
+
+// otherPeer returns a random peer other than self.
+func (g *loadGenerator) otherPeer(self peer.ID) peer.ID {
+	for {
+		p := g.sim.peers[g.rnd.Intn(len(g.sim.peers))]
+		if p != self {
+			return p
+		}
+	}
+}
+
+// rpcMeta generates the metadata of an rpc carrying some messages and gossip for a topic.
+func (g *loadGenerator) rpcMeta(topic string) *RPCMetaEvent {
+	sim := g.sim
+	meta := new(RPCMetaEvent)
+
+	for i := g.rnd.Intn(3); i > 0; i-- {
+		t := topic
+		meta.Messages = append(meta.Messages, &MessageMetaEvent{
+			MessageID: sim.message(g.rnd, topic),
+			Topic:     &t,
+		})
+	}
+
+	if g.rnd.Intn(10) == 0 {
+		subscribe := g.rnd.Intn(2) == 0
+		t := topic
+		meta.Subscription = append(meta.Subscription, &SubMetaEvent{Subscribe: &subscribe, Topic: &t})
+	}
+
+	if g.rnd.Intn(4) == 0 {
+		t := topic
+		ctl := new(ControlMetaEvent)
+		ihave := &ControlIHaveMetaEvent{Topic: &t}
+		for i := g.rnd.Intn(5) + 1; i > 0; i-- {
+			ihave.MessageIDs = append(ihave.MessageIDs, sim.message(g.rnd, topic))
+		}
+		ctl.Ihave = append(ctl.Ihave, ihave)
+		if g.rnd.Intn(2) == 0 {
+			ctl.Iwant = append(ctl.Iwant, &ControlIWantMetaEvent{MessageIDs: [][]byte{sim.message(g.rnd, topic)}})
+		}
+		meta.Control = ctl
+	}
+
+	return meta
+}
+
+// peerScore generates a score for a peer with a breakdown for each topic it is subscribed to.
+func (g *loadGenerator) peerScore(p peer.ID) *PeerScoreEvent {
+	ps := &PeerScoreEvent{
+		PeerID:             []byte(p),
+		AppSpecificScore:   float64(g.rnd.Intn(10)),
+		IPColocationFactor: 0,
+		BehaviourPenalty:   0,
+	}
+	if g.rnd.Intn(20) == 0 {
+		ps.IPColocationFactor = float64(g.rnd.Intn(5))
+	}
+	if g.rnd.Intn(20) == 0 {
+		ps.BehaviourPenalty = float64(g.rnd.Intn(3))
+	}
+
+	for _, topic := range g.sim.topics {
+		if g.rnd.Intn(4) == 0 {
+			continue
+		}
+		ps.Topics = append(ps.Topics, TopicScoreEvent{
+			Topic:                    topic,
+			TimeInMesh:               time.Duration(g.rnd.Int63n(int64(2 * time.Hour))),
+			FirstMessageDeliveries:   g.rnd.Float64() * 100,
+			MeshMessageDeliveries:    g.rnd.Float64() * 50,
+			InvalidMessageDeliveries: float64(g.rnd.Intn(2)),
+		})
+	}
+
+	ps.Score = ps.AppSpecificScore - ps.IPColocationFactor - ps.BehaviourPenalty
+	for _, t := range ps.Topics {
+		ps.Score += t.FirstMessageDeliveries/10 + t.MeshMessageDeliveries/10 - t.InvalidMessageDeliveries*10
+	}
+	return ps
+}
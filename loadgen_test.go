@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func newTestLoadGenerator(t *testing.T, sim *loadSimulation, limiter *rate.Limiter, end time.Time) *loadGenerator {
+	t.Helper()
+	return &loadGenerator{
+		ctx:     context.Background(),
+		sim:     sim,
+		rnd:     rand.New(rand.NewSource(2)),
+		limiter: limiter,
+		end:     end,
+	}
+}
+
+func TestNewLoadSimulation(t *testing.T) {
+	sim, err := newLoadSimulation(1, 20, 3)
+	if err != nil {
+		t.Fatalf("newLoadSimulation: %v", err)
+	}
+	if len(sim.peers) != 20 {
+		t.Errorf("got %d peers, wanted 20", len(sim.peers))
+	}
+	if len(sim.topics) != 3 {
+		t.Errorf("got %d topics, wanted 3", len(sim.topics))
+	}
+
+	seen := make(map[string]bool)
+	for _, id := range sim.peers {
+		if err := id.Validate(); err != nil {
+			t.Errorf("invalid peer id %s: %v", id, err)
+		}
+		if seen[string(id)] {
+			t.Errorf("duplicate peer id %s", id)
+		}
+		seen[string(id)] = true
+	}
+
+	// the same seed simulates the same peers
+	same, err := newLoadSimulation(1, 20, 3)
+	if err != nil {
+		t.Fatalf("newLoadSimulation: %v", err)
+	}
+	other, err := newLoadSimulation(2, 20, 3)
+	if err != nil {
+		t.Fatalf("newLoadSimulation: %v", err)
+	}
+	for i := range sim.peers {
+		if same.peers[i] != sim.peers[i] {
+			t.Errorf("peer %d differs for the same seed", i)
+		}
+		if other.peers[i] == sim.peers[i] {
+			t.Errorf("peer %d is the same for a different seed", i)
+		}
+	}
+}
+
+func TestLoadGeneratorEvents(t *testing.T) {
+	sim, err := newLoadSimulation(1, 20, 3)
+	if err != nil {
+		t.Fatalf("newLoadSimulation: %v", err)
+	}
+	g := newTestLoadGenerator(t, sim, rate.NewLimiter(rate.Inf, 0), time.Now().Add(time.Hour))
+
+	const n = 5000
+	byType := make(map[EventType][]*TraceEvent)
+	for i := 0; i < n; i++ {
+		ev, err := g.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		byType[*ev.Type] = append(byType[*ev.Type], ev)
+
+		// every event survives encoding as it is sent
+		data, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatalf("marshal event: %v", err)
+		}
+		mustParseEvent(t, string(data))
+	}
+
+	// every type in the mix is generated in roughly its proportion
+	total := 0
+	for _, m := range loadgenMix {
+		total += m.Weight
+	}
+	for _, m := range loadgenMix {
+		want := n * m.Weight / total
+		if got := len(byType[m.Type]); got < want/2 || got > want*2 {
+			t.Errorf("%s: got %d events, wanted about %d", m.Type.Key(), got, want)
+		}
+	}
+
+	// the generated events can be stored
+	for et, evs := range byType {
+		if eventDefs[et].BatchInsert == nil {
+			// rpc events are not stored
+			continue
+		}
+		var rejected []string
+		reject := func(ev *TraceEvent, reason string, detail string) {
+			rejected = append(rejected, reason+": "+detail)
+		}
+		batch, err := eventDefs[et].BatchInsert(context.Background(), Namespace{}, evs, reject)
+		if err != nil {
+			t.Errorf("%s: BatchInsert: %v", et.Key(), err)
+			continue
+		}
+		if len(rejected) > 0 {
+			t.Errorf("%s: got %d events rejected, first %s", et.Key(), len(rejected), rejected[0])
+		}
+		if batch == nil || batch.Len() == 0 {
+			t.Errorf("%s: got no statements in insert batch", et.Key())
+		}
+	}
+
+	for _, ev := range byType[EventTypeRejectMessage] {
+		if reason := derefString(ev.RejectMessage.Reason, ""); !rejectReasonTags[reason] {
+			t.Errorf("got reject reason %q, wanted one given by go-libp2p-pubsub", reason)
+		}
+	}
+	for _, ev := range byType[EventTypeAddPeer] {
+		if string(ev.AddPeer.PeerID) == string(ev.PeerID) {
+			t.Errorf("peer added itself")
+		}
+	}
+}
+
+func TestLoadGeneratorRate(t *testing.T) {
+	sim, err := newLoadSimulation(1, 2, 1)
+	if err != nil {
+		t.Fatalf("newLoadSimulation: %v", err)
+	}
+
+	// the first event is allowed immediately and each following one after 10ms
+	g := newTestLoadGenerator(t, sim, rate.NewLimiter(100, 1), time.Now().Add(time.Hour))
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		if _, err := g.Next(); err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("generated 11 events in %v, wanted at least 100ms", elapsed)
+	}
+
+	// no events are generated after the end time
+	g = newTestLoadGenerator(t, sim, rate.NewLimiter(rate.Inf, 0), time.Now().Add(-time.Second))
+	if _, err := g.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("got error %v after end time, wanted io.EOF", err)
+	}
+}
+
+func TestLoadgenAccepted(t *testing.T) {
+	ts, bat := newTestServer(t, IndexLimits{})
+	sim, err := newLoadSimulation(1, 10, 2)
+	if err != nil {
+		t.Fatalf("newLoadSimulation: %v", err)
+	}
+
+	rp := &replayer{
+		client:   ts.Client(),
+		target:   ts.URL + "/traces/_bulk",
+		bulk:     true,
+		bulkSize: 100,
+	}
+	g := newTestLoadGenerator(t, sim, rate.NewLimiter(rate.Inf, 0), time.Now().Add(time.Hour))
+	events := &limitedEventSource{src: g, n: 500}
+	if err := rp.replay(context.Background(), events, 0, 0); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+
+	if got := rp.sent.Load(); got != 500 {
+		t.Errorf("got %d events sent, wanted 500", got)
+	}
+	if got := rp.failed.Load(); got != 0 {
+		t.Errorf("got %d events failed, wanted 0", got)
+	}
+	bat.mu.Lock()
+	defer bat.mu.Unlock()
+	if bat.count != 500 {
+		t.Errorf("got %d events queued, wanted 500", bat.count)
+	}
+}
+
+// limitedEventSource supplies the first n events from another source.
+type limitedEventSource struct {
+	src eventSource
+	n   int
+}
+
+func (s *limitedEventSource) Next() (*TraceEvent, error) {
+	if s.n == 0 {
+		return nil, io.EOF
+	}
+	s.n--
+	return s.src.Next()
+}
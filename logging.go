@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/time/rate"
+)
+
+// Formats for log output.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Components whose log level may be set separately from the level of the default logger.
+const (
+	LogComponentServer  = "server"
+	LogComponentBatcher = "batcher"
+	LogComponentDB      = "db"
+)
+
+// logLevel is the level of the default logger, which may be changed while running.
+var logLevel = new(slog.LevelVar)
+
+// componentLevels are the levels of the component loggers, which may be changed while running.
+var componentLevels = map[string]*componentLevel{
+	LogComponentServer:  new(componentLevel),
+	LogComponentBatcher: new(componentLevel),
+	LogComponentDB:      new(componentLevel),
+}
+
+// Loggers for each component. They log at the level of the default logger unless their own level is set.
+var (
+	serverLog  = slog.Default()
+	batcherLog = slog.Default()
+	dbLog      = slog.Default()
+)
+
+// eventLogLimit limits the messages logged for individual events, which would otherwise flood the log
+// when a large batch is rejected.
+var eventLogLimit = newLogLimiter(10)
+
+// setupLogging configures the default logger and the component loggers to write to w, or to the file
+// given by --log-file.
+func setupLogging(w io.Writer) error {
+	if options.logFile != "" {
+		f, err := openRotatingFile(options.logFile, options.logFileMaxSize*1024*1024, options.logFileMaxBackups)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		w = f
+	}
+
+	// the handler passes every record to the loggers, which filter by their own level
+	var h slog.Handler
+	hopts := slog.HandlerOptions{Level: slog.LevelDebug}
+	switch options.logFormat {
+	case LogFormatText, "":
+		h = hopts.NewTextHandler(w)
+	case LogFormatJSON:
+		h = hopts.NewJSONHandler(w)
+	default:
+		return fmt.Errorf("unsupported log format %q, must be %q or %q", options.logFormat, LogFormatText, LogFormatJSON)
+	}
+
+	slog.SetDefault(slog.New(&levelHandler{level: logLevel, h: h}))
+	serverLog = newComponentLogger(h, LogComponentServer)
+	batcherLog = newComponentLogger(h, LogComponentBatcher)
+	dbLog = newComponentLogger(h, LogComponentDB)
+	eventLogLimit = newLogLimiter(options.logEventRate)
+
+	level, err := logLevelFromOptions(options.logLevel)
+	if err != nil {
+		level = slog.LevelWarn
+		slog.Warn("ignoring invalid log level", "error", err)
+	}
+	logLevel.Set(level)
+
+	for component, level := range map[string]string{
+		LogComponentServer:  options.logLevelServer,
+		LogComponentBatcher: options.logLevelBatcher,
+		LogComponentDB:      options.logLevelDB,
+	} {
+		if err := setComponentLevel(component, level); err != nil {
+			slog.Warn("ignoring invalid log level", "component", component, "error", err)
+		}
+	}
+	return nil
+}
+
+// logLevelFromOptions returns the log level named by level, or the level selected by the verbose
+// flags if level is empty.
+func logLevelFromOptions(level string) (slog.Level, error) {
+	switch level {
+	case "":
+		if options.veryverbose {
+			return slog.LevelDebug, nil
+		}
+		if options.verbose {
+			return slog.LevelInfo, nil
+		}
+		return slog.LevelWarn, nil
+	default:
+		return parseLogLevel(level)
+	}
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	switch level {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unsupported log level %q, must be 'debug', 'info', 'warn' or 'error'", level)
+	}
+}
+
+// setComponentLevel sets the log level of a component. An empty level makes the component log at
+// the level of the default logger.
+func setComponentLevel(component string, level string) error {
+	cl, ok := componentLevels[component]
+	if !ok {
+		return fmt.Errorf("unknown log component %q", component)
+	}
+	if level == "" {
+		cl.set.Store(false)
+		return nil
+	}
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	cl.level.Set(lvl)
+	cl.set.Store(true)
+	return nil
+}
+
+// componentLevel is the log level of a component, which follows the level of the default logger
+// until it is set.
+type componentLevel struct {
+	set   atomic.Bool
+	level slog.LevelVar
+}
+
+func (c *componentLevel) Level() slog.Level {
+	if c.set.Load() {
+		return c.level.Level()
+	}
+	return logLevel.Level()
+}
+
+func newComponentLogger(h slog.Handler, component string) *slog.Logger {
+	return slog.New(&levelHandler{
+		level: componentLevels[component],
+		h:     h.WithAttrs([]slog.Attr{slog.String("component", component)}),
+	})
+}
+
+// levelHandler discards records below a level that may change while running.
+type levelHandler struct {
+	level slog.Leveler
+	h     slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *levelHandler) Handle(r slog.Record) error {
+	return h.h.Handle(r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, h: h.h.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, h: h.h.WithGroup(name)}
+}
+
+// logLimiter limits how often a frequent message is logged. The number of messages that were not
+// logged is added to the next one that is.
+type logLimiter struct {
+	limiter *rate.Limiter // nil when not limited
+	skipped atomic.Int64
+}
+
+// newLogLimiter creates a logLimiter that allows perSecond messages each second, with bursts of the
+// same size. Zero or less does not limit messages.
+func newLogLimiter(perSecond float64) *logLimiter {
+	l := new(logLimiter)
+	if perSecond > 0 {
+		burst := int(perSecond)
+		if burst < 1 {
+			burst = 1
+		}
+		l.limiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+	}
+	return l
+}
+
+// Log logs a message at level if the logger is enabled for it and the limit has not been reached.
+func (l *logLimiter) Log(logger *slog.Logger, level slog.Level, msg string, args ...any) {
+	if !logger.Enabled(level) {
+		return
+	}
+	if l.limiter != nil && !l.limiter.Allow() {
+		l.skipped.Add(1)
+		return
+	}
+	if n := l.skipped.Swap(0); n > 0 {
+		args = append(args, "suppressed", n)
+	}
+	logger.Log(level, msg, args...)
+}
+
+// rotatingFile is a log file that is renamed once it reaches a maximum size, keeping a number of
+// previous files named with the suffixes .1, .2 and so on, .1 being the most recent.
+type rotatingFile struct {
+	path       string
+	maxSize    int64 // zero for no limit
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	// assumes mutex is held by caller
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, fmt.Errorf("rotate log file: %w", err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	// assumes mutex is held by caller
+	rf.f.Close()
+	// if the files cannot be renamed logging continues to the current file
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		os.Rename(rf.backup(i), rf.backup(i+1))
+	}
+	if rf.maxBackups > 0 {
+		os.Rename(rf.path, rf.backup(1))
+	} else {
+		os.Remove(rf.path)
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) backup(i int) string {
+	return rf.path + "." + strconv.Itoa(i)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/time/rate"
+)
+
+func TestRotatingFile(t *testing.T) {
+	testCases := []struct {
+		name       string
+		maxBackups int
+		writes     int
+		want       []string // contents of the file and each backup, most recent first
+	}{
+		{name: "not full", maxBackups: 2, writes: 2, want: []string{"line 0\nline 1\n"}},
+		{name: "rotated", maxBackups: 2, writes: 3, want: []string{"line 2\n", "line 0\nline 1\n"}},
+		{name: "oldest discarded", maxBackups: 2, writes: 7, want: []string{"line 6\n", "line 4\nline 5\n", "line 2\nline 3\n"}},
+		{name: "no backups", writes: 5, want: []string{"line 4\n"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tracecatcher.log")
+			// each line is 7 bytes so two fit in a file
+			rf, err := openRotatingFile(path, 14, tc.maxBackups)
+			if err != nil {
+				t.Fatalf("openRotatingFile: %v", err)
+			}
+			defer rf.f.Close()
+
+			for i := 0; i < tc.writes; i++ {
+				line := "line " + string(rune('0'+i)) + "\n"
+				if _, err := rf.Write([]byte(line)); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+			}
+
+			names := []string{path}
+			for i := 1; i <= tc.maxBackups+1; i++ {
+				names = append(names, rf.backup(i))
+			}
+			for i, name := range names {
+				data, err := os.ReadFile(name)
+				if i >= len(tc.want) {
+					if err == nil {
+						t.Errorf("got unexpected file %s", name)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("read %s: %v", name, err)
+				}
+				if string(data) != tc.want[i] {
+					t.Errorf("%s: got %q, wanted %q", name, data, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tracecatcher.log")
+	if err := os.WriteFile(path, []byte("line 0\nline 1\n"), 0o644); err != nil {
+		t.Fatalf("write log file: %v", err)
+	}
+
+	// the size of an existing file counts towards the limit
+	rf, err := openRotatingFile(path, 14, 1)
+	if err != nil {
+		t.Fatalf("openRotatingFile: %v", err)
+	}
+	defer rf.f.Close()
+	if _, err := rf.Write([]byte("line 2\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if data := readFile(t, rf.backup(1)); data != "line 0\nline 1\n" {
+		t.Errorf("got backup %q, wanted the existing lines", data)
+	}
+	if data := readFile(t, path); data != "line 2\n" {
+		t.Errorf("got log file %q, wanted the new line", data)
+	}
+}
+
+// setTestLogLevels restores the log levels changed by a test.
+func setTestLogLevels(t *testing.T) {
+	t.Helper()
+	level := logLevel.Level()
+	t.Cleanup(func() {
+		logLevel.Set(level)
+		for component := range componentLevels {
+			setComponentLevel(component, "")
+		}
+	})
+}
+
+func TestComponentLevel(t *testing.T) {
+	setTestLogLevels(t)
+	var buf bytes.Buffer
+	h := slog.HandlerOptions{Level: slog.LevelDebug}.NewTextHandler(&buf)
+	logger := newComponentLogger(h, LogComponentServer)
+
+	// the component follows the default level until its own is set
+	logLevel.Set(slog.LevelWarn)
+	logger.Info("hidden")
+	if err := setComponentLevel(LogComponentServer, "debug"); err != nil {
+		t.Fatalf("setComponentLevel: %v", err)
+	}
+	logger.Debug("shown")
+
+	// the default level is followed again once the component level is cleared
+	if err := setComponentLevel(LogComponentServer, ""); err != nil {
+		t.Fatalf("setComponentLevel: %v", err)
+	}
+	logger.Info("hidden again")
+	logLevel.Set(slog.LevelInfo)
+	logger.Info("shown again")
+
+	out := buf.String()
+	if strings.Contains(out, "msg=hidden") {
+		t.Errorf("got records below the level in %q", out)
+	}
+	if !strings.Contains(out, "msg=shown ") || !strings.Contains(out, `msg="shown again"`) {
+		t.Errorf("records missing from %q", out)
+	}
+	if !strings.Contains(out, "component=server") {
+		t.Errorf("component missing from %q", out)
+	}
+
+	if err := setComponentLevel("unknown", "debug"); err == nil {
+		t.Errorf("got no error for unknown component")
+	}
+	if err := setComponentLevel(LogComponentDB, "verbose"); err == nil {
+		t.Errorf("got no error for unknown level")
+	}
+}
+
+func TestLogLevelFromOptions(t *testing.T) {
+	verbose, veryverbose := options.verbose, options.veryverbose
+	defer func() { options.verbose, options.veryverbose = verbose, veryverbose }()
+
+	testCases := []struct {
+		name        string
+		level       string
+		verbose     bool
+		veryverbose bool
+		want        slog.Level
+		wantErr     bool
+	}{
+		{name: "default", want: slog.LevelWarn},
+		{name: "verbose", verbose: true, want: slog.LevelInfo},
+		{name: "veryverbose", veryverbose: true, want: slog.LevelDebug},
+		{name: "level overrides verbose", level: "error", veryverbose: true, want: slog.LevelError},
+		{name: "invalid", level: "trace", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			options.verbose, options.veryverbose = tc.verbose, tc.veryverbose
+			got, err := logLevelFromOptions(tc.level)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got level %v, wanted error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("logLevelFromOptions: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("got level %v, wanted %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLogLimiter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.HandlerOptions{Level: slog.LevelDebug}.NewTextHandler(&buf))
+
+	l := newLogLimiter(2)
+	for i := 0; i < 5; i++ {
+		l.Log(logger, slog.LevelInfo, "rejected")
+	}
+	if got := strings.Count(buf.String(), "msg=rejected"); got != 2 {
+		t.Errorf("got %d messages logged, wanted 2", got)
+	}
+	if got := l.skipped.Load(); got != 3 {
+		t.Errorf("got %d messages skipped, wanted 3", got)
+	}
+
+	// the count of skipped messages is added to the next one logged
+	l.limiter.SetLimit(rate.Inf)
+	buf.Reset()
+	l.Log(logger, slog.LevelInfo, "rejected")
+	if !strings.Contains(buf.String(), "suppressed=3") {
+		t.Errorf("got %q, wanted suppressed count", buf.String())
+	}
+
+	// messages the logger would discard are not counted
+	quiet := slog.New(slog.HandlerOptions{Level: slog.LevelWarn}.NewTextHandler(&buf))
+	l = newLogLimiter(1)
+	for i := 0; i < 3; i++ {
+		l.Log(quiet, slog.LevelInfo, "rejected")
+	}
+	if l.skipped.Load() != 0 {
+		t.Errorf("got skipped count for disabled level")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/exp/slog"
 	"golang.org/x/sync/errgroup"
@@ -28,7 +30,24 @@ var options struct {
 	addr                 string
 	verbose              bool
 	veryverbose          bool
+	logLevel             string
+	logLevelServer       string
+	logLevelBatcher      string
+	logLevelDB           string
+	logFormat            string
+	logFile              string
+	logFileMaxSize       int64
+	logFileMaxBackups    int
+	logEventRate         float64
 	diagnosticsAddr      string
+	diagnosticsDebug     bool
+	networkMetrics       bool
+	readyMaxQueue        int
+	readyFlushAge        time.Duration
+	flushInterval        time.Duration
+	retention            time.Duration
+	shutdownTimeout      time.Duration
+	shutdownSpoolDir     string
 	dbHost               string
 	dbPort               int
 	dbName               string
@@ -36,103 +55,464 @@ var options struct {
 	dbPassword           string
 	dbSSLMode            string
 	batchSize            int
+	rejectedSample       float64
+	rejectedRate         float64
+	rawArchive           bool
+	dedupWindow          time.Duration
+	filterRules          string
+	pseudonymise         string
+	pseudonymKeyFile     string
+	configFile           string
 	metricReportInterval int
+	otlpMetricsEndpoint  string
+	traceExporter        string
+	traceFile            string
+	otlpTracesEndpoint   string
+	traceSampleRatio     float64
+	sourceHeader         string
+	authTokens           cli.StringSlice
+	authTokensFile       string
+	authClientCert       bool
+	authSourceAuth       bool
+	tlsCert              string
+	tlsKey               string
+	tlsClientCA          string
+	maxDecompressedSize  int64
+	maxBodySize          int64
+	rateLimitEvents      float64
+	rateLimitBytes       float64
+	indexMapping         string
+	defaultIndex         string
+	allowedIndexes       cli.StringSlice
+	metricSources        cli.StringSlice
+	metricTopics         cli.StringSlice
+	maxIndexes           int
 }
 
 var envPrefix = "TRACECATCHER_"
 
+// loggingFlags are the flags that configure logging, used by every command.
+var loggingFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:        "verbose",
+		Aliases:     []string{"v"},
+		Usage:       "Set logging level more verbose to include info level logs",
+		Value:       false,
+		EnvVars:     []string{envPrefix + "VERBOSE"},
+		Destination: &options.verbose,
+	},
+	&cli.BoolFlag{
+		Name:        "veryverbose",
+		Aliases:     []string{"vv"},
+		Usage:       "Set logging level very verbose to include debug level logs",
+		Value:       false,
+		EnvVars:     []string{envPrefix + "VERY_VERBOSE"},
+		Destination: &options.veryverbose,
+	},
+	&cli.StringFlag{
+		Name:        "log-level",
+		Usage:       "Set the logging level to 'debug', 'info', 'warn' or 'error', overriding --verbose and --veryverbose",
+		EnvVars:     []string{envPrefix + "LOG_LEVEL"},
+		Destination: &options.logLevel,
+	},
+	&cli.StringFlag{
+		Name:        "log-level-server",
+		Usage:       "Set the logging level of the HTTP server, defaulting to the level set by --log-level",
+		EnvVars:     []string{envPrefix + "LOG_LEVEL_SERVER"},
+		Destination: &options.logLevelServer,
+	},
+	&cli.StringFlag{
+		Name:        "log-level-batcher",
+		Usage:       "Set the logging level of the batcher that queues and flushes events, defaulting to the level set by --log-level",
+		EnvVars:     []string{envPrefix + "LOG_LEVEL_BATCHER"},
+		Destination: &options.logLevelBatcher,
+	},
+	&cli.StringFlag{
+		Name:        "log-level-db",
+		Usage:       "Set the logging level of the database connection and schema management, defaulting to the level set by --log-level",
+		EnvVars:     []string{envPrefix + "LOG_LEVEL_DB"},
+		Destination: &options.logLevelDB,
+	},
+	&cli.StringFlag{
+		Name:        "log-format",
+		Usage:       "Write logs as 'text' or 'json'",
+		EnvVars:     []string{envPrefix + "LOG_FORMAT"},
+		Value:       LogFormatText,
+		Destination: &options.logFormat,
+	},
+	&cli.StringFlag{
+		Name:        "log-file",
+		Usage:       "Write logs to `FILE` instead of standard output, rotating it when it reaches --log-file-max-size",
+		EnvVars:     []string{envPrefix + "LOG_FILE"},
+		Destination: &options.logFile,
+	},
+	&cli.Int64Flag{
+		Name:        "log-file-max-size",
+		Usage:       "The size in megabytes at which the log file is rotated, 0 for no limit",
+		EnvVars:     []string{envPrefix + "LOG_FILE_MAX_SIZE"},
+		Value:       100,
+		Destination: &options.logFileMaxSize,
+	},
+	&cli.IntFlag{
+		Name:        "log-file-max-backups",
+		Usage:       "The number of rotated log files to keep",
+		EnvVars:     []string{envPrefix + "LOG_FILE_MAX_BACKUPS"},
+		Value:       5,
+		Destination: &options.logFileMaxBackups,
+	},
+	&cli.Float64Flag{
+		Name:        "log-event-rate",
+		Usage:       "The maximum number of messages about individual events, such as dropped events, logged each second. The number not logged is reported with the next message. 0 for no limit.",
+		EnvVars:     []string{envPrefix + "LOG_EVENT_RATE"},
+		Value:       10,
+		Destination: &options.logEventRate,
+	},
+}
+
+// databaseFlags are the flags that configure the database connection, used by every command that
+// reads or writes traces.
+var databaseFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:        "db-host",
+		Usage:       "The hostname/address of the database server",
+		EnvVars:     []string{envPrefix + "DB_HOST"},
+		Destination: &options.dbHost,
+	},
+	&cli.IntFlag{
+		Name:        "db-port",
+		Usage:       "The port number of the database server",
+		EnvVars:     []string{envPrefix + "DB_PORT"},
+		Value:       5432,
+		Destination: &options.dbPort,
+	},
+	&cli.StringFlag{
+		Name:        "db-name",
+		Usage:       "The name of the database to use",
+		EnvVars:     []string{envPrefix + "DB_NAME"},
+		Destination: &options.dbName,
+	},
+	&cli.StringFlag{
+		Name:        "db-password",
+		Usage:       "The password to use when connecting the the database",
+		EnvVars:     []string{envPrefix + "DB_PASSWORD"},
+		Destination: &options.dbPassword,
+	},
+	&cli.StringFlag{
+		Name:        "db-user",
+		Usage:       "The user to use when connecting the the database",
+		EnvVars:     []string{envPrefix + "DB_USER"},
+		Destination: &options.dbUser,
+	},
+	&cli.StringFlag{
+		Name:        "db-sslmode",
+		Usage:       "The sslmode to use when connecting the the database",
+		EnvVars:     []string{envPrefix + "DB_SSL_MODE"},
+		Value:       "prefer",
+		Destination: &options.dbSSLMode,
+	},
+	&cli.IntFlag{
+		Name:        "batch-size",
+		Aliases:     []string{"b"},
+		Usage:       "The size of query batches to use when inserting into the database",
+		EnvVars:     []string{envPrefix + "BATCH_SIZE"},
+		Value:       100,
+		Destination: &options.batchSize,
+	},
+	&cli.Float64Flag{
+		Name:        "rejected-sample",
+		Usage:       "The fraction of dropped events whose payload is stored in the rejected_trace table",
+		EnvVars:     []string{envPrefix + "REJECTED_SAMPLE"},
+		Value:       1,
+		Destination: &options.rejectedSample,
+	},
+	&cli.Float64Flag{
+		Name:        "rejected-rate",
+		Usage:       "The maximum number of dropped events per second stored in the rejected_trace table. Zero disables storing dropped events.",
+		EnvVars:     []string{envPrefix + "REJECTED_RATE"},
+		Value:       10,
+		Destination: &options.rejectedRate,
+	},
+	&cli.BoolFlag{
+		Name:        "raw-archive",
+		Usage:       "Store every event as received in the raw_trace_event table so the other tables can be rebuilt using the reprocess command",
+		EnvVars:     []string{envPrefix + "RAW_ARCHIVE"},
+		Destination: &options.rawArchive,
+	},
+	&cli.DurationFlag{
+		Name:        "dedup-window",
+		Usage:       "The period within which duplicate events are discarded before being written. Zero disables deduplication.",
+		EnvVars:     []string{envPrefix + "DEDUP_WINDOW"},
+		Value:       time.Minute,
+		Destination: &options.dedupWindow,
+	},
+	&cli.StringFlag{
+		Name:        "filter-rules",
+		Usage:       "Read rules that select the events to store, and sample them, from the yaml or json `FILE`. Reloaded on SIGHUP.",
+		EnvVars:     []string{envPrefix + "FILTER_RULES"},
+		Destination: &options.filterRules,
+	},
+}
+
+// indexFlags are the flags that configure how the index that traces are sent to is recorded.
+var indexFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:        "index-mapping",
+		Usage:       "How the index that traces are sent to is recorded: 'none' to ignore it, 'schema' to use a database schema per index, 'prefix' to prefix table names with the index name or 'source' to record it in the index_name column of each event",
+		EnvVars:     []string{envPrefix + "INDEX_MAPPING"},
+		Value:       string(IndexMappingNone),
+		Destination: &options.indexMapping,
+	},
+	&cli.StringFlag{
+		Name:        "default-index",
+		Usage:       "The index whose traces are written to the default tables when using the 'schema' or 'prefix' index mappings",
+		EnvVars:     []string{envPrefix + "DEFAULT_INDEX"},
+		Value:       defaultIndex,
+		Destination: &options.defaultIndex,
+	},
+}
+
+func concatFlags(groups ...[]cli.Flag) []cli.Flag {
+	var flags []cli.Flag
+	for _, g := range groups {
+		flags = append(flags, g...)
+	}
+	return flags
+}
+
 var app = &cli.App{
 	Name:     "tracecatcher",
 	HelpName: "tracecatcher",
 	Usage:    "Listens to gossipsub traces emitted from Lotus and stores them in postgresql.",
-	Flags: []cli.Flag{
-		&cli.StringFlag{
-			Name:        "addr",
-			Aliases:     []string{"a"},
-			Usage:       "Listen for traces on `ADDRESS:PORT`",
-			Value:       ":5151",
-			EnvVars:     []string{envPrefix + "ADDR"},
-			Destination: &options.addr,
-		},
-		&cli.StringFlag{
-			Name:        "diag-addr",
-			Aliases:     []string{"da"},
-			Usage:       "Run diagnostics server for metrics on `ADDRESS:PORT`",
-			Value:       "",
-			EnvVars:     []string{envPrefix + "DIAG_ADDR"},
-			Destination: &options.diagnosticsAddr,
-		},
-		&cli.BoolFlag{
-			Name:        "verbose",
-			Aliases:     []string{"v"},
-			Usage:       "Set logging level more verbose to include info level logs",
-			Value:       false,
-			EnvVars:     []string{envPrefix + "VERBOSE"},
-			Destination: &options.verbose,
+	Flags: concatFlags(
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:        "config",
+				Usage:       "Read settings from the yaml `FILE`. Flags and environment variables take precedence over the file. The log level, rate limits and filter rules are reloaded on SIGHUP.",
+				EnvVars:     []string{envPrefix + "CONFIG"},
+				Destination: &options.configFile,
+			},
+			&cli.StringFlag{
+				Name:        "addr",
+				Aliases:     []string{"a"},
+				Usage:       "Listen for traces on `ADDRESS:PORT`",
+				Value:       ":5151",
+				EnvVars:     []string{envPrefix + "ADDR"},
+				Destination: &options.addr,
+			},
+			&cli.StringFlag{
+				Name:        "diag-addr",
+				Aliases:     []string{"da"},
+				Usage:       "Run diagnostics server for metrics on `ADDRESS:PORT`",
+				Value:       "",
+				EnvVars:     []string{envPrefix + "DIAG_ADDR"},
+				Destination: &options.diagnosticsAddr,
+			},
+			&cli.BoolFlag{
+				Name:        "diag-debug",
+				Usage:       "Serve pprof profiles and a json dump of internal state under /debug/ on the diagnostics server",
+				EnvVars:     []string{envPrefix + "DIAG_DEBUG"},
+				Destination: &options.diagnosticsDebug,
+			},
+			&cli.BoolFlag{
+				Name:        "network-metrics",
+				Usage:       "Derive metrics describing the gossipsub network, such as mesh sizes and peer scores, from the events received and serve them on the diagnostics server",
+				EnvVars:     []string{envPrefix + "NETWORK_METRICS"},
+				Destination: &options.networkMetrics,
+			},
+			&cli.IntFlag{
+				Name:        "ready-max-queue",
+				Usage:       "Report not ready on the diagnostics server's /readyz when this many events are queued or waiting to be queued. Zero disables the check.",
+				EnvVars:     []string{envPrefix + "READY_MAX_QUEUE"},
+				Value:       1000,
+				Destination: &options.readyMaxQueue,
+			},
+			&cli.DurationFlag{
+				Name:        "ready-flush-age",
+				Usage:       "Report not ready on the diagnostics server's /readyz for this long after a flush to the database fails, or when a flush has taken longer than this",
+				EnvVars:     []string{envPrefix + "READY_FLUSH_AGE"},
+				Value:       time.Minute,
+				Destination: &options.readyFlushAge,
+			},
+			&cli.DurationFlag{
+				Name:        "flush-interval",
+				Usage:       "The longest time events are queued before being written to the database when fewer than --batch-size arrive. Zero means events are only written once --batch-size are queued.",
+				EnvVars:     []string{envPrefix + "FLUSH_INTERVAL"},
+				Value:       10 * time.Second,
+				Destination: &options.flushInterval,
+			},
+			&cli.DurationFlag{
+				Name:        "retention",
+				Usage:       "Delete stored, archived and rejected events older than this, checking every hour. Zero keeps events forever, otherwise at least 1h.",
+				EnvVars:     []string{envPrefix + "RETENTION"},
+				Destination: &options.retention,
+			},
+			&cli.DurationFlag{
+				Name:        "shutdown-timeout",
+				Usage:       "On SIGTERM or SIGINT, the time allowed for requests in progress to finish and queued events to be written to the database",
+				EnvVars:     []string{envPrefix + "SHUTDOWN_TIMEOUT"},
+				Value:       30 * time.Second,
+				Destination: &options.shutdownTimeout,
+			},
+			&cli.StringFlag{
+				Name:        "shutdown-spool-dir",
+				Usage:       "On shutdown, write queued events that could not be written to the database to newline delimited json files in `DIR`, which may be loaded with the import command",
+				EnvVars:     []string{envPrefix + "SHUTDOWN_SPOOL_DIR"},
+				Destination: &options.shutdownSpoolDir,
+			},
 		},
-		&cli.BoolFlag{
-			Name:        "veryverbose",
-			Aliases:     []string{"vv"},
-			Usage:       "Set logging level very verbose to include debug level logs",
-			Value:       false,
-			EnvVars:     []string{envPrefix + "VERY_VERBOSE"},
-			Destination: &options.veryverbose,
-		},
-		&cli.StringFlag{
-			Name:        "db-host",
-			Usage:       "The hostname/address of the database server",
-			EnvVars:     []string{envPrefix + "DB_HOST"},
-			Destination: &options.dbHost,
-		},
-		&cli.IntFlag{
-			Name:        "db-port",
-			Usage:       "The port number of the database server",
-			EnvVars:     []string{envPrefix + "DB_PORT"},
-			Value:       5432,
-			Destination: &options.dbPort,
-		},
-		&cli.StringFlag{
-			Name:        "db-name",
-			Usage:       "The name of the database to use",
-			EnvVars:     []string{envPrefix + "DB_NAME"},
-			Destination: &options.dbName,
-		},
-		&cli.StringFlag{
-			Name:        "db-password",
-			Usage:       "The password to use when connecting the the database",
-			EnvVars:     []string{envPrefix + "DB_PASSWORD"},
-			Destination: &options.dbPassword,
-		},
-		&cli.StringFlag{
-			Name:        "db-user",
-			Usage:       "The user to use when connecting the the database",
-			EnvVars:     []string{envPrefix + "DB_USER"},
-			Destination: &options.dbUser,
-		},
-		&cli.StringFlag{
-			Name:        "db-sslmode",
-			Usage:       "The sslmode to use when connecting the the database",
-			EnvVars:     []string{envPrefix + "DB_SSL_MODE"},
-			Value:       "prefer",
-			Destination: &options.dbSSLMode,
-		},
-		&cli.IntFlag{
-			Name:        "batch-size",
-			Aliases:     []string{"b"},
-			Usage:       "The size of query batches to use when inserting into the database",
-			EnvVars:     []string{envPrefix + "BATCH_SIZE"},
-			Value:       100,
-			Destination: &options.batchSize,
-		},
-		&cli.IntFlag{
-			Name:        "metric-report-interval",
-			Usage:       "The interval (in seconds) on which metrics should be updated",
-			EnvVars:     []string{envPrefix + "METRIC_REPORT_INTERVAL"},
-			Value:       30,
-			Destination: &options.metricReportInterval,
+		loggingFlags,
+		databaseFlags,
+		[]cli.Flag{
+			&cli.IntFlag{
+				Name:        "metric-report-interval",
+				Usage:       "The interval (in seconds) on which metrics are pushed to the OTLP endpoint",
+				EnvVars:     []string{envPrefix + "METRIC_REPORT_INTERVAL"},
+				Value:       30,
+				Destination: &options.metricReportInterval,
+			},
+			&cli.StringFlag{
+				Name:        "otlp-metrics-endpoint",
+				Usage:       "Push metrics using OTLP over HTTP to `URL`, such as http://localhost:4318/v1/metrics",
+				EnvVars:     []string{envPrefix + "OTLP_METRICS_ENDPOINT"},
+				Destination: &options.otlpMetricsEndpoint,
+			},
+			&cli.StringFlag{
+				Name:        "trace-exporter",
+				Usage:       "Export spans describing the handling of requests and flushes to the database. One of 'none', 'otlp' (OTLP over HTTP) or 'stdout', which writes them as json to stderr or --trace-file",
+				EnvVars:     []string{envPrefix + "TRACE_EXPORTER"},
+				Value:       TraceExporterNone,
+				Destination: &options.traceExporter,
+			},
+			&cli.StringFlag{
+				Name:        "trace-file",
+				Usage:       "Append the spans exported by the stdout exporter to `FILE` instead of writing them to stderr",
+				EnvVars:     []string{envPrefix + "TRACE_FILE"},
+				Destination: &options.traceFile,
+			},
+			&cli.StringFlag{
+				Name:        "otlp-traces-endpoint",
+				Usage:       "Push spans using OTLP over HTTP to `URL`, such as http://localhost:4318/v1/traces. Defaults to the OTEL_EXPORTER_OTLP_* environment variables.",
+				EnvVars:     []string{envPrefix + "OTLP_TRACES_ENDPOINT"},
+				Destination: &options.otlpTracesEndpoint,
+			},
+			&cli.Float64Flag{
+				Name:        "trace-sample-ratio",
+				Usage:       "The fraction of requests that are traced, unless the client's trace context says otherwise",
+				EnvVars:     []string{envPrefix + "TRACE_SAMPLE_RATIO"},
+				Value:       1,
+				Destination: &options.traceSampleRatio,
+			},
+			&cli.StringFlag{
+				Name:        "source-header",
+				Usage:       "The name of an HTTP header used to identify the source of traces that do not specify a source auth",
+				EnvVars:     []string{envPrefix + "SOURCE_HEADER"},
+				Destination: &options.sourceHeader,
+			},
+			&cli.StringSliceFlag{
+				Name:        "metric-source",
+				Usage:       "A `SOURCE` that metrics such as events_received are tagged with. Other sources are counted with the source 'other'. May be repeated.",
+				EnvVars:     []string{envPrefix + "METRIC_SOURCE"},
+				Destination: &options.metricSources,
+			},
+			&cli.StringSliceFlag{
+				Name:        "metric-topic",
+				Usage:       "A `TOPIC` that network metrics are tagged with. Other topics are counted with the topic 'other'. May be repeated.",
+				EnvVars:     []string{envPrefix + "METRIC_TOPIC"},
+				Destination: &options.metricTopics,
+			},
+			&cli.StringSliceFlag{
+				Name:        "allowed-index",
+				Usage:       "An `INDEX` that traces may be sent to. Requests for other indexes are rejected. May be repeated. The default index is always allowed and any index is allowed if none are given.",
+				EnvVars:     []string{envPrefix + "ALLOWED_INDEX"},
+				Destination: &options.allowedIndexes,
+			},
+			&cli.IntFlag{
+				Name:        "max-indexes",
+				Usage:       "The maximum number of indexes that traces may be sent to, including the default index. Requests that would add an index beyond this are rejected. Zero means no limit.",
+				EnvVars:     []string{envPrefix + "MAX_INDEXES"},
+				Value:       100,
+				Destination: &options.maxIndexes,
+			},
+			&cli.StringSliceFlag{
+				Name:        "auth-token",
+				Usage:       "A token that clients must present to send traces, as `TOKEN` or LABEL:TOKEN. The label is recorded as the source of the client's traces. May be repeated.",
+				EnvVars:     []string{envPrefix + "AUTH_TOKEN"},
+				Destination: &options.authTokens,
+			},
+			&cli.StringFlag{
+				Name:        "auth-tokens-file",
+				Usage:       "Read tokens that clients must present to send traces from `FILE`, one per line in the same format as --auth-token",
+				EnvVars:     []string{envPrefix + "AUTH_TOKENS_FILE"},
+				Destination: &options.authTokensFile,
+			},
+			&cli.BoolFlag{
+				Name:        "auth-client-cert",
+				Usage:       "Accept clients that present a verified TLS client certificate, recording the certificate's common name as the source of their traces",
+				EnvVars:     []string{envPrefix + "AUTH_CLIENT_CERT"},
+				Destination: &options.authClientCert,
+			},
+			&cli.BoolFlag{
+				Name:        "auth-source-auth",
+				Usage:       "Accept tokens in the sourceAuth field of each trace event, as sent by Lotus, from requests that present no other credentials. The bodies of such requests are read before they can be authenticated.",
+				EnvVars:     []string{envPrefix + "AUTH_SOURCE_AUTH"},
+				Destination: &options.authSourceAuth,
+			},
+			&cli.StringFlag{
+				Name:        "tls-cert",
+				Usage:       "Serve traces and diagnostics over TLS using the certificate in `FILE`. Reloaded on SIGHUP.",
+				EnvVars:     []string{envPrefix + "TLS_CERT"},
+				Destination: &options.tlsCert,
+			},
+			&cli.StringFlag{
+				Name:        "tls-key",
+				Usage:       "The private key in `FILE` for the certificate given by --tls-cert. Reloaded on SIGHUP.",
+				EnvVars:     []string{envPrefix + "TLS_KEY"},
+				Destination: &options.tlsKey,
+			},
+			&cli.StringFlag{
+				Name:        "tls-client-ca",
+				Usage:       "Verify TLS client certificates against the certificate authorities in `FILE`. Reloaded on SIGHUP.",
+				EnvVars:     []string{envPrefix + "TLS_CLIENT_CA"},
+				Destination: &options.tlsClientCA,
+			},
+			&cli.Int64Flag{
+				Name:        "max-decompressed-body-size",
+				Usage:       "The maximum size in bytes of a request body after decompression",
+				EnvVars:     []string{envPrefix + "MAX_DECOMPRESSED_BODY_SIZE"},
+				Value:       32 << 20,
+				Destination: &options.maxDecompressedSize,
+			},
+			&cli.Int64Flag{
+				Name:        "max-body-size",
+				Usage:       "The maximum size in bytes of a request body as received, before decompression",
+				EnvVars:     []string{envPrefix + "MAX_BODY_SIZE"},
+				Value:       16 << 20,
+				Destination: &options.maxBodySize,
+			},
+			&cli.Float64Flag{
+				Name:        "rate-limit-events",
+				Usage:       "The maximum number of events per second accepted from each source. Zero means no limit.",
+				EnvVars:     []string{envPrefix + "RATE_LIMIT_EVENTS"},
+				Destination: &options.rateLimitEvents,
+			},
+			&cli.Float64Flag{
+				Name:        "rate-limit-bytes",
+				Usage:       "The maximum number of request body bytes per second accepted from each source. Zero means no limit.",
+				EnvVars:     []string{envPrefix + "RATE_LIMIT_BYTES"},
+				Destination: &options.rateLimitBytes,
+			},
 		},
+		indexFlags,
+		pseudonymFlags,
+	),
+	Action: run,
+	Commands: []*cli.Command{
+		importCommand,
+		exportCommand,
+		replayCommand,
+		loadgenCommand,
+		reprocessCommand,
 	},
-	Action:          run,
 	HideHelpCommand: true,
 }
 
@@ -141,15 +521,23 @@ func Run(args []string) error {
 }
 
 func run(cc *cli.Context) error {
-	logLevel := new(slog.LevelVar)
-	logLevel.Set(slog.LevelWarn)
-	slog.SetDefault(slog.New(slog.HandlerOptions{Level: logLevel}.NewTextHandler(os.Stdout)))
-
-	if options.verbose {
-		logLevel.Set(slog.LevelInfo)
+	var cfg *Config
+	var reloader *ConfigReloader
+	if options.configFile != "" {
+		// flags set on the command line must be noted before the file sets the others
+		reloader = NewConfigReloader(cc, options.configFile)
+		var err error
+		cfg, err = ReadConfig(options.configFile)
+		if err != nil {
+			return err
+		}
+		if err := cfg.Apply(cc); err != nil {
+			return err
+		}
 	}
-	if options.veryverbose {
-		logLevel.Set(slog.LevelDebug)
+
+	if err := setupLogging(os.Stdout); err != nil {
+		return err
 	}
 
 	ctx, cancel := context.WithCancel(cc.Context)
@@ -157,43 +545,251 @@ func run(cc *cli.Context) error {
 
 	conn, err := connect(ctx, options.dbHost, options.dbPort, options.dbName, options.dbSSLMode, options.dbUser, options.dbPassword)
 	if err != nil {
-		slog.Error("pgconn failed to connect", err)
+		dbLog.Error("pgconn failed to connect", err)
 		return err
 	}
 	defer func() {
-		slog.Info("closing database connection")
+		dbLog.Info("closing database connection")
 		conn.Close(context.Background())
 	}()
 
 	rg := new(RunGroup)
 
+	var tlsConfig *tls.Config
+	if options.tlsCert != "" || options.tlsKey != "" {
+		if options.tlsCert == "" || options.tlsKey == "" {
+			return fmt.Errorf("--tls-cert and --tls-key must be specified together")
+		}
+		cr, err := NewCertReloader(options.tlsCert, options.tlsKey, options.tlsClientCA)
+		if err != nil {
+			return fmt.Errorf("failed to load tls certificate: %w", err)
+		}
+		rg.AddReloadable(cr)
+		tlsConfig = cr.TLSConfig()
+	} else if options.tlsClientCA != "" {
+		return fmt.Errorf("--tls-client-ca requires --tls-cert and --tls-key")
+	}
+
+	if options.authClientCert && options.tlsClientCA == "" {
+		return fmt.Errorf("--auth-client-cert requires --tls-client-ca")
+	}
+
 	// Init metric reporting if required
-	if options.diagnosticsAddr != "" {
-		if err := InitMetricReporting(time.Duration(options.metricReportInterval) * time.Second); err != nil {
+	var metrics *MetricReporter
+	if options.diagnosticsAddr != "" || options.otlpMetricsEndpoint != "" {
+		metrics, err = InitMetricReporting(ctx, MetricsConfig{
+			Namespace:    "tracecatcher",
+			Prometheus:   options.diagnosticsAddr != "",
+			OTLPEndpoint: options.otlpMetricsEndpoint,
+			Interval:     time.Duration(options.metricReportInterval) * time.Second,
+		})
+		if err != nil {
 			return fmt.Errorf("failed to initialize metric reporting: %w", err)
 		}
+		defer func() {
+			if err := metrics.Shutdown(context.Background()); err != nil {
+				slog.Error("failed to shut down metric reporting", err)
+			}
+		}()
+	}
+
+	traces, err := InitTracing(ctx, TracingConfig{
+		Exporter:     options.traceExporter,
+		OTLPEndpoint: options.otlpTracesEndpoint,
+		SampleRatio:  options.traceSampleRatio,
+		File:         options.traceFile,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize tracing: %w", err)
+	}
+	if traces != nil {
+		defer func() {
+			if err := traces.Shutdown(context.Background()); err != nil {
+				slog.Error("failed to shut down tracing", err)
+			}
+		}()
+	}
+
+	filter, err := newEventFilterFromOptions()
+	if err != nil {
+		return err
+	}
+	if filter != nil {
+		rg.AddReloadable(filter)
+		if cfg != nil && cfg.hasFilterRules() {
+			slog.Warn("ignoring filter rules in config file since --filter-rules was given")
+		}
+	} else if cfg != nil {
+		// rules given in the config file may be added or changed when it is reloaded
+		filter, err = NewConfigEventFilter(&cfg.Filters.FilterConfig)
+		if err != nil {
+			return fmt.Errorf("failed to load filter rules: %w", err)
+		}
+		reloader.filter = filter
+	}
+
+	pseudonyms, err := newPseudonymiserFromOptions(PseudonymiseStore)
+	if err != nil {
+		return err
+	}
+
+	var network *NetworkObserver
+	if options.networkMetrics && options.diagnosticsAddr != "" {
+		// observing peers are labelled with their pseudonyms when peer ids are pseudonymised on store
+		network, err = NewNetworkObserver(pseudonyms, NewMetricSources(options.metricTopics.Value()))
+		if err != nil {
+			return fmt.Errorf("failed to create network observer: %w", err)
+		}
+	}
+
+	bat, err := NewBatcher(conn, BatcherConfig{
+		Size:          options.batchSize,
+		FlushInterval: options.flushInterval,
+		Rejects:       NewRejectSampler(options.rejectedSample, options.rejectedRate),
+		Archive:       options.rawArchive,
+		DedupWindow:   options.dedupWindow,
+		Filter:        filter,
+		Pseudonyms:    pseudonyms,
+		Network:       network,
+		MetricSources: NewMetricSources(options.metricSources.Value()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create batcher: %w", err)
+	}
+
+	rg.Add(bat)
+
+	if err := validateRetention(options.retention); err != nil {
+		return err
+	}
+	if options.retention > 0 {
+		rg.Add(NewRetention(dialDatabase, options.retention))
+	}
+
+	shutdown := NewShutdownDeadline(options.shutdownTimeout)
+
+	if options.diagnosticsAddr != "" {
+		pinger := NewDBPinger(dialDatabase)
+		defer pinger.Close(context.Background())
+
 		dr := &DiagRunner{
-			addr: options.diagnosticsAddr,
+			addr:     options.diagnosticsAddr,
+			tls:      tlsConfig,
+			metrics:  metrics.Handler(),
+			batcher:  bat,
+			debug:    options.diagnosticsDebug,
+			shutdown: shutdown,
+			ready: ReadinessConfig{
+				MaxQueue: options.readyMaxQueue,
+				FlushAge: options.readyFlushAge,
+				DB:       pinger,
+			},
 		}
 		rg.Add(dr)
 	}
 
-	bat, err := NewBatcher(conn, options.batchSize)
+	auth, err := newAuthenticatorFromOptions()
 	if err != nil {
-		return fmt.Errorf("failed to create batcher: %w", err)
+		return fmt.Errorf("failed to configure authentication: %w", err)
+	}
+
+	indexes, err := NewIndexRouter(IndexMapping(options.indexMapping), options.defaultIndex, IndexLimits{
+		Allowed: options.allowedIndexes.Value(),
+		Max:     options.maxIndexes,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure index mapping: %w", err)
+	}
+
+	limiter := NewSourceLimiter(options.rateLimitEvents, options.rateLimitBytes)
+	if reloader != nil {
+		reloader.limiter = limiter
+		rg.AddReloadable(reloader)
 	}
 
-	svr, err := NewServer(bat)
+	svr, err := NewServer(bat, ServerConfig{
+		SourceHeader:            options.sourceHeader,
+		Auth:                    auth,
+		MaxDecompressedBodySize: options.maxDecompressedSize,
+		MaxBodySize:             options.maxBodySize,
+		Limiter:                 limiter,
+		Indexes:                 indexes,
+		MetricSources:           NewMetricSources(options.metricSources.Value()),
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create web server: %w", err)
 	}
 
 	p := &WebRunner{
-		server: svr,
+		server:   svr,
+		tls:      tlsConfig,
+		shutdown: shutdown,
 	}
 	rg.Add(p)
 
-	return rg.RunAndWait(ctx)
+	runErr := rg.RunAndWait(ctx)
+
+	// the server has stopped accepting requests so the queue can be drained
+	dctx, dcancel := shutdown.Context()
+	defer dcancel()
+	res, err := bat.Drain(dctx, options.shutdownSpoolDir)
+	for _, f := range res.SpoolFiles {
+		slog.Warn("spooled events", "file", f.Name, "schema", f.NS.Schema, "prefix", f.NS.Prefix, "index", f.NS.Index, "source", f.Source, "events", f.Events)
+	}
+	counts := []any{"queued", res.Queued, "stored", res.Stored, "dropped", res.Dropped, "spooled", res.Spooled, "lost", res.Lost}
+	switch {
+	case err != nil:
+		slog.Error("failed to write queued events", err, counts...)
+	case res.Spooled > 0 || res.Lost > 0:
+		slog.Warn("some queued events were not written", counts...)
+	default:
+		slog.Info("wrote queued events", counts...)
+	}
+
+	return runErr
+}
+
+// dialDatabase makes an additional connection to the database, for tasks that must not wait for the
+// batcher's connection.
+func dialDatabase(ctx context.Context) (*pgx.Conn, error) {
+	return pgx.Connect(ctx, databaseDSN(options.dbHost, options.dbPort, options.dbName, options.dbSSLMode, options.dbUser, options.dbPassword))
+}
+
+func newAuthenticatorFromOptions() (*Authenticator, error) {
+	var tokens []AuthToken
+	for _, spec := range options.authTokens.Value() {
+		tok, err := ParseAuthToken(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth token: %w", err)
+		}
+		tokens = append(tokens, tok)
+	}
+
+	if options.authTokensFile != "" {
+		fileTokens, err := ReadAuthTokensFile(options.authTokensFile)
+		if err != nil {
+			return nil, fmt.Errorf("read auth tokens file: %w", err)
+		}
+		tokens = append(tokens, fileTokens...)
+	}
+
+	if options.authSourceAuth && len(tokens) == 0 {
+		return nil, fmt.Errorf("--auth-source-auth requires --auth-token or --auth-tokens-file")
+	}
+
+	return NewAuthenticator(tokens, options.authClientCert, options.authSourceAuth), nil
+}
+
+// newEventFilterFromOptions returns the filter configured by --filter-rules, or nil if no rules were given.
+func newEventFilterFromOptions() (*EventFilter, error) {
+	if options.filterRules == "" {
+		return nil, nil
+	}
+	filter, err := NewEventFilter(options.filterRules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load filter rules: %w", err)
+	}
+	return filter, nil
 }
 
 // Runnable allows a component to be started.
@@ -202,14 +798,25 @@ type Runnable interface {
 	Run(context.Context) error
 }
 
+// Reloadable allows a component to reload its configuration while running.
+type Reloadable interface {
+	// Reload is called when the process receives a SIGHUP signal.
+	Reload() error
+}
+
 type RunGroup struct {
-	runnables []Runnable
+	runnables   []Runnable
+	reloadables []Reloadable
 }
 
 func (rg *RunGroup) Add(r Runnable) {
 	rg.runnables = append(rg.runnables, r)
 }
 
+func (rg *RunGroup) AddReloadable(r Reloadable) {
+	rg.reloadables = append(rg.reloadables, r)
+}
+
 func (rg *RunGroup) RunAndWait(ctx context.Context) error {
 	if len(rg.runnables) == 0 {
 		return nil
@@ -235,6 +842,28 @@ func (rg *RunGroup) RunAndWait(ctx context.Context) error {
 		return nil
 	})
 
+	// Reload components when we receive a hangup signal.
+	if len(rg.reloadables) > 0 {
+		g.Go(func() error {
+			hangup := make(chan os.Signal, 1)
+			signal.Notify(hangup, syscall.SIGHUP)
+			defer signal.Stop(hangup)
+			for {
+				select {
+				case <-hangup:
+					slog.Info("reloading configuration")
+					for _, r := range rg.reloadables {
+						if err := r.Reload(); err != nil {
+							slog.Error("failed to reload", err)
+						}
+					}
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		})
+	}
+
 	// Wait for all servers to run to completion.
 	if err := g.Wait(); err != nil {
 		if !errors.Is(err, context.Canceled) {
@@ -245,7 +874,9 @@ func (rg *RunGroup) RunAndWait(ctx context.Context) error {
 }
 
 type WebRunner struct {
-	server *Server
+	server   *Server
+	tls      *tls.Config       // optional, serves plain HTTP when nil
+	shutdown *ShutdownDeadline // bounds the time allowed for requests in progress to finish
 }
 
 func (r *WebRunner) Run(ctx context.Context) error {
@@ -253,14 +884,21 @@ func (r *WebRunner) Run(ctx context.Context) error {
 
 	r.server.ConfigureRoutes(mx)
 
+	// requests in progress are not canceled when shutting down so the events they carry are queued
 	srv := &http.Server{
 		Handler:     mx,
-		BaseContext: func(net.Listener) context.Context { return ctx },
+		BaseContext: func(net.Listener) context.Context { return context.WithoutCancel(ctx) },
 	}
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		<-ctx.Done()
-		if err := srv.Shutdown(context.Background()); err != nil {
-			slog.Error("failed to shut down RPC server", err)
+		sctx, cancel := r.shutdown.Context()
+		defer cancel()
+		serverLog.Info("shutting down server, waiting for requests in progress")
+		if err := srv.Shutdown(sctx); err != nil {
+			serverLog.Error("failed to shut down RPC server", err)
+			srv.Close()
 		}
 	}()
 
@@ -269,6 +907,9 @@ func (r *WebRunner) Run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to listen on %q: %w", options.addr, err)
 	}
+	if r.tls != nil {
+		listener = tls.NewListener(listener, r.tls)
+	}
 
 	if err := srv.Serve(listener); err != nil {
 		if !errors.Is(err, http.ErrServerClosed) {
@@ -276,11 +917,20 @@ func (r *WebRunner) Run(ctx context.Context) error {
 		}
 	}
 
+	// Serve returns as soon as shutdown starts so wait for requests in progress to finish
+	<-stopped
 	return nil
 }
 
 type DiagRunner struct {
-	addr string
+	addr    string
+	tls     *tls.Config // optional, serves plain HTTP when nil
+	metrics http.Handler
+	batcher *Batcher
+	ready   ReadinessConfig
+	debug   bool // serve pprof profiles and internal state
+
+	shutdown *ShutdownDeadline // bounds the time allowed for requests in progress to finish
 }
 
 func (dr *DiagRunner) Run(ctx context.Context) error {
@@ -288,27 +938,47 @@ func (dr *DiagRunner) Run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to listen on %q: %w", dr.addr, err)
 	}
-
-	pe, err := RegisterPrometheusExporter("tracecatcher")
-	if err != nil {
-		return fmt.Errorf("failed to register prometheus exporter: %w", err)
+	if dr.tls != nil {
+		diagListener = tls.NewListener(diagListener, dr.tls)
 	}
 
-	mx := mux.NewRouter()
-	mx.Handle("/metrics", pe)
-
 	srv := &http.Server{
-		Handler:     mx,
+		Handler:     dr.handler(),
 		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		<-ctx.Done()
-		if err := srv.Shutdown(context.Background()); err != nil {
+		sctx, cancel := dr.shutdown.Context()
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
 			slog.Error("failed to shut down diagnostics server", err)
+			srv.Close()
 		}
 	}()
 
 	slog.Info("starting diagnostics server", "addr", dr.addr)
-	return srv.Serve(diagListener)
+	if err := srv.Serve(diagListener); err != nil {
+		if !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("serve diagnostics failed: %w", err)
+		}
+	}
+
+	<-stopped
+	return nil
+}
+
+// handler returns the routes served by the diagnostics server.
+func (dr *DiagRunner) handler() http.Handler {
+	mx := mux.NewRouter()
+	mx.Handle("/metrics", dr.metrics)
+	mx.HandleFunc("/healthz", healthzHandler)
+	mx.Handle("/readyz", readyzHandler(dr.batcher, dr.ready))
+	mx.Handle("/status", statusHandler(dr.batcher, time.Now()))
+	if dr.debug {
+		mountDebugHandlers(mx, dr.batcher)
+	}
+	return mx
 }
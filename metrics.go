@@ -2,99 +2,316 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"net/http"
 	"time"
 
-	"contrib.go.opencensus.io/exporter/prometheus"
 	prom "github.com/prometheus/client_golang/prometheus"
-	"go.opencensus.io/stats"
-	"go.opencensus.io/stats/view"
-	"go.opencensus.io/tag"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
 )
 
-var eventTypeTag, _ = tag.NewKey("event_type")
+// instrumentationName identifies the metrics and spans created by tracecatcher.
+const instrumentationName = "github.com/iand/tracecatcher"
+
+const (
+	unitDimensionless = "1"
+	unitBytes         = "By"
+	unitSeconds       = "s"
+)
+
+var (
+	eventTypeTag = attribute.Key("event_type")
+	sourceTag    = attribute.Key("source")
+	reasonTag    = attribute.Key("reason")
+	encodingTag  = attribute.Key("encoding")
+	handlerTag   = attribute.Key("handler")
+	statusTag    = attribute.Key("status")
+	tableTag     = attribute.Key("table")
+	topicTag     = attribute.Key("topic")
+)
+
+var (
+	// latencyBounds are the histogram buckets, in seconds, used for the duration of requests and flushes.
+	latencyBounds = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+	// sizeBounds are the histogram buckets, in bytes, used for the size of requests.
+	sizeBounds = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}
+
+	// lagBounds are the histogram buckets, in seconds, used for the time between an event occurring
+	// and it being stored.
+	lagBounds = []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 300, 600, 1800, 3600}
+)
+
+// otherSource is the value of the source tag for sources that metrics are not tagged with individually.
+const otherSource = "other"
+
+// MetricSources is the set of sources that metrics are tagged with. Sources are chosen by clients so
+// tagging metrics with every source would allow them to create an unbounded number of series.
+type MetricSources map[string]bool
+
+// NewMetricSources returns a set of the given sources.
+func NewMetricSources(sources []string) MetricSources {
+	ms := make(MetricSources, len(sources))
+	for _, source := range sources {
+		ms[source] = true
+	}
+	return ms
+}
+
+// Tag returns the value of the source tag for measurements relating to source: the source itself if
+// it is in the set, otherwise "other".
+func (ms MetricSources) Tag(source string) string {
+	if ms[source] {
+		return source
+	}
+	return otherSource
+}
+
+// metricTagsKey is the context key for the tags applied to measurements.
+type metricTagsKey struct{}
+
+// withTag returns a context whose measurements are tagged with kv, replacing any existing tag with
+// the same key.
+func withTag(ctx context.Context, kv attribute.KeyValue) context.Context {
+	prev, _ := ctx.Value(metricTagsKey{}).([]attribute.KeyValue)
+	tags := make([]attribute.KeyValue, 0, len(prev)+1)
+	for _, t := range prev {
+		if t.Key != kv.Key {
+			tags = append(tags, t)
+		}
+	}
+	tags = append(tags, kv)
+	return context.WithValue(ctx, metricTagsKey{}, tags)
+}
+
+// measurementTags returns the tags in the context that a metric is tagged by. Tags that are not in
+// the context are given an empty value so that every measurement of a metric has the same labels.
+func measurementTags(ctx context.Context, keys []attribute.Key) metric.MeasurementOption {
+	tags, _ := ctx.Value(metricTagsKey{}).([]attribute.KeyValue)
+	kvs := make([]attribute.KeyValue, 0, len(keys))
+	for _, k := range keys {
+		v := k.String("")
+		for _, t := range tags {
+			if t.Key == k {
+				v = t
+			}
+		}
+		kvs = append(kvs, v)
+	}
+	return metric.WithAttributes(kvs...)
+}
 
 func eventTypeContext(ctx context.Context, name string) context.Context {
-	ctx, _ = tag.New(ctx, tag.Upsert(eventTypeTag, name))
-	return ctx
+	return withTag(ctx, eventTypeTag.String(name))
+}
+
+func sourceContext(ctx context.Context, source string) context.Context {
+	return withTag(ctx, sourceTag.String(source))
+}
+
+func reasonContext(ctx context.Context, reason string) context.Context {
+	return withTag(ctx, reasonTag.String(reason))
+}
+
+func encodingContext(ctx context.Context, encoding string) context.Context {
+	return withTag(ctx, encodingTag.String(encoding))
+}
+
+func handlerContext(ctx context.Context, handler string) context.Context {
+	return withTag(ctx, handlerTag.String(handler))
+}
+
+func statusContext(ctx context.Context, status string) context.Context {
+	return withTag(ctx, statusTag.String(status))
+}
+
+func tableContext(ctx context.Context, table string) context.Context {
+	return withTag(ctx, tableTag.String(table))
+}
+
+func topicContext(ctx context.Context, topic string) context.Context {
+	return withTag(ctx, topicTag.String(topic))
+}
+
+// meter returns the meter used to create tracecatcher's metrics. Metrics may be created before
+// InitMetricReporting is called.
+func meter() metric.Meter {
+	return otel.Meter(instrumentationName)
+}
+
+// MetricsConfig configures how metrics are exported.
+type MetricsConfig struct {
+	// Namespace is prefixed to the names of metrics served in Prometheus format.
+	Namespace string
+
+	// Prometheus serves metrics in Prometheus format using the handler returned by MetricReporter.Handler.
+	Prometheus bool
+
+	// OTLPEndpoint is the URL to which metrics are pushed using OTLP over HTTP, such as
+	// http://localhost:4318/v1/metrics. Empty disables pushing metrics.
+	OTLPEndpoint string
+
+	// Interval is the interval on which metrics are pushed to the OTLP endpoint.
+	Interval time.Duration
+}
+
+// MetricReporter exports the measurements made by every metric.
+type MetricReporter struct {
+	provider *sdkmetric.MeterProvider
+	handler  http.Handler
+}
+
+// InitMetricReporting creates the exporters for metrics and sets the meter provider that they are
+// reported to.
+func InitMetricReporting(ctx context.Context, cfg MetricsConfig) (*MetricReporter, error) {
+	mr := new(MetricReporter)
+
+	res, err := serviceResource()
+	if err != nil {
+		return nil, fmt.Errorf("resource: %w", err)
+	}
+	opts := []sdkmetric.Option{sdkmetric.WithResource(res)}
+
+	if cfg.Prometheus {
+		handler, reader, err := newPrometheusExporter(cfg.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("prometheus exporter: %w", err)
+		}
+		mr.handler = handler
+		opts = append(opts, sdkmetric.WithReader(reader))
+	}
+
+	if cfg.OTLPEndpoint != "" {
+		exp, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(cfg.OTLPEndpoint))
+		if err != nil {
+			return nil, fmt.Errorf("otlp exporter: %w", err)
+		}
+		opts = append(opts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exp, sdkmetric.WithInterval(cfg.Interval))))
+	}
+
+	mr.provider = sdkmetric.NewMeterProvider(opts...)
+	otel.SetMeterProvider(mr.provider)
+	return mr, nil
+}
+
+// serviceResource describes tracecatcher to the collectors that metrics and spans are pushed to.
+func serviceResource() (*resource.Resource, error) {
+	return resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", "tracecatcher")))
+}
+
+// Handler returns a handler that serves metrics in Prometheus format, or nil if they are not served.
+func (mr *MetricReporter) Handler() http.Handler {
+	return mr.handler
+}
+
+// Shutdown pushes any metrics that have not been exported and stops the exporters.
+func (mr *MetricReporter) Shutdown(ctx context.Context) error {
+	return mr.provider.Shutdown(ctx)
 }
 
-func InitMetricReporting(reportingInterval time.Duration) error {
-	view.SetReportingPeriod(reportingInterval)
+// newPrometheusExporter creates a reader that serves metrics in Prometheus format, along with metrics
+// describing the Go runtime and the process. Metric names are not given unit or counter suffixes so
+// that they match the names used before metrics were reported using OpenTelemetry.
+func newPrometheusExporter(namespace string) (http.Handler, sdkmetric.Reader, error) {
+	registry := prom.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 
-	return nil
+	exp, err := prometheus.New(
+		prometheus.WithRegisterer(registry),
+		prometheus.WithNamespace(namespace),
+		prometheus.WithoutUnits(),
+		prometheus.WithoutCounterSuffixes(),
+		prometheus.WithoutScopeInfo(),
+		prometheus.WithoutTargetInfo(),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{}), exp, nil
 }
 
 type Gauge struct {
-	*stats.Int64Measure
+	g    metric.Int64Gauge
+	keys []attribute.Key
 }
 
 // Set sets the current value of the gauge.
 // If there are any tags in the context, measurements will be tagged with them.
 func (g *Gauge) Set(ctx context.Context, v int64) {
-	stats.Record(ctx, g.M(v))
+	g.g.Record(ctx, v, measurementTags(ctx, g.keys))
 }
 
 // Add adds a value to the gauge.
 // If there are any tags in the context, measurements will be tagged with them.
 func (g *Gauge) Add(ctx context.Context, v int64) {
-	stats.Record(ctx, g.M(v))
+	g.g.Record(ctx, v, measurementTags(ctx, g.keys))
 }
 
-func NewDimensionlessGauge(name string, desc string, tagKeys ...tag.Key) (*Gauge, error) {
-	m := stats.Int64(name, desc, stats.UnitDimensionless)
-
-	if err := view.Register(&view.View{
-		Name:        name,
-		Description: desc,
-		Measure:     m,
-		TagKeys:     tagKeys,
-		Aggregation: view.LastValue(),
-	}); err != nil {
+func NewDimensionlessGauge(name string, desc string, tagKeys ...attribute.Key) (*Gauge, error) {
+	g, err := meter().Int64Gauge(name, metric.WithDescription(desc), metric.WithUnit(unitDimensionless))
+	if err != nil {
 		return nil, err
 	}
 
-	return &Gauge{Int64Measure: m}, nil
+	return &Gauge{g: g, keys: tagKeys}, nil
 }
 
 type Counter struct {
-	*stats.Int64Measure
+	c    metric.Int64Counter
+	keys []attribute.Key
 }
 
 // Add adds a value to the counter.
 // If there are any tags in the context, measurements will be tagged with them.
 func (c *Counter) Add(ctx context.Context, v int64) {
-	stats.Record(ctx, c.M(v))
+	c.c.Add(ctx, v, measurementTags(ctx, c.keys))
 }
 
-func NewDimensionlessCounter(name string, desc string, tagKeys ...tag.Key) (*Counter, error) {
-	m := stats.Int64(name, desc, stats.UnitDimensionless)
-
-	if err := view.Register(&view.View{
-		Name:        name,
-		Description: desc,
-		Measure:     m,
-		TagKeys:     tagKeys,
-		Aggregation: view.Sum(),
-	}); err != nil {
+func NewDimensionlessCounter(name string, desc string, tagKeys ...attribute.Key) (*Counter, error) {
+	c, err := meter().Int64Counter(name, metric.WithDescription(desc), metric.WithUnit(unitDimensionless))
+	if err != nil {
 		return nil, err
 	}
 
-	return &Counter{Int64Measure: m}, nil
+	return &Counter{c: c, keys: tagKeys}, nil
 }
 
-func RegisterPrometheusExporter(namespace string) (*prometheus.Exporter, error) {
-	registry := prom.NewRegistry()
-	registry.MustRegister(prom.NewGoCollector(), prom.NewProcessCollector(prom.ProcessCollectorOpts{}))
+type Histogram struct {
+	h    metric.Float64Histogram
+	keys []attribute.Key
+}
 
-	pe, err := prometheus.NewExporter(prometheus.Options{
-		Namespace: namespace,
-		Registry:  registry,
-	})
+// Record records a value in the histogram.
+// If there are any tags in the context, measurements will be tagged with them.
+func (h *Histogram) Record(ctx context.Context, v float64) {
+	h.h.Record(ctx, v, measurementTags(ctx, h.keys))
+}
+
+// NewHistogram creates a histogram that counts values in buckets with the given upper bounds.
+func NewHistogram(name string, desc string, unit string, bounds []float64, tagKeys ...attribute.Key) (*Histogram, error) {
+	h, err := meter().Float64Histogram(name, metric.WithDescription(desc), metric.WithUnit(unit), metric.WithExplicitBucketBoundaries(bounds...))
 	if err != nil {
 		return nil, err
 	}
 
-	view.RegisterExporter(pe)
+	return &Histogram{h: h, keys: tagKeys}, nil
+}
 
-	return pe, nil
+// NewGaugeFunc registers a gauge whose value is obtained by calling fn whenever metrics are exported.
+func NewGaugeFunc(name string, desc string, unit string, fn func() float64) error {
+	_, err := meter().Float64ObservableGauge(name, metric.WithDescription(desc), metric.WithUnit(unit),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			o.Observe(fn())
+			return nil
+		}))
+	return err
 }
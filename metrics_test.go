@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpReceiver collects the metrics pushed to it using OTLP over HTTP.
+type otlpReceiver struct {
+	mu      sync.Mutex
+	metrics map[string]*metricpb.Metric
+	service string
+}
+
+func (rc *otlpReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := new(colmetricpb.ExportMetricsServiceRequest)
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, rm := range req.ResourceMetrics {
+		for _, kv := range rm.GetResource().GetAttributes() {
+			if kv.Key == "service.name" {
+				rc.service = kv.GetValue().GetStringValue()
+			}
+		}
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				rc.metrics[m.Name] = m
+			}
+		}
+	}
+
+	resp, _ := proto.Marshal(&colmetricpb.ExportMetricsServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(resp)
+}
+
+func otlpAttributes(kvs []*commonpb.KeyValue) map[string]string {
+	attrs := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		attrs[kv.Key] = kv.GetValue().GetStringValue()
+	}
+	return attrs
+}
+
+func matchesAttributes(got map[string]string, want map[string]string) bool {
+	for k, v := range want {
+		if got[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	rc := &otlpReceiver{metrics: make(map[string]*metricpb.Metric)}
+	collector := httptest.NewServer(rc)
+	defer collector.Close()
+
+	prev := otel.GetMeterProvider()
+	t.Cleanup(func() { otel.SetMeterProvider(prev) })
+
+	ctx := context.Background()
+	mr, err := InitMetricReporting(ctx, MetricsConfig{
+		Namespace:    "tracecatcher",
+		OTLPEndpoint: collector.URL + "/v1/metrics",
+		Interval:     time.Hour, // metrics are pushed on shutdown
+	})
+	if err != nil {
+		t.Fatalf("InitMetricReporting: %v", err)
+	}
+
+	// the server's instruments are created once the meter provider is set
+	ts, _ := newTestServer(t, IndexLimits{})
+	for _, doc := range []string{testTraceDoc, testTraceDoc, `{"type":`} {
+		resp, body := doTestRequest(t, ts, testRequest{method: "POST", path: "/traces/_doc", body: doc})
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("got status %d: %s", resp.StatusCode, body)
+		}
+	}
+
+	if err := mr.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.service != "tracecatcher" {
+		t.Errorf("got service name %q, wanted %q", rc.service, "tracecatcher")
+	}
+
+	counters := []struct {
+		name  string
+		attrs map[string]string
+		want  int64
+	}{
+		{name: "events_received", attrs: map[string]string{"event_type": "join", "source": otherSource}, want: 2},
+		{name: "parse_errors", want: 1},
+		{name: "bytes_received", attrs: map[string]string{"encoding": "identity"}, want: int64(2*len(testTraceDoc) + len(`{"type":`))},
+	}
+	for _, c := range counters {
+		m, ok := rc.metrics[c.name]
+		if !ok {
+			t.Errorf("%s: not received", c.name)
+			continue
+		}
+		if strings.HasPrefix(m.Name, "tracecatcher") {
+			t.Errorf("%s: name has prometheus namespace", c.name)
+		}
+		sum := m.GetSum()
+		if sum == nil || !sum.IsMonotonic {
+			t.Errorf("%s: not a monotonic sum", c.name)
+			continue
+		}
+		var total int64
+		for _, dp := range sum.DataPoints {
+			if matchesAttributes(otlpAttributes(dp.Attributes), c.attrs) {
+				total += dp.GetAsInt()
+			}
+		}
+		if total != c.want {
+			t.Errorf("%s: got %d with attributes %v, wanted %d", c.name, total, c.attrs, c.want)
+		}
+	}
+
+	histograms := []struct {
+		name   string
+		unit   string
+		attrs  map[string]string
+		want   uint64
+		bounds []float64
+	}{
+		{
+			name:   "http_request_duration_seconds",
+			unit:   unitSeconds,
+			attrs:  map[string]string{"handler": "/{index}/_doc", "status": "201"},
+			want:   2,
+			bounds: latencyBounds,
+		},
+		{
+			name:   "http_request_duration_seconds",
+			unit:   unitSeconds,
+			attrs:  map[string]string{"handler": "/{index}/_doc", "status": "400"},
+			want:   1,
+			bounds: latencyBounds,
+		},
+		{
+			name:   "http_request_size_bytes",
+			unit:   unitBytes,
+			attrs:  map[string]string{"handler": "/{index}/_doc"},
+			want:   3,
+			bounds: sizeBounds,
+		},
+	}
+	for _, h := range histograms {
+		m, ok := rc.metrics[h.name]
+		if !ok {
+			t.Errorf("%s: not received", h.name)
+			continue
+		}
+		if m.Unit != h.unit {
+			t.Errorf("%s: got unit %q, wanted %q", h.name, m.Unit, h.unit)
+		}
+		hist := m.GetHistogram()
+		if hist == nil {
+			t.Errorf("%s: not a histogram", h.name)
+			continue
+		}
+		var count uint64
+		for _, dp := range hist.DataPoints {
+			if !matchesAttributes(otlpAttributes(dp.Attributes), h.attrs) {
+				continue
+			}
+			count += dp.Count
+			if len(dp.ExplicitBounds) != len(h.bounds) {
+				t.Errorf("%s: got %d bucket bounds, wanted %d", h.name, len(dp.ExplicitBounds), len(h.bounds))
+			}
+		}
+		if count != h.want {
+			t.Errorf("%s: got count %d with attributes %v, wanted %d", h.name, count, h.attrs, h.want)
+		}
+	}
+}
+
+func TestMetricSourcesTag(t *testing.T) {
+	testCases := []struct {
+		name    string
+		sources []string
+		source  string
+		want    string
+	}{
+		{name: "configured", sources: []string{"node1", "node2"}, source: "node2", want: "node2"},
+		{name: "not configured", sources: []string{"node1"}, source: "192.0.2.1", want: otherSource},
+		{name: "none configured", source: "node1", want: otherSource},
+		{name: "empty source", sources: []string{"node1"}, source: "", want: otherSource},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := NewMetricSources(tc.sources).Tag(tc.source); got != tc.want {
+				t.Errorf("got %q, wanted %q", got, tc.want)
+			}
+		})
+	}
+
+	var ms MetricSources
+	if got := ms.Tag("node1"); got != otherSource {
+		t.Errorf("nil set: got %q, wanted %q", got, otherSource)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -80,6 +81,17 @@ type TraceEvent struct {
 	Prune            *PruneEvent            `json:"prune,omitempty"`
 	PeerScore        *PeerScoreEvent        `json:"peerScore,omitempty"`
 	SourceAuth       *string                `json:"sourceAuth,omitempty"`
+
+	// Source identifies the node or tracer that sent the event. It is not part of the trace
+	// format and is assigned by tracecatcher when the event is received.
+	Source string `json:"-"`
+
+	// Raw holds the event as it was received, if known, including any fields not modelled here.
+	Raw json.RawMessage `json:"-"`
+
+	// DedupKey identifies the content of the event so that duplicates are not stored. It is nil when
+	// deduplication is disabled.
+	DedupKey []byte `json:"-"`
 }
 
 type PublishMessageEvent struct {
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	// networkStaleAfter is how long the state reported by an observing peer is kept after its last event.
+	// Peer scores that have not been updated for this long are also discarded.
+	networkStaleAfter = 10 * time.Minute
+
+	// maxNetworkObservers is the number of observing peers whose state is kept. Each is a set of metric
+	// series labelled with its peer id, so events from further peers are not observed until the state
+	// of idle peers is discarded.
+	maxNetworkObservers = 1000
+)
+
+// rejectReasons are the reasons go-libp2p-pubsub gives for rejecting a message. Rejections with any
+// other reason are counted with the reason "other".
+var rejectReasons = []string{
+	"validation failed",
+	"validation ignored",
+	"validation throttled",
+	"validation queue full",
+	"blacklisted peer",
+	"blacklisted source",
+	"missing signature",
+	"invalid signature",
+	"self originated message",
+}
+
+var rejectReasonTags = NewMetricSources(rejectReasons)
+
+// peerScoreQuantiles are the quantiles of the latest peer scores reported for each observing peer.
+var peerScoreQuantiles = []float64{0, 0.1, 0.5, 0.9, 1}
+
+// peerIDTag labels the network metrics with the observing peer.
+var peerIDTag = attribute.Key("peer_id")
+
+// NetworkObserver derives metrics describing the gossipsub network from the events sent by each
+// observing peer. Gauges are calculated from the observed state when metrics are exported.
+type NetworkObserver struct {
+	pseudonyms *Pseudonymiser // replaces the ids of observing peers in metric labels, nil to use them unchanged
+	topics     MetricSources  // topics that metrics are tagged with, others are tagged "other"
+
+	published  *Counter
+	delivered  *Counter
+	duplicates *Counter
+	rejected   *Counter
+
+	meshPeers      metric.Int64ObservableGauge
+	connectedPeers metric.Int64ObservableGauge
+	scoredPeers    metric.Int64ObservableGauge
+	peerScore      metric.Float64ObservableGauge
+
+	mu        sync.Mutex
+	observers map[string]*observedPeer // keyed by the peer id in its binary form
+}
+
+// observedPeer is the state of the network as seen by one peer.
+type observedPeer struct {
+	label    string // peer id used in metric labels
+	lastSeen time.Time
+	mesh     map[string]map[string]struct{} // peers in the mesh of each topic that metrics are tagged with
+	peers    map[string]struct{}            // connected peers
+	scores   map[string]observedScore       // latest score of each peer
+}
+
+type observedScore struct {
+	score float64
+	time  time.Time
+}
+
+// NewNetworkObserver creates a NetworkObserver and registers its metrics. Topics are chosen by the
+// observing peers so metrics are only tagged with the given topics, and the mesh is only tracked for them.
+func NewNetworkObserver(pseudonyms *Pseudonymiser, topics MetricSources) (*NetworkObserver, error) {
+	n := &NetworkObserver{
+		pseudonyms: pseudonyms,
+		topics:     topics,
+		observers:  make(map[string]*observedPeer),
+	}
+
+	var err error
+	n.published, err = NewDimensionlessCounter("messages_published", "Number of messages published by observing peers, tagged by topic", topicTag)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	n.delivered, err = NewDimensionlessCounter("messages_delivered", "Number of messages delivered to observing peers, tagged by topic", topicTag)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	n.duplicates, err = NewDimensionlessCounter("messages_duplicate", "Number of duplicate messages received by observing peers, tagged by topic", topicTag)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	n.rejected, err = NewDimensionlessCounter("messages_rejected", "Number of messages rejected by observing peers, tagged by topic and reason", topicTag, reasonTag)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	m := meter()
+	n.meshPeers, err = m.Int64ObservableGauge("mesh_peers", metric.WithDescription("Number of peers in the mesh of each topic, tagged by observing peer and topic"), metric.WithUnit(unitDimensionless))
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+	n.connectedPeers, err = m.Int64ObservableGauge("connected_peers", metric.WithDescription("Number of peers connected to each observing peer"), metric.WithUnit(unitDimensionless))
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+	n.scoredPeers, err = m.Int64ObservableGauge("scored_peers", metric.WithDescription("Number of peers with a recent score reported by each observing peer"), metric.WithUnit(unitDimensionless))
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+	n.peerScore, err = m.Float64ObservableGauge("peer_score", metric.WithDescription("Quantiles of the latest scores reported by each observing peer"), metric.WithUnit(unitDimensionless))
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+	if _, err := m.RegisterCallback(n.observe, n.meshPeers, n.connectedPeers, n.scoredPeers, n.peerScore); err != nil {
+		return nil, fmt.Errorf("register callback: %w", err)
+	}
+
+	return n, nil
+}
+
+// Observe updates the state of the network with an event. It does nothing if n is nil.
+func (n *NetworkObserver) Observe(ctx context.Context, ev *TraceEvent, now time.Time) {
+	if n == nil || ev.Type == nil {
+		return
+	}
+
+	switch *ev.Type {
+	case EventTypePublishMessage:
+		if ev.PublishMessage != nil {
+			n.published.Add(n.topicContext(ctx, ev.PublishMessage.Topic), 1)
+		}
+	case EventTypeDeliverMessage:
+		if ev.DeliverMessage != nil {
+			n.delivered.Add(n.topicContext(ctx, ev.DeliverMessage.Topic), 1)
+		}
+	case EventTypeDuplicateMessage:
+		if ev.DuplicateMessage != nil {
+			n.duplicates.Add(n.topicContext(ctx, ev.DuplicateMessage.Topic), 1)
+		}
+	case EventTypeRejectMessage:
+		if ev.RejectMessage != nil {
+			reason := rejectReasonTags.Tag(derefString(ev.RejectMessage.Reason, ""))
+			n.rejected.Add(reasonContext(n.topicContext(ctx, ev.RejectMessage.Topic), reason), 1)
+		}
+	}
+
+	if len(ev.PeerID) == 0 {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	op := n.observer(ev.PeerID, now)
+	if op == nil {
+		return
+	}
+
+	switch *ev.Type {
+	case EventTypeAddPeer:
+		if ev.AddPeer != nil {
+			op.peers[peerKey(ev.AddPeer.PeerID)] = struct{}{}
+		}
+	case EventTypeRemovePeer:
+		if ev.RemovePeer != nil {
+			id := peerKey(ev.RemovePeer.PeerID)
+			delete(op.peers, id)
+			delete(op.scores, id)
+			for _, mesh := range op.mesh {
+				delete(mesh, id)
+			}
+		}
+	case EventTypeGraft:
+		if ev.Graft != nil {
+			topic := derefString(ev.Graft.Topic, "")
+			if !n.topics[topic] {
+				break
+			}
+			mesh, ok := op.mesh[topic]
+			if !ok {
+				mesh = make(map[string]struct{})
+				op.mesh[topic] = mesh
+			}
+			mesh[peerKey(ev.Graft.PeerID)] = struct{}{}
+		}
+	case EventTypePrune:
+		if ev.Prune != nil {
+			delete(op.mesh[derefString(ev.Prune.Topic, "")], peerKey(ev.Prune.PeerID))
+		}
+	case EventTypeLeave:
+		if ev.Leave != nil {
+			delete(op.mesh, derefString(ev.Leave.Topic, ""))
+		}
+	case EventTypePeerScore:
+		if ev.PeerScore != nil {
+			op.scores[peerKey(ev.PeerScore.PeerID)] = observedScore{score: ev.PeerScore.Score, time: now}
+		}
+	}
+}
+
+// topicContext returns a context whose measurements are tagged with a topic if metrics are tagged
+// with it, otherwise with "other".
+func (n *NetworkObserver) topicContext(ctx context.Context, topic *string) context.Context {
+	return topicContext(ctx, n.topics.Tag(derefString(topic, "")))
+}
+
+// peerKey returns the key used for a peer id in the observed state, which is the id in its binary form
+// whichever form it was sent in.
+func peerKey(b []byte) string {
+	id, err := decodePeerID(b)
+	if err != nil {
+		return string(b)
+	}
+	return string(id)
+}
+
+// observer returns the state of an observing peer, creating it if needed, or nil if the peer id is
+// not valid or maxNetworkObservers peers are already observed. The peer id may be in its binary form
+// or base64 text, as sent by Lotus in peer score events.
+func (n *NetworkObserver) observer(id []byte, now time.Time) *observedPeer {
+	// assumes mutex is held by caller
+	pid, err := decodePeerID(id)
+	if err != nil {
+		return nil
+	}
+	op, ok := n.observers[string(pid)]
+	if !ok {
+		if len(n.observers) >= maxNetworkObservers {
+			for id, op := range n.observers {
+				if now.Sub(op.lastSeen) > networkStaleAfter {
+					delete(n.observers, id)
+				}
+			}
+			if len(n.observers) >= maxNetworkObservers {
+				return nil
+			}
+		}
+		label := pid
+		if n.pseudonyms != nil {
+			label = n.pseudonyms.ID(pid)
+		}
+		op = &observedPeer{
+			label:  label.String(),
+			mesh:   make(map[string]map[string]struct{}),
+			peers:  make(map[string]struct{}),
+			scores: make(map[string]observedScore),
+		}
+		n.observers[string(pid)] = op
+	}
+	op.lastSeen = now
+	return op
+}
+
+// observe reports the mesh size, connected peers and latest peer scores seen by each observing peer.
+func (n *NetworkObserver) observe(_ context.Context, o metric.Observer) error {
+	now := time.Now()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for id, op := range n.observers {
+		if now.Sub(op.lastSeen) > networkStaleAfter {
+			delete(n.observers, id)
+			continue
+		}
+		label := peerIDTag.String(op.label)
+
+		for topic, peers := range op.mesh {
+			o.ObserveInt64(n.meshPeers, int64(len(peers)), metric.WithAttributes(label, topicTag.String(topic)))
+		}
+		o.ObserveInt64(n.connectedPeers, int64(len(op.peers)), metric.WithAttributes(label))
+
+		scores := make([]float64, 0, len(op.scores))
+		for pid, s := range op.scores {
+			if now.Sub(s.time) > networkStaleAfter {
+				delete(op.scores, pid)
+				continue
+			}
+			scores = append(scores, s.score)
+		}
+		o.ObserveInt64(n.scoredPeers, int64(len(scores)), metric.WithAttributes(label))
+		if len(scores) == 0 {
+			continue
+		}
+		sort.Float64s(scores)
+		for _, q := range peerScoreQuantiles {
+			quantile := attribute.String("quantile", strconv.FormatFloat(q, 'g', -1, 64))
+			o.ObserveFloat64(n.peerScore, scores[int(q*float64(len(scores)-1))], metric.WithAttributes(label, quantile))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestNetworkObserverPeerScore(t *testing.T) {
+	addPeer := `{"type":4,"peerID":"` + testObserverID + `","timestamp":1680000000000000000,"addPeer":{"peerID":"` + testOtherID + `","proto":"/meshsub/1.1.0"}}`
+	graft := `{"type":11,"peerID":"` + testObserverID + `","timestamp":1680000000000000000,"graft":{"peerID":"` + testOtherID + `","topic":"/fil/msgs/mainnet"}}`
+	peerScore := `{"type":100,"peerID":"` + testLotusObserverID + `","timestamp":1680000000000000000,"peerScore":{"peerID":"` + testLotusOtherID + `","score":12.5,"appSpecificScore":10,"ipColocationFactor":0,"behaviourPenalty":0,"topics":[{"topic":"/fil/msgs/mainnet","timeInMesh":60000000000,"firstMessageDeliveries":1,"meshMessageDeliveries":2,"invalidMessageDeliveries":0}]}}`
+	removePeer := `{"type":5,"peerID":"` + testObserverID + `","timestamp":1680000000000000000,"removePeer":{"peerID":"` + testOtherID + `"}}`
+
+	otherID, err := peer.IDFromBytes(mustDecodeBase64(t, testOtherID))
+	if err != nil {
+		t.Fatalf("other peer id: %v", err)
+	}
+	other := string(otherID)
+	observerID, err := peer.IDFromBytes(mustDecodeBase64(t, testObserverID))
+	if err != nil {
+		t.Fatalf("observer peer id: %v", err)
+	}
+
+	testCases := []struct {
+		name       string
+		events     []string
+		wantPeers  int
+		wantMesh   int
+		wantScores int
+	}{
+		{
+			name:       "peer score only",
+			events:     []string{peerScore},
+			wantScores: 1,
+		},
+		{
+			name:       "peer score after add peer",
+			events:     []string{addPeer, graft, peerScore},
+			wantPeers:  1,
+			wantMesh:   1,
+			wantScores: 1,
+		},
+		{
+			name:   "remove peer clears score",
+			events: []string{addPeer, graft, peerScore, removePeer},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := NewNetworkObserver(nil, NewMetricSources([]string{"/fil/msgs/mainnet"}))
+			if err != nil {
+				t.Fatalf("NewNetworkObserver: %v", err)
+			}
+
+			now := time.Now()
+			for _, doc := range tc.events {
+				n.Observe(context.Background(), mustParseEvent(t, doc), now)
+			}
+
+			// events sent by the same peer are attributed to one observer whichever form its id was sent in
+			if len(n.observers) != 1 {
+				t.Fatalf("got %d observers, wanted 1", len(n.observers))
+			}
+			var op *observedPeer
+			for _, o := range n.observers {
+				op = o
+			}
+			if op.label != observerID.String() {
+				t.Errorf("got label %q, wanted %q", op.label, observerID.String())
+			}
+
+			if len(op.peers) != tc.wantPeers {
+				t.Errorf("got %d connected peers, wanted %d", len(op.peers), tc.wantPeers)
+			}
+			if got := len(op.mesh["/fil/msgs/mainnet"]); got != tc.wantMesh {
+				t.Errorf("got %d mesh peers, wanted %d", got, tc.wantMesh)
+			}
+			if len(op.scores) != tc.wantScores {
+				t.Errorf("got %d scores, wanted %d", len(op.scores), tc.wantScores)
+			}
+			if tc.wantScores > 0 {
+				s, ok := op.scores[other]
+				if !ok {
+					t.Fatalf("no score recorded for other peer")
+				}
+				if s.score != 12.5 {
+					t.Errorf("got score %v, wanted 12.5", s.score)
+				}
+			}
+		})
+	}
+}
+
+func TestNetworkObserverBounds(t *testing.T) {
+	n, err := NewNetworkObserver(nil, NewMetricSources([]string{"/fil/msgs/mainnet"}))
+	if err != nil {
+		t.Fatalf("NewNetworkObserver: %v", err)
+	}
+
+	tags := func(ctx context.Context) map[attribute.Key]string {
+		m := make(map[attribute.Key]string)
+		kvs, _ := ctx.Value(metricTagsKey{}).([]attribute.KeyValue)
+		for _, kv := range kvs {
+			m[kv.Key] = kv.Value.AsString()
+		}
+		return m
+	}
+
+	t.Run("topics", func(t *testing.T) {
+		known, unknown := "/fil/msgs/mainnet", "/spam/1"
+		if got := tags(n.topicContext(context.Background(), &known))[topicTag]; got != known {
+			t.Errorf("got topic tag %q, wanted %q", got, known)
+		}
+		if got := tags(n.topicContext(context.Background(), &unknown))[topicTag]; got != otherSource {
+			t.Errorf("got topic tag %q, wanted %q", got, otherSource)
+		}
+	})
+
+	t.Run("reasons", func(t *testing.T) {
+		if got := rejectReasonTags.Tag("validation failed"); got != "validation failed" {
+			t.Errorf("got reason tag %q, wanted %q", got, "validation failed")
+		}
+		if got := rejectReasonTags.Tag("made up"); got != otherSource {
+			t.Errorf("got reason tag %q, wanted %q", got, otherSource)
+		}
+	})
+
+	t.Run("mesh", func(t *testing.T) {
+		now := time.Now()
+		for _, topic := range []string{"/fil/msgs/mainnet", "/spam/1"} {
+			doc := `{"type":11,"peerID":"` + testObserverID + `","graft":{"peerID":"` + testOtherID + `","topic":"` + topic + `"}}`
+			n.Observe(context.Background(), mustParseEvent(t, doc), now)
+		}
+		for _, op := range n.observers {
+			if len(op.mesh) != 1 {
+				t.Errorf("got mesh for %d topics, wanted 1", len(op.mesh))
+			}
+		}
+	})
+
+	t.Run("observers", func(t *testing.T) {
+		now := time.Now()
+		n.observers = make(map[string]*observedPeer)
+		for i := 0; i < maxNetworkObservers; i++ {
+			n.observers[strconv.Itoa(i)] = &observedPeer{lastSeen: now}
+		}
+		if op := n.observer(mustDecodeBase64(t, testObserverID), now); op != nil {
+			t.Errorf("new observer added beyond maximum")
+		}
+
+		// idle observers are discarded to make room
+		n.observers["0"].lastSeen = now.Add(-networkStaleAfter - time.Second)
+		if op := n.observer(mustDecodeBase64(t, testObserverID), now); op == nil {
+			t.Errorf("new observer not added after idle observer discarded")
+		}
+		if len(n.observers) != maxNetworkObservers {
+			t.Errorf("got %d observers, wanted %d", len(n.observers), maxNetworkObservers)
+		}
+	})
+}
+
+func TestDecodePeerID(t *testing.T) {
+	binary := mustDecodeBase64(t, testOtherID)
+	want, err := peer.IDFromBytes(binary)
+	if err != nil {
+		t.Fatalf("peer id: %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "binary", data: binary},
+		{name: "base64 text", data: mustDecodeBase64(t, testLotusOtherID)},
+		{name: "empty", data: []byte{}, wantErr: true},
+		{name: "invalid", data: []byte("not a peer id"), wantErr: true},
+		{name: "base64 of invalid", data: []byte("bm90IGEgcGVlciBpZA=="), wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := decodePeerID(tc.data)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got %q, wanted error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if !bytes.Equal([]byte(got), []byte(want)) {
+				t.Errorf("got %s, wanted %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// This file decodes trace events written in the protobuf format defined by go-libp2p-pubsub
+// in https://github.com/libp2p/go-libp2p-pubsub/blob/master/pb/trace.proto
+
+// pbFieldFunc is called for each field of a protobuf message with the field number, wire type
+// and the remaining bytes of the message. It returns the number of bytes consumed by the field's
+// value or a negative number if the field could not be parsed.
+type pbFieldFunc func(num protowire.Number, typ protowire.Type, b []byte) int
+
+// decodePBMessage calls fn for each field of a protobuf message. Fields that are not consumed by
+// fn, indicated by it returning zero, are skipped.
+func decodePBMessage(b []byte, fn pbFieldFunc) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n = fn(num, typ, b)
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("field %d: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// pbDecoder accumulates the first error encountered while decoding the fields of a message.
+type pbDecoder struct {
+	err error
+}
+
+func (d *pbDecoder) bytes(typ protowire.Type, b []byte, dst *[]byte) int {
+	if typ != protowire.BytesType {
+		return -1
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n >= 0 {
+		*dst = append([]byte(nil), v...)
+	}
+	return n
+}
+
+func (d *pbDecoder) repeatedBytes(typ protowire.Type, b []byte, dst *[][]byte) int {
+	var v []byte
+	n := d.bytes(typ, b, &v)
+	if n >= 0 {
+		*dst = append(*dst, v)
+	}
+	return n
+}
+
+func (d *pbDecoder) string(typ protowire.Type, b []byte, dst **string) int {
+	if typ != protowire.BytesType {
+		return -1
+	}
+	v, n := protowire.ConsumeString(b)
+	if n >= 0 {
+		*dst = &v
+	}
+	return n
+}
+
+func (d *pbDecoder) varint(typ protowire.Type, b []byte) (uint64, int) {
+	if typ != protowire.VarintType {
+		return 0, -1
+	}
+	return protowire.ConsumeVarint(b)
+}
+
+// message decodes an embedded message using fn.
+func (d *pbDecoder) message(typ protowire.Type, b []byte, fn pbFieldFunc) int {
+	if typ != protowire.BytesType {
+		return -1
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n
+	}
+	if err := decodePBMessage(v, fn); err != nil && d.err == nil {
+		d.err = err
+	}
+	return n
+}
+
+// decodePBTraceEvent decodes a single TraceEvent message.
+func decodePBTraceEvent(b []byte) (*TraceEvent, error) {
+	d := new(pbDecoder)
+	ev := new(TraceEvent)
+
+	err := decodePBMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			v, n := d.varint(typ, b)
+			if n >= 0 {
+				et := EventType(int64(v))
+				ev.Type = &et
+			}
+			return n
+		case 2:
+			return d.bytes(typ, b, &ev.PeerID)
+		case 3:
+			v, n := d.varint(typ, b)
+			if n >= 0 {
+				ts := int64(v)
+				ev.Timestamp = &ts
+			}
+			return n
+		case 4:
+			ev.PublishMessage = new(PublishMessageEvent)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return d.bytes(typ, b, &ev.PublishMessage.MessageID)
+				case 2:
+					return d.string(typ, b, &ev.PublishMessage.Topic)
+				}
+				return 0
+			})
+		case 5:
+			ev.RejectMessage = new(RejectMessageEvent)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return d.bytes(typ, b, &ev.RejectMessage.MessageID)
+				case 2:
+					return d.bytes(typ, b, &ev.RejectMessage.ReceivedFrom)
+				case 3:
+					return d.string(typ, b, &ev.RejectMessage.Reason)
+				case 4:
+					return d.string(typ, b, &ev.RejectMessage.Topic)
+				}
+				return 0
+			})
+		case 6:
+			ev.DuplicateMessage = new(DuplicateMessageEvent)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return d.bytes(typ, b, &ev.DuplicateMessage.MessageID)
+				case 2:
+					return d.bytes(typ, b, &ev.DuplicateMessage.ReceivedFrom)
+				case 3:
+					return d.string(typ, b, &ev.DuplicateMessage.Topic)
+				}
+				return 0
+			})
+		case 7:
+			ev.DeliverMessage = new(DeliverMessageEvent)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return d.bytes(typ, b, &ev.DeliverMessage.MessageID)
+				case 2:
+					return d.string(typ, b, &ev.DeliverMessage.Topic)
+				case 3:
+					return d.bytes(typ, b, &ev.DeliverMessage.ReceivedFrom)
+				}
+				return 0
+			})
+		case 8:
+			ev.AddPeer = new(AddPeerEvent)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return d.bytes(typ, b, &ev.AddPeer.PeerID)
+				case 2:
+					return d.string(typ, b, &ev.AddPeer.Proto)
+				}
+				return 0
+			})
+		case 9:
+			ev.RemovePeer = new(RemovePeerEvent)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				if num == 1 {
+					return d.bytes(typ, b, &ev.RemovePeer.PeerID)
+				}
+				return 0
+			})
+		case 10:
+			ev.RecvRPC = new(RecvRPCEvent)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return d.bytes(typ, b, &ev.RecvRPC.ReceivedFrom)
+				case 2:
+					ev.RecvRPC.Meta = new(RPCMetaEvent)
+					return d.message(typ, b, d.rpcMeta(ev.RecvRPC.Meta))
+				}
+				return 0
+			})
+		case 11:
+			ev.SendRPC = new(SendRPCEvent)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return d.bytes(typ, b, &ev.SendRPC.SendTo)
+				case 2:
+					ev.SendRPC.Meta = new(RPCMetaEvent)
+					return d.message(typ, b, d.rpcMeta(ev.SendRPC.Meta))
+				}
+				return 0
+			})
+		case 12:
+			ev.DropRPC = new(DropRPCEvent)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return d.bytes(typ, b, &ev.DropRPC.SendTo)
+				case 2:
+					ev.DropRPC.Meta = new(RPCMetaEvent)
+					return d.message(typ, b, d.rpcMeta(ev.DropRPC.Meta))
+				}
+				return 0
+			})
+		case 13:
+			ev.Join = new(JoinEvent)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				if num == 1 {
+					return d.string(typ, b, &ev.Join.Topic)
+				}
+				return 0
+			})
+		case 14:
+			ev.Leave = new(LeaveEvent)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				if num == 2 {
+					return d.string(typ, b, &ev.Leave.Topic)
+				}
+				return 0
+			})
+		case 15:
+			ev.Graft = new(GraftEvent)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return d.bytes(typ, b, &ev.Graft.PeerID)
+				case 2:
+					return d.string(typ, b, &ev.Graft.Topic)
+				}
+				return 0
+			})
+		case 16:
+			ev.Prune = new(PruneEvent)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return d.bytes(typ, b, &ev.Prune.PeerID)
+				case 2:
+					return d.string(typ, b, &ev.Prune.Topic)
+				}
+				return 0
+			})
+		}
+		return 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if ev.Type == nil {
+		return nil, errors.New("event has no type")
+	}
+	return ev, nil
+}
+
+func (d *pbDecoder) rpcMeta(meta *RPCMetaEvent) pbFieldFunc {
+	return func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			mm := new(MessageMetaEvent)
+			meta.Messages = append(meta.Messages, mm)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return d.bytes(typ, b, &mm.MessageID)
+				case 2:
+					return d.string(typ, b, &mm.Topic)
+				}
+				return 0
+			})
+		case 2:
+			sm := new(SubMetaEvent)
+			meta.Subscription = append(meta.Subscription, sm)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					v, n := d.varint(typ, b)
+					if n >= 0 {
+						sub := protowire.DecodeBool(v)
+						sm.Subscribe = &sub
+					}
+					return n
+				case 2:
+					return d.string(typ, b, &sm.Topic)
+				}
+				return 0
+			})
+		case 3:
+			meta.Control = new(ControlMetaEvent)
+			return d.message(typ, b, d.controlMeta(meta.Control))
+		}
+		return 0
+	}
+}
+
+func (d *pbDecoder) controlMeta(ctl *ControlMetaEvent) pbFieldFunc {
+	return func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			ih := new(ControlIHaveMetaEvent)
+			ctl.Ihave = append(ctl.Ihave, ih)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return d.string(typ, b, &ih.Topic)
+				case 2:
+					return d.repeatedBytes(typ, b, &ih.MessageIDs)
+				}
+				return 0
+			})
+		case 2:
+			iw := new(ControlIWantMetaEvent)
+			ctl.Iwant = append(ctl.Iwant, iw)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				if num == 1 {
+					return d.repeatedBytes(typ, b, &iw.MessageIDs)
+				}
+				return 0
+			})
+		case 3:
+			gr := new(ControlGraftMetaEvent)
+			ctl.Graft = append(ctl.Graft, gr)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				if num == 1 {
+					return d.string(typ, b, &gr.Topic)
+				}
+				return 0
+			})
+		case 4:
+			pr := new(ControlPruneMetaEvent)
+			ctl.Prune = append(ctl.Prune, pr)
+			return d.message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					return d.string(typ, b, &pr.Topic)
+				case 2:
+					return d.repeatedBytes(typ, b, &pr.Peers)
+				}
+				return 0
+			})
+		}
+		return 0
+	}
+}
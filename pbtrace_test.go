@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Peer ids in their binary form, base64 encoded as they are in json trace events.
+const (
+	testObserverID = "ACQIARIgdW9lSDAUXbBP5cEuIUugYQrYpZjnmK3OvgbjWRTnWkw="
+	testOtherID    = "ACQIARIg9lgKzoq9yXaYc7PhBPFqxkVfd9bNmDgNU1KZwLRzJVg="
+)
+
+func mustParseEvent(t *testing.T, doc string) *TraceEvent {
+	t.Helper()
+	ev := new(TraceEvent)
+	if err := json.Unmarshal([]byte(doc), ev); err != nil {
+		t.Fatalf("unmarshal event: %v", err)
+	}
+	return ev
+}
+
+func mustDecodeBase64(t *testing.T, s string) []byte {
+	t.Helper()
+	var b []byte
+	if err := json.Unmarshal([]byte(`"`+s+`"`), &b); err != nil {
+		t.Fatalf("decode base64: %v", err)
+	}
+	return b
+}
+
+func pbVarint(num protowire.Number, v uint64) []byte {
+	b := protowire.AppendTag(nil, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func pbBytes(num protowire.Number, v []byte) []byte {
+	b := protowire.AppendTag(nil, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func pbString(num protowire.Number, v string) []byte {
+	return pbBytes(num, []byte(v))
+}
+
+func pbMessage(num protowire.Number, fields ...[]byte) []byte {
+	return pbBytes(num, bytes.Join(fields, nil))
+}
+
+func TestDecodePBTraceEvent(t *testing.T) {
+	observerID := mustDecodeBase64(t, testObserverID)
+	otherID := mustDecodeBase64(t, testOtherID)
+	const ts = 1680000000000000000
+
+	testCases := []struct {
+		name    string
+		fields  [][]byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "publish message",
+			fields: [][]byte{
+				pbVarint(1, uint64(EventTypePublishMessage)),
+				pbBytes(2, observerID),
+				pbVarint(3, ts),
+				pbMessage(4, pbBytes(1, []byte("msg1")), pbString(2, "/fil/msgs/mainnet")),
+			},
+			want: `{"type":0,"peerID":"` + testObserverID + `","timestamp":1680000000000000000,"publishMessage":{"messageID":"bXNnMQ==","topic":"/fil/msgs/mainnet"}}`,
+		},
+		{
+			name: "reject message",
+			fields: [][]byte{
+				pbVarint(1, uint64(EventTypeRejectMessage)),
+				pbMessage(5, pbBytes(1, []byte("msg1")), pbBytes(2, otherID), pbString(3, "validation failed"), pbString(4, "/fil/msgs/mainnet")),
+			},
+			want: `{"type":1,"rejectMessage":{"messageID":"bXNnMQ==","receivedFrom":"` + testOtherID + `","reason":"validation failed","topic":"/fil/msgs/mainnet"}}`,
+		},
+		{
+			name: "deliver message",
+			fields: [][]byte{
+				pbVarint(1, uint64(EventTypeDeliverMessage)),
+				pbMessage(7, pbBytes(1, []byte("msg1")), pbString(2, "/fil/msgs/mainnet"), pbBytes(3, otherID)),
+			},
+			want: `{"type":3,"deliverMessage":{"messageID":"bXNnMQ==","topic":"/fil/msgs/mainnet","receivedFrom":"` + testOtherID + `"}}`,
+		},
+		{
+			name: "add peer",
+			fields: [][]byte{
+				pbVarint(1, uint64(EventTypeAddPeer)),
+				pbMessage(8, pbBytes(1, otherID), pbString(2, "/meshsub/1.1.0")),
+			},
+			want: `{"type":4,"addPeer":{"peerID":"` + testOtherID + `","proto":"/meshsub/1.1.0"}}`,
+		},
+		{
+			name: "leave topic is field 2",
+			fields: [][]byte{
+				pbVarint(1, uint64(EventTypeLeave)),
+				pbMessage(14, pbString(1, "ignored"), pbString(2, "/fil/msgs/mainnet")),
+			},
+			want: `{"type":10,"leave":{"topic":"/fil/msgs/mainnet"}}`,
+		},
+		{
+			name: "recv rpc with meta",
+			fields: [][]byte{
+				pbVarint(1, uint64(EventTypeRecvRPC)),
+				pbMessage(10,
+					pbBytes(1, otherID),
+					pbMessage(2,
+						pbMessage(1, pbBytes(1, []byte("msg1")), pbString(2, "/fil/msgs/mainnet")),
+						pbMessage(2, pbVarint(1, 1), pbString(2, "/fil/blocks/mainnet")),
+						pbMessage(3,
+							pbMessage(1, pbString(1, "/fil/msgs/mainnet"), pbBytes(2, []byte("msg1")), pbBytes(2, []byte("msg2"))),
+							pbMessage(2, pbBytes(1, []byte("msg3"))),
+							pbMessage(3, pbString(1, "/fil/msgs/mainnet")),
+							pbMessage(4, pbString(1, "/fil/blocks/mainnet"), pbBytes(2, observerID)),
+						),
+					),
+				),
+			},
+			want: `{"type":6,"recvRPC":{"receivedFrom":"` + testOtherID + `","meta":{` +
+				`"messages":[{"messageID":"bXNnMQ==","topic":"/fil/msgs/mainnet"}],` +
+				`"subscription":[{"subscribe":true,"topic":"/fil/blocks/mainnet"}],` +
+				`"control":{"ihave":[{"topic":"/fil/msgs/mainnet","messageIDs":["bXNnMQ==","bXNnMg=="]}],` +
+				`"iwant":[{"messageIDs":["bXNnMw=="]}],` +
+				`"graft":[{"topic":"/fil/msgs/mainnet"}],` +
+				`"prune":[{"topic":"/fil/blocks/mainnet","peers":["` + testObserverID + `"]}]}}}}`,
+		},
+		{
+			name: "unknown fields skipped",
+			fields: [][]byte{
+				pbVarint(1, uint64(EventTypeJoin)),
+				pbVarint(99, 7),
+				protowire.AppendFixed32(protowire.AppendTag(nil, 98, protowire.Fixed32Type), 7),
+				pbMessage(13, pbString(1, "/fil/msgs/mainnet"), pbString(5, "unknown")),
+			},
+			want: `{"type":9,"join":{"topic":"/fil/msgs/mainnet"}}`,
+		},
+		{
+			name: "unknown event type",
+			fields: [][]byte{
+				pbVarint(1, 50),
+				pbBytes(2, observerID),
+			},
+			want: `{"type":50,"peerID":"` + testObserverID + `"}`,
+		},
+		{
+			name:    "empty",
+			wantErr: true,
+		},
+		{
+			name: "no type",
+			fields: [][]byte{
+				pbBytes(2, observerID),
+				pbVarint(3, ts),
+			},
+			wantErr: true,
+		},
+		{
+			name: "truncated",
+			fields: [][]byte{
+				pbVarint(1, uint64(EventTypeAddPeer)),
+				pbMessage(8, pbBytes(1, otherID))[:10],
+			},
+			wantErr: true,
+		},
+		{
+			name: "truncated tag",
+			fields: [][]byte{
+				pbVarint(1, uint64(EventTypeJoin)),
+				{0x80},
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong wire type",
+			fields: [][]byte{
+				pbString(1, "join"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong wire type in embedded message",
+			fields: [][]byte{
+				pbVarint(1, uint64(EventTypeJoin)),
+				pbMessage(13, pbVarint(1, 1)),
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid embedded message",
+			fields: [][]byte{
+				pbVarint(1, uint64(EventTypeJoin)),
+				pbBytes(13, []byte{0x0a, 0x05, 'a'}),
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ev, err := decodePBTraceEvent(bytes.Join(tc.fields, nil))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got no error, wanted one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodePBTraceEvent: %v", err)
+			}
+
+			got, err := json.Marshal(ev)
+			if err != nil {
+				t.Fatalf("marshal event: %v", err)
+			}
+			want, err := json.Marshal(mustParseEvent(t, tc.want))
+			if err != nil {
+				t.Fatalf("marshal wanted event: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("got %s\nwanted %s", got, want)
+			}
+		})
+	}
+}
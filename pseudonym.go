@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"os"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/urfave/cli/v2"
+)
+
+// Modes in which peer ids are replaced by pseudonyms.
+const (
+	PseudonymiseOff    = "off"    // peer ids are stored and exported unchanged
+	PseudonymiseStore  = "store"  // peer ids are replaced before events are stored
+	PseudonymiseExport = "export" // peer ids are stored unchanged and replaced when events are exported
+)
+
+// minPseudonymKeySize is the minimum size in bytes of the key used to derive pseudonyms.
+const minPseudonymKeySize = 16
+
+// pseudonymFlags are the flags that configure the replacement of peer ids by pseudonyms.
+var pseudonymFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:        "pseudonymise",
+		Usage:       "Replace peer ids with stable pseudonyms: 'off', 'store' to replace them before events are stored or 'export' to replace them only when events are exported",
+		EnvVars:     []string{envPrefix + "PSEUDONYMISE"},
+		Value:       PseudonymiseOff,
+		Destination: &options.pseudonymise,
+	},
+	&cli.StringFlag{
+		Name:        "pseudonym-key-file",
+		Usage:       "Read the secret key used to derive pseudonyms from `FILE`. Required unless --pseudonymise is off.",
+		EnvVars:     []string{envPrefix + "PSEUDONYM_KEY_FILE"},
+		Destination: &options.pseudonymKeyFile,
+	},
+}
+
+// newPseudonymiserFromOptions returns the Pseudonymiser configured by the pseudonym flags if they select
+// the given mode, otherwise nil.
+func newPseudonymiserFromOptions(mode string) (*Pseudonymiser, error) {
+	switch options.pseudonymise {
+	case PseudonymiseOff, PseudonymiseStore, PseudonymiseExport:
+	default:
+		return nil, fmt.Errorf("unsupported pseudonymise mode %q, must be %q, %q or %q", options.pseudonymise, PseudonymiseOff, PseudonymiseStore, PseudonymiseExport)
+	}
+	if options.pseudonymise != mode {
+		return nil, nil
+	}
+	if options.pseudonymKeyFile == "" {
+		return nil, fmt.Errorf("--pseudonym-key-file is required when --pseudonymise is %s", options.pseudonymise)
+	}
+	key, err := os.ReadFile(options.pseudonymKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read pseudonym key: %w", err)
+	}
+	return NewPseudonymiser(bytes.TrimSpace(key))
+}
+
+// Pseudonymiser replaces peer ids with pseudonyms derived from a secret key. The same peer id always
+// has the same pseudonym for a key, so events for a peer can still be related, but the peer id cannot
+// be recovered without the key. Pseudonyms are valid peer ids.
+type Pseudonymiser struct {
+	key []byte
+}
+
+// NewPseudonymiser creates a Pseudonymiser that derives pseudonyms using key.
+func NewPseudonymiser(key []byte) (*Pseudonymiser, error) {
+	if len(key) < minPseudonymKeySize {
+		return nil, fmt.Errorf("pseudonym key must be at least %d bytes", minPseudonymKeySize)
+	}
+	return &Pseudonymiser{key: key}, nil
+}
+
+// ID returns the pseudonym of a peer id.
+func (p *Pseudonymiser) ID(id peer.ID) peer.ID {
+	h := hmac.New(sha256.New, p.key)
+	h.Write([]byte(id))
+	encoded, err := mh.Encode(h.Sum(nil), mh.SHA2_256)
+	if err != nil {
+		// cannot happen, the digest length matches the hash function
+		panic(err)
+	}
+	return peer.ID(encoded)
+}
+
+// String returns the pseudonym of a peer id in its string form, or an empty string if s is not a
+// valid peer id.
+func (p *Pseudonymiser) String(s string) string {
+	id, err := peer.Decode(s)
+	if err != nil {
+		return ""
+	}
+	return p.ID(id).String()
+}
+
+// bytes returns the pseudonym of a peer id in its binary form, or nil if b is not a valid peer id
+// so that the id is not stored.
+func (p *Pseudonymiser) bytes(b []byte) []byte {
+	if len(b) == 0 {
+		return b
+	}
+	id, err := decodePeerID(b)
+	if err != nil {
+		return nil
+	}
+	return []byte(p.ID(id))
+}
+
+// Event replaces every peer id in an event with its pseudonym. The event as received is discarded
+// since it contains the original peer ids.
+func (p *Pseudonymiser) Event(ev *TraceEvent) {
+	ev.Raw = nil
+	ev.PeerID = p.bytes(ev.PeerID)
+
+	if sub := ev.RejectMessage; sub != nil {
+		sub.ReceivedFrom = p.bytes(sub.ReceivedFrom)
+	}
+	if sub := ev.DuplicateMessage; sub != nil {
+		sub.ReceivedFrom = p.bytes(sub.ReceivedFrom)
+	}
+	if sub := ev.DeliverMessage; sub != nil {
+		sub.ReceivedFrom = p.bytes(sub.ReceivedFrom)
+	}
+	if sub := ev.AddPeer; sub != nil {
+		sub.PeerID = p.bytes(sub.PeerID)
+	}
+	if sub := ev.RemovePeer; sub != nil {
+		sub.PeerID = p.bytes(sub.PeerID)
+	}
+	if sub := ev.RecvRPC; sub != nil {
+		sub.ReceivedFrom = p.bytes(sub.ReceivedFrom)
+		p.rpcMeta(sub.Meta)
+	}
+	if sub := ev.SendRPC; sub != nil {
+		sub.SendTo = p.bytes(sub.SendTo)
+		p.rpcMeta(sub.Meta)
+	}
+	if sub := ev.DropRPC; sub != nil {
+		sub.SendTo = p.bytes(sub.SendTo)
+		p.rpcMeta(sub.Meta)
+	}
+	if sub := ev.Graft; sub != nil {
+		sub.PeerID = p.bytes(sub.PeerID)
+	}
+	if sub := ev.Prune; sub != nil {
+		sub.PeerID = p.bytes(sub.PeerID)
+	}
+	if sub := ev.PeerScore; sub != nil {
+		sub.PeerID = p.bytes(sub.PeerID)
+	}
+}
+
+func (p *Pseudonymiser) rpcMeta(meta *RPCMetaEvent) {
+	if meta == nil || meta.Control == nil {
+		return
+	}
+	for _, prune := range meta.Control.Prune {
+		if prune == nil {
+			continue
+		}
+		for i := range prune.Peers {
+			prune.Peers[i] = p.bytes(prune.Peers[i])
+		}
+	}
+}
+
+// pseudonymColumns are the columns of exported rows that hold peer ids.
+var pseudonymColumns = []string{"peer_id", "received_from", "other_peer_id"}
+
+// Row replaces the peer ids in an exported row with their pseudonyms. Values that are not valid peer
+// ids are removed so that they are exported as null, as is done for ids that were not stored.
+func (p *Pseudonymiser) Row(r exportRow) {
+	for _, col := range pseudonymColumns {
+		s, ok := r[col].(string)
+		if !ok {
+			continue
+		}
+		if pseudonym := p.String(s); pseudonym != "" {
+			r[col] = pseudonym
+		} else {
+			delete(r, col)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const testPseudonymKey = "0123456789abcdef0123456789abcdef"
+
+// Lotus sends the peer ids in peer score events as base64 text, which is base64 encoded again when the
+// event is encoded to json.
+const (
+	testLotusObserverID = "QUNRSUFSSWdkVzlsU0RBVVhiQlA1Y0V1SVV1Z1lRcllwWmpubUszT3ZnYmpXUlRuV2t3PQ=="
+	testLotusOtherID    = "QUNRSUFSSWc5bGdLem9xOXlYYVljN1BoQlBGcXhrVmZkOWJObURnTlUxS1p3TFJ6SlZnPQ=="
+)
+
+func newTestPseudonymiser(t *testing.T, key string) *Pseudonymiser {
+	t.Helper()
+	p, err := NewPseudonymiser([]byte(key))
+	if err != nil {
+		t.Fatalf("NewPseudonymiser: %v", err)
+	}
+	return p
+}
+
+func TestNewPseudonymiser(t *testing.T) {
+	testCases := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{name: "empty", key: "", wantErr: true},
+		{name: "short", key: strings.Repeat("k", minPseudonymKeySize-1), wantErr: true},
+		{name: "minimum", key: strings.Repeat("k", minPseudonymKeySize)},
+		{name: "long", key: testPseudonymKey},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewPseudonymiser([]byte(tc.key))
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got error %v, wanted error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPseudonymiserID(t *testing.T) {
+	observerID, err := peer.IDFromBytes(mustDecodeBase64(t, testObserverID))
+	if err != nil {
+		t.Fatalf("observer peer id: %v", err)
+	}
+	otherID, err := peer.IDFromBytes(mustDecodeBase64(t, testOtherID))
+	if err != nil {
+		t.Fatalf("other peer id: %v", err)
+	}
+
+	p := newTestPseudonymiser(t, testPseudonymKey)
+	pseudonym := p.ID(observerID)
+
+	if pseudonym == observerID {
+		t.Errorf("pseudonym is the peer id")
+	}
+	if err := pseudonym.Validate(); err != nil {
+		t.Errorf("pseudonym is not a valid peer id: %v", err)
+	}
+	if got := p.ID(observerID); got != pseudonym {
+		t.Errorf("got pseudonym %s on second call, wanted %s", got, pseudonym)
+	}
+	if got := newTestPseudonymiser(t, testPseudonymKey).ID(observerID); got != pseudonym {
+		t.Errorf("got pseudonym %s from same key, wanted %s", got, pseudonym)
+	}
+	if got := newTestPseudonymiser(t, strings.ToUpper(testPseudonymKey)).ID(observerID); got == pseudonym {
+		t.Errorf("got same pseudonym from different key")
+	}
+	if got := p.ID(otherID); got == pseudonym {
+		t.Errorf("got same pseudonym for different peer ids")
+	}
+}
+
+func TestPseudonymiserBytes(t *testing.T) {
+	p := newTestPseudonymiser(t, testPseudonymKey)
+	observerID, err := peer.IDFromBytes(mustDecodeBase64(t, testObserverID))
+	if err != nil {
+		t.Fatalf("observer peer id: %v", err)
+	}
+	pseudonym := []byte(p.ID(observerID))
+
+	testCases := []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{name: "empty", in: []byte{}, want: []byte{}},
+		{name: "binary", in: mustDecodeBase64(t, testObserverID), want: pseudonym},
+		// Lotus sends peer ids in peer score events as base64 text
+		{name: "base64 text", in: []byte(testObserverID), want: pseudonym},
+		{name: "invalid", in: []byte("not a peer id"), want: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := p.bytes(tc.in)
+			if !bytes.Equal(got, tc.want) || (got == nil) != (tc.want == nil) {
+				t.Errorf("got %x, wanted %x", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPseudonymiserEvent(t *testing.T) {
+	p := newTestPseudonymiser(t, testPseudonymKey)
+	otherID, err := peer.IDFromBytes(mustDecodeBase64(t, testOtherID))
+	if err != nil {
+		t.Fatalf("other peer id: %v", err)
+	}
+	otherPseudonym := []byte(p.ID(otherID))
+
+	peerID := `"peerID":"` + testObserverID + `"`
+	testCases := []struct {
+		name  string
+		doc   string
+		other func(ev *TraceEvent) [][]byte
+	}{
+		{
+			name: "reject message",
+			doc:  `{"type":1,` + peerID + `,"rejectMessage":{"messageID":"bXNnMQ==","receivedFrom":"` + testOtherID + `"}}`,
+			other: func(ev *TraceEvent) [][]byte {
+				return [][]byte{ev.RejectMessage.ReceivedFrom}
+			},
+		},
+		{
+			name: "duplicate message",
+			doc:  `{"type":2,` + peerID + `,"duplicateMessage":{"messageID":"bXNnMQ==","receivedFrom":"` + testOtherID + `"}}`,
+			other: func(ev *TraceEvent) [][]byte {
+				return [][]byte{ev.DuplicateMessage.ReceivedFrom}
+			},
+		},
+		{
+			name: "deliver message",
+			doc:  `{"type":3,` + peerID + `,"deliverMessage":{"messageID":"bXNnMQ==","receivedFrom":"` + testOtherID + `"}}`,
+			other: func(ev *TraceEvent) [][]byte {
+				return [][]byte{ev.DeliverMessage.ReceivedFrom}
+			},
+		},
+		{
+			name: "add peer",
+			doc:  `{"type":4,` + peerID + `,"addPeer":{"peerID":"` + testOtherID + `"}}`,
+			other: func(ev *TraceEvent) [][]byte {
+				return [][]byte{ev.AddPeer.PeerID}
+			},
+		},
+		{
+			name: "remove peer",
+			doc:  `{"type":5,` + peerID + `,"removePeer":{"peerID":"` + testOtherID + `"}}`,
+			other: func(ev *TraceEvent) [][]byte {
+				return [][]byte{ev.RemovePeer.PeerID}
+			},
+		},
+		{
+			name: "recv rpc",
+			doc:  `{"type":6,` + peerID + `,"recvRPC":{"receivedFrom":"` + testOtherID + `","meta":{"control":{"prune":[{"topic":"t","peers":["` + testOtherID + `"]}]}}}}`,
+			other: func(ev *TraceEvent) [][]byte {
+				return [][]byte{ev.RecvRPC.ReceivedFrom, ev.RecvRPC.Meta.Control.Prune[0].Peers[0]}
+			},
+		},
+		{
+			name: "send rpc",
+			doc:  `{"type":7,` + peerID + `,"sendRPC":{"sendTo":"` + testOtherID + `","meta":{"control":{"prune":[{"topic":"t","peers":["` + testOtherID + `"]}]}}}}`,
+			other: func(ev *TraceEvent) [][]byte {
+				return [][]byte{ev.SendRPC.SendTo, ev.SendRPC.Meta.Control.Prune[0].Peers[0]}
+			},
+		},
+		{
+			name: "drop rpc",
+			doc:  `{"type":8,` + peerID + `,"dropRPC":{"sendTo":"` + testOtherID + `"}}`,
+			other: func(ev *TraceEvent) [][]byte {
+				return [][]byte{ev.DropRPC.SendTo}
+			},
+		},
+		{
+			name: "graft",
+			doc:  `{"type":11,` + peerID + `,"graft":{"peerID":"` + testOtherID + `","topic":"t"}}`,
+			other: func(ev *TraceEvent) [][]byte {
+				return [][]byte{ev.Graft.PeerID}
+			},
+		},
+		{
+			name: "prune",
+			doc:  `{"type":12,` + peerID + `,"prune":{"peerID":"` + testOtherID + `","topic":"t"}}`,
+			other: func(ev *TraceEvent) [][]byte {
+				return [][]byte{ev.Prune.PeerID}
+			},
+		},
+		{
+			name: "lotus peer score",
+			doc:  `{"type":100,"peerID":"` + testLotusObserverID + `","peerScore":{"peerID":"` + testLotusOtherID + `","score":1}}`,
+			other: func(ev *TraceEvent) [][]byte {
+				return [][]byte{ev.PeerScore.PeerID}
+			},
+		},
+	}
+
+	observerPseudonym := p.bytes(mustDecodeBase64(t, testObserverID))
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ev := mustParseEvent(t, tc.doc)
+			ev.Raw = json.RawMessage(tc.doc)
+			p.Event(ev)
+
+			if ev.Raw != nil {
+				t.Errorf("event as received was not discarded")
+			}
+			if !bytes.Equal(ev.PeerID, observerPseudonym) {
+				t.Errorf("got peer id %x, wanted %x", ev.PeerID, observerPseudonym)
+			}
+			for i, got := range tc.other(ev) {
+				if !bytes.Equal(got, otherPseudonym) {
+					t.Errorf("other peer id %d: got %x, wanted %x", i, got, otherPseudonym)
+				}
+			}
+		})
+	}
+}
+
+func TestPseudonymiserRow(t *testing.T) {
+	p := newTestPseudonymiser(t, testPseudonymKey)
+	observerID, err := peer.IDFromBytes(mustDecodeBase64(t, testObserverID))
+	if err != nil {
+		t.Fatalf("observer peer id: %v", err)
+	}
+	otherID, err := peer.IDFromBytes(mustDecodeBase64(t, testOtherID))
+	if err != nil {
+		t.Fatalf("other peer id: %v", err)
+	}
+
+	row := exportRow{
+		"peer_id":       observerID.String(),
+		"received_from": otherID.String(),
+		"other_peer_id": "not a peer id",
+		"topic":         observerID.String(),
+		"score":         1.5,
+		"timestamp":     time.Unix(1680000000, 0),
+	}
+	p.Row(row)
+
+	want := exportRow{
+		"peer_id":       p.ID(observerID).String(),
+		"received_from": p.ID(otherID).String(),
+		"topic":         observerID.String(),
+		"score":         1.5,
+	}
+	for col, v := range want {
+		if row[col] != v {
+			t.Errorf("%s: got %v, wanted %v", col, row[col], v)
+		}
+	}
+	if v, ok := row["other_peer_id"]; ok {
+		t.Errorf("other_peer_id: got %v, wanted it to be removed", v)
+	}
+
+	// the removed id is written as null and omitted from trace events
+	var buf bytes.Buffer
+	if err := (&ndjsonExportWriter{w: &buf, cols: []string{"other_peer_id"}}).Write(row); err != nil {
+		t.Fatalf("ndjson writer: %v", err)
+	}
+	if got := buf.String(); got != `{"other_peer_id":null}`+"\n" {
+		t.Errorf("got ndjson %q, wanted null other_peer_id", got)
+	}
+	buf.Reset()
+	if err := (&traceExportWriter{enc: json.NewEncoder(&buf), def: exportDefs[EventTypeAddPeer]}).Write(row); err != nil {
+		t.Fatalf("trace writer: %v", err)
+	}
+	ev := mustParseEvent(t, buf.String())
+	if ev.AddPeer == nil || ev.AddPeer.PeerID != nil {
+		t.Errorf("got add peer %+v, wanted no peer id", ev.AddPeer)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// sourceLimiterIdleTimeout is how long a source's limiters are retained after the source was last seen.
+	sourceLimiterIdleTimeout = 10 * time.Minute
+
+	// defaultMaxLimitedSources is the number of sources given their own limiters. Sources seen once
+	// this many are tracked share a single set of limiters until idle sources are removed.
+	defaultMaxLimitedSources = 10000
+)
+
+// SourceLimiter applies token bucket rate limits to the events and bytes received from each source.
+type SourceLimiter struct {
+	eventsPerSec float64
+	bytesPerSec  float64
+	maxSources   int
+
+	mu        sync.Mutex
+	sources   map[string]*sourceLimits
+	overflow  *sourceLimits // shared by sources seen once maxSources are tracked
+	lastSweep time.Time
+}
+
+type sourceLimits struct {
+	events   *rate.Limiter
+	bytes    *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewSourceLimiter creates a limiter that allows each source to send eventsPerSec events and
+// bytesPerSec bytes per second, with bursts of up to one second's allowance. A limit of zero
+// disables limiting of that quantity.
+func NewSourceLimiter(eventsPerSec, bytesPerSec float64) *SourceLimiter {
+	return &SourceLimiter{
+		eventsPerSec: eventsPerSec,
+		bytesPerSec:  bytesPerSec,
+		maxSources:   defaultMaxLimitedSources,
+		sources:      make(map[string]*sourceLimits),
+	}
+}
+
+// Enabled reports whether any limits are configured.
+func (l *SourceLimiter) Enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enabled()
+}
+
+func (l *SourceLimiter) enabled() bool {
+	// assumes mutex is held by caller
+	return l.eventsPerSec > 0 || l.bytesPerSec > 0
+}
+
+// SetLimits changes the limits applied to each source. If they differ from the current limits every
+// source starts again with a full allowance.
+func (l *SourceLimiter) SetLimits(eventsPerSec, bytesPerSec float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if eventsPerSec == l.eventsPerSec && bytesPerSec == l.bytesPerSec {
+		return
+	}
+	l.eventsPerSec = eventsPerSec
+	l.bytesPerSec = bytesPerSec
+	l.sources = make(map[string]*sourceLimits)
+	l.overflow = nil
+}
+
+// Allow reports whether a source may send a request containing the given number of events and bytes.
+// If it may not, the duration after which the client should retry is returned.
+func (l *SourceLimiter) Allow(source string, events int, bytes int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.enabled() {
+		return true, 0
+	}
+
+	now := time.Now()
+
+	l.sweep(now)
+
+	sl := l.limits(source)
+	sl.lastSeen = now
+
+	er := reserve(sl.events, now, events)
+	br := reserve(sl.bytes, now, bytes)
+
+	delay := er.DelayFrom(now)
+	if d := br.DelayFrom(now); d > delay {
+		delay = d
+	}
+	if delay == 0 {
+		borrow(sl.events, now, events)
+		borrow(sl.bytes, now, bytes)
+		return true, 0
+	}
+
+	// the request will be rejected so return the tokens for use by later requests
+	er.CancelAt(now)
+	br.CancelAt(now)
+	return false, delay
+}
+
+// limits returns the limiters for a source, creating them if the source is new. Once maxSources are
+// tracked new sources share the overflow limiters. It assumes the mutex is held by the caller.
+func (l *SourceLimiter) limits(source string) *sourceLimits {
+	if sl, ok := l.sources[source]; ok {
+		return sl
+	}
+	if l.maxSources > 0 && len(l.sources) >= l.maxSources {
+		if l.overflow == nil {
+			l.overflow = l.newSourceLimits()
+		}
+		return l.overflow
+	}
+	sl := l.newSourceLimits()
+	l.sources[source] = sl
+	return sl
+}
+
+func (l *SourceLimiter) newSourceLimits() *sourceLimits {
+	return &sourceLimits{
+		events: newLimiter(l.eventsPerSec),
+		bytes:  newLimiter(l.bytesPerSec),
+	}
+}
+
+// sweep removes limiters for sources that have not been seen recently. It assumes the mutex is held by the caller.
+func (l *SourceLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for source, sl := range l.sources {
+		if now.Sub(sl.lastSeen) > sourceLimiterIdleTimeout {
+			delete(l.sources, source)
+		}
+	}
+	if l.overflow != nil && now.Sub(l.overflow.lastSeen) > sourceLimiterIdleTimeout {
+		l.overflow = nil
+	}
+}
+
+func newLimiter(perSec float64) *rate.Limiter {
+	if perSec <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(perSec), int(math.Ceil(perSec)))
+}
+
+// reserve reserves n tokens from a limiter. Requests larger than the limiter's burst only reserve
+// the burst, so they are allowed once a full burst is available, and the remainder is taken by borrow.
+func reserve(lim *rate.Limiter, now time.Time, n int) *rate.Reservation {
+	if b := lim.Burst(); lim.Limit() != rate.Inf && n > b {
+		n = b
+	}
+	return lim.ReserveN(now, n)
+}
+
+// borrow takes the tokens of an allowed request that exceed the limiter's burst from the allowance
+// for the following seconds, so that later requests are delayed until they have been repaid and the
+// average rate stays within the limit however large the request.
+func borrow(lim *rate.Limiter, now time.Time, n int) {
+	b := lim.Burst()
+	if lim.Limit() == rate.Inf || n <= b {
+		return
+	}
+	// a reservation cannot exceed the burst so it is raised while the excess is reserved
+	lim.SetBurstAt(now, n-b)
+	lim.ReserveN(now, n-b)
+	lim.SetBurstAt(now, b)
+}
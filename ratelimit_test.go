@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSourceLimiterAllow(t *testing.T) {
+	type request struct {
+		source string
+		events int
+		bytes  int
+		want   bool
+	}
+
+	testCases := []struct {
+		name         string
+		eventsPerSec float64
+		bytesPerSec  float64
+		maxSources   int
+		requests     []request
+	}{
+		{
+			name: "disabled",
+			requests: []request{
+				{source: "a", events: 1000, bytes: 1 << 20, want: true},
+				{source: "a", events: 1000, bytes: 1 << 20, want: true},
+			},
+		},
+		{
+			name:         "events limited",
+			eventsPerSec: 2,
+			requests: []request{
+				{source: "a", events: 1, want: true},
+				{source: "a", events: 1, want: true},
+				{source: "a", events: 1, want: false},
+			},
+		},
+		{
+			name:        "bytes limited",
+			bytesPerSec: 100,
+			requests: []request{
+				{source: "a", events: 1, bytes: 60, want: true},
+				{source: "a", events: 1, bytes: 60, want: false},
+				// the tokens of the rejected request are returned
+				{source: "a", events: 1, bytes: 40, want: true},
+			},
+		},
+		{
+			name:         "request larger than burst",
+			eventsPerSec: 2,
+			requests: []request{
+				{source: "a", events: 10, want: true},
+				{source: "a", events: 1, want: false},
+			},
+		},
+		{
+			name:         "sources limited separately",
+			eventsPerSec: 1,
+			requests: []request{
+				{source: "a", events: 1, want: true},
+				{source: "a", events: 1, want: false},
+				{source: "b", events: 1, want: true},
+			},
+		},
+		{
+			name:         "sources beyond maximum share limits",
+			eventsPerSec: 1,
+			maxSources:   2,
+			requests: []request{
+				{source: "a", events: 1, want: true},
+				{source: "b", events: 1, want: true},
+				{source: "c", events: 1, want: true},
+				{source: "d", events: 1, want: false},
+				{source: "a", events: 1, want: false},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewSourceLimiter(tc.eventsPerSec, tc.bytesPerSec)
+			if tc.maxSources > 0 {
+				l.maxSources = tc.maxSources
+			}
+			for i, req := range tc.requests {
+				ok, delay := l.Allow(req.source, req.events, req.bytes)
+				if ok != req.want {
+					t.Errorf("request %d from %s: got allowed %v, wanted %v", i, req.source, ok, req.want)
+				}
+				if !ok && delay <= 0 {
+					t.Errorf("request %d from %s: got retry delay %v, wanted positive", i, req.source, delay)
+				}
+			}
+			if tc.maxSources > 0 && len(l.sources) > tc.maxSources {
+				t.Errorf("got %d sources tracked, wanted at most %d", len(l.sources), tc.maxSources)
+			}
+		})
+	}
+}
+
+func TestSourceLimiterLargeRequest(t *testing.T) {
+	testCases := []struct {
+		name         string
+		eventsPerSec float64
+		bytesPerSec  float64
+		events       int
+		bytes        int
+		wantDelay    time.Duration // at least, before another request is allowed
+	}{
+		{name: "events", eventsPerSec: 10, events: 50, wantDelay: 4 * time.Second},
+		{name: "bytes", bytesPerSec: 100, events: 1, bytes: 1000, wantDelay: 9 * time.Second},
+		{name: "within burst", bytesPerSec: 100, events: 1, bytes: 100, wantDelay: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewSourceLimiter(tc.eventsPerSec, tc.bytesPerSec)
+			if ok, _ := l.Allow("a", tc.events, tc.bytes); !ok {
+				t.Fatalf("request larger than burst with full allowance not allowed")
+			}
+
+			// the excess over the burst is repaid before any further request is allowed
+			ok, delay := l.Allow("a", 1, 1)
+			if ok {
+				t.Fatalf("following request allowed")
+			}
+			if delay < tc.wantDelay {
+				t.Errorf("got retry delay %v, wanted at least %v", delay, tc.wantDelay)
+			}
+
+			// a rejected request does not add to the debt
+			if _, again := l.Allow("a", 1, 1); again > delay+time.Second/10 {
+				t.Errorf("got retry delay %v after rejected request, wanted about %v", again, delay)
+			}
+		})
+	}
+}
+
+func TestSourceLimiterSetLimits(t *testing.T) {
+	l := NewSourceLimiter(1, 0)
+	if ok, _ := l.Allow("a", 1, 0); !ok {
+		t.Fatalf("first request not allowed")
+	}
+	if ok, _ := l.Allow("a", 1, 0); ok {
+		t.Fatalf("second request allowed")
+	}
+
+	l.SetLimits(1, 0)
+	if ok, _ := l.Allow("a", 1, 0); ok {
+		t.Errorf("unchanged limits reset allowance")
+	}
+
+	l.SetLimits(2, 0)
+	if ok, _ := l.Allow("a", 1, 0); !ok {
+		t.Errorf("changed limits did not reset allowance")
+	}
+
+	l.SetLimits(0, 0)
+	if l.Enabled() {
+		t.Errorf("got enabled with no limits")
+	}
+}
+
+func TestLimitKey(t *testing.T) {
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		label      string
+		want       string
+	}{
+		{name: "label", remoteAddr: "192.0.2.1:1234", label: "node1", want: "label:node1"},
+		{name: "address", remoteAddr: "192.0.2.1:1234", want: "addr:192.0.2.1"},
+		{name: "source header ignored", remoteAddr: "192.0.2.1:1234", header: "node2", want: "addr:192.0.2.1"},
+		{name: "ipv6 address", remoteAddr: "[2001:db8::1]:1234", want: "addr:2001:db8::1"},
+		{name: "address without port", remoteAddr: "192.0.2.1", want: "addr:192.0.2.1"},
+		// a label cannot be mistaken for an address
+		{name: "label like address", remoteAddr: "192.0.2.1:1234", label: "192.0.2.2", want: "label:192.0.2.2"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/traces/_doc", nil)
+			r.RemoteAddr = tc.remoteAddr
+			if tc.header != "" {
+				r.Header.Set("X-Trace-Source", tc.header)
+			}
+			if got := limitKey(r, tc.label); got != tc.want {
+				t.Errorf("got %q, wanted %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/time/rate"
+)
+
+// Reasons recorded when an event is dropped.
+const (
+	DropReasonParseError       = "parse_error"        // the event could not be parsed
+	DropReasonMissingType      = "missing_type"       // the event had no type
+	DropReasonUnknownType      = "unknown_type"       // the event type is not known
+	DropReasonUnhandledType    = "unhandled_type"     // the event type is known but not stored
+	DropReasonMissingTimestamp = "missing_timestamp"  // the event had no timestamp
+	DropReasonMissingSubEvent  = "missing_sub_event"  // the event did not contain the details for its type
+	DropReasonInvalidPeerID    = "invalid_peer_id"    // a peer id in the event could not be decoded
+	DropReasonSchemaFailed     = "schema_failed"      // the tables for the event's namespace could not be created
+	DropReasonWriteFailed      = "write_failed"       // the batch containing the event could not be written
+	DropReasonDuplicate        = "duplicate"          // the event was a duplicate of one received recently
+	DropReasonFiltered         = "filtered"           // the event was excluded by a filter rule
+	DropReasonSampled          = "sampled"            // the event was not selected by a filter rule's sampling
+	DropReasonShutdown         = "shutdown"           // the event was received after queued events were drained for shutdown
+	dropEventTypeUnknown       = "unknown_event_type" // event type label used when the type cannot be determined
+)
+
+// maxRejectedPayload is the maximum number of bytes of a rejected payload that are stored.
+const maxRejectedPayload = 64 << 10
+
+const rejectedTraceDDL = `
+	CREATE TABLE IF NOT EXISTS {{.Prefix}}rejected_trace (
+	    id               INT         GENERATED ALWAYS AS IDENTITY,
+		timestamp        TIMESTAMPTZ NOT NULL,
+		source           TEXT        NOT NULL DEFAULT '',
+		index_name       TEXT        NOT NULL DEFAULT '',
+		event_type       TEXT        NOT NULL,
+		reason           TEXT        NOT NULL,
+		detail           TEXT        NOT NULL DEFAULT '',
+		payload          BYTEA       NOT NULL,
+	    PRIMARY KEY (id)
+	);
+
+	ALTER TABLE {{.Prefix}}rejected_trace ADD COLUMN IF NOT EXISTS index_name TEXT NOT NULL DEFAULT '';
+
+	CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}rejected_trace_timestamp   ON {{.Prefix}}rejected_trace (timestamp);
+	CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}rejected_trace_reason      ON {{.Prefix}}rejected_trace (reason);
+	CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}rejected_trace_source      ON {{.Prefix}}rejected_trace (source);
+	CREATE INDEX IF NOT EXISTS idx_{{.Prefix}}rejected_trace_index_name  ON {{.Prefix}}rejected_trace (index_name);
+`
+
+// Rejection records an event that was dropped and why.
+type Rejection struct {
+	Time      time.Time
+	Source    string
+	EventType string
+	Reason    string
+	Detail    string
+
+	// Payload is the event as received. When it is nil the payload is taken from Event.
+	Payload []byte
+	Event   *TraceEvent
+}
+
+func newEventRejection(ev *TraceEvent, reason string, detail string) *Rejection {
+	et := dropEventTypeUnknown
+	if ev.Type != nil {
+		et = ev.Type.Key()
+	}
+	return &Rejection{
+		Time:      time.Now(),
+		Source:    ev.Source,
+		EventType: et,
+		Reason:    reason,
+		Detail:    detail,
+		Event:     ev,
+	}
+}
+
+// payload returns the payload to be stored, truncated to maxRejectedPayload.
+func (r *Rejection) payload() []byte {
+	p := r.Payload
+	if p == nil && r.Event != nil {
+		p = r.Event.Raw
+		if p == nil {
+			p, _ = json.Marshal(r.Event)
+		}
+	}
+	if len(p) > maxRejectedPayload {
+		p = p[:maxRejectedPayload]
+	}
+	return p
+}
+
+// RejectSampler decides which rejected events are stored in the rejected_trace table, sampling a
+// fraction of them and capping the rate at which they are stored.
+type RejectSampler struct {
+	fraction float64
+	limiter  *rate.Limiter
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewRejectSampler creates a RejectSampler that stores the given fraction of rejected events, up to
+// perSecond each second. It returns nil if no events would be stored.
+func NewRejectSampler(fraction float64, perSecond float64) *RejectSampler {
+	if fraction <= 0 || perSecond <= 0 {
+		return nil
+	}
+	burst := int(perSecond)
+	if burst < 1 {
+		burst = 1
+	}
+	return &RejectSampler{
+		fraction: fraction,
+		limiter:  rate.NewLimiter(rate.Limit(perSecond), burst),
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Sample reports whether a rejected event should be stored.
+func (rs *RejectSampler) Sample() bool {
+	if rs == nil {
+		return false
+	}
+	if rs.fraction < 1 {
+		rs.mu.Lock()
+		keep := rs.rnd.Float64() < rs.fraction
+		rs.mu.Unlock()
+		if !keep {
+			return false
+		}
+	}
+	return rs.limiter.Allow()
+}
+
+// rejectedTraceBatch builds a batch that inserts rejected events into the rejected_trace table of a namespace.
+func rejectedTraceBatch(ns Namespace, rejected []*Rejection) *pgx.Batch {
+	b := new(pgx.Batch)
+	if len(rejected) == 0 {
+		return b
+	}
+
+	cols := []string{"timestamp", "source", "index_name", "event_type", "reason", "detail", "payload"}
+	values := make([]any, 0, len(rejected)*len(cols))
+	for _, r := range rejected {
+		values = append(values,
+			r.Time,
+			textValue(r.Source),
+			ns.Index,
+			textValue(r.EventType),
+			r.Reason,
+			textValue(r.Detail),
+			r.payload(),
+		)
+	}
+
+	b.Queue(buildBulkInsert(ns.Table("rejected_trace"), cols, len(rejected)), values...)
+	return b
+}
+
+// textValue makes a string safe to store in a text column, which may not contain invalid utf8 or NUL.
+func textValue(s string) string {
+	return strings.ToValidUTF8(strings.ReplaceAll(s, "\x00", ""), "\uFFFD")
+}
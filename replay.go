@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/exp/slog"
+)
+
+var replayOptions struct {
+	target           string
+	eventTypes       cli.StringSlice
+	file             string
+	speed            float64
+	bulkSize         int
+	headers          cli.StringSlice
+	sourceHeader     string
+	timeout          time.Duration
+	retries          int
+	progressInterval time.Duration
+}
+
+var replayCommand = &cli.Command{
+	Name:  "replay",
+	Usage: "Send stored or exported traces to another tracecatcher or Elasticsearch endpoint",
+	Flags: concatFlags(
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:        "target",
+				Usage:       "The `URL` to send events to. Events are sent one per request unless the path ends in /_bulk, such as http://localhost:5151/traces/_bulk",
+				Required:    true,
+				Destination: &replayOptions.target,
+			},
+			&cli.StringSliceFlag{
+				Name:        "type",
+				Usage:       "The type of event to replay from the database, such as 'deliver_message'. May be repeated. Defaults to all stored types.",
+				Destination: &replayOptions.eventTypes,
+			},
+			&cli.StringFlag{
+				Name:        "file",
+				Usage:       "Replay events from `FILE`, which contains newline delimited json trace events such as written by 'export --format trace', instead of the database",
+				Destination: &replayOptions.file,
+			},
+			&cli.Float64Flag{
+				Name:        "speed",
+				Usage:       "Preserve the original timing between events, sped up by this factor. Zero sends events as fast as possible.",
+				Destination: &replayOptions.speed,
+			},
+			&cli.IntFlag{
+				Name:        "bulk-size",
+				Usage:       "The maximum number of events to send in each bulk request",
+				Value:       500,
+				Destination: &replayOptions.bulkSize,
+			},
+			&cli.StringSliceFlag{
+				Name:        "header",
+				Usage:       "An HTTP header to send with each request, in the form 'Name: value', such as an Authorization header. May be repeated.",
+				Destination: &replayOptions.headers,
+			},
+			&cli.StringFlag{
+				Name:        "target-source-header",
+				Usage:       "Send the source recorded for each event in this HTTP header so the target can attribute it",
+				Destination: &replayOptions.sourceHeader,
+			},
+			&cli.DurationFlag{
+				Name:        "timeout",
+				Usage:       "The timeout for each request",
+				Value:       30 * time.Second,
+				Destination: &replayOptions.timeout,
+			},
+			&cli.IntFlag{
+				Name:        "retries",
+				Usage:       "The number of times a request is retried when the target is unavailable or throttles requests",
+				Value:       5,
+				Destination: &replayOptions.retries,
+			},
+			&cli.DurationFlag{
+				Name:        "progress-interval",
+				Usage:       "The interval on which progress is reported",
+				Value:       10 * time.Second,
+				Destination: &replayOptions.progressInterval,
+			},
+		},
+		filterFlags,
+		pseudonymFlags,
+		loggingFlags,
+		databaseFlags,
+		indexFlags,
+	),
+	Action: runReplay,
+}
+
+// eventSource supplies events to be replayed in time order. Next returns io.EOF when there are no
+// more events.
+type eventSource interface {
+	Next() (*TraceEvent, error)
+}
+
+func runReplay(cc *cli.Context) error {
+	if err := setupLogging(os.Stdout); err != nil {
+		return err
+	}
+
+	if replayOptions.speed < 0 {
+		return fmt.Errorf("speed must not be negative")
+	}
+	if replayOptions.bulkSize < 1 {
+		return fmt.Errorf("bulk size must be at least 1")
+	}
+
+	headers := make(http.Header)
+	for _, h := range replayOptions.headers.Value() {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			return fmt.Errorf("invalid header %q, must be in the form 'Name: value'", h)
+		}
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	pseudonyms, err := newPseudonymiserFromOptions(PseudonymiseExport)
+	if err != nil {
+		return err
+	}
+
+	rp := &replayer{
+		client:       &http.Client{Timeout: replayOptions.timeout},
+		target:       replayOptions.target,
+		bulk:         strings.HasSuffix(strings.TrimRight(replayOptions.target, "/"), "/_bulk"),
+		bulkSize:     replayOptions.bulkSize,
+		headers:      headers,
+		sourceHeader: replayOptions.sourceHeader,
+		retries:      replayOptions.retries,
+		pseudonyms:   pseudonyms,
+	}
+
+	ctx, stop := signal.NotifyContext(cc.Context, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	var src eventSource
+	var store *storeEventSource
+	if replayOptions.file != "" {
+		tr, err := OpenTraceFile(replayOptions.file, TraceFormatJSON, 0)
+		if err != nil {
+			return err
+		}
+		defer tr.Close()
+		src = tr
+	} else {
+		ns, filter, err := filterFromOptions()
+		if err != nil {
+			return err
+		}
+
+		conn, err := connect(ctx, options.dbHost, options.dbPort, options.dbName, options.dbSSLMode, options.dbUser, options.dbPassword)
+		if err != nil {
+			return err
+		}
+		defer conn.Close(context.Background())
+
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("begin transaction: %w", err)
+		}
+		defer tx.Rollback(context.Background())
+
+		if err := ns.setSearchPath(ctx, tx); err != nil {
+			return err
+		}
+
+		ss, err := newStoreEventSource(ctx, tx, ns, filter, replayOptions.eventTypes.Value())
+		if err != nil {
+			return err
+		}
+		src = ss
+		store = ss
+	}
+
+	start := time.Now()
+	err = rp.replay(ctx, src, replayOptions.speed, replayOptions.progressInterval)
+	rp.report(start)
+	if store != nil && store.skipped > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d stored events that could not be converted to trace events\n", store.skipped)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			fmt.Fprintln(os.Stderr, "replay interrupted")
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// storeEventSource merges events of several types read from the database into time order.
+type storeEventSource struct {
+	ctx     context.Context
+	cursors []*exportCursor
+	defs    []ExportDef
+	heads   []*TraceEvent // the next event from each cursor, nil once a cursor is exhausted
+	skipped int64
+}
+
+func newStoreEventSource(ctx context.Context, tx pgx.Tx, ns Namespace, filter exportFilter, keys []string) (*storeEventSource, error) {
+	var types []EventType
+	if len(keys) == 0 {
+		for et, def := range exportDefs {
+			// types that cannot be filtered by topic have no events for a topic
+			if filter.Topic != "" && def.TopicFilter == "" {
+				continue
+			}
+			types = append(types, et)
+		}
+	} else {
+		for _, key := range keys {
+			et, _, err := exportEventType(key)
+			if err != nil {
+				return nil, err
+			}
+			types = append(types, et)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	ss := &storeEventSource{ctx: ctx}
+	for _, et := range types {
+		def := exportDefs[et]
+		if filter.Topic != "" && def.TopicFilter == "" {
+			return nil, fmt.Errorf("%s events cannot be filtered by topic", et.Key())
+		}
+		query, args, err := def.query(ns, filter)
+		if err != nil {
+			return nil, err
+		}
+		cur, err := declareExportCursor(ctx, tx, "replay_"+et.Key(), query, args)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", et.Key(), err)
+		}
+		ss.cursors = append(ss.cursors, cur)
+		ss.defs = append(ss.defs, def)
+		ss.heads = append(ss.heads, nil)
+	}
+
+	for i := range ss.cursors {
+		if err := ss.advance(i); err != nil {
+			return nil, err
+		}
+	}
+	return ss, nil
+}
+
+// advance reads the next event from a cursor into its head, skipping rows that cannot be converted.
+func (ss *storeEventSource) advance(i int) error {
+	for {
+		row, err := ss.cursors[i].Next(ss.ctx)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			ss.heads[i] = nil
+			return nil
+		}
+		ev, err := ss.defs[i].TraceEvent(row)
+		if err != nil {
+			slog.Warn("skipping stored event", "error", err)
+			ss.skipped++
+			continue
+		}
+		ss.heads[i] = ev
+		return nil
+	}
+}
+
+func (ss *storeEventSource) Next() (*TraceEvent, error) {
+	next := -1
+	for i, ev := range ss.heads {
+		if ev != nil && (next == -1 || *ev.Timestamp < *ss.heads[next].Timestamp) {
+			next = i
+		}
+	}
+	if next == -1 {
+		return nil, io.EOF
+	}
+	ev := ss.heads[next]
+	if err := ss.advance(next); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// replayer sends events to a target endpoint.
+type replayer struct {
+	client       *http.Client
+	target       string
+	bulk         bool
+	bulkSize     int
+	headers      http.Header
+	sourceHeader string
+	retries      int
+	pseudonyms   *Pseudonymiser // replaces the peer ids in events before they are sent, nil to send them unchanged
+
+	pending       []*TraceEvent
+	pendingSource string
+
+	sent     atomic.Int64 // events accepted by the target
+	failed   atomic.Int64 // events rejected by the target or that could not be sent
+	requests atomic.Int64
+	errors   atomic.Int64 // requests that failed
+}
+
+// replay sends the events from a source, reporting progress on an interval unless it is zero.
+func (rp *replayer) replay(ctx context.Context, src eventSource, speed float64, progressInterval time.Duration) error {
+	var progress <-chan time.Time
+	if progressInterval > 0 {
+		t := time.NewTicker(progressInterval)
+		defer t.Stop()
+		progress = t.C
+	}
+
+	start := time.Now()
+	var first int64 // timestamp of the first event when preserving timing
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		ev, err := src.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+
+		if speed > 0 && ev.Timestamp != nil {
+			if first == 0 {
+				first = *ev.Timestamp
+			}
+			due := start.Add(time.Duration(float64(*ev.Timestamp-first) / speed))
+			if wait := time.Until(due); wait > 0 {
+				// send what has been gathered before waiting for the event to become due
+				if err := rp.flush(ctx); err != nil {
+					return err
+				}
+				t := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return ctx.Err()
+				case <-t.C:
+				}
+			}
+		}
+
+		if err := rp.add(ctx, ev); err != nil {
+			return err
+		}
+
+		select {
+		case <-progress:
+			rp.report(start)
+		default:
+		}
+	}
+
+	return rp.flush(ctx)
+}
+
+// add queues an event, sending the queue if it is full or the event has a different source.
+func (rp *replayer) add(ctx context.Context, ev *TraceEvent) error {
+	if rp.pseudonyms != nil {
+		rp.pseudonyms.Event(ev)
+	}
+	if rp.sourceHeader != "" && len(rp.pending) > 0 && ev.Source != rp.pendingSource {
+		if err := rp.flush(ctx); err != nil {
+			return err
+		}
+	}
+	rp.pending = append(rp.pending, ev)
+	rp.pendingSource = ev.Source
+	if !rp.bulk || len(rp.pending) >= rp.bulkSize {
+		return rp.flush(ctx)
+	}
+	return nil
+}
+
+func (rp *replayer) flush(ctx context.Context) error {
+	if len(rp.pending) == 0 {
+		return nil
+	}
+	defer func() { rp.pending = rp.pending[:0] }()
+
+	var body bytes.Buffer
+	contentType := "application/json"
+	if rp.bulk {
+		contentType = "application/x-ndjson"
+		for _, ev := range rp.pending {
+			body.WriteString("{\"index\":{}}\n")
+			if err := json.NewEncoder(&body).Encode(ev); err != nil {
+				return fmt.Errorf("encode event: %w", err)
+			}
+		}
+	} else {
+		if err := json.NewEncoder(&body).Encode(rp.pending[0]); err != nil {
+			return fmt.Errorf("encode event: %w", err)
+		}
+	}
+
+	failed, err := rp.post(ctx, body.Bytes(), contentType)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		slog.Error("failed to send events", err, "count", len(rp.pending))
+		rp.errors.Add(1)
+		rp.failed.Add(int64(len(rp.pending)))
+		return nil
+	}
+	rp.sent.Add(int64(len(rp.pending) - failed))
+	rp.failed.Add(int64(failed))
+	return nil
+}
+
+// post sends a request to the target, retrying if it is unavailable or throttling requests. It returns
+// the number of events in a bulk request that were rejected.
+func (rp *replayer) post(ctx context.Context, body []byte, contentType string) (int, error) {
+	var lastErr error
+	for attempt := 0; attempt <= rp.retries; attempt++ {
+		if attempt > 0 {
+			wait := time.Duration(1<<(attempt-1)) * time.Second
+			if ra, ok := lastErr.(*replayRetryError); ok && ra.after > 0 {
+				wait = ra.after
+			}
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return 0, ctx.Err()
+			case <-t.C:
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, rp.target, bytes.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		for name, values := range rp.headers {
+			req.Header[name] = values
+		}
+		req.Header.Set("Content-Type", contentType)
+		if rp.sourceHeader != "" && rp.pendingSource != "" {
+			req.Header.Set(rp.sourceHeader, rp.pendingSource)
+		}
+
+		rp.requests.Add(1)
+		resp, err := rp.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			lastErr = &replayRetryError{err: err}
+			continue
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = &replayRetryError{err: err}
+			continue
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			lastErr = &replayRetryError{
+				err:   fmt.Errorf("target responded with %s", resp.Status),
+				after: time.Duration(retryAfter) * time.Second,
+			}
+			continue
+		case resp.StatusCode >= 300:
+			return 0, fmt.Errorf("target responded with %s: %s", resp.Status, bytes.TrimSpace(data))
+		}
+
+		if !rp.bulk {
+			return 0, nil
+		}
+
+		var br struct {
+			Errors bool `json:"errors"`
+			Items  []map[string]struct {
+				Status int             `json:"status"`
+				Error  json.RawMessage `json:"error"`
+			} `json:"items"`
+		}
+		if err := json.Unmarshal(data, &br); err != nil {
+			return 0, fmt.Errorf("parse bulk response: %w", err)
+		}
+		failed := 0
+		if br.Errors {
+			for _, item := range br.Items {
+				for _, result := range item {
+					if result.Status >= 300 {
+						failed++
+						slog.Debug("event rejected by target", "status", result.Status, "error", string(result.Error))
+					}
+				}
+			}
+		}
+		return failed, nil
+	}
+	return 0, lastErr
+}
+
+// replayRetryError is a failed request that may be retried.
+type replayRetryError struct {
+	err   error
+	after time.Duration // the delay requested by the target
+}
+
+func (e *replayRetryError) Error() string { return e.err.Error() }
+
+func (rp *replayer) report(start time.Time) {
+	elapsed := time.Since(start)
+	sent := rp.sent.Load()
+	rate := float64(sent) / elapsed.Seconds()
+	fmt.Fprintf(os.Stderr, "sent %d events, %d failed, %d requests, %d request errors, %.0f events/s in %s\n", sent, rp.failed.Load(), rp.requests.Load(), rp.errors.Load(), rate, elapsed.Round(time.Millisecond))
+}
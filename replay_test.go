@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sliceEventSource supplies events from a slice.
+type sliceEventSource []*TraceEvent
+
+func (s *sliceEventSource) Next() (*TraceEvent, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	ev := (*s)[0]
+	*s = (*s)[1:]
+	return ev, nil
+}
+
+// replayTarget records the events posted to it.
+type replayTarget struct {
+	mu       sync.Mutex
+	events   []*TraceEvent
+	requests []int    // number of events in each request
+	sources  []string // value of the source header of each request
+}
+
+func newReplayTarget(t *testing.T, rt *replayTarget, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read request body: %v", err)
+		}
+		rt.mu.Lock()
+		n := 0
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		for sc.Scan() {
+			if bytes.HasPrefix(sc.Bytes(), []byte(`{"index"`)) {
+				continue
+			}
+			rt.events = append(rt.events, mustParseEvent(t, sc.Text()))
+			n++
+		}
+		rt.requests = append(rt.requests, n)
+		rt.sources = append(rt.sources, r.Header.Get("X-Trace-Source"))
+		rt.mu.Unlock()
+		if handler != nil {
+			handler(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// replayEvents returns join events with the given sources, one second apart.
+func replayEvents(t *testing.T, sources ...string) []*TraceEvent {
+	t.Helper()
+	evs := make([]*TraceEvent, len(sources))
+	for i, source := range sources {
+		ts := strconv.FormatInt(1680000000000000000+int64(i)*int64(time.Second), 10)
+		evs[i] = mustParseEvent(t, `{"type":9,"peerID":"`+testObserverID+`","timestamp":`+ts+`,"join":{"topic":"/fil/msgs/mainnet"}}`)
+		evs[i].Source = source
+	}
+	return evs
+}
+
+func TestReplayRequests(t *testing.T) {
+	testCases := []struct {
+		name         string
+		bulk         bool
+		bulkSize     int
+		sourceHeader string
+		sources      []string
+		wantRequests []int
+		wantSources  []string
+	}{
+		{
+			name:         "single",
+			sources:      []string{"a", "a", "a"},
+			wantRequests: []int{1, 1, 1},
+		},
+		{
+			name:         "bulk",
+			bulk:         true,
+			bulkSize:     2,
+			sources:      []string{"a", "a", "a"},
+			wantRequests: []int{2, 1},
+		},
+		{
+			name:         "bulk split by source",
+			bulk:         true,
+			bulkSize:     10,
+			sourceHeader: "X-Trace-Source",
+			sources:      []string{"a", "a", "b", "a"},
+			wantRequests: []int{2, 1, 1},
+			wantSources:  []string{"a", "b", "a"},
+		},
+		{
+			name:         "bulk not split without source header",
+			bulk:         true,
+			bulkSize:     10,
+			sources:      []string{"a", "a", "b", "a"},
+			wantRequests: []int{4},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := new(replayTarget)
+			srv := newReplayTarget(t, rt, func(w http.ResponseWriter, r *http.Request) {
+				if tc.bulk {
+					w.Write([]byte(`{"errors":false,"items":[]}`))
+				}
+			})
+			path := "/traces/_doc"
+			if tc.bulk {
+				path = "/_bulk"
+			}
+			rp := &replayer{
+				client:       srv.Client(),
+				target:       srv.URL + path,
+				bulk:         tc.bulk,
+				bulkSize:     tc.bulkSize,
+				sourceHeader: tc.sourceHeader,
+			}
+			src := sliceEventSource(replayEvents(t, tc.sources...))
+			if err := rp.replay(context.Background(), &src, 0, 0); err != nil {
+				t.Fatalf("replay: %v", err)
+			}
+
+			if !slices.Equal(rt.requests, tc.wantRequests) {
+				t.Errorf("got requests of %v events, wanted %v", rt.requests, tc.wantRequests)
+			}
+			if tc.wantSources != nil && !slices.Equal(rt.sources, tc.wantSources) {
+				t.Errorf("got source headers %q, wanted %q", rt.sources, tc.wantSources)
+			}
+			if got := rp.sent.Load(); got != int64(len(tc.sources)) {
+				t.Errorf("got %d events sent, wanted %d", got, len(tc.sources))
+			}
+			// events are sent in time order
+			for i := 1; i < len(rt.events); i++ {
+				if *rt.events[i].Timestamp < *rt.events[i-1].Timestamp {
+					t.Errorf("event %d sent out of order", i)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayResponses(t *testing.T) {
+	testCases := []struct {
+		name         string
+		bulk         bool
+		responses    []int // status of each response, the last is repeated
+		body         string
+		retries      int
+		wantSent     int64
+		wantFailed   int64
+		wantErrors   int64
+		wantRequests int64
+	}{
+		{name: "accepted", responses: []int{http.StatusCreated}, wantSent: 1, wantRequests: 1},
+		{name: "throttled then accepted", responses: []int{http.StatusTooManyRequests, http.StatusCreated}, retries: 2, wantSent: 1, wantRequests: 2},
+		{name: "unavailable then accepted", responses: []int{http.StatusServiceUnavailable, http.StatusCreated}, retries: 2, wantSent: 1, wantRequests: 2},
+		{name: "retries exhausted", responses: []int{http.StatusTooManyRequests}, retries: 1, wantFailed: 1, wantErrors: 1, wantRequests: 2},
+		{name: "rejected not retried", responses: []int{http.StatusUnauthorized}, retries: 2, wantFailed: 1, wantErrors: 1, wantRequests: 1},
+		{
+			name:         "bulk items rejected",
+			bulk:         true,
+			responses:    []int{http.StatusOK},
+			body:         `{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":400,"error":{"type":"parse_exception"}}}]}`,
+			wantSent:     1,
+			wantFailed:   1,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			n := 0
+			srv := newReplayTarget(t, new(replayTarget), func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				status := tc.responses[len(tc.responses)-1]
+				if n < len(tc.responses) {
+					status = tc.responses[n]
+				}
+				n++
+				mu.Unlock()
+				if status == http.StatusTooManyRequests {
+					w.Header().Set("Retry-After", "1")
+				}
+				w.WriteHeader(status)
+				w.Write([]byte(tc.body))
+			})
+
+			path := "/traces/_doc"
+			if tc.bulk {
+				path = "/_bulk"
+			}
+			rp := &replayer{
+				client:   srv.Client(),
+				target:   srv.URL + path,
+				bulk:     tc.bulk,
+				bulkSize: 10,
+				retries:  tc.retries,
+			}
+			sources := []string{"a"}
+			if tc.bulk {
+				sources = []string{"a", "a"}
+			}
+			src := sliceEventSource(replayEvents(t, sources...))
+			if err := rp.replay(context.Background(), &src, 0, 0); err != nil {
+				t.Fatalf("replay: %v", err)
+			}
+
+			if got := rp.sent.Load(); got != tc.wantSent {
+				t.Errorf("got %d sent, wanted %d", got, tc.wantSent)
+			}
+			if got := rp.failed.Load(); got != tc.wantFailed {
+				t.Errorf("got %d failed, wanted %d", got, tc.wantFailed)
+			}
+			if got := rp.errors.Load(); got != tc.wantErrors {
+				t.Errorf("got %d request errors, wanted %d", got, tc.wantErrors)
+			}
+			if got := rp.requests.Load(); got != tc.wantRequests {
+				t.Errorf("got %d requests, wanted %d", got, tc.wantRequests)
+			}
+		})
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	rt := new(replayTarget)
+	srv := newReplayTarget(t, rt, nil)
+	rp := &replayer{
+		client:   srv.Client(),
+		target:   srv.URL + "/traces/_doc",
+		bulkSize: 1,
+	}
+
+	// three events one second apart replayed ten times faster take about 200ms
+	src := sliceEventSource(replayEvents(t, "a", "a", "a"))
+	start := time.Now()
+	if err := rp.replay(context.Background(), &src, 10, 0); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("replay took %v, wanted about 200ms", elapsed)
+	}
+	if len(rt.events) != 3 {
+		t.Errorf("got %d events, wanted 3", len(rt.events))
+	}
+
+	// cancelling stops a replay that is waiting for the next event
+	src = sliceEventSource(replayEvents(t, "a", "a"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := rp.replay(ctx, &src, 0.001, 0); err == nil {
+		t.Errorf("got no error from cancelled replay")
+	}
+}
+
+func TestReplayTraceFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "traces.json")
+	var data []byte
+	for _, ev := range replayEvents(t, "", "") {
+		doc, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatalf("marshal event: %v", err)
+		}
+		data = append(append(data, doc...), '\n')
+	}
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatalf("write trace file: %v", err)
+	}
+
+	tr, err := OpenTraceFile(name, TraceFormatJSON, 0)
+	if err != nil {
+		t.Fatalf("OpenTraceFile: %v", err)
+	}
+	defer tr.Close()
+
+	rt := new(replayTarget)
+	srv := newReplayTarget(t, rt, nil)
+	rp := &replayer{
+		client:   srv.Client(),
+		target:   srv.URL + "/traces/_doc",
+		bulkSize: 1,
+	}
+	if err := rp.replay(context.Background(), tr, 0, 0); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(rt.events) != 2 {
+		t.Fatalf("got %d events, wanted 2", len(rt.events))
+	}
+	if ev := rt.events[0]; ev.Join == nil || derefString(ev.Join.Topic, "") != "/fil/msgs/mainnet" {
+		t.Errorf("got join %+v, wanted topic /fil/msgs/mainnet", ev.Join)
+	}
+}
+
+func TestReplayPseudonymise(t *testing.T) {
+	p := newTestPseudonymiser(t, testPseudonymKey)
+	rt := new(replayTarget)
+	srv := newReplayTarget(t, rt, nil)
+
+	rp := &replayer{
+		client:     srv.Client(),
+		target:     srv.URL + "/traces/_doc",
+		bulkSize:   1,
+		pseudonyms: p,
+	}
+	src := &sliceEventSource{
+		mustParseEvent(t, `{"type":4,"peerID":"`+testObserverID+`","timestamp":1680000000000000000,"addPeer":{"peerID":"`+testOtherID+`"}}`),
+	}
+	if err := rp.replay(context.Background(), src, 0, 0); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+
+	if len(rt.events) != 1 {
+		t.Fatalf("got %d events, wanted 1", len(rt.events))
+	}
+	ev := rt.events[0]
+	if want := p.bytes(mustDecodeBase64(t, testObserverID)); !bytes.Equal(ev.PeerID, want) {
+		t.Errorf("got peer id %x, wanted pseudonym %x", ev.PeerID, want)
+	}
+	if want := p.bytes(mustDecodeBase64(t, testOtherID)); ev.AddPeer == nil || !bytes.Equal(ev.AddPeer.PeerID, want) {
+		t.Errorf("got add peer %+v, wanted pseudonym %x", ev.AddPeer, want)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/exp/slog"
+)
+
+var reprocessOptions struct {
+	eventTypes       cli.StringSlice
+	replace          bool
+	progressInterval time.Duration
+}
+
+var reprocessCommand = &cli.Command{
+	Name:  "reprocess",
+	Usage: "Rebuild the tables for each event type from events stored in the raw_trace_event table by --raw-archive",
+	Flags: concatFlags(
+		[]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:        "type",
+				Usage:       "The type of event to reprocess, such as 'deliver_message'. May be repeated. Defaults to all stored types.",
+				Destination: &reprocessOptions.eventTypes,
+			},
+			&cli.BoolFlag{
+				Name:        "replace",
+				Usage:       "Delete the stored events matching the filters before reprocessing, so they are not duplicated",
+				Destination: &reprocessOptions.replace,
+			},
+			&cli.DurationFlag{
+				Name:        "progress-interval",
+				Usage:       "The interval on which progress is reported",
+				Value:       10 * time.Second,
+				Destination: &reprocessOptions.progressInterval,
+			},
+		},
+		filterFlags,
+		loggingFlags,
+		databaseFlags,
+		indexFlags,
+	),
+	Action: runReprocess,
+}
+
+// childTables holds the tables that hold details of events stored in another table, keyed by the
+// event type, and the column that refers to the parent event.
+var childTables = map[EventType][2]string{
+	EventTypePeerScore: {"peer_score_topic", "peer_score_event_id"},
+}
+
+// storedEventTypes returns the event types named by keys, or every type that is stored if keys is empty.
+func storedEventTypes(keys []string) ([]EventType, error) {
+	stored := make(map[string]EventType)
+	for et, tbl := range eventDefs {
+		if tbl.BatchInsert != nil {
+			stored[et.Key()] = et
+		}
+	}
+
+	if len(keys) == 0 {
+		ets := make([]EventType, 0, len(stored))
+		for _, et := range stored {
+			ets = append(ets, et)
+		}
+		sort.Slice(ets, func(i, j int) bool { return ets[i] < ets[j] })
+		return ets, nil
+	}
+
+	ets := make([]EventType, 0, len(keys))
+	for _, key := range keys {
+		et, ok := stored[key]
+		if !ok {
+			valid := make([]string, 0, len(stored))
+			for k := range stored {
+				valid = append(valid, k)
+			}
+			sort.Strings(valid)
+			return nil, fmt.Errorf("unsupported event type %q, must be one of %s", key, strings.Join(valid, ", "))
+		}
+		ets = append(ets, et)
+	}
+	return ets, nil
+}
+
+func runReprocess(cc *cli.Context) error {
+	if err := setupLogging(os.Stdout); err != nil {
+		return err
+	}
+
+	ns, filter, err := filterFromOptions()
+	if err != nil {
+		return err
+	}
+	if filter.Topic != "" {
+		return fmt.Errorf("archived events cannot be filtered by topic")
+	}
+
+	ets, err := storedEventTypes(reprocessOptions.eventTypes.Value())
+	if err != nil {
+		return err
+	}
+	if len(reprocessOptions.eventTypes.Value()) > 0 {
+		for _, et := range ets {
+			filter.Types = append(filter.Types, et.Key())
+		}
+	}
+
+	rules, err := newEventFilterFromOptions()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(cc.Context, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	// archived events are read through a cursor, which needs a transaction that is kept open while the
+	// batcher commits its writes, so each uses its own connection
+	rconn, err := connect(ctx, options.dbHost, options.dbPort, options.dbName, options.dbSSLMode, options.dbUser, options.dbPassword)
+	if err != nil {
+		return err
+	}
+	defer rconn.Close(context.Background())
+
+	wconn, err := connect(ctx, options.dbHost, options.dbPort, options.dbName, options.dbSSLMode, options.dbUser, options.dbPassword)
+	if err != nil {
+		return err
+	}
+	defer wconn.Close(context.Background())
+
+	if reprocessOptions.replace {
+		if err := deleteStoredEvents(ctx, wconn, ns, filter, ets); err != nil {
+			return fmt.Errorf("delete stored events: %w", err)
+		}
+	}
+
+	bat, err := NewBatcher(wconn, BatcherConfig{
+		Size:        options.batchSize,
+		Rejects:     NewRejectSampler(options.rejectedSample, options.rejectedRate),
+		DedupWindow: options.dedupWindow,
+		Filter:      rules,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create batcher: %w", err)
+	}
+
+	query, args, err := rawExportDef.query(ns, filter)
+	if err != nil {
+		return err
+	}
+
+	tx, err := rconn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := ns.setSearchPath(ctx, tx); err != nil {
+		return err
+	}
+
+	cur, err := declareExportCursor(ctx, tx, "reprocess_cursor", query, args)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var events, skipped int64
+	report := func() {
+		rate := float64(events) / time.Since(start).Seconds()
+		fmt.Fprintf(os.Stderr, "reprocessed %d events, skipped %d, %.0f events/s\n", events, skipped, rate)
+	}
+
+	progress := time.NewTicker(reprocessOptions.progressInterval)
+	defer progress.Stop()
+
+	for ctx.Err() == nil {
+		row, err := cur.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			break
+		}
+
+		ev, err := rawExportDef.TraceEvent(row)
+		if err != nil {
+			slog.Debug("skipping archived event", "id", row["id"], "error", err)
+			skipped++
+			continue
+		}
+
+		bat.Add(ctx, ns, ev)
+		events++
+
+		select {
+		case <-progress.C:
+			report()
+		default:
+		}
+	}
+
+	interrupted := ctx.Err() != nil
+	// use a fresh context so queued events are written after an interrupt
+	if err := bat.Flush(context.Background()); err != nil {
+		return fmt.Errorf("write events: %w", err)
+	}
+	report()
+	if interrupted {
+		fmt.Fprintln(os.Stderr, "reprocess interrupted")
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "reprocessed %d events in %s\n", events, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// deleteStoredEvents deletes the events of the given types that match a filter from the tables of a namespace.
+func deleteStoredEvents(ctx context.Context, conn *pgx.Conn, ns Namespace, filter exportFilter, ets []EventType) error {
+	stmts, args, err := deleteStatements(ns, filter, ets)
+	if err != nil {
+		return err
+	}
+
+	if !filter.From.IsZero() || !filter.To.IsZero() || filter.Peer != "" || filter.Source != "" || filter.Index != "" {
+		slog.Info("deleting stored events matching filters", "schema", ns.Schema, "prefix", ns.Prefix)
+	} else {
+		slog.Info("deleting all stored events", "schema", ns.Schema, "prefix", ns.Prefix)
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := ns.setSearchPath(ctx, tx); err != nil {
+		return err
+	}
+
+	for _, stmt := range stmts {
+		tag, err := tx.Exec(ctx, stmt.sql, args...)
+		if err != nil {
+			return fmt.Errorf("delete %s: %w", stmt.et.Key(), err)
+		}
+		slog.Debug("deleted stored events", "event_type", stmt.et.Key(), "rows", tag.RowsAffected())
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// deleteStatement is a statement that deletes stored events of a type.
+type deleteStatement struct {
+	et  EventType
+	sql string
+}
+
+// deleteStatements returns the statements, in the order they must be run, that delete the events of the
+// given types that match a filter, and the arguments shared by every statement.
+func deleteStatements(ns Namespace, filter exportFilter, ets []EventType) ([]deleteStatement, []any, error) {
+	// the tables for each type hold a single type so are not filtered by type
+	filter.Types = nil
+	where, args, err := filter.where("")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var stmts []deleteStatement
+	for _, et := range ets {
+		table := "{{.Prefix}}" + eventDefs[et].Name
+
+		var tmpls []string
+		if child, ok := childTables[et]; ok {
+			tmpls = append(tmpls, "DELETE FROM {{.Prefix}}"+child[0]+" WHERE "+child[1]+" IN (SELECT e.id FROM "+table+" e"+where+")")
+		}
+		tmpls = append(tmpls, "DELETE FROM "+table+" e"+where)
+
+		for _, tmpl := range tmpls {
+			stmt, err := ns.DDL(tmpl)
+			if err != nil {
+				return nil, nil, fmt.Errorf("delete template for %s: %w", et.Key(), err)
+			}
+			stmts = append(stmts, deleteStatement{et: et, sql: stmt})
+		}
+	}
+	return stmts, args, nil
+}
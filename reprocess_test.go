@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStoredEventTypes(t *testing.T) {
+	all, err := storedEventTypes(nil)
+	if err != nil {
+		t.Fatalf("storedEventTypes: %v", err)
+	}
+	for i, et := range all {
+		if eventDefs[et].BatchInsert == nil {
+			t.Errorf("got %s, which is not stored", et.Key())
+		}
+		if i > 0 && all[i-1] >= et {
+			t.Errorf("got types out of order: %v", all)
+		}
+	}
+
+	got, err := storedEventTypes([]string{EventTypeJoin.Key(), EventTypePeerScore.Key()})
+	if err != nil {
+		t.Fatalf("storedEventTypes: %v", err)
+	}
+	if want := []EventType{EventTypeJoin, EventTypePeerScore}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	if _, err := storedEventTypes([]string{"unknown"}); err == nil {
+		t.Errorf("got no error for unknown event type")
+	}
+}
+
+func TestDeleteStatements(t *testing.T) {
+	from := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		ns       Namespace
+		filter   exportFilter
+		ets      []EventType
+		want     []string
+		wantArgs []any
+	}{
+		{
+			name: "all events",
+			ets:  []EventType{EventTypeJoin},
+			want: []string{`DELETE FROM join_event e`},
+		},
+		{
+			name:     "filtered with prefix",
+			ns:       Namespace{Prefix: "lotus_"},
+			filter:   exportFilter{From: from, Source: "node1"},
+			ets:      []EventType{EventTypeJoin, EventTypeLeave},
+			want:     []string{`DELETE FROM lotus_join_event e WHERE e.timestamp >= $1::TIMESTAMPTZ AND e.source = $2::TEXT`, `DELETE FROM lotus_leave_event e WHERE e.timestamp >= $1::TIMESTAMPTZ AND e.source = $2::TEXT`},
+			wantArgs: []any{from, "node1"},
+		},
+		{
+			name:     "child table deleted first",
+			filter:   exportFilter{Peer: "12D3KooW"},
+			ets:      []EventType{EventTypePeerScore},
+			want:     []string{`DELETE FROM peer_score_topic WHERE peer_score_event_id IN (SELECT e.id FROM peer_score_event e WHERE e.peer_id = $1::TEXT)`, `DELETE FROM peer_score_event e WHERE e.peer_id = $1::TEXT`},
+			wantArgs: []any{"12D3KooW"},
+		},
+		{
+			// the type filter selects the tables rather than the rows within them
+			name:   "types not filtered",
+			filter: exportFilter{Types: []string{EventTypeJoin.Key()}},
+			ets:    []EventType{EventTypeJoin},
+			want:   []string{`DELETE FROM join_event e`},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stmts, args, err := deleteStatements(tc.ns, tc.filter, tc.ets)
+			if err != nil {
+				t.Fatalf("deleteStatements: %v", err)
+			}
+			var got []string
+			for _, stmt := range stmts {
+				got = append(got, stmt.sql)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got statements\n%q\nwanted\n%q", got, tc.want)
+			}
+			if !reflect.DeepEqual(args, tc.wantArgs) {
+				t.Errorf("got args %v, wanted %v", args, tc.wantArgs)
+			}
+		})
+	}
+
+	if _, _, err := deleteStatements(Namespace{}, exportFilter{Topic: "/fil/msgs/mainnet"}, []EventType{EventTypeJoin}); err == nil {
+		t.Errorf("got no error for topic filter")
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	doc := `{"type":9,"peerID":"` + testObserverID + `","timestamp":1680000000123456789,"sourceAuth":"secret","join":{"topic":"/fil/msgs/mainnet"},"extra":1}`
+	ev := mustParseEvent(t, doc)
+	ev.Raw = json.RawMessage(doc)
+	ev.Source = "node1"
+
+	raw, err := rawEvent(ev)
+	if err != nil {
+		t.Fatalf("rawEvent: %v", err)
+	}
+	if bytes.Contains(raw, []byte("secret")) {
+		t.Errorf("archived event %s holds the source credential", raw)
+	}
+	if !bytes.Contains(raw, []byte(`"extra":1`)) {
+		t.Errorf("archived event %s lost a field not modelled", raw)
+	}
+
+	batch, err := rawTraceBatch(Namespace{}, []*TraceEvent{ev})
+	if err != nil {
+		t.Fatalf("rawTraceBatch: %v", err)
+	}
+	if batch.Len() != 1 {
+		t.Errorf("got %d statements in batch, wanted 1", batch.Len())
+	}
+
+	// reprocessing reads back the event as it was received
+	got, err := rawExportDef.TraceEvent(exportRow{"source": "node1", "event": string(raw)})
+	if err != nil {
+		t.Fatalf("TraceEvent: %v", err)
+	}
+	if got.Source != "node1" || got.Timestamp == nil || *got.Timestamp != 1680000000123456789 {
+		t.Errorf("got source %q and timestamp %v, wanted node1 and 1680000000123456789", got.Source, got.Timestamp)
+	}
+	if got.Join == nil || derefString(got.Join.Topic, "") != "/fil/msgs/mainnet" {
+		t.Errorf("got join %+v, wanted topic /fil/msgs/mainnet", got.Join)
+	}
+	if !bytes.Equal(got.Raw, raw) {
+		t.Errorf("got raw %s, wanted %s", got.Raw, raw)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// minRetention is the shortest retention period that may be configured, to guard against a
+	// period given in the wrong unit deleting events as soon as they are stored.
+	minRetention = time.Hour
+
+	// retentionInterval is the interval on which expired events are deleted.
+	retentionInterval = time.Hour
+)
+
+// validateRetention checks a retention period, which is either zero to keep events forever or at
+// least minRetention.
+func validateRetention(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("retention must not be negative")
+	}
+	if d > 0 && d < minRetention {
+		return fmt.Errorf("retention must be zero or at least %s", minRetention)
+	}
+	return nil
+}
+
+// Retention deletes events older than a retention period from every namespace in the database,
+// including archived and rejected events.
+type Retention struct {
+	connect func(context.Context) (*pgx.Conn, error)
+	period  time.Duration
+}
+
+// NewRetention creates a Retention that deletes events older than period using a connection made
+// with connect for each pass.
+func NewRetention(connect func(context.Context) (*pgx.Conn, error), period time.Duration) *Retention {
+	return &Retention{connect: connect, period: period}
+}
+
+// Run deletes expired events when started and every retentionInterval until the context is canceled.
+func (r *Retention) Run(ctx context.Context) error {
+	t := time.NewTicker(retentionInterval)
+	defer t.Stop()
+	for {
+		if err := r.Expire(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			dbLog.Error("failed to delete expired events", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// Expire deletes the events stored before now less the retention period.
+func (r *Retention) Expire(ctx context.Context, now time.Time) error {
+	conn, err := r.connect(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	namespaces, err := storedNamespaces(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	cutoff := now.Add(-r.period)
+	dbLog.Info("deleting expired events", "before", cutoff, "namespaces", len(namespaces))
+	for _, ns := range namespaces {
+		if err := deleteExpiredEvents(ctx, conn, ns, cutoff); err != nil {
+			return fmt.Errorf("namespace %s.%s: %w", ns.Schema, ns.Table("*"), err)
+		}
+	}
+	return nil
+}
+
+// storedNamespaces finds the namespaces in the database, identified by their rejected_trace tables
+// which are created with every namespace.
+func storedNamespaces(ctx context.Context, conn *pgx.Conn) ([]Namespace, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT table_schema = current_schema(), table_schema, table_name
+		FROM information_schema.tables
+		WHERE table_type = 'BASE TABLE' AND table_name LIKE '%rejected\_trace'`)
+	if err != nil {
+		return nil, fmt.Errorf("query tables: %w", err)
+	}
+	defer rows.Close()
+
+	var namespaces []Namespace
+	for rows.Next() {
+		var current bool
+		var schema, table string
+		if err := rows.Scan(&current, &schema, &table); err != nil {
+			return nil, fmt.Errorf("scan table: %w", err)
+		}
+		if ns, ok := tableNamespace(current, schema, table); ok {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query tables: %w", err)
+	}
+	return namespaces, nil
+}
+
+// tableNamespace returns the namespace containing a rejected_trace table. The connection's default
+// schema is given as the empty schema.
+func tableNamespace(current bool, schema string, table string) (Namespace, bool) {
+	prefix, ok := strings.CutSuffix(table, "rejected_trace")
+	if !ok {
+		return Namespace{}, false
+	}
+	if current {
+		schema = ""
+	}
+	return Namespace{Schema: schema, Prefix: prefix}, true
+}
+
+// deleteExpiredEvents deletes the events stored before cutoff from the tables of a namespace.
+func deleteExpiredEvents(ctx context.Context, conn *pgx.Conn, ns Namespace, cutoff time.Time) error {
+	ets, err := storedEventTypes(nil)
+	if err != nil {
+		return err
+	}
+	if err := deleteStoredEvents(ctx, conn, ns, exportFilter{To: cutoff}, ets); err != nil {
+		return err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := ns.setSearchPath(ctx, tx); err != nil {
+		return err
+	}
+	for _, table := range []string{"raw_trace_event", "rejected_trace"} {
+		tag, err := tx.Exec(ctx, "DELETE FROM "+pgx.Identifier{ns.Table(table)}.Sanitize()+" WHERE timestamp < $1::TIMESTAMPTZ", cutoff)
+		if err != nil {
+			return fmt.Errorf("delete %s: %w", table, err)
+		}
+		slog.Debug("deleted expired events", "table", ns.Table(table), "rows", tag.RowsAffected())
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
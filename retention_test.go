@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestValidateRetention(t *testing.T) {
+	testCases := []struct {
+		period  time.Duration
+		wantErr bool
+	}{
+		{period: 0},
+		{period: time.Hour},
+		{period: 30 * 24 * time.Hour},
+		{period: 30 * time.Second, wantErr: true},
+		{period: -time.Hour, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.period.String(), func(t *testing.T) {
+			err := validateRetention(tc.period)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got error %v, wanted error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestTableNamespace(t *testing.T) {
+	testCases := []struct {
+		name    string
+		current bool
+		schema  string
+		table   string
+		want    Namespace
+		wantOK  bool
+	}{
+		{name: "default", current: true, schema: "public", table: "rejected_trace", want: Namespace{}, wantOK: true},
+		{name: "prefix", current: true, schema: "public", table: "calibnet_rejected_trace", want: Namespace{Prefix: "calibnet_"}, wantOK: true},
+		{name: "schema", schema: "calibnet", table: "rejected_trace", want: Namespace{Schema: "calibnet"}, wantOK: true},
+		{name: "schema and prefix", schema: "calibnet", table: "a_rejected_trace", want: Namespace{Schema: "calibnet", Prefix: "a_"}, wantOK: true},
+		{name: "other table", current: true, schema: "public", table: "rejected_trace_old"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := tableNamespace(tc.current, tc.schema, tc.table)
+			if ok != tc.wantOK {
+				t.Fatalf("got ok %v, wanted %v", ok, tc.wantOK)
+			}
+			if got != tc.want {
+				t.Errorf("got %+v, wanted %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRetentionExpireConnectFailure(t *testing.T) {
+	r := NewRetention(func(ctx context.Context) (*pgx.Conn, error) {
+		return nil, errors.New("connection refused")
+	}, 24*time.Hour)
+
+	err := r.Expire(context.Background(), time.Now())
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("got error %v, wanted connection failure", err)
+	}
+}
+
+func TestConfigRetention(t *testing.T) {
+	testCases := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{name: "valid", value: "720h"},
+		{name: "disabled", value: "0s"},
+		{name: "too short", value: "30s", wantErr: "line 3: database.retention: retention must be zero or at least 1h0m0s"},
+		{name: "negative", value: "-1h", wantErr: "line 3: database.retention: retention must not be negative"},
+		{name: "not a duration", value: "30d", wantErr: "line 3: database.retention"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.yaml")
+			data := "database:\n  host: localhost\n  retention: " + tc.value + "\n"
+			if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+				t.Fatalf("write config: %v", err)
+			}
+
+			cfg, err := ReadConfig(file)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("got error %v, wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadConfig: %v", err)
+			}
+			if cfg.Database.Retention == nil || *cfg.Database.Retention != tc.value {
+				t.Errorf("got retention %v, wanted %q", cfg.Database.Retention, tc.value)
+			}
+		})
+	}
+}
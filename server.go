@@ -2,75 +2,656 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
-	"golang.org/x/exp/slog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+type ServerConfig struct {
+	// SourceHeader is the name of an HTTP header that identifies the source of traces when
+	// they do not carry their own source authentication.
+	SourceHeader string
+
+	// Auth authenticates clients sending traces. When nil, or when no authentication methods are
+	// configured, traces are accepted from any client.
+	Auth *Authenticator
+
+	// MaxDecompressedBodySize is the maximum size in bytes of a request body after it has been
+	// decompressed.
+	MaxDecompressedBodySize int64
+
+	// MaxBodySize is the maximum size in bytes of a request body as received, before decompression.
+	// Zero means no limit.
+	MaxBodySize int64
+
+	// Limiter limits the rate at which each source may send events. When nil no limits are applied.
+	Limiter *SourceLimiter
+
+	// Indexes maps the index that each trace is sent to onto the namespace it is stored in. When nil
+	// traces for every index are stored in the same tables.
+	Indexes *IndexRouter
+
+	// MetricSources are the sources that metrics are tagged with. Requests from other sources are
+	// counted with the source "other".
+	MetricSources MetricSources
+}
+
 type Server struct {
 	batcher *Batcher
+	cfg     ServerConfig
+
+	authRejected      *Counter
+	bytesReceived     *Counter
+	bytesDecompressed *Counter
+	throttled         *Counter
+	parseErrors       *Counter
+	requestDuration   *Histogram
+	requestSize       *Histogram
+
+	docs  *documentIDs
+	seqNo int64 // sequence number assigned to indexed documents, accessed atomically
 }
 
-func NewServer(batcher *Batcher) (*Server, error) {
-	return &Server{
+func NewServer(batcher *Batcher, cfg ServerConfig) (*Server, error) {
+	if cfg.Auth == nil {
+		cfg.Auth = NewAuthenticator(nil, false, false)
+	}
+	if cfg.Limiter == nil {
+		cfg.Limiter = NewSourceLimiter(0, 0)
+	}
+	if cfg.Indexes == nil {
+		ir, err := NewIndexRouter(IndexMappingNone, defaultIndex, IndexLimits{})
+		if err != nil {
+			return nil, fmt.Errorf("new index router: %w", err)
+		}
+		cfg.Indexes = ir
+	}
+
+	s := &Server{
 		batcher: batcher,
-	}, nil
+		cfg:     cfg,
+		docs:    newDocumentIDs(maxDocumentIDs),
+	}
+
+	ar, err := NewDimensionlessCounter("auth_rejected", "Number of requests rejected by authentication, tagged by reason", reasonTag)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	s.authRejected = ar
+
+	br, err := NewDimensionlessCounter("bytes_received", "Number of request body bytes received before decompression, tagged by content encoding", encodingTag)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	s.bytesReceived = br
+
+	bd, err := NewDimensionlessCounter("bytes_decompressed", "Number of request body bytes received after decompression, tagged by content encoding", encodingTag)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	s.bytesDecompressed = bd
+
+	th, err := NewDimensionlessCounter("requests_throttled", "Number of requests rejected by rate limiting, tagged by source", sourceTag)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	s.throttled = th
+
+	pe, err := NewDimensionlessCounter("parse_errors", "Number of documents and bulk action lines that could not be parsed")
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	s.parseErrors = pe
+
+	rd, err := NewHistogram("http_request_duration_seconds", "Time taken to handle requests, tagged by handler and status", unitSeconds, latencyBounds, handlerTag, statusTag)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+	s.requestDuration = rd
+
+	rs, err := NewHistogram("http_request_size_bytes", "Size of request bodies before decompression, tagged by handler", unitBytes, sizeBounds, handlerTag)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+	s.requestSize = rs
+
+	return s, nil
 }
 
 func (s *Server) ConfigureRoutes(r *mux.Router) {
 	r.NotFoundHandler = http.HandlerFunc(s.NotFoundHandler)
-	r.Path("/traces/_doc").Methods("POST").HandlerFunc(s.TraceHandler)
-	r.PathPrefix("/").Methods("GET").HandlerFunc(s.RootHandler)
+	r.MethodNotAllowedHandler = http.HandlerFunc(s.MethodNotAllowedHandler)
+	r.Use(s.instrument)
+	r.Path("/").Methods("GET", "HEAD").HandlerFunc(s.RootHandler)
+	r.Path("/_cluster/health").Methods("GET").HandlerFunc(s.ClusterHealthHandler)
+	r.Path("/_cluster/health/{index}").Methods("GET").HandlerFunc(s.ClusterHealthHandler)
+	r.Path("/_bulk").Methods("POST", "PUT").HandlerFunc(s.BulkHandler)
+	r.Path("/{index}/_bulk").Methods("POST", "PUT").HandlerFunc(s.BulkHandler)
+	r.Path("/{index}/_doc").Methods("POST").HandlerFunc(s.TraceHandler)
+	r.Path("/{index}/_doc/{id}").Methods("POST", "PUT").HandlerFunc(s.TraceHandler)
+	r.Path("/{index}/_create/{id}").Methods("POST", "PUT").HandlerFunc(s.CreateHandler)
+	r.Path("/{index}").Methods("GET", "HEAD").HandlerFunc(s.IndexHandler)
+	r.Path("/{index}").Methods("PUT").HandlerFunc(s.CreateIndexHandler)
+}
+
+// instrument records the duration and size of requests, tagged by the path template of the route
+// that handled them.
+func (s *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		handler := "unknown"
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				handler = tmpl
+			}
+		}
+
+		// continue any trace the client started
+		r = r.WithContext(otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header)))
+
+		body := &countingReader{r: r.Body}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(sw, r)
+
+		ctx := handlerContext(r.Context(), handler)
+		s.requestDuration.Record(statusContext(ctx, strconv.Itoa(sw.status)), time.Since(start).Seconds())
+		s.requestSize.Record(ctx, float64(body.n))
+	})
+}
+
+// statusWriter records the status code written to a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
 }
 
 func (s *Server) NotFoundHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotFound)
-	w.Write([]byte("Not Found"))
+	writeESResponse(w, http.StatusBadRequest, map[string]any{
+		"error":  fmt.Sprintf("no handler found for uri [%s] and method [%s]", r.URL.Path, r.Method),
+		"status": http.StatusBadRequest,
+	})
+}
+
+func (s *Server) MethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeESResponse(w, http.StatusMethodNotAllowed, map[string]any{
+		"error":  fmt.Sprintf("Incorrect HTTP method for uri [%s] and method [%s]", r.URL.Path, r.Method),
+		"status": http.StatusMethodNotAllowed,
+	})
 }
 
+// TraceHandler indexes a single trace event document.
 func (s *Server) TraceHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	s.indexDocument(w, r, "TraceHandler", false)
+}
+
+// CreateHandler indexes a single trace event document, failing if a document with the same id has
+// already been indexed.
+func (s *Server) CreateHandler(w http.ResponseWriter, r *http.Request) {
+	s.indexDocument(w, r, "CreateHandler", true)
+}
+
+func (s *Server) indexDocument(w http.ResponseWriter, r *http.Request, name string, create bool) {
+	vars := mux.Vars(r)
+	index := vars["index"]
+	id := vars["id"]
+	explicitID := id != ""
+	if !explicitID {
+		id = newDocumentID()
+	}
+
+	ctx, span := tracer().Start(r.Context(), name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(indexAttr.String(index)))
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	auth, eserr := s.authenticate(r)
+	if eserr != nil {
+		span.SetStatus(codes.Error, eserr.Reason)
+		writeESError(w, eserr)
+		return
+	}
+
+	body, eserr := s.readBody(w, r)
+	if eserr != nil {
+		span.SetStatus(codes.Error, eserr.Reason)
+		writeESError(w, eserr)
+		return
+	}
+
+	if eserr := s.ingest(r, auth, index, id, create, body.Data, body.WireSize); eserr != nil {
+		span.SetStatus(codes.Error, eserr.Reason)
+		writeESError(w, eserr)
+		return
+	}
+	if explicitID && !create {
+		s.docs.Put(index, id)
+	}
+
+	writeESResponse(w, http.StatusCreated, s.docCreated(index, id))
+}
+
+// BulkHandler indexes trace event documents supplied using the Elasticsearch bulk API. Only the index
+// and create actions are supported.
+func (s *Server) BulkHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	pathIndex := mux.Vars(r)["index"]
+
+	ctx, span := tracer().Start(r.Context(), "BulkHandler", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(indexAttr.String(pathIndex)))
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	auth, eserr := s.authenticate(r)
+	if eserr != nil {
+		span.SetStatus(codes.Error, eserr.Reason)
+		writeESError(w, eserr)
+		return
+	}
 
-	buf := new(bytes.Buffer)
-	if _, err := buf.ReadFrom(r.Body); err != nil {
-		slog.Error("read body", err)
-		w.WriteHeader(http.StatusBadRequest)
+	body, eserr := s.readBody(w, r)
+	if eserr != nil {
+		writeESError(w, eserr)
 		return
 	}
 
+	resp := esBulkResponse{
+		Items: []map[string]esDocResult{},
+	}
+
+	lines := bytes.Split(body.Data, []byte("\n"))
+	for i := 0; i < len(lines); i++ {
+		line := bytes.TrimSpace(lines[i])
+		if len(line) == 0 {
+			continue
+		}
+
+		var actions map[string]esBulkAction
+		if err := json.Unmarshal(line, &actions); err != nil || len(actions) != 1 {
+			s.parseErrors.Add(r.Context(), 1)
+			writeESError(w, &esError{
+				Status: http.StatusBadRequest,
+				Type:   "illegal_argument_exception",
+				Reason: fmt.Sprintf("Malformed action/metadata line [%d], expected a single action", i+1),
+			})
+			return
+		}
+
+		for action, meta := range actions {
+			if meta.Index == "" {
+				meta.Index = pathIndex
+			}
+			explicitID := meta.ID != ""
+			if !explicitID {
+				meta.ID = newDocumentID()
+			}
+
+			var doc []byte
+			if action != "delete" {
+				// every action other than delete is followed by a source document
+				i++
+				if i >= len(lines) || len(bytes.TrimSpace(lines[i])) == 0 {
+					writeESError(w, &esError{
+						Status: http.StatusBadRequest,
+						Type:   "illegal_argument_exception",
+						Reason: fmt.Sprintf("Validation Failed: 1: source is missing for action [%s] on line [%d];", action, i),
+					})
+					return
+				}
+				doc = bytes.TrimSpace(lines[i])
+			}
+
+			var eserr *esError
+			switch {
+			case action != "index" && action != "create":
+				eserr = &esError{
+					Status: http.StatusBadRequest,
+					Type:   "action_request_validation_exception",
+					Reason: "Validation Failed: 1: action [" + action + "] is not supported;",
+				}
+			case meta.Index == "":
+				eserr = &esError{
+					Status: http.StatusBadRequest,
+					Type:   "action_request_validation_exception",
+					Reason: "Validation Failed: 1: index is missing;",
+				}
+			default:
+				// attribute a share of the bytes received to each document
+				wireSize := int64(len(doc))
+				if len(body.Data) > 0 {
+					wireSize = body.WireSize * int64(len(doc)) / int64(len(body.Data))
+				}
+				eserr = s.ingest(r, auth, meta.Index, meta.ID, action == "create", doc, wireSize)
+				if eserr == nil && action == "index" && explicitID {
+					s.docs.Put(meta.Index, meta.ID)
+				}
+			}
+
+			if eserr != nil {
+				resp.Errors = true
+				resp.Items = append(resp.Items, map[string]esDocResult{
+					action: {
+						Index:  meta.Index,
+						Type:   "_doc",
+						ID:     meta.ID,
+						Status: eserr.Status,
+						Error:  eserr,
+					},
+				})
+				continue
+			}
+
+			res := s.docCreated(meta.Index, meta.ID)
+			res.Status = http.StatusCreated
+			resp.Items = append(resp.Items, map[string]esDocResult{action: res})
+		}
+	}
+
+	span.SetAttributes(eventsAttr.Int(len(resp.Items)))
+	if resp.Errors {
+		span.SetStatus(codes.Error, "some documents were not indexed")
+	}
+	resp.Took = time.Since(start).Milliseconds()
+	writeESResponse(w, http.StatusOK, resp)
+}
+
+// ingest parses a trace event document destined for an index and queues it for storage. Events sent
+// in requests without credentials of their own are authenticated by their SourceAuth field. When create
+// is true the document's id is reserved, and the document rejected if the id is already in use, only
+// once the client has been authenticated and allowed by the rate limits so that other clients cannot
+// fill the remembered ids. It returns nil if the event was accepted or an error describing why it was
+// rejected.
+func (s *Server) ingest(r *http.Request, auth RequestAuth, index string, id string, create bool, doc []byte, wireSize int64) *esError {
+	if eserr := validateIndexName(index); eserr != nil {
+		return eserr
+	}
+
+	_, span := tracer().Start(r.Context(), "parse")
 	event := new(TraceEvent)
-	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
-		slog.Error("unmarshal body", err)
-		w.WriteHeader(http.StatusBadRequest)
+	err := json.Unmarshal(doc, &event)
+	span.End()
+	if err != nil {
+		serverLog.Error("unmarshal body", err)
+		s.parseErrors.Add(r.Context(), 1)
+		s.rejectUnparsed(r, auth, index, doc, err)
+		return newParseError(err)
+	}
+	event.Raw = doc
+
+	label := auth.Label
+	if auth.PerEvent {
+		var reason string
+		label, reason = s.cfg.Auth.AuthenticateEvent(event)
+		if reason != "" {
+			s.authFailed(r, reason)
+			return newAuthError(reason)
+		}
+	}
+
+	event.Source = s.eventSource(r, event, label)
+
+	if ok, delay := s.allow(r, limitKey(r, label), event.Source, 1, wireSize); !ok {
+		return newThrottledError(delay)
+	}
+
+	ns, eserr := s.cfg.Indexes.Route(index)
+	if eserr != nil {
+		return eserr
+	}
+	if create && !s.docs.Reserve(index, id) {
+		return newVersionConflictError(index, id)
+	}
+	s.batcher.Add(r.Context(), ns, event)
+	return nil
+}
+
+// rejectUnparsed records a document that could not be parsed as a trace event. The document is only
+// kept for diagnosis if the request carried valid credentials of its own, so clients that have not
+// been authenticated cannot fill the rejected_trace table.
+func (s *Server) rejectUnparsed(r *http.Request, auth RequestAuth, index string, doc []byte, err error) {
+	rej := &Rejection{
+		Time:      time.Now(),
+		EventType: dropEventTypeUnknown,
+		Reason:    DropReasonParseError,
+		Detail:    err.Error(),
+		Payload:   doc,
+	}
+
+	if auth.PerEvent {
+		s.batcher.dropped(r.Context(), rej.EventType, rej.Reason, 1)
 		return
+	}
 
+	ns, eserr := s.cfg.Indexes.Route(index)
+	if eserr != nil {
+		// the index may not be written to so there are no tables to store the document in
+		s.batcher.dropped(r.Context(), rej.EventType, rej.Reason, 1)
+		return
 	}
-	s.batcher.Add(r.Context(), event)
-	w.WriteHeader(http.StatusOK)
+	rej.Source = s.eventSource(r, new(TraceEvent), auth.Label)
+	s.batcher.Reject(r.Context(), ns, rej)
+}
+
+func (s *Server) docCreated(index, id string) esDocResult {
+	seqNo := atomic.AddInt64(&s.seqNo, 1) - 1
+	return esDocResult{
+		Index:       index,
+		Type:        "_doc",
+		ID:          id,
+		Version:     1,
+		Result:      "created",
+		Shards:      &esShards{Total: 1, Successful: 1},
+		SeqNo:       &seqNo,
+		PrimaryTerm: 1,
+	}
+}
+
+// authenticate checks the credentials presented with a request before its body is read.
+func (s *Server) authenticate(r *http.Request) (RequestAuth, *esError) {
+	auth, reason := s.cfg.Auth.Authenticate(r)
+	if reason != "" {
+		s.authFailed(r, reason)
+		return auth, newAuthError(reason)
+	}
+	return auth, nil
+}
+
+// authFailed records a request or event that was rejected by authentication.
+func (s *Server) authFailed(r *http.Request, reason string) {
+	serverLog.Info("rejected unauthenticated trace", "remote_addr", r.RemoteAddr, "reason", reason)
+	s.authRejected.Add(reasonContext(r.Context(), reason), 1)
+}
+
+// readBody reads and decompresses the body of a request, recording the number of bytes received.
+func (s *Server) readBody(w http.ResponseWriter, r *http.Request) (*requestBody, *esError) {
+	if s.cfg.MaxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodySize)
+	}
+
+	body, err := readRequestBody(r, s.cfg.MaxDecompressedBodySize)
+	if err != nil {
+		serverLog.Error("read body", err, "remote_addr", r.RemoteAddr)
+		switch {
+		case errors.Is(err, errBodyTooLarge):
+			return nil, &esError{Status: http.StatusRequestEntityTooLarge, Type: "content_too_long_exception", Reason: err.Error()}
+		case errors.Is(err, errUnsupportedEncoding):
+			return nil, &esError{Status: http.StatusUnsupportedMediaType, Type: "illegal_argument_exception", Reason: err.Error()}
+		default:
+			return nil, &esError{Status: http.StatusBadRequest, Type: "parse_exception", Reason: err.Error()}
+		}
+	}
+
+	mctx := encodingContext(r.Context(), body.Encoding)
+	s.bytesReceived.Add(mctx, body.WireSize)
+	s.bytesDecompressed.Add(mctx, int64(len(body.Data)))
+
+	return body, nil
+}
+
+// allow applies the rate limits for a client to a request. If the request exceeds the limits it is
+// counted as throttled, tagged by the source of its events, and the duration after which the client
+// may retry is returned.
+func (s *Server) allow(r *http.Request, key string, source string, events int, bytes int64) (bool, time.Duration) {
+	ok, delay := s.cfg.Limiter.Allow(key, events, int(bytes))
+	if ok {
+		return true, 0
+	}
+
+	serverLog.Debug("throttled request", "client", key, "source", source, "retry_after", delay)
+	s.throttled.Add(sourceContext(r.Context(), s.cfg.MetricSources.Tag(source)), 1)
+	return false, delay
+}
+
+// limitKey identifies the client that rate limits are applied to: the label associated with its
+// credentials or, without one, the host part of its address. Values the client chooses freely, such as
+// the event's SourceAuth or the source header, are not used so it cannot evade its limits by varying them.
+func limitKey(r *http.Request, label string) string {
+	if label != "" {
+		return "label:" + label
+	}
+	return "addr:" + remoteHost(r)
+}
+
+// eventSource derives the source of an event. The label associated with the client's credentials
+// takes precedence, followed by a hash of the event's SourceAuth, the configured source header and
+// finally the host part of the client's address. SourceAuth is only used when authentication is
+// disabled, and then hashed since it is a credential that must not be stored in the clear.
+func (s *Server) eventSource(r *http.Request, ev *TraceEvent, label string) string {
+	if label != "" {
+		return label
+	}
+
+	if !s.cfg.Auth.Enabled() && ev.SourceAuth != nil && *ev.SourceAuth != "" {
+		return sourceAuthSource(*ev.SourceAuth)
+	}
+
+	if s.cfg.SourceHeader != "" {
+		if v := r.Header.Get(s.cfg.SourceHeader); v != "" {
+			return v
+		}
+	}
+
+	return remoteHost(r)
+}
+
+// sourceAuthSource returns the source recorded for events carrying a SourceAuth: the first eight
+// bytes of its SHA-256 hash, hex encoded.
+func sourceAuthSource(auth string) string {
+	sum := sha256.Sum256([]byte(auth))
+	return "sourceauth:" + hex.EncodeToString(sum[:8])
+}
+
+// remoteHost returns the host part of the address of the client that sent a request.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 func (s *Server) RootHandler(w http.ResponseWriter, r *http.Request) {
-	slog.Info("connection from client", "remote_addr", r.RemoteAddr)
-	w.Header().Set("X-Elastic-Product", "Elasticsearch")
-	w.WriteHeader(http.StatusOK)
-
-	w.Write([]byte(`{
-		"cluster_name": "traces",
-		"cluster_uuid": "aaaabbbbccccddddaaaabbbbccccdddd",
-		"name": "traces",
-		"tagline": "You Know, for Search",
-		"version": {
-			"build_date": "2023-01-01",
-			"build_flavor": "default",
-			"build_hash": "",
-			"build_snapshot": false,
-			"build_type": "",
-			"lucene_version": "",
-			"minimum_index_compatibility_version": "5.6.0",
-			"minimum_wire_compatibility_version": "5.6.0",
-			"number": "7.0.0"
+	serverLog.Info("connection from client", "remote_addr", r.RemoteAddr)
+	if r.Method == http.MethodHead {
+		writeESResponse(w, http.StatusOK, nil)
+		return
+	}
+	writeESResponse(w, http.StatusOK, esRootDocument)
+}
+
+func (s *Server) ClusterHealthHandler(w http.ResponseWriter, r *http.Request) {
+	if index, ok := mux.Vars(r)["index"]; ok {
+		for _, name := range strings.Split(index, ",") {
+			if !s.cfg.Indexes.Exists(name) {
+				writeESError(w, newIndexNotFoundError(name))
+				return
+			}
 		}
-	}`))
+	}
+	writeESResponse(w, http.StatusOK, esClusterHealth(1))
+}
+
+// IndexHandler reports whether an index exists and returns a minimal description of it.
+func (s *Server) IndexHandler(w http.ResponseWriter, r *http.Request) {
+	index := mux.Vars(r)["index"]
+	if !s.cfg.Indexes.Exists(index) {
+		if r.Method == http.MethodHead {
+			writeESResponse(w, http.StatusNotFound, nil)
+			return
+		}
+		writeESError(w, newIndexNotFoundError(index))
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		writeESResponse(w, http.StatusOK, nil)
+		return
+	}
+
+	writeESResponse(w, http.StatusOK, map[string]any{
+		index: map[string]any{
+			"aliases":  map[string]any{},
+			"mappings": map[string]any{},
+			"settings": map[string]any{
+				"index": map[string]any{
+					"number_of_shards":   "1",
+					"number_of_replicas": "0",
+					"provided_name":      index,
+				},
+			},
+		},
+	})
+}
+
+// CreateIndexHandler handles requests to create an index. Tables for an index are created when traces
+// are first written to it, so creating an index only records that it exists.
+func (s *Server) CreateIndexHandler(w http.ResponseWriter, r *http.Request) {
+	index := mux.Vars(r)["index"]
+	if eserr := validateIndexName(index); eserr != nil {
+		writeESError(w, eserr)
+		return
+	}
+
+	created, eserr := s.cfg.Indexes.Create(index)
+	if eserr != nil {
+		writeESError(w, eserr)
+		return
+	}
+	if !created {
+		writeESError(w, &esError{
+			Status: http.StatusBadRequest,
+			Type:   "resource_already_exists_exception",
+			Reason: "index [" + index + "/_na_] already exists",
+			Index:  index,
+		})
+		return
+	}
+
+	writeESResponse(w, http.StatusOK, map[string]any{
+		"acknowledged":        true,
+		"shards_acknowledged": true,
+		"index":               index,
+	})
 }
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+const testTraceDoc = `{"type":9,"peerID":"ACQIARIgdW9lSDAUXbBP5cEuIUugYQrYpZjnmK3OvgbjWRTnWkw=","timestamp":1680000000000000000,"join":{"topic":"/fil/msgs/mainnet"}}`
+
+type testRequest struct {
+	method string
+	path   string
+	body   string
+}
+
+func newTestServer(t *testing.T, limits IndexLimits) (*httptest.Server, *Batcher) {
+	t.Helper()
+	bat, err := NewBatcher(nil, BatcherConfig{Size: 1000})
+	if err != nil {
+		t.Fatalf("NewBatcher: %v", err)
+	}
+	indexes, err := NewIndexRouter(IndexMappingPrefix, defaultIndex, limits)
+	if err != nil {
+		t.Fatalf("NewIndexRouter: %v", err)
+	}
+	svr, err := NewServer(bat, ServerConfig{Indexes: indexes, MaxDecompressedBodySize: 1 << 20})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	r := mux.NewRouter()
+	svr.ConfigureRoutes(r)
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+	return ts, bat
+}
+
+func doTestRequest(t *testing.T, ts *httptest.Server, req testRequest) (*http.Response, []byte) {
+	t.Helper()
+	r, err := http.NewRequest(req.method, ts.URL+req.path, strings.NewReader(req.body))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	resp, err := ts.Client().Do(r)
+	if err != nil {
+		t.Fatalf("%s %s: %v", req.method, req.path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return resp, body
+}
+
+// jsonField returns the value at a dotted path in a decoded json document, in which array elements
+// are selected by their index.
+func jsonField(v any, path string) (any, bool) {
+	for _, name := range strings.Split(path, ".") {
+		switch tv := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = tv[name]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= len(tv) {
+				return nil, false
+			}
+			v = tv[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func bulkBody(lines ...string) string {
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestServerConformance(t *testing.T) {
+	testCases := []struct {
+		name       string
+		limits     IndexLimits
+		requests   []testRequest // the response to the last request is checked
+		wantStatus int
+		want       map[string]any // values expected at dotted paths in the response
+		wantQueued int
+	}{
+		{
+			name:       "root",
+			requests:   []testRequest{{method: "GET", path: "/"}},
+			wantStatus: http.StatusOK,
+			want:       map[string]any{"tagline": "You Know, for Search", "version.number": "7.0.0"},
+		},
+		{
+			name:       "root head",
+			requests:   []testRequest{{method: "HEAD", path: "/"}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "doc without id",
+			requests:   []testRequest{{method: "POST", path: "/traces/_doc", body: testTraceDoc}},
+			wantStatus: http.StatusCreated,
+			want:       map[string]any{"_index": "traces", "_type": "_doc", "result": "created", "_version": 1.0},
+			wantQueued: 1,
+		},
+		{
+			name:       "doc with id",
+			requests:   []testRequest{{method: "PUT", path: "/traces/_doc/abc", body: testTraceDoc}},
+			wantStatus: http.StatusCreated,
+			want:       map[string]any{"_index": "traces", "_id": "abc", "result": "created"},
+			wantQueued: 1,
+		},
+		{
+			name:       "doc invalid index",
+			requests:   []testRequest{{method: "POST", path: "/Traces/_doc", body: testTraceDoc}},
+			wantStatus: http.StatusBadRequest,
+			want: map[string]any{
+				"status":                   400.0,
+				"error.type":               "invalid_index_name_exception",
+				"error.reason":             "Invalid index name [Traces], must be lowercase",
+				"error.root_cause.0.type":  "invalid_index_name_exception",
+				"error.root_cause.0.index": "Traces",
+			},
+		},
+		{
+			name:       "doc parse error",
+			requests:   []testRequest{{method: "POST", path: "/traces/_doc", body: `{"type":`}},
+			wantStatus: http.StatusBadRequest,
+			want:       map[string]any{"status": 400.0, "error.type": "mapper_parsing_exception"},
+		},
+		{
+			name:       "doc index not allowed",
+			limits:     IndexLimits{Allowed: []string{"calibnet"}},
+			requests:   []testRequest{{method: "POST", path: "/mainnet/_doc", body: testTraceDoc}},
+			wantStatus: http.StatusNotFound,
+			want: map[string]any{
+				"error.type":               "index_not_found_exception",
+				"error.reason":             "no such index [mainnet] and [action.auto_create_index] does not allow it",
+				"error.root_cause.0.index": "mainnet",
+			},
+		},
+		{
+			name:       "create",
+			requests:   []testRequest{{method: "PUT", path: "/traces/_create/a", body: testTraceDoc}},
+			wantStatus: http.StatusCreated,
+			want:       map[string]any{"_id": "a", "result": "created"},
+			wantQueued: 1,
+		},
+		{
+			name: "create existing",
+			requests: []testRequest{
+				{method: "PUT", path: "/traces/_create/a", body: testTraceDoc},
+				{method: "POST", path: "/traces/_create/a", body: testTraceDoc},
+			},
+			wantStatus: http.StatusConflict,
+			want: map[string]any{
+				"status":                   409.0,
+				"error.type":               "version_conflict_engine_exception",
+				"error.reason":             "[a]: version conflict, document already exists (current version [1])",
+				"error.root_cause.0.index": "traces",
+			},
+			wantQueued: 1,
+		},
+		{
+			name: "create existing doc",
+			requests: []testRequest{
+				{method: "PUT", path: "/traces/_doc/a", body: testTraceDoc},
+				{method: "PUT", path: "/traces/_create/a", body: testTraceDoc},
+			},
+			wantStatus: http.StatusConflict,
+			want:       map[string]any{"error.type": "version_conflict_engine_exception"},
+			wantQueued: 1,
+		},
+		{
+			name: "create in other index",
+			requests: []testRequest{
+				{method: "PUT", path: "/traces/_create/a", body: testTraceDoc},
+				{method: "PUT", path: "/calibnet/_create/a", body: testTraceDoc},
+			},
+			wantStatus: http.StatusCreated,
+			want:       map[string]any{"_index": "calibnet", "_id": "a"},
+			wantQueued: 2,
+		},
+		{
+			name: "create after failure",
+			requests: []testRequest{
+				{method: "PUT", path: "/traces/_create/a", body: `{"type":`},
+				{method: "PUT", path: "/traces/_create/a", body: testTraceDoc},
+			},
+			wantStatus: http.StatusCreated,
+			wantQueued: 1,
+		},
+		{
+			name: "bulk",
+			requests: []testRequest{{method: "POST", path: "/_bulk", body: bulkBody(
+				`{"index":{"_index":"traces"}}`, testTraceDoc,
+				`{"create":{"_index":"calibnet","_id":"b"}}`, testTraceDoc,
+			)}},
+			wantStatus: http.StatusOK,
+			want: map[string]any{
+				"errors":                false,
+				"items.0.index.status":  201.0,
+				"items.0.index._index":  "traces",
+				"items.1.create._id":    "b",
+				"items.1.create._index": "calibnet",
+				"items.1.create.result": "created",
+			},
+			wantQueued: 2,
+		},
+		{
+			name: "bulk path index",
+			requests: []testRequest{{method: "PUT", path: "/calibnet/_bulk", body: bulkBody(
+				`{"index":{}}`, testTraceDoc,
+			)}},
+			wantStatus: http.StatusOK,
+			want:       map[string]any{"errors": false, "items.0.index._index": "calibnet"},
+			wantQueued: 1,
+		},
+		{
+			name: "bulk create existing",
+			requests: []testRequest{{method: "POST", path: "/traces/_bulk", body: bulkBody(
+				`{"create":{"_id":"c"}}`, testTraceDoc,
+				`{"create":{"_id":"c"}}`, testTraceDoc,
+			)}},
+			wantStatus: http.StatusOK,
+			want: map[string]any{
+				"errors":                    true,
+				"items.0.create.status":     201.0,
+				"items.1.create.status":     409.0,
+				"items.1.create.error.type": "version_conflict_engine_exception",
+			},
+			wantQueued: 1,
+		},
+		{
+			name: "bulk document errors",
+			requests: []testRequest{{method: "POST", path: "/_bulk", body: bulkBody(
+				`{"index":{"_index":"traces"}}`, `{"type":`,
+				`{"index":{"_index":"Traces"}}`, testTraceDoc,
+				`{"delete":{"_index":"traces","_id":"d"}}`,
+				`{"index":{}}`, testTraceDoc,
+			)}},
+			wantStatus: http.StatusOK,
+			want: map[string]any{
+				"errors":                     true,
+				"items.0.index.status":       400.0,
+				"items.0.index.error.type":   "mapper_parsing_exception",
+				"items.1.index.error.type":   "invalid_index_name_exception",
+				"items.2.delete.error.type":  "action_request_validation_exception",
+				"items.3.index.error.reason": "Validation Failed: 1: index is missing;",
+			},
+		},
+		{
+			name:       "bulk malformed action",
+			requests:   []testRequest{{method: "POST", path: "/_bulk", body: bulkBody(`{"index":`, testTraceDoc)}},
+			wantStatus: http.StatusBadRequest,
+			want: map[string]any{
+				"error.type":   "illegal_argument_exception",
+				"error.reason": "Malformed action/metadata line [1], expected a single action",
+			},
+		},
+		{
+			name:       "bulk missing source",
+			requests:   []testRequest{{method: "POST", path: "/_bulk", body: bulkBody(`{"index":{"_index":"traces"}}`)}},
+			wantStatus: http.StatusBadRequest,
+			want:       map[string]any{"error.type": "illegal_argument_exception"},
+		},
+		{
+			name:       "head default index",
+			requests:   []testRequest{{method: "HEAD", path: "/traces"}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "head missing index",
+			requests:   []testRequest{{method: "HEAD", path: "/calibnet"}},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "get index",
+			requests:   []testRequest{{method: "GET", path: "/traces"}},
+			wantStatus: http.StatusOK,
+			want:       map[string]any{"traces.settings.index.provided_name": "traces"},
+		},
+		{
+			name:       "get missing index",
+			requests:   []testRequest{{method: "GET", path: "/calibnet"}},
+			wantStatus: http.StatusNotFound,
+			want: map[string]any{
+				"status":                   404.0,
+				"error.type":               "index_not_found_exception",
+				"error.reason":             "no such index [calibnet]",
+				"error.root_cause.0.index": "calibnet",
+			},
+		},
+		{
+			name: "get written index",
+			requests: []testRequest{
+				{method: "POST", path: "/calibnet/_doc", body: testTraceDoc},
+				{method: "GET", path: "/calibnet"},
+			},
+			wantStatus: http.StatusOK,
+			want:       map[string]any{"calibnet.settings.index.provided_name": "calibnet"},
+			wantQueued: 1,
+		},
+		{
+			name:       "put index",
+			requests:   []testRequest{{method: "PUT", path: "/calibnet"}},
+			wantStatus: http.StatusOK,
+			want:       map[string]any{"acknowledged": true, "index": "calibnet"},
+		},
+		{
+			name: "head created index",
+			requests: []testRequest{
+				{method: "PUT", path: "/calibnet"},
+				{method: "HEAD", path: "/calibnet"},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "put existing index",
+			requests: []testRequest{
+				{method: "PUT", path: "/calibnet"},
+				{method: "PUT", path: "/calibnet"},
+			},
+			wantStatus: http.StatusBadRequest,
+			want: map[string]any{
+				"error.type":   "resource_already_exists_exception",
+				"error.reason": "index [calibnet/_na_] already exists",
+			},
+		},
+		{
+			name:       "put invalid index",
+			requests:   []testRequest{{method: "PUT", path: "/_calibnet"}},
+			wantStatus: http.StatusBadRequest,
+			want:       map[string]any{"error.type": "invalid_index_name_exception"},
+		},
+		{
+			name:       "put too many indexes",
+			limits:     IndexLimits{Max: 1},
+			requests:   []testRequest{{method: "PUT", path: "/calibnet"}},
+			wantStatus: http.StatusBadRequest,
+			want:       map[string]any{"error.type": "validation_exception"},
+		},
+		{
+			name:       "cluster health",
+			requests:   []testRequest{{method: "GET", path: "/_cluster/health/traces"}},
+			wantStatus: http.StatusOK,
+			want:       map[string]any{"status": "green"},
+		},
+		{
+			name:       "cluster health missing index",
+			requests:   []testRequest{{method: "GET", path: "/_cluster/health/calibnet"}},
+			wantStatus: http.StatusNotFound,
+			want:       map[string]any{"error.type": "index_not_found_exception"},
+		},
+		{
+			name:       "unknown path",
+			requests:   []testRequest{{method: "GET", path: "/traces/_search/x/y"}},
+			wantStatus: http.StatusBadRequest,
+			want:       map[string]any{"error": "no handler found for uri [/traces/_search/x/y] and method [GET]"},
+		},
+		{
+			name:       "method not allowed",
+			requests:   []testRequest{{method: "DELETE", path: "/traces/_doc/a"}},
+			wantStatus: http.StatusMethodNotAllowed,
+			want:       map[string]any{"status": 405.0},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts, bat := newTestServer(t, tc.limits)
+
+			var resp *http.Response
+			var body []byte
+			for _, req := range tc.requests {
+				resp, body = doTestRequest(t, ts, req)
+			}
+
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("got status %d, wanted %d: %s", resp.StatusCode, tc.wantStatus, body)
+			}
+			if got := resp.Header.Get("X-Elastic-Product"); got != "Elasticsearch" {
+				t.Errorf("got X-Elastic-Product header %q, wanted %q", got, "Elasticsearch")
+			}
+
+			if len(tc.want) > 0 {
+				var doc any
+				if err := json.Unmarshal(body, &doc); err != nil {
+					t.Fatalf("unmarshal response %q: %v", body, err)
+				}
+				for path, want := range tc.want {
+					got, ok := jsonField(doc, path)
+					if !ok {
+						t.Errorf("%s: not found in %s", path, body)
+						continue
+					}
+					if got != want {
+						t.Errorf("%s: got %v (%T), wanted %v (%T)", path, got, got, want, want)
+					}
+				}
+			}
+
+			if got := bat.Status().Queued; got != tc.wantQueued {
+				t.Errorf("got %d queued events, wanted %d", got, tc.wantQueued)
+			}
+		})
+	}
+}
+
+func TestDocumentIDs(t *testing.T) {
+	d := newDocumentIDs(2)
+
+	steps := []struct {
+		op    string
+		index string
+		id    string
+		want  bool
+	}{
+		{op: "reserve", index: "traces", id: "a", want: true},
+		{op: "reserve", index: "traces", id: "a", want: false},
+		{op: "reserve", index: "calibnet", id: "a", want: true},
+		// the least recently used id is forgotten once more than two are remembered
+		{op: "put", index: "traces", id: "b"},
+		{op: "reserve", index: "traces", id: "b", want: false},
+		{op: "reserve", index: "traces", id: "a", want: true},
+		// putting an id that is remembered makes it the most recently used
+		{op: "put", index: "traces", id: "b"},
+		{op: "reserve", index: "calibnet", id: "c", want: true},
+		{op: "reserve", index: "traces", id: "b", want: false},
+		{op: "reserve", index: "traces", id: "a", want: true},
+	}
+
+	for i, st := range steps {
+		switch st.op {
+		case "reserve":
+			if got := d.Reserve(st.index, st.id); got != st.want {
+				t.Errorf("step %d: Reserve(%q, %q) got %v, wanted %v", i, st.index, st.id, got, st.want)
+			}
+		case "put":
+			d.Put(st.index, st.id)
+		}
+		if len(d.ids) > d.max || d.order.Len() != len(d.ids) {
+			t.Errorf("step %d: got %d ids and %d in order, wanted at most %d", i, len(d.ids), d.order.Len(), d.max)
+		}
+	}
+}
+
+func TestCreateReservesIDAfterAuthentication(t *testing.T) {
+	bat, err := NewBatcher(nil, BatcherConfig{Size: 1000})
+	if err != nil {
+		t.Fatalf("NewBatcher: %v", err)
+	}
+	svr, err := NewServer(bat, ServerConfig{
+		Auth:                    NewAuthenticator([]AuthToken{{Token: "token"}}, false, false),
+		MaxDecompressedBodySize: 1 << 20,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	r := mux.NewRouter()
+	svr.ConfigureRoutes(r)
+
+	testCases := []struct {
+		name       string
+		path       string
+		body       string
+		token      string
+		wantStatus int
+	}{
+		{name: "create unauthenticated", path: "/traces/_create/1", body: testTraceDoc, wantStatus: http.StatusUnauthorized},
+		{name: "create invalid token", path: "/traces/_create/1", body: testTraceDoc, token: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "bulk create unauthenticated", path: "/_bulk", body: bulkBody(`{"create":{"_index":"traces","_id":"1"}}`, testTraceDoc), wantStatus: http.StatusUnauthorized},
+		{name: "create unparsed", path: "/traces/_create/1", body: `{"type":`, token: "token", wantStatus: http.StatusBadRequest},
+		// the id was not reserved by the rejected requests
+		{name: "create", path: "/traces/_create/1", body: testTraceDoc, token: "token", wantStatus: http.StatusCreated},
+		{name: "create again", path: "/traces/_create/1", body: testTraceDoc, token: "token", wantStatus: http.StatusConflict},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("PUT", tc.path, strings.NewReader(tc.body))
+		if strings.HasSuffix(tc.path, "_bulk") {
+			req.Method = "POST"
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, wanted %d: %s", tc.name, rec.Code, tc.wantStatus, rec.Body.String())
+		}
+	}
+	if n := len(svr.docs.ids); n != 1 {
+		t.Errorf("got %d ids remembered, wanted 1", n)
+	}
+}
+
+// readCounter counts the bytes read from a request body.
+type readCounter struct {
+	r io.Reader
+	n int
+}
+
+func (rc *readCounter) Read(p []byte) (int, error) {
+	n, err := rc.r.Read(p)
+	rc.n += n
+	return n, err
+}
+
+func TestServerAuthentication(t *testing.T) {
+	withSourceAuth := func(auth string) string {
+		return strings.Replace(testTraceDoc, `{"type":9,`, `{"type":9,"sourceAuth":"`+auth+`",`, 1)
+	}
+
+	testCases := []struct {
+		name       string
+		sourceAuth bool // accept tokens in the sourceAuth field
+		path       string
+		body       string
+		header     string // Authorization header
+		wantStatus int
+		wantItem   int  // status of the single item in a bulk response, if non-zero
+		wantRead   bool // whether the body was read
+		wantLabel  string
+	}{
+		{name: "bearer token", path: "/traces/_doc", body: testTraceDoc, header: "Bearer token", wantStatus: http.StatusCreated, wantRead: true, wantLabel: "node1"},
+		{name: "basic auth", path: "/traces/_doc", body: testTraceDoc, header: "Basic " + basicAuth("lotus", "token"), wantStatus: http.StatusCreated, wantRead: true, wantLabel: "node1"},
+		{name: "bulk bearer token", path: "/_bulk", body: bulkBody(`{"index":{"_index":"traces"}}`, testTraceDoc), header: "Bearer token", wantStatus: http.StatusOK, wantItem: http.StatusCreated, wantRead: true, wantLabel: "node1"},
+		{name: "missing", path: "/traces/_doc", body: testTraceDoc, wantStatus: http.StatusUnauthorized},
+		{name: "invalid token", path: "/traces/_doc", body: testTraceDoc, header: "Bearer wrong", wantStatus: http.StatusUnauthorized},
+		{name: "unsupported scheme", path: "/traces/_doc", body: testTraceDoc, header: "Digest token", wantStatus: http.StatusUnauthorized},
+		{name: "bulk missing", path: "/_bulk", body: bulkBody(`{"index":{"_index":"traces"}}`, testTraceDoc), wantStatus: http.StatusUnauthorized},
+		{name: "bulk invalid token", path: "/_bulk", body: bulkBody(`{"index":{"_index":"traces"}}`, testTraceDoc), header: "Bearer wrong", wantStatus: http.StatusUnauthorized},
+		{name: "source auth not accepted", path: "/traces/_doc", body: withSourceAuth("token"), wantStatus: http.StatusUnauthorized},
+		{name: "source auth", sourceAuth: true, path: "/traces/_doc", body: withSourceAuth("token"), wantStatus: http.StatusCreated, wantRead: true, wantLabel: "node1"},
+		{name: "invalid source auth", sourceAuth: true, path: "/traces/_doc", body: withSourceAuth("wrong"), wantStatus: http.StatusUnauthorized, wantRead: true},
+		{name: "missing source auth", sourceAuth: true, path: "/traces/_doc", body: testTraceDoc, wantStatus: http.StatusUnauthorized, wantRead: true},
+		{name: "bulk invalid source auth", sourceAuth: true, path: "/_bulk", body: bulkBody(`{"index":{"_index":"traces"}}`, withSourceAuth("wrong")), wantStatus: http.StatusOK, wantItem: http.StatusUnauthorized, wantRead: true},
+		{name: "invalid token with source auth", sourceAuth: true, path: "/traces/_doc", body: withSourceAuth("token"), header: "Bearer wrong", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bat, err := NewBatcher(nil, BatcherConfig{Size: 1000})
+			if err != nil {
+				t.Fatalf("NewBatcher: %v", err)
+			}
+			svr, err := NewServer(bat, ServerConfig{
+				Auth:                    NewAuthenticator([]AuthToken{{Token: "token", Label: "node1"}}, false, tc.sourceAuth),
+				MaxDecompressedBodySize: 1 << 20,
+			})
+			if err != nil {
+				t.Fatalf("NewServer: %v", err)
+			}
+			r := mux.NewRouter()
+			svr.ConfigureRoutes(r)
+
+			body := &readCounter{r: strings.NewReader(tc.body)}
+			req := httptest.NewRequest("POST", tc.path, body)
+			req.Header.Set("Content-Type", "application/json")
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("got status %d, wanted %d: %s", rec.Code, tc.wantStatus, rec.Body.String())
+			}
+			if read := body.n > 0; read != tc.wantRead {
+				t.Errorf("got body read %v, wanted %v", read, tc.wantRead)
+			}
+			if tc.wantItem != 0 {
+				var resp any
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("unmarshal response: %v", err)
+				}
+				if got, _ := jsonField(resp, "items.0.index.status"); got != float64(tc.wantItem) {
+					t.Errorf("got item status %v, wanted %d", got, tc.wantItem)
+				}
+			}
+
+			var sources []string
+			for _, evs := range bat.traces[Namespace{}] {
+				for _, ev := range evs {
+					sources = append(sources, ev.Source)
+				}
+			}
+			if tc.wantLabel != "" && (len(sources) != 1 || sources[0] != tc.wantLabel) {
+				t.Errorf("got sources %q, wanted [%s]", sources, tc.wantLabel)
+			}
+			if tc.wantLabel == "" && len(sources) != 0 {
+				t.Errorf("got %d events queued, wanted none", len(sources))
+			}
+		})
+	}
+}
+
+func basicAuth(user, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+}
+
+func TestServerRateLimitKey(t *testing.T) {
+	bat, err := NewBatcher(nil, BatcherConfig{Size: 1000})
+	if err != nil {
+		t.Fatalf("NewBatcher: %v", err)
+	}
+	indexes, err := NewIndexRouter(IndexMappingPrefix, defaultIndex, IndexLimits{})
+	if err != nil {
+		t.Fatalf("NewIndexRouter: %v", err)
+	}
+	svr, err := NewServer(bat, ServerConfig{
+		Indexes:                 indexes,
+		MaxDecompressedBodySize: 1 << 20,
+		SourceHeader:            "X-Trace-Source",
+		Limiter:                 NewSourceLimiter(1, 0),
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	r := mux.NewRouter()
+	svr.ConfigureRoutes(r)
+
+	// each request claims a different source but all come from the same address so share its limit
+	testCases := []struct {
+		name       string
+		sourceAuth string
+		header     string
+		wantStatus int
+	}{
+		{name: "first", sourceAuth: "node1", wantStatus: http.StatusCreated},
+		{name: "different source auth", sourceAuth: "node2", wantStatus: http.StatusTooManyRequests},
+		{name: "different source header", header: "node3", wantStatus: http.StatusTooManyRequests},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			doc := strings.Replace(testTraceDoc, `{"type":9,`, `{"type":9,"sourceAuth":"`+tc.sourceAuth+`",`, 1)
+			req := httptest.NewRequest("POST", "/traces/_doc", strings.NewReader(doc))
+			req.Header.Set("Content-Type", "application/json")
+			if tc.header != "" {
+				req.Header.Set("X-Trace-Source", tc.header)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tc.wantStatus {
+				t.Errorf("got status %d, wanted %d: %s", rec.Code, tc.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestEventSource(t *testing.T) {
+	secret := "secret"
+	empty := ""
+
+	testCases := []struct {
+		name       string
+		auth       bool
+		label      string
+		sourceAuth *string
+		header     string
+		want       string
+	}{
+		{name: "label", label: "node1", sourceAuth: &secret, header: "node2", want: "node1"},
+		{name: "source auth hashed", sourceAuth: &secret, header: "node2", want: "sourceauth:2bb80d537b1da3e3"},
+		{name: "source auth ignored with authentication", auth: true, sourceAuth: &secret, header: "node2", want: "node2"},
+		{name: "empty source auth", sourceAuth: &empty, header: "node2", want: "node2"},
+		{name: "source header", header: "node2", want: "node2"},
+		{name: "address", want: "192.0.2.1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := ServerConfig{SourceHeader: "X-Trace-Source"}
+			if tc.auth {
+				cfg.Auth = NewAuthenticator([]AuthToken{{Token: "token"}}, false, false)
+			}
+			svr, err := NewServer(nil, cfg)
+			if err != nil {
+				t.Fatalf("NewServer: %v", err)
+			}
+
+			r := httptest.NewRequest("POST", "/traces/_doc", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if tc.header != "" {
+				r.Header.Set("X-Trace-Source", tc.header)
+			}
+			if got := svr.eventSource(r, &TraceEvent{SourceAuth: tc.sourceAuth}, tc.label); got != tc.want {
+				t.Errorf("got %q, wanted %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ShutdownDeadline is the time by which every stage of an orderly shutdown must finish. The deadline
+// is set when the first stage starts.
+type ShutdownDeadline struct {
+	timeout time.Duration
+
+	once     sync.Once
+	deadline time.Time
+}
+
+func NewShutdownDeadline(timeout time.Duration) *ShutdownDeadline {
+	return &ShutdownDeadline{timeout: timeout}
+}
+
+// Context returns a context that is canceled at the deadline, starting the shutdown if it has not
+// already started.
+func (d *ShutdownDeadline) Context() (context.Context, context.CancelFunc) {
+	d.once.Do(func() {
+		d.deadline = time.Now().Add(d.timeout)
+	})
+	return context.WithDeadline(context.Background(), d.deadline)
+}
+
+// DrainResult reports what happened to the events that were queued when a Batcher was drained.
+type DrainResult struct {
+	Queued  int // events queued when the drain started
+	Stored  int // events written to the database
+	Dropped int // events that were rejected or could not be stored because of their type
+	Spooled int // events that could not be written and were saved to spool files
+	Lost    int // events that could not be written or spooled
+
+	SpoolFiles []SpoolFile
+}
+
+// SpoolFile is a file of events, one json object per line, that could not be written to the database.
+// The events in a file were sent to the same namespace by the same source.
+type SpoolFile struct {
+	Name   string
+	NS     Namespace
+	Source string
+	Events int
+}
+
+// Drain writes the queued events to the database before the process exits. Events that cannot be
+// written before ctx is done are written to files in spoolDir, if given, so they may be imported
+// later. Events added after Drain are dropped.
+func (b *Batcher) Drain(ctx context.Context, spoolDir string) (DrainResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := DrainResult{Queued: b.count}
+	stored := b.storedTotal()
+
+	b.unwritten = make(map[Namespace][]*TraceEvent)
+	defer func() {
+		b.unwritten = nil
+		b.drained = true
+	}()
+
+	flushErr := b.flush(ctx)
+	res.Stored = b.storedTotal() - stored
+
+	unwritten := 0
+	for _, evs := range b.unwritten {
+		unwritten += len(evs)
+	}
+	res.Dropped = res.Queued - res.Stored - unwritten
+	if unwritten == 0 {
+		return res, flushErr
+	}
+
+	if spoolDir == "" {
+		res.Lost = unwritten
+		return res, flushErr
+	}
+	files, err := spoolEvents(spoolDir, time.Now(), b.unwritten)
+	res.SpoolFiles = files
+	for _, f := range files {
+		res.Spooled += f.Events
+	}
+	res.Lost = unwritten - res.Spooled
+	if err != nil {
+		return res, fmt.Errorf("spool events: %w", err)
+	}
+	return res, flushErr
+}
+
+func (b *Batcher) storedTotal() int {
+	total := 0
+	for _, st := range b.Status().EventTypes {
+		total += int(st.Stored)
+	}
+	return total
+}
+
+// spoolEvents writes events to files in dir, one for each namespace and source, in the newline
+// delimited json format read by the import command. Files are named with the time they were written.
+func spoolEvents(dir string, now time.Time, events map[Namespace][]*TraceEvent) ([]SpoolFile, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	type group struct {
+		ns     Namespace
+		source string
+	}
+	groups := make(map[group][]*TraceEvent)
+	for ns, evs := range events {
+		for _, ev := range evs {
+			g := group{ns: ns, source: ev.Source}
+			groups[g] = append(groups[g], ev)
+		}
+	}
+	keys := make([]group, 0, len(groups))
+	for g := range groups {
+		keys = append(keys, g)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ns.Schema != keys[j].ns.Schema {
+			return keys[i].ns.Schema < keys[j].ns.Schema
+		}
+		if keys[i].ns.Prefix != keys[j].ns.Prefix {
+			return keys[i].ns.Prefix < keys[j].ns.Prefix
+		}
+		if keys[i].ns.Index != keys[j].ns.Index {
+			return keys[i].ns.Index < keys[j].ns.Index
+		}
+		return keys[i].source < keys[j].source
+	})
+
+	var files []SpoolFile
+	for i, g := range keys {
+		name := filepath.Join(dir, fmt.Sprintf("spool-%s-%d.ndjson", now.UTC().Format("20060102T150405Z"), i+1))
+		n, err := writeSpoolFile(name, groups[g])
+		if n > 0 {
+			files = append(files, SpoolFile{Name: name, NS: g.ns, Source: g.source, Events: n})
+		}
+		if err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
+
+func writeSpoolFile(name string, evs []*TraceEvent) (int, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(f)
+	n := 0
+	for _, ev := range evs {
+		raw, err := rawEvent(ev)
+		if err != nil {
+			// the event is counted as lost
+			continue
+		}
+		w.Write(raw)
+		w.WriteByte('\n')
+		n++
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestDrainSpoolsUnwrittenEvents(t *testing.T) {
+	sourceAuth := "secret"
+
+	testCases := []struct {
+		name        string
+		archive     bool
+		failInsert  EventType
+		events      func() []*TraceEvent
+		wantDropped int
+		wantSpooled int
+		wantLost    int
+	}{
+		{
+			name:       "batch insert failure",
+			failInsert: EventTypeJoin,
+			events: func() []*TraceEvent {
+				return []*TraceEvent{
+					testEvent(EventTypeJoin, true),
+					testEvent(EventTypeJoin, true),
+					// rejected when its batch is built since it has no timestamp
+					testEvent(EventTypeLeave, false),
+				}
+			},
+			wantDropped: 1,
+			wantSpooled: 2,
+		},
+		{
+			name:       "archive failure",
+			archive:    true,
+			failInsert: -1,
+			events: func() []*TraceEvent {
+				// the archive batch cannot be built since the event as received cannot be decoded to
+				// remove its source auth, and the event cannot be spooled for the same reason
+				bad := testEvent(EventTypeJoin, true)
+				bad.Raw = json.RawMessage(`not json`)
+				bad.SourceAuth = &sourceAuth
+				return []*TraceEvent{
+					testEvent(EventTypeJoin, true),
+					testEvent(EventTypeLeave, true),
+					bad,
+				}
+			},
+			wantSpooled: 2,
+			wantLost:    1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.failInsert >= 0 {
+				failBatchInsert(t, tc.failInsert)
+			}
+
+			b, err := NewBatcher(nil, BatcherConfig{Size: 1000, Archive: tc.archive})
+			if err != nil {
+				t.Fatalf("NewBatcher: %v", err)
+			}
+			ctx := context.Background()
+			evs := tc.events()
+			for _, ev := range evs {
+				b.Add(ctx, Namespace{}, ev)
+			}
+
+			dir := t.TempDir()
+			res, err := b.Drain(ctx, dir)
+			if err == nil {
+				t.Errorf("got no error")
+			}
+
+			if res.Queued != len(evs) {
+				t.Errorf("got %d queued, wanted %d", res.Queued, len(evs))
+			}
+			if res.Stored != 0 {
+				t.Errorf("got %d stored, wanted 0", res.Stored)
+			}
+			if res.Dropped != tc.wantDropped {
+				t.Errorf("got %d dropped, wanted %d", res.Dropped, tc.wantDropped)
+			}
+			if res.Spooled != tc.wantSpooled {
+				t.Errorf("got %d spooled, wanted %d", res.Spooled, tc.wantSpooled)
+			}
+			if res.Lost != tc.wantLost {
+				t.Errorf("got %d lost, wanted %d", res.Lost, tc.wantLost)
+			}
+			if len(b.traces) != 0 {
+				t.Errorf("got %d namespaces still queued, wanted none", len(b.traces))
+			}
+
+			lines := 0
+			for _, f := range res.SpoolFiles {
+				lines += countLines(t, f.Name)
+			}
+			if lines != tc.wantSpooled {
+				t.Errorf("got %d events in spool files, wanted %d", lines, tc.wantSpooled)
+			}
+		})
+	}
+}
+
+func countLines(t *testing.T, name string) int {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("open spool file: %v", err)
+	}
+	defer f.Close()
+	n := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		n++
+	}
+	return n
+}
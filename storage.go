@@ -2,113 +2,564 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slog"
 )
 
+// BatcherConfig configures a Batcher.
+type BatcherConfig struct {
+	// Size is the number of events that are queued before they are written to the database.
+	Size int
+
+	// FlushInterval is the longest time events are queued before they are written to the database,
+	// when fewer than Size arrive. Zero means events are only written once Size are queued.
+	FlushInterval time.Duration
+
+	// Rejects selects the dropped events that are stored in the rejected_trace table. When nil
+	// dropped events are only counted.
+	Rejects *RejectSampler
+
+	// Archive stores every event, as received, in the raw_trace_event table in addition to the
+	// tables for its type.
+	Archive bool
+	// DedupWindow is the period within which duplicate events are discarded before being written.
+	// Events are also given a key that prevents duplicates being stored by the database. Zero disables
+	// deduplication.
+	DedupWindow time.Duration
+
+	// Filter decides which events are stored. When nil every event is stored.
+	Filter *EventFilter
+
+	// Pseudonyms replaces the peer ids in events before they are stored. When nil peer ids are
+	// stored unchanged.
+	Pseudonyms *Pseudonymiser
+
+	// Network derives metrics describing the gossipsub network from every event received, including
+	// those that are filtered out. When nil no network metrics are derived.
+	Network *NetworkObserver
+
+	// MetricSources are the sources that metrics are tagged with. Events from other sources are
+	// counted with the source "other".
+	MetricSources MetricSources
+}
+
 type Batcher struct {
-	conn *pgx.Conn
-	size int
+	conn  *pgx.Conn
+	cfg   BatcherConfig
+	dedup *DedupWindow // nil if deduplication is disabled
+	stats *batcherStats
+
+	// send sends a batch to the database and returns the number of rows affected. It is replaced in tests.
+	send func(ctx context.Context, ns Namespace, batch *pgx.Batch) (int64, error)
 
 	eventsReceived *Counter
+	eventsDropped  *Counter
+	rowsInserted   *Counter
+	batchFailures  *Counter
+	batchRetries   *Counter
+	flushDuration  *Histogram
+	eventLag       *Histogram
+
+	mu       sync.Mutex
+	traces   map[Namespace]map[EventType][]*TraceEvent
+	rejected map[Namespace][]*Rejection
+	count    int
+	ensured  map[Namespace]bool // namespaces whose tables are known to exist
 
-	mu     sync.Mutex
-	traces map[EventType][]*TraceEvent
-	count  int
+	unwritten map[Namespace][]*TraceEvent // events that could not be written, only collected while draining
+	drained   bool                        // queued events have been drained for shutdown
 }
 
-func NewBatcher(conn *pgx.Conn, size int) (*Batcher, error) {
+// NewBatcher creates a Batcher that writes events to the database once cfg.Size events have been queued.
+func NewBatcher(conn *pgx.Conn, cfg BatcherConfig) (*Batcher, error) {
 	b := &Batcher{
-		conn:   conn,
-		size:   size,
-		traces: make(map[EventType][]*TraceEvent),
+		conn:     conn,
+		cfg:      cfg,
+		dedup:    NewDedupWindow(cfg.DedupWindow),
+		stats:    newBatcherStats(),
+		traces:   make(map[Namespace]map[EventType][]*TraceEvent),
+		rejected: make(map[Namespace][]*Rejection),
+		ensured: map[Namespace]bool{
+			{}: true, // the default namespace is created when connecting to the database
+		},
 	}
+	b.send = b.sendBatch
 
-	er, err := NewDimensionlessCounter("events_received", "Number of events received, tagged by type", eventTypeTag)
+	er, err := NewDimensionlessCounter("events_received", "Number of events received, tagged by type and source", eventTypeTag, sourceTag)
 	if err != nil {
 		return nil, fmt.Errorf("new gauge: %w", err)
 	}
 	b.eventsReceived = er
 
+	ed, err := NewDimensionlessCounter("events_dropped", "Number of events dropped without being stored, tagged by type and reason", eventTypeTag, reasonTag)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	b.eventsDropped = ed
+
+	ri, err := NewDimensionlessCounter("rows_inserted", "Number of events written to each table, tagged by table", tableTag)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	b.rowsInserted = ri
+
+	bf, err := NewDimensionlessCounter("batch_failures", "Number of batches that could not be written, tagged by table", tableTag)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	b.batchFailures = bf
+
+	br, err := NewDimensionlessCounter("batch_retries", "Number of times a batch was sent again after a transient failure, tagged by table", tableTag)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	b.batchRetries = br
+
+	fd, err := NewHistogram("flush_duration_seconds", "Time taken to write queued events to the database", unitSeconds, latencyBounds)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+	b.flushDuration = fd
+
+	el, err := NewHistogram("event_lag_seconds", "Time between an event occurring and it being written to the database, tagged by type", unitSeconds, lagBounds, eventTypeTag)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+	b.eventLag = el
+
+	started := time.Now()
+	if err := NewGaugeFunc("seconds_since_last_flush", "Time since queued events were last written to the database without error", unitSeconds, func() float64 {
+		last := b.Status().LastSuccessfulFlush
+		if last == nil {
+			return time.Since(started).Seconds()
+		}
+		return time.Since(*last).Seconds()
+	}); err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
 	return b, err
 }
 
-func (b *Batcher) Add(ctx context.Context, e *TraceEvent) {
+// Add queues an event to be written to the tables in a namespace, flushing queued events to the
+// database if the batch size has been reached. It reports whether the event was queued, which it is
+// not if it has no type, was filtered out or is a duplicate, or if the Batcher has been drained.
+func (b *Batcher) Add(ctx context.Context, ns Namespace, e *TraceEvent) bool {
+	ctx, span := tracer().Start(ctx, "Batcher.Add")
+	defer span.End()
+
+	// the network observer has its own lock and sees the event before it is filtered or pseudonymised
+	b.cfg.Network.Observe(ctx, e, time.Now())
+
+	start := time.Now()
+	b.stats.wait(1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stats.wait(-1)
+	span.SetAttributes(lockWaitAttr.Float64(time.Since(start).Seconds()))
+
 	if e.Type == nil {
-		slog.Warn("trace event had no type, dropping")
+		eventLogLimit.Log(batcherLog, slog.LevelWarn, "trace event had no type, dropping")
+		b.pseudonymise(e)
+		b.reject(ctx, ns, newEventRejection(e, DropReasonMissingType, ""))
+		return false
+	}
+
+	if b.drained {
+		eventLogLimit.Log(batcherLog, slog.LevelWarn, "event received after shutdown, dropping", "event_type", e.Type.Key(), "source", e.Source)
+		b.dropped(ctx, e.Type.Key(), DropReasonShutdown, 1)
+		return false
+	}
+
+	span.SetAttributes(eventTypeTag.String(e.Type.Key()), sourceTag.String(e.Source))
+	mctx := sourceContext(eventTypeContext(ctx, e.Type.Key()), b.cfg.MetricSources.Tag(e.Source))
+	b.eventsReceived.Add(mctx, 1)
+	b.stats.received(e.Type.Key(), e.Source, time.Now())
+
+	if keep, reason := b.cfg.Filter.Filter(e); !keep {
+		b.dropped(ctx, e.Type.Key(), reason, 1)
+		return false
+	}
+	// filters are matched against the original peer ids
+	b.pseudonymise(e)
+
+	if b.dedup != nil {
+		key, err := eventDedupKey(e)
+		if err != nil {
+			batcherLog.Error("failed to create dedup key", err, "event_type", e.Type.Key())
+		} else {
+			e.DedupKey = key
+			if b.dedup.Seen(ns, key, time.Now()) {
+				b.dropped(ctx, e.Type.Key(), DropReasonDuplicate, 1)
+				return false
+			}
+		}
+	}
+
+	nstraces, ok := b.traces[ns]
+	if !ok {
+		nstraces = make(map[EventType][]*TraceEvent)
+		b.traces[ns] = nstraces
+	}
+	nstraces[*e.Type] = append(nstraces[*e.Type], e)
+	b.count++
+	b.stats.queue(e.Type.Key())
+
+	if b.count >= b.cfg.Size {
+		if err := b.flush(ctx); err != nil {
+			batcherLog.Error("failed to flush", err)
+		}
+	}
+	return true
+}
+
+// Reject records an event that was dropped before it could be queued. The drop is counted and, if
+// sampled, the rejection is written to the rejected_trace table of the namespace on the next flush.
+func (b *Batcher) Reject(ctx context.Context, ns Namespace, r *Rejection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg.Pseudonyms != nil && r.Event == nil {
+		// the peer ids in an event that could not be parsed cannot be replaced so it is not stored
+		r.Payload = []byte{}
+		r.Detail += " (payload withheld since peer ids are pseudonymised)"
+	}
+	b.reject(ctx, ns, r)
+}
+
+func (b *Batcher) reject(ctx context.Context, ns Namespace, r *Rejection) {
+	// assumes mutex is held by caller
+	eventLogLimit.Log(batcherLog, slog.LevelDebug, "dropping event", "event_type", r.EventType, "reason", r.Reason, "detail", r.Detail, "source", r.Source)
+	b.dropped(ctx, r.EventType, r.Reason, 1)
+	if b.cfg.Rejects.Sample() {
+		b.rejected[ns] = append(b.rejected[ns], r)
+	}
+}
+
+// pseudonymise replaces the peer ids in an event if pseudonyms are configured.
+func (b *Batcher) pseudonymise(e *TraceEvent) {
+	if b.cfg.Pseudonyms != nil {
+		b.cfg.Pseudonyms.Event(e)
+	}
+}
+
+// dropped counts events that were dropped.
+func (b *Batcher) dropped(ctx context.Context, eventType string, reason string, n int) {
+	if n <= 0 {
 		return
 	}
+	b.eventsDropped.Add(reasonContext(eventTypeContext(ctx, eventType), reason), int64(n))
+	b.stats.dropped(eventType, n)
+}
 
+// Run writes the queued events to the database every FlushInterval until the context is canceled.
+func (b *Batcher) Run(ctx context.Context) error {
+	if b.cfg.FlushInterval <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	t := time.NewTicker(b.cfg.FlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			// a flush in progress when shutting down is allowed to finish so its events are not lost
+			if err := b.flushQueued(context.WithoutCancel(ctx)); err != nil {
+				batcherLog.Error("failed to flush", err)
+			}
+		}
+	}
+}
+
+// flushQueued writes the queued events to the database if there are any.
+func (b *Batcher) flushQueued(ctx context.Context) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	b.traces[*e.Type] = append(b.traces[*e.Type], e)
-	b.count++
+	if b.drained || (b.count == 0 && len(b.rejected) == 0) {
+		return nil
+	}
+	return b.flush(ctx)
+}
 
-	mctx := eventTypeContext(ctx, e.Type.Key())
-	b.eventsReceived.Add(mctx, 1)
+// Flush writes all queued events to the database. Events that could not be written are discarded and
+// an error is returned.
+func (b *Batcher) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush(ctx)
+}
 
-	if b.count >= b.size {
-		if err := b.flush(ctx); err != nil {
-			slog.Error("failed to flush", err)
-			return
+func (b *Batcher) flush(ctx context.Context) (err error) {
+	// assumes mutex is held by caller
+	ctx, span := tracer().Start(ctx, "Batcher.flush", trace.WithAttributes(eventsAttr.Int(b.count)))
+	defer func() {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
 		}
+		span.End()
+	}()
+
+	namespaces := make(map[Namespace]bool, len(b.traces)+len(b.rejected))
+	for ns := range b.traces {
+		namespaces[ns] = true
+	}
+	for ns := range b.rejected {
+		namespaces[ns] = true
 	}
-	return
+
+	start := time.Now()
+	b.stats.flushStart(start)
+	var flushErr error
+	for ns := range namespaces {
+		nstraces := b.traces[ns]
+		if !b.ensured[ns] {
+			err := ensureDatabaseSchema(ctx, b.conn, ns)
+			b.stats.schema(ns, err, time.Now())
+			if err != nil {
+				batcherLog.Error("failed to create tables", err, "schema", ns.Schema, "prefix", ns.Prefix)
+				for evtype, evs := range nstraces {
+					b.dropped(ctx, evtype.Key(), DropReasonSchemaFailed, len(evs))
+					b.unwrite(ns, evs, nil)
+				}
+				if flushErr == nil {
+					flushErr = fmt.Errorf("ensure schema: %w", err)
+				}
+				continue
+			}
+			b.ensured[ns] = true
+		}
+
+		// events that cannot be archived are still written to the tables for their types, except while
+		// draining when they are spooled instead so they can be archived when they are sent again
+		write := true
+		if b.cfg.Archive && len(nstraces) > 0 {
+			if err := b.archive(ctx, ns, nstraces); err != nil {
+				if b.unwritten != nil {
+					write = false
+					for evtype, evs := range nstraces {
+						b.dropped(ctx, evtype.Key(), DropReasonWriteFailed, len(evs))
+						b.unwrite(ns, evs, nil)
+					}
+				}
+				if flushErr == nil {
+					flushErr = err
+				}
+			}
+		}
+
+		if write {
+			if err := b.flushNamespace(ctx, ns, nstraces); err != nil && flushErr == nil {
+				flushErr = err
+			}
+		}
+
+		// rejections include any made while preparing the namespace's events
+		if rejected := b.rejected[ns]; len(rejected) > 0 {
+			rows, err := b.execBatch(ctx, ns, "rejected_trace", rejectedTraceBatch(ns, rejected))
+			if err != nil {
+				// rejected events are kept for diagnosis so failing to store them does not fail the flush
+				batcherLog.Error("failed to store rejected events", err, "count", len(rejected), "schema", ns.Schema, "prefix", ns.Prefix)
+			} else {
+				b.rowsInserted.Add(tableContext(ctx, "rejected_trace"), rows)
+			}
+		}
+	}
+
+	b.traces = make(map[Namespace]map[EventType][]*TraceEvent)
+	b.rejected = make(map[Namespace][]*Rejection)
+	b.count = 0
+	if b.dedup != nil {
+		// events that were not stored may be sent again
+		b.dedup.Flushed()
+	}
+	b.flushDuration.Record(ctx, time.Since(start).Seconds())
+	b.stats.flushEnd(time.Now(), flushErr)
+	return flushErr
 }
 
-func (b *Batcher) flush(ctx context.Context) error {
+func (b *Batcher) flushNamespace(ctx context.Context, ns Namespace, traces map[EventType][]*TraceEvent) error {
 	// assumes mutex is held by caller
-	for evtype, evs := range b.traces {
-		logger := slog.With("event_type", evtype.Key(), "count", len(evs))
+	var flushErr error
+	for evtype, evs := range traces {
+		logger := batcherLog.With("event_type", evtype.Key(), "count", len(evs), "schema", ns.Schema, "prefix", ns.Prefix)
 
 		tbl, ok := eventDefs[evtype]
 		if !ok {
 			logger.Log(slog.LevelError, "skipping unknown event type")
+			b.dropped(ctx, evtype.Key(), DropReasonUnknownType, len(evs))
 			continue
 		}
 
 		if tbl.BatchInsert == nil {
 			logger.Warn("skipping unhandled event type")
+			b.dropped(ctx, evtype.Key(), DropReasonUnhandledType, len(evs))
 			continue
 		}
 
-		batch, err := tbl.BatchInsert(ctx, evs)
+		rejected := make(map[*TraceEvent]bool)
+		reject := func(ev *TraceEvent, reason string, detail string) {
+			rejected[ev] = true
+			b.reject(ctx, ns, newEventRejection(ev, reason, detail))
+		}
+
+		bctx, span := tracer().Start(ctx, "BatchInsert", trace.WithAttributes(eventTypeTag.String(evtype.Key()), namespaceAttr.String(ns.Table("*")), eventsAttr.Int(len(evs))))
+		batch, err := tbl.BatchInsert(bctx, ns, evs, reject)
+		span.SetAttributes(attribute.Int("rejected", len(rejected)))
 		if err != nil {
-			logger.Error("failed to create insert batch", err, "event_type")
-			return fmt.Errorf("commit transaction: %w", err)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetAttributes(statementsAttr.Int(batch.Len()))
+		}
+		span.End()
+		if err != nil {
+			logger.Error("failed to create insert batch", err)
+			b.batchFailures.Add(tableContext(ctx, tbl.Name), 1)
+			b.dropped(ctx, evtype.Key(), DropReasonWriteFailed, len(evs)-len(rejected))
+			b.unwrite(ns, evs, rejected)
+			if flushErr == nil {
+				flushErr = fmt.Errorf("create insert batch for %s: %w", evtype.Key(), err)
+			}
+			continue
+		}
+
+		if batch.Len() == 0 {
+			logger.Debug("no events to persist")
+			continue
 		}
 
 		logger.Debug("persisting events")
-		if err := b.execBatch(ctx, batch); err != nil {
+		rows, err := b.execBatch(ctx, ns, tbl.Name, batch)
+		if err != nil {
 			logger.Error("batch failed", err)
+			b.dropped(ctx, evtype.Key(), DropReasonWriteFailed, len(evs)-len(rejected))
+			b.unwrite(ns, evs, rejected)
+			if flushErr == nil {
+				flushErr = fmt.Errorf("batch for %s: %w", evtype.Key(), err)
+			}
+			continue
+		}
+		b.stats.stored(evtype.Key(), len(evs)-len(rejected))
+		b.rowsInserted.Add(tableContext(ctx, tbl.Name), rows)
+
+		now := time.Now()
+		lctx := eventTypeContext(ctx, evtype.Key())
+		for _, ev := range evs {
+			if rejected[ev] {
+				continue
+			}
+			if b.dedup != nil && ev.DedupKey != nil {
+				b.dedup.Stored(ns, ev.DedupKey, now)
+			}
+			if ev.Timestamp != nil {
+				b.eventLag.Record(lctx, now.Sub(time.Unix(0, *ev.Timestamp)).Seconds())
+			}
 		}
 	}
+	return flushErr
+}
 
-	b.traces = make(map[EventType][]*TraceEvent)
-	b.count = 0
-	return nil
+// unwrite records events that could not be written so they can be spooled when draining. Rejected
+// events are not recorded since they would not be written if sent again.
+func (b *Batcher) unwrite(ns Namespace, evs []*TraceEvent, rejected map[*TraceEvent]bool) {
+	// assumes mutex is held by caller
+	if b.unwritten == nil {
+		return
+	}
+	for _, ev := range evs {
+		if !rejected[ev] {
+			b.unwritten[ns] = append(b.unwritten[ns], ev)
+		}
+	}
+}
+
+// batchAttempts is the number of times a batch is sent when it fails with an error that shows it was
+// not applied.
+const batchAttempts = 3
+
+// execBatch writes a batch of statements for a table in a single transaction, sending it again if it
+// fails with a transient error. It returns the number of rows inserted, which may be fewer than the
+// number of statements when rows already exist.
+func (b *Batcher) execBatch(ctx context.Context, ns Namespace, table string, batch *pgx.Batch) (int64, error) {
+	ctx, span := tracer().Start(ctx, "execBatch", trace.WithAttributes(tableTag.String(table), namespaceAttr.String(ns.Table("*")), statementsAttr.Int(batch.Len())))
+	defer span.End()
+
+	tctx := tableContext(ctx, table)
+	for attempt := 1; ; attempt++ {
+		rows, err := b.send(ctx, ns, batch)
+		if err == nil {
+			span.SetAttributes(attemptsAttr.Int(attempt))
+			return rows, nil
+		}
+		if attempt >= batchAttempts || !retryableError(err) {
+			span.SetAttributes(attemptsAttr.Int(attempt))
+			span.SetStatus(codes.Error, err.Error())
+			b.batchFailures.Add(tctx, 1)
+			return 0, err
+		}
+		batcherLog.Warn("retrying batch", "table", table, "attempt", attempt, "error", err)
+		b.batchRetries.Add(tctx, 1)
+	}
 }
 
-func (b *Batcher) execBatch(ctx context.Context, batch *pgx.Batch) error {
+// retryableError reports whether a failed transaction may be sent again, either because it was not
+// sent or because it was rolled back due to contention with another transaction.
+func retryableError(err error) bool {
+	if pgconn.SafeToRetry(err) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "40001", "40P01": // serialization_failure, deadlock_detected
+			return true
+		}
+	}
+	return false
+}
+
+// sendBatch sends a batch in a transaction and returns the number of rows its statements affected.
+func (b *Batcher) sendBatch(ctx context.Context, ns Namespace, batch *pgx.Batch) (int64, error) {
 	tx, err := b.conn.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("begin transaction: %w", err)
+		return 0, fmt.Errorf("begin transaction: %w", err)
 	}
 	defer tx.Rollback(ctx)
 
+	if err := ns.setSearchPath(ctx, tx); err != nil {
+		return 0, err
+	}
+
 	br := tx.SendBatch(ctx, batch)
 
+	var rows int64
+	for i := 0; i < batch.Len(); i++ {
+		tag, err := br.Exec()
+		if err != nil {
+			br.Close()
+			return 0, fmt.Errorf("exec statement %d: %w", i, err)
+		}
+		rows += tag.RowsAffected()
+	}
+
 	if err := br.Close(); err != nil {
-		return fmt.Errorf("close: %w", err)
+		return 0, fmt.Errorf("close: %w", err)
 	}
 
 	err = tx.Commit(context.Background())
 	if err != nil {
-		return fmt.Errorf("commit transaction: %w", err)
+		return 0, fmt.Errorf("commit transaction: %w", err)
 	}
 
-	return nil
+	return rows, nil
 }
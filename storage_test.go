@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func newTestBatcher(t *testing.T) *Batcher {
+	t.Helper()
+	b, err := NewBatcher(nil, BatcherConfig{Size: 1000, Rejects: NewRejectSampler(1, 1000)})
+	if err != nil {
+		t.Fatalf("NewBatcher: %v", err)
+	}
+	return b
+}
+
+// failBatchInsert replaces the function that builds the insert batch for an event type with one that
+// fails, until the test ends.
+func failBatchInsert(t *testing.T, et EventType) {
+	t.Helper()
+	def := eventDefs[et]
+	failing := def
+	failing.BatchInsert = func(ctx context.Context, ns Namespace, evs []*TraceEvent, reject RejectFunc) (*pgx.Batch, error) {
+		return nil, errors.New("broken")
+	}
+	eventDefs[et] = failing
+	t.Cleanup(func() { eventDefs[et] = def })
+}
+
+func testEvent(et EventType, timestamp bool) *TraceEvent {
+	ev := &TraceEvent{Type: &et, PeerID: []byte("peer")}
+	if timestamp {
+		ts := int64(1680000000000000000)
+		ev.Timestamp = &ts
+	}
+	topic := "/fil/msgs/mainnet"
+	switch et {
+	case EventTypeJoin:
+		ev.Join = &JoinEvent{Topic: &topic}
+	case EventTypeLeave:
+		ev.Leave = &LeaveEvent{Topic: &topic}
+	}
+	return ev
+}
+
+func TestFlushNamespaceBatchInsertFailure(t *testing.T) {
+	failBatchInsert(t, EventTypeJoin)
+
+	// events without a timestamp are rejected when their batch is built so they are never sent to
+	// the database
+	traces := map[EventType][]*TraceEvent{
+		EventTypeJoin:    {testEvent(EventTypeJoin, true), testEvent(EventTypeJoin, true)},
+		EventTypeLeave:   {testEvent(EventTypeLeave, false)},
+		EventTypeGraft:   {testEvent(EventTypeGraft, false)},
+		EventTypePrune:   {testEvent(EventTypePrune, false)},
+		EventTypeAddPeer: {testEvent(EventTypeAddPeer, false)},
+	}
+
+	b := newTestBatcher(t)
+	b.unwritten = make(map[Namespace][]*TraceEvent)
+	ns := Namespace{Prefix: "test_"}
+
+	err := b.flushNamespace(context.Background(), ns, traces)
+	if err == nil {
+		t.Fatalf("got no error")
+	}
+	if want := "create insert batch for join: broken"; err.Error() != want {
+		t.Errorf("got error %q, wanted %q", err.Error(), want)
+	}
+
+	// every other type is still processed after the failure
+	if got := len(b.rejected[ns]); got != 4 {
+		t.Errorf("got %d rejected events, wanted 4", got)
+	}
+	if got := len(b.unwritten[ns]); got != 2 {
+		t.Errorf("got %d unwritten events, wanted 2", got)
+	}
+	for _, ev := range b.unwritten[ns] {
+		if *ev.Type != EventTypeJoin {
+			t.Errorf("got unwritten %s event, wanted join", ev.Type.Key())
+		}
+	}
+
+	st := b.Status().EventTypes
+	if got := st["join"].Dropped; got != 2 {
+		t.Errorf("got %d dropped join events, wanted 2", got)
+	}
+	for _, key := range []string{"leave", "graft", "prune", "add_peer"} {
+		if got := st[key].Dropped; got != 1 {
+			t.Errorf("got %d dropped %s events, wanted 1", got, key)
+		}
+	}
+}
+
+func TestUnwrite(t *testing.T) {
+	ns := Namespace{Prefix: "test_"}
+	evs := []*TraceEvent{testEvent(EventTypeJoin, true), testEvent(EventTypeJoin, true), testEvent(EventTypeJoin, true)}
+
+	testCases := []struct {
+		name     string
+		draining bool
+		rejected map[*TraceEvent]bool
+		want     int
+	}{
+		{name: "not draining", want: 0},
+		{name: "draining", draining: true, want: 3},
+		{name: "draining with rejections", draining: true, rejected: map[*TraceEvent]bool{evs[1]: true}, want: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBatcher(t)
+			if tc.draining {
+				b.unwritten = make(map[Namespace][]*TraceEvent)
+			}
+			b.unwrite(ns, evs, tc.rejected)
+			if got := len(b.unwritten[ns]); got != tc.want {
+				t.Errorf("got %d unwritten events, wanted %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFlushArchiveFailure(t *testing.T) {
+	sourceAuth := "secret"
+
+	b, err := NewBatcher(nil, BatcherConfig{Size: 1000, Archive: true})
+	if err != nil {
+		t.Fatalf("NewBatcher: %v", err)
+	}
+	sent := 0
+	b.send = func(ctx context.Context, ns Namespace, batch *pgx.Batch) (int64, error) {
+		sent++
+		return 2, nil
+	}
+
+	// the archive batch cannot be built since the event as received cannot be decoded to remove its
+	// source auth
+	bad := testEvent(EventTypeJoin, true)
+	bad.Raw = json.RawMessage(`not json`)
+	bad.SourceAuth = &sourceAuth
+	good := testEvent(EventTypeJoin, true)
+
+	ctx := context.Background()
+	for _, ev := range []*TraceEvent{good, bad} {
+		ev.PeerID = mustDecodeBase64(t, testObserverID)
+		b.Add(ctx, Namespace{}, ev)
+	}
+	if err := b.Flush(ctx); err == nil {
+		t.Errorf("got no error")
+	}
+
+	// the events are still written to the table for their type
+	if sent != 1 {
+		t.Errorf("got %d batches sent, wanted 1", sent)
+	}
+	st := b.Status().EventTypes["join"]
+	if st.Stored != 2 || st.Dropped != 0 {
+		t.Errorf("got %d stored and %d dropped join events, wanted 2 stored", st.Stored, st.Dropped)
+	}
+}
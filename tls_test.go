@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// testCert is a certificate and its key, signed by a test certificate authority or self signed.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, ca *testCert, serial int64) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	parent, parentKey := tmpl, key
+	if ca != nil {
+		parent, parentKey = ca.cert, ca.key
+	} else {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key to files in dir, returning their names.
+func (c *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatalf("write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestCertReloaderClientCert(t *testing.T) {
+	dir := t.TempDir()
+	serverCA := newTestCert(t, "server ca", nil, 1)
+	clientCA := newTestCert(t, "client ca", nil, 2)
+	otherCA := newTestCert(t, "other ca", nil, 3)
+
+	certFile, keyFile := newTestCert(t, "server", serverCA, 10).write(t, dir, "server")
+	clientCAFile, _ := clientCA.write(t, dir, "client-ca")
+
+	cr, err := NewCertReloader(certFile, keyFile, clientCAFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader: %v", err)
+	}
+
+	bat, err := NewBatcher(nil, BatcherConfig{Size: 1000})
+	if err != nil {
+		t.Fatalf("NewBatcher: %v", err)
+	}
+	svr, err := NewServer(bat, ServerConfig{
+		Auth:                    NewAuthenticator([]AuthToken{{Token: "token", Label: "node1"}}, true, false),
+		MaxDecompressedBodySize: 1 << 20,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	r := mux.NewRouter()
+	svr.ConfigureRoutes(r)
+	ts := httptest.NewUnstartedServer(r)
+	ts.TLS = cr.TLSConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+
+	testCases := []struct {
+		name       string
+		clientCert *testCert
+		token      string
+		wantStatus int
+		wantErr    bool // the handshake fails
+		wantSource string
+	}{
+		{name: "no certificate", wantStatus: http.StatusUnauthorized},
+		{name: "no certificate with token", token: "token", wantStatus: http.StatusCreated, wantSource: "node1"},
+		{name: "verified certificate", clientCert: newTestCert(t, "node2", clientCA, 20), wantStatus: http.StatusCreated, wantSource: "node2"},
+		{name: "token takes precedence", clientCert: newTestCert(t, "node2", clientCA, 21), token: "token", wantStatus: http.StatusCreated, wantSource: "node1"},
+		{name: "certificate from other authority", clientCert: newTestCert(t, "node3", otherCA, 22), wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &tls.Config{RootCAs: roots}
+			if tc.clientCert != nil {
+				// the certificate is presented even if it is not issued by an authority the server accepts
+				cert := tc.clientCert.tlsCertificate()
+				cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return &cert, nil
+				}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+
+			req, err := http.NewRequest("POST", ts.URL+"/traces/_doc", strings.NewReader(testTraceDoc))
+			if err != nil {
+				t.Fatalf("new request: %v", err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			resp, err := client.Do(req)
+			if tc.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("got status %d, wanted handshake to fail", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("got status %d, wanted %d", resp.StatusCode, tc.wantStatus)
+			}
+
+			if tc.wantSource != "" {
+				bat.mu.Lock()
+				evs := bat.traces[Namespace{}][EventTypeJoin]
+				bat.mu.Unlock()
+				if len(evs) == 0 || evs[len(evs)-1].Source != tc.wantSource {
+					t.Errorf("got events %v, wanted last from %q", evs, tc.wantSource)
+				}
+			}
+		})
+	}
+}
+
+func TestCertReloaderReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, 1)
+	certFile, keyFile := newTestCert(t, "first", ca, 10).write(t, dir, "server")
+
+	cr, err := NewCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("NewCertReloader: %v", err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = cr.TLSConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	servedCN := func() string {
+		t.Helper()
+		conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	if got := servedCN(); got != "first" {
+		t.Fatalf("got certificate %q, wanted %q", got, "first")
+	}
+
+	// new connections use the reloaded certificate without restarting the listener
+	newTestCert(t, "second", ca, 11).write(t, dir, "server")
+	if err := cr.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if got := servedCN(); got != "second" {
+		t.Errorf("got certificate %q after reload, wanted %q", got, "second")
+	}
+
+	// a certificate that cannot be loaded leaves the previous one in use
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	if err := cr.Reload(); err == nil {
+		t.Errorf("Reload of invalid key succeeded")
+	}
+	if got := servedCN(); got != "second" {
+		t.Errorf("got certificate %q after failed reload, wanted %q", got, "second")
+	}
+}
+
+func TestNewCertReloaderInvalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := newTestCert(t, "server", nil, 1).write(t, dir, "server")
+	emptyCA := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(emptyCA, []byte("no certificates"), 0o600); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		certFile string
+		keyFile  string
+		caFile   string
+	}{
+		{name: "missing certificate", certFile: filepath.Join(dir, "missing.pem"), keyFile: keyFile},
+		{name: "mismatched key", certFile: keyFile, keyFile: certFile},
+		{name: "missing client ca", certFile: certFile, keyFile: keyFile, caFile: filepath.Join(dir, "missing.pem")},
+		{name: "client ca without certificates", certFile: certFile, keyFile: keyFile, caFile: emptyCA},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewCertReloader(tc.certFile, tc.keyFile, tc.caFile); err == nil {
+				t.Errorf("got no error, wanted one")
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Trace file formats written by the tracers in go-libp2p-pubsub.
+const (
+	TraceFormatPB   = "pb"   // length delimited protobuf messages, written by PBTracer
+	TraceFormatJSON = "json" // newline delimited json, written by JSONTracer
+)
+
+// maxPBMessageSize is the largest protobuf trace event that will be read from a file.
+const maxPBMessageSize = 16 << 20
+
+// TraceFileReader reads trace events from a file, which may be gzip compressed.
+type TraceFileReader struct {
+	f      *os.File
+	gz     *gzip.Reader
+	r      *bufio.Reader
+	format string
+	offset int64 // offset in the uncompressed stream of the end of the last event read
+
+	dec *json.Decoder
+}
+
+// OpenTraceFile opens a trace file in the given format and positions it at offset, which must be
+// the offset of the end of an event in the uncompressed stream as reported by Offset.
+func OpenTraceFile(name string, format string, offset int64) (*TraceFileReader, error) {
+	if format != TraceFormatPB && format != TraceFormatJSON {
+		return nil, fmt.Errorf("unsupported trace format %q", format)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &TraceFileReader{
+		f:      f,
+		format: format,
+	}
+
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(2)
+	if err != nil && !errors.Is(err, io.EOF) {
+		f.Close()
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		tr.gz, err = gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		tr.r = bufio.NewReader(tr.gz)
+		if offset > 0 {
+			// compressed streams cannot seek so discard data up to the offset
+			if _, err := io.CopyN(io.Discard, tr.r, offset); err != nil {
+				tr.Close()
+				return nil, fmt.Errorf("skip to offset %d: %w", offset, err)
+			}
+		}
+	} else if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("seek to offset %d: %w", offset, err)
+		}
+		tr.r = bufio.NewReader(f)
+	} else {
+		tr.r = br
+	}
+	tr.offset = offset
+
+	if format == TraceFormatJSON {
+		tr.dec = json.NewDecoder(tr.r)
+	}
+
+	return tr, nil
+}
+
+// Next returns the next event in the file. It returns io.EOF when there are no more events.
+func (tr *TraceFileReader) Next() (*TraceEvent, error) {
+	if tr.format == TraceFormatJSON {
+		var raw json.RawMessage
+		start := tr.dec.InputOffset()
+		if err := tr.dec.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("decode event at offset %d: %w", tr.offset, err)
+		}
+		ev := new(TraceEvent)
+		if err := json.Unmarshal(raw, ev); err != nil {
+			return nil, fmt.Errorf("decode event at offset %d: %w", tr.offset, err)
+		}
+		ev.Raw = raw
+		tr.offset += tr.dec.InputOffset() - start
+		return ev, nil
+	}
+
+	size, err := binary.ReadUvarint(tr.r)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("read event length at offset %d: %w", tr.offset, err)
+	}
+	if size > maxPBMessageSize {
+		return nil, fmt.Errorf("event at offset %d too large: %d bytes", tr.offset, size)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(tr.r, buf); err != nil {
+		return nil, fmt.Errorf("read event at offset %d: %w", tr.offset, err)
+	}
+
+	ev, err := decodePBTraceEvent(buf)
+	if err != nil {
+		return nil, fmt.Errorf("decode event at offset %d: %w", tr.offset, err)
+	}
+	tr.offset += int64(uvarintLen(size)) + int64(size)
+	return ev, nil
+}
+
+// Offset returns the offset in the uncompressed stream of the end of the last event read.
+func (tr *TraceFileReader) Offset() int64 {
+	return tr.offset
+}
+
+// Compressed reports whether the file is gzip compressed.
+func (tr *TraceFileReader) Compressed() bool {
+	return tr.gz != nil
+}
+
+func (tr *TraceFileReader) Close() error {
+	if tr.gz != nil {
+		tr.gz.Close()
+	}
+	return tr.f.Close()
+}
+
+func uvarintLen(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attributes of spans, in addition to the tags used by metrics.
+var (
+	indexAttr      = attribute.Key("index")
+	eventsAttr     = attribute.Key("events")
+	statementsAttr = attribute.Key("statements")
+	attemptsAttr   = attribute.Key("attempts")
+	namespaceAttr  = attribute.Key("namespace")
+	lockWaitAttr   = attribute.Key("lock_wait_seconds")
+)
+
+// Exporters for spans.
+const (
+	TraceExporterNone   = "none"
+	TraceExporterOTLP   = "otlp"
+	TraceExporterStdout = "stdout"
+)
+
+// TracingConfig configures how spans are exported.
+type TracingConfig struct {
+	// Exporter is the exporter spans are sent to: none, otlp or stdout.
+	Exporter string
+
+	// OTLPEndpoint is the URL to which spans are pushed using OTLP over HTTP, such as
+	// http://localhost:4318/v1/traces. When empty the standard OTEL_EXPORTER_OTLP_* environment
+	// variables are used.
+	OTLPEndpoint string
+
+	// SampleRatio is the fraction of requests that are traced when the client has not already
+	// decided whether the request is traced.
+	SampleRatio float64
+
+	// File is the file that the stdout exporter appends spans to. When empty spans are written to
+	// stderr so they are not mixed with anything written to stdout.
+	File string
+}
+
+// TraceReporter exports the spans recorded by tracecatcher.
+type TraceReporter struct {
+	provider *sdktrace.TracerProvider
+	file     *os.File // the file spans are written to, nil unless configured
+}
+
+// InitTracing creates the exporter for spans and sets the tracer provider that they are reported to.
+// It returns nil if spans are not exported.
+func InitTracing(ctx context.Context, cfg TracingConfig) (*TraceReporter, error) {
+	var exp sdktrace.SpanExporter
+	var file *os.File
+	switch cfg.Exporter {
+	case TraceExporterNone, "":
+		return nil, nil
+	case TraceExporterOTLP:
+		var opts []otlptracehttp.Option
+		if cfg.OTLPEndpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.OTLPEndpoint))
+		}
+		e, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("otlp exporter: %w", err)
+		}
+		exp = e
+	case TraceExporterStdout:
+		var w io.Writer = os.Stderr
+		if cfg.File != "" {
+			f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+			if err != nil {
+				return nil, fmt.Errorf("open trace file: %w", err)
+			}
+			file = f
+			w = f
+		}
+		e, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			if file != nil {
+				file.Close()
+			}
+			return nil, fmt.Errorf("stdout exporter: %w", err)
+		}
+		exp = e
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter %q, must be %q, %q or %q", cfg.Exporter, TraceExporterNone, TraceExporterOTLP, TraceExporterStdout)
+	}
+
+	res, err := serviceResource()
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, fmt.Errorf("resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return &TraceReporter{provider: tp, file: file}, nil
+}
+
+// Shutdown exports any spans that have not been exported and stops the exporter.
+func (tr *TraceReporter) Shutdown(ctx context.Context) error {
+	err := tr.provider.Shutdown(ctx)
+	if tr.file != nil {
+		if cerr := tr.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// tracer returns the tracer used to record tracecatcher's spans. Spans are not recorded unless
+// InitTracing has been called.
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
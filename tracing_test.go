@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestStdoutTraceExporterOutput(t *testing.T) {
+	testCases := []struct {
+		name   string
+		file   bool
+		stderr bool // whether spans are written to stderr
+	}{
+		{name: "stderr", stderr: true},
+		{name: "file", file: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			prev := otel.GetTracerProvider()
+			t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+			dir := t.TempDir()
+			stdout := redirectOutput(t, &os.Stdout, filepath.Join(dir, "stdout"))
+			stderr := redirectOutput(t, &os.Stderr, filepath.Join(dir, "stderr"))
+
+			cfg := TracingConfig{Exporter: TraceExporterStdout, SampleRatio: 1}
+			if tc.file {
+				cfg.File = filepath.Join(dir, "spans.json")
+			}
+			tr, err := InitTracing(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("InitTracing: %v", err)
+			}
+			_, span := tracer().Start(context.Background(), "test-span")
+			span.End()
+			if err := tr.Shutdown(context.Background()); err != nil {
+				t.Fatalf("Shutdown: %v", err)
+			}
+
+			if got := readFile(t, stdout); got != "" {
+				t.Errorf("got output on stdout: %s", got)
+			}
+			if got := readFile(t, stderr); strings.Contains(got, "test-span") != tc.stderr {
+				t.Errorf("got stderr %q, wanted span written %v", got, tc.stderr)
+			}
+			if tc.file {
+				if got := readFile(t, cfg.File); !strings.Contains(got, `"Name":"test-span"`) {
+					t.Errorf("span not written to file, got %q", got)
+				}
+			}
+		})
+	}
+}
+
+// redirectOutput replaces one of the standard output files with a file until the test ends and
+// returns the name of the file.
+func redirectOutput(t *testing.T, std **os.File, name string) string {
+	t.Helper()
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("create %s: %v", name, err)
+	}
+	prev := *std
+	*std = f
+	t.Cleanup(func() {
+		*std = prev
+		f.Close()
+	})
+	return name
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return string(data)
+}